@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/Abuelodelanada/multipass-exporter/internal/collector"
+	"github.com/Abuelodelanada/multipass-exporter/internal/config"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/sirupsen/logrus"
+)
+
+// dumpUsage describes the dump subcommand
+const dumpUsage = `Usage: multipass-exporter dump [flags]
+
+Runs the collector once with the exporter's configuration and prints the
+metrics to stdout; the table format lists the instances instead. With --debug, the raw multipass output and the reasons
+instances or values were skipped are printed to stderr.
+
+Flags:
+`
+
+// Formats accepted by dump --format
+const (
+	dumpFormatText        = "text"
+	dumpFormatOpenMetrics = "openmetrics"
+	dumpFormatJSON        = "json"
+	dumpFormatTable       = "table"
+)
+
+// dumpFormats lists the formats accepted by dump --format
+var dumpFormats = []string{dumpFormatText, dumpFormatOpenMetrics, dumpFormatJSON, dumpFormatTable}
+
+// runDump runs `multipass-exporter dump` with the arguments following the
+// subcommand. The metrics are written to w and the debug report to stderr,
+// so w stays parseable. Collection errors are returned after printing.
+func runDump(args []string, w io.Writer, stderr io.Writer) error {
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), dumpUsage)
+		fs.PrintDefaults()
+	}
+
+	path := fs.String("config", "", "Path to configuration file (optional)")
+	dir := fs.String("config-dir", "", "Directory of *.yaml files merged on top of the configuration file (default config.d next to it)")
+	format := fs.String("format", dumpFormatText, "Output format: "+strings.Join(dumpFormats, ", "))
+	debug := fs.Bool("debug", false, "Also print the raw multipass output and the skip reasons to stderr")
+	collectors := fs.String("collectors", "", "Comma-separated sub-collectors to run: "+strings.Join(collector.CollectorNames, ", ")+" (default all)")
+	instance := fs.String("instance", "", "Only report instances whose name matches this regular expression")
+	flags := config.RegisterFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return fmt.Errorf("unexpected arguments %v", fs.Args())
+	}
+	if !slices.Contains(dumpFormats, *format) {
+		return fmt.Errorf("--format must be one of %s, got %q", strings.Join(dumpFormats, ", "), *format)
+	}
+
+	// Only warnings reach stderr unless a log level is asked for, so the
+	// effective configuration is not logged before every dump
+	if _, ok := flags["log_level"]; !ok {
+		flags["log_level"] = "warn"
+	}
+	a := &App{configPath: *path, configDir: *dir, flagValues: flags, lookupEnv: os.LookupEnv}
+	if err := a.LoadConfiguration(); err != nil {
+		return err
+	}
+
+	c, err := a.newCollector(a.cfg)
+	if err != nil {
+		return err
+	}
+	var report *dumpReport
+	if *debug {
+		report = newDumpReport()
+		c.SetLogger(report.logger)
+		c.AddOutputObserver(report.observeOutput)
+	}
+	var collectErr error
+	c.AddErrorObserver(func(err error) {
+		collectErr = err
+	})
+
+	var filter collector.Filter
+	if *collectors != "" {
+		for _, name := range strings.Split(*collectors, ",") {
+			filter.Collectors = append(filter.Collectors, strings.TrimSpace(name))
+		}
+	}
+	if *instance != "" {
+		if filter.Instance, err = regexp.Compile(*instance); err != nil {
+			return fmt.Errorf("invalid --instance: %w", err)
+		}
+	}
+	if c, err = c.Filtered(filter); err != nil {
+		return err
+	}
+	// The table lists the instances of the response the collection used
+	var info collector.MultipassInfoResponse
+	c.AddInfoObserver(func(data collector.MultipassInfoResponse) {
+		info = data
+	})
+
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(c); err != nil {
+		return fmt.Errorf("failed to register multipass collector: %w", err)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather metrics: %w", err)
+	}
+
+	if report != nil {
+		report.write(stderr)
+	}
+	if err := writeDump(w, *format, families, dumpInstances(c.Select(info), filter.Instance)); err != nil {
+		return fmt.Errorf("failed to write metrics: %w", err)
+	}
+	if collectErr != nil {
+		return fmt.Errorf("failed to collect metrics: %w", collectErr)
+	}
+	return nil
+}
+
+// writeDump writes families to w in format, or instances for the table
+// format
+func writeDump(w io.Writer, format string, families []*dto.MetricFamily, instances []collector.MultipassInfoOutput) error {
+	switch format {
+	case dumpFormatOpenMetrics:
+		encoder := expfmt.NewEncoder(w, expfmt.NewFormat(expfmt.TypeOpenMetrics))
+		for _, family := range families {
+			if err := encoder.Encode(family); err != nil {
+				return err
+			}
+		}
+		if closer, ok := encoder.(expfmt.Closer); ok {
+			return closer.Close()
+		}
+		return nil
+	case dumpFormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(dumpFamilies(families))
+	case dumpFormatTable:
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tSTATE\tRELEASE\tIPV4\tCPUS\tMEMORY\tDISK")
+		for _, instance := range instances {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				instance.Name,
+				instance.State,
+				orDash(instance.Release),
+				orDash(strings.Join(instance.IPv4, ",")),
+				orDash(instance.CPUCount),
+				formatUsage(instance.Memory.Used, instance.Memory.Total),
+				formatDiskUsage(instance.Disks))
+		}
+		return tw.Flush()
+	default:
+		for _, family := range families {
+			if _, err := expfmt.MetricFamilyToText(w, family); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// dumpFamily is a metric family in the JSON format
+type dumpFamily struct {
+	Name    string       `json:"name"`
+	Help    string       `json:"help"`
+	Type    string       `json:"type"`
+	Samples []dumpSample `json:"samples"`
+}
+
+// dumpSample is a single series of a dumpFamily
+type dumpSample struct {
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+// dumpFamilies converts gathered families, whose metrics are gauges,
+// counters or untyped, to their JSON form
+func dumpFamilies(families []*dto.MetricFamily) []dumpFamily {
+	result := make([]dumpFamily, 0, len(families))
+	for _, family := range families {
+		converted := dumpFamily{
+			Name:    family.GetName(),
+			Help:    family.GetHelp(),
+			Type:    strings.ToLower(family.GetType().String()),
+			Samples: make([]dumpSample, 0, len(family.GetMetric())),
+		}
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string, len(metric.GetLabel()))
+			for _, pair := range metric.GetLabel() {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+			value := metric.GetGauge().GetValue()
+			switch {
+			case metric.Counter != nil:
+				value = metric.GetCounter().GetValue()
+			case metric.Untyped != nil:
+				value = metric.GetUntyped().GetValue()
+			}
+			converted.Samples = append(converted.Samples, dumpSample{Labels: labels, Value: value})
+		}
+		result = append(result, converted)
+	}
+	return result
+}
+
+// dumpInstances returns the instances of data matching instance, or all of
+// them when it is nil, sorted by name
+func dumpInstances(data collector.MultipassInfoResponse, instance *regexp.Regexp) []collector.MultipassInfoOutput {
+	instances := make([]collector.MultipassInfoOutput, 0, len(data.Info))
+	for name, info := range data.Info {
+		if instance != nil && !instance.MatchString(name) {
+			continue
+		}
+		info.Name = name
+		instances = append(instances, info)
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].Name < instances[j].Name
+	})
+	return instances
+}
+
+// formatDiskUsage sums the used and total bytes of every disk, which
+// multipass reports as strings, and formats them with formatUsage
+func formatDiskUsage(disks map[string]collector.DiskInfo) string {
+	var used, total int64
+	for _, disk := range disks {
+		diskUsed, usedErr := strconv.ParseInt(disk.Used, 10, 64)
+		diskTotal, totalErr := strconv.ParseInt(disk.Total, 10, 64)
+		if usedErr != nil || totalErr != nil {
+			return "-"
+		}
+		used += diskUsed
+		total += diskTotal
+	}
+	return formatUsage(used, total)
+}
+
+// formatUsage renders used and total bytes as e.g. "1.2GiB/4.0GiB", or "-"
+// when multipass reports no total, as for stopped instances
+func formatUsage(used, total int64) string {
+	if total <= 0 {
+		return "-"
+	}
+	return formatBytes(used) + "/" + formatBytes(total)
+}
+
+// formatBytes renders n bytes with a binary unit, e.g. 1.5GiB
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatInt(n, 10) + "B"
+	}
+	value := float64(n)
+	prefix := -1
+	for value >= unit && prefix < len("KMGTPE")-1 {
+		value /= unit
+		prefix++
+	}
+	return strconv.FormatFloat(value, 'f', 1, 64) + string("KMGTPE"[prefix]) + "iB"
+}
+
+// orDash renders an empty value as "-"
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// dumpReport records what dump --debug prints: the raw output of every
+// multipass command and the collector's log entries explaining why
+// instances or values were skipped
+type dumpReport struct {
+	logger *logrus.Logger
+
+	mu      sync.Mutex
+	outputs []commandOutput
+	skipped []string
+	errors  []string
+	// seen drops repeated skip reasons, e.g. from the disk used and disk
+	// total collectors
+	seen map[string]bool
+}
+
+// commandOutput is the raw output of a multipass command
+type commandOutput struct {
+	args   []string
+	stdout []byte
+	stderr []byte
+}
+
+func newDumpReport() *dumpReport {
+	r := &dumpReport{logger: logrus.New(), seen: make(map[string]bool)}
+	r.logger.SetOutput(io.Discard)
+	r.logger.SetLevel(logrus.DebugLevel)
+	r.logger.AddHook(r)
+	return r
+}
+
+func (r *dumpReport) observeOutput(args []string, stdout, stderr []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.outputs = append(r.outputs, commandOutput{
+		args:   args,
+		stdout: append([]byte(nil), stdout...),
+		stderr: append([]byte(nil), stderr...),
+	})
+}
+
+// Levels makes the report a logrus hook for every level
+func (r *dumpReport) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire records skip reasons, which the collector logs at debug level as
+// "Skipping ...", and every warning or error
+func (r *dumpReport) Fire(entry *logrus.Entry) error {
+	line := entry.Message
+	if fields := formatFields(entry.Data); fields != "" {
+		line = fields + ": " + line
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case entry.Level <= logrus.WarnLevel:
+		r.errors = append(r.errors, line)
+	case strings.HasPrefix(entry.Message, "Skipping") && !r.seen[line]:
+		r.seen[line] = true
+		r.skipped = append(r.skipped, line)
+	}
+	return nil
+}
+
+// formatFields renders log fields as name=value pairs sorted by name
+func formatFields(data logrus.Fields) string {
+	names := make([]string, 0, len(data))
+	for name := range data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%v", name, data[name]))
+	}
+	return strings.Join(pairs, " ")
+}
+
+// write prints the report, one section per command output and one each
+// for the skip reasons and the errors
+func (r *dumpReport) write(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, output := range r.outputs {
+		fmt.Fprintf(w, "### $ %s\n", strings.Join(output.args, " "))
+		writeSection(w, "stdout", string(output.stdout))
+		if len(output.stderr) > 0 {
+			writeSection(w, "stderr", string(output.stderr))
+		}
+	}
+	writeSection(w, fmt.Sprintf("skipped (%d)", len(r.skipped)), strings.Join(r.skipped, "\n"))
+	if len(r.errors) > 0 {
+		writeSection(w, fmt.Sprintf("errors (%d)", len(r.errors)), strings.Join(r.errors, "\n"))
+	}
+}
+
+func writeSection(w io.Writer, title, content string) {
+	fmt.Fprintf(w, "### %s\n", title)
+	if content = strings.TrimRight(content, "\n"); content != "" {
+		fmt.Fprintln(w, content)
+	}
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/Abuelodelanada/multipass-exporter/internal/collector"
+	"github.com/Abuelodelanada/multipass-exporter/internal/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+// newHandlerOpts translates the exposition settings into promhttp options
+func newHandlerOpts(cfg config.ExpositionConfig) (promhttp.HandlerOpts, error) {
+	opts := promhttp.HandlerOpts{
+		DisableCompression:                  cfg.DisableCompression,
+		MaxRequestsInFlight:                 cfg.MaxRequestsInFlight,
+		Timeout:                             time.Duration(cfg.TimeoutSeconds) * time.Second,
+		EnableOpenMetrics:                   cfg.OpenMetrics,
+		EnableOpenMetricsTextCreatedSamples: cfg.OpenMetrics && cfg.CreatedTimestamps,
+	}
+
+	switch cfg.ErrorHandling {
+	case "", "http_error":
+		opts.ErrorHandling = promhttp.HTTPErrorOnError
+	case "continue":
+		opts.ErrorHandling = promhttp.ContinueOnError
+	case "panic":
+		opts.ErrorHandling = promhttp.PanicOnError
+	default:
+		return promhttp.HandlerOpts{}, fmt.Errorf("invalid error_handling %q: must be http_error, continue or panic", cfg.ErrorHandling)
+	}
+
+	return opts, nil
+}
+
+// errorLog returns the logger promhttp reports errors to, if any
+func (a *App) errorLog() promhttp.Logger {
+	if a.logger == nil {
+		return nil
+	}
+	return a.logger.WithField("component", "promhttp")
+}
+
+// exporterMetricsHandler serves the exporter's own metrics alone
+func (a *App) exporterMetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.mu.RLock()
+		current := a.exporterMetrics
+		a.mu.RUnlock()
+		current.ServeHTTP(w, r)
+	})
+}
+
+// metricsHandler serves the metrics endpoint with the current configuration.
+// Requests may narrow the collection with collect[]=<name> (repeatable) and
+// instance=<regex>; requests without those parameters get the Multipass and
+// exporter metrics.
+func (a *App) metricsHandler() http.Handler {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.mu.RLock()
+		current := a.metrics
+		a.mu.RUnlock()
+		current.ServeHTTP(w, r)
+	})
+
+	return promhttp.InstrumentMetricHandler(a.exporterRegistry, handler)
+}
+
+// newMetricsHandler builds the metrics endpoint for one configuration. The
+// in-flight limit and timeout of opts apply to default and filtered scrapes
+// together, rather than per promhttp handler, and both serve the exporter's
+// own metrics along with the Multipass ones.
+func (a *App) newMetricsHandler(c *collector.MultipassCollector, registry *prometheus.Registry, opts promhttp.HandlerOpts) http.Handler {
+	maxInFlight, timeout := opts.MaxRequestsInFlight, opts.Timeout
+	opts.MaxRequestsInFlight, opts.Timeout = 0, 0
+
+	defaultHandler := promhttp.HandlerFor(
+		prometheus.Gatherers{registry, a.exporterRegistry},
+		opts,
+	)
+
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		collectors := query["collect[]"]
+		instance := query.Get("instance")
+
+		if len(collectors) == 0 && instance == "" {
+			defaultHandler.ServeHTTP(w, r)
+			return
+		}
+
+		filter, err := parseFilter(collectors, instance)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		filtered, err := c.Filtered(filter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		registry := prometheus.NewRegistry()
+		if err := registry.Register(filtered); err != nil {
+			http.Error(w, fmt.Sprintf("failed to register collector: %v", err), http.StatusInternalServerError)
+			return
+		}
+		promhttp.HandlerFor(prometheus.Gatherers{registry, a.exporterRegistry}, opts).ServeHTTP(w, r)
+	})
+
+	if timeout > 0 {
+		handler = http.TimeoutHandler(handler, timeout, fmt.Sprintf("Exceeded configured timeout of %v.\n", timeout))
+	}
+	return limitInFlight(handler, maxInFlight)
+}
+
+// limitInFlight answers 503 to requests beyond max concurrent ones, as
+// promhttp does for a single handler; max 0 means no limit
+func limitInFlight(handler http.Handler, max int) http.Handler {
+	if max <= 0 {
+		return handler
+	}
+	inFlight := make(chan struct{}, max)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case inFlight <- struct{}{}:
+			defer func() { <-inFlight }()
+		default:
+			http.Error(w, fmt.Sprintf("Limit of concurrent requests reached (%d), try again later.", max), http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// parseFilter builds a collector filter from query parameters. The instance
+// regex is fully anchored, as in Prometheus label matchers.
+func parseFilter(collectors []string, instance string) (collector.Filter, error) {
+	filter := collector.Filter{Collectors: collectors}
+
+	if instance != "" {
+		re, err := regexp.Compile("^(?:" + instance + ")$")
+		if err != nil {
+			return collector.Filter{}, fmt.Errorf("invalid instance regex %q: %w", instance, err)
+		}
+		filter.Instance = re
+	}
+
+	return filter, nil
+}
+
+// simulatorFaultsPath serves the faults injected on demand into the
+// simulated fleet
+const simulatorFaultsPath = "/simulator/faults"
+
+// simulatorFaultsHandler reports how many runs each injected fault still
+// affects. POST injects fault=<name> into the next count=<n> runs (default
+// 1), e.g. POST /simulator/faults?fault=slow&count=3.
+func (a *App) simulatorFaultsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodPost {
+			count := 1
+			if raw := r.FormValue("count"); raw != "" {
+				n, err := strconv.Atoi(raw)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("invalid count %q", raw)})
+					return
+				}
+				count = n
+			}
+			fault := r.FormValue("fault")
+			if err := a.simulator.Inject(fault, count); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+				return
+			}
+			a.logger.WithFields(logrus.Fields{"fault": fault, "count": count}).Warn("Injecting simulator faults")
+		}
+		json.NewEncoder(w).Encode(a.simulator.Pending())
+	})
+}
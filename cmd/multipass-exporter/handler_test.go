@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Abuelodelanada/multipass-exporter/internal/collector"
+	"github.com/Abuelodelanada/multipass-exporter/internal/config"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const testInfoJSON = `{
+	"info": {
+		"charm-dev-36": {"name": "charm-dev-36", "state": "Running", "ipv4": ["10.0.0.2"], "release": "Ubuntu 24.04 LTS", "memory": {"total": 2147483648, "used": 1073741824}, "cpu_count": "2", "load": [0.1, 0.2, 0.3], "disks": {"sda1": {"total": "10737418240", "used": "1073741824"}}},
+		"coslite": {"name": "coslite", "state": "Stopped", "ipv4": [], "release": "Ubuntu 22.04 LTS", "memory": {"total": 1073741824, "used": 268435456}, "cpu_count": "1", "load": [0.0, 0.0, 0.0], "disks": {"sda1": {"total": "8589934592", "used": "536870912"}}}
+	}
+}`
+
+// echoExecutor prints canned multipass output
+type echoExecutor struct {
+	output string
+}
+
+func (e echoExecutor) CommandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, "echo", e.output)
+}
+
+func newTestHandlerApp(t *testing.T) *App {
+	t.Helper()
+	app := &App{
+		cfg:       config.DefaultConfig(),
+		collector: collector.NewMultipassCollectorWithExecutor(5, echoExecutor{output: testInfoJSON}),
+	}
+	if err := app.setupRegistries(); err != nil {
+		t.Fatalf("Failed to set up registries: %v", err)
+	}
+	return app
+}
+
+func scrape(t *testing.T, handler http.Handler, target string) (int, string) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	body, err := io.ReadAll(rec.Result().Body)
+	if err != nil {
+		t.Fatalf("Failed to read response body: %v", err)
+	}
+	return rec.Code, string(body)
+}
+
+func TestMetricsHandler_CollectFilter(t *testing.T) {
+	app := newTestHandlerApp(t)
+
+	code, body := scrape(t, app.metricsHandler(), "/metrics?collect[]=memory&collect[]=disk")
+	if code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", code, body)
+	}
+
+	if !strings.Contains(body, "multipass_instance_memory_bytes") {
+		t.Error("Expected memory metrics in filtered output")
+	}
+	if !strings.Contains(body, "multipass_instance_disk_used_bytes") {
+		t.Error("Expected disk metrics in filtered output")
+	}
+	if strings.Contains(body, "multipass_instance_load_1m") {
+		t.Error("Expected load metrics to be filtered out")
+	}
+	if strings.Contains(body, "multipass_instances_running") {
+		t.Error("Expected instance counts to be filtered out")
+	}
+}
+
+func TestMetricsHandler_InstanceFilter(t *testing.T) {
+	app := newTestHandlerApp(t)
+
+	code, body := scrape(t, app.metricsHandler(), "/metrics?instance=charm-.*")
+	if code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", code, body)
+	}
+
+	if !strings.Contains(body, `name="charm-dev-36"`) {
+		t.Error("Expected charm-dev-36 metrics in filtered output")
+	}
+	if strings.Contains(body, `name="coslite"`) {
+		t.Error("Expected coslite metrics to be filtered out")
+	}
+	if !strings.Contains(body, "multipass_instances_total 1") {
+		t.Error("Expected instance total to only count matching instances")
+	}
+}
+
+func TestMetricsHandler_InstanceFilterIsAnchored(t *testing.T) {
+	app := newTestHandlerApp(t)
+
+	_, body := scrape(t, app.metricsHandler(), "/metrics?instance=charm")
+	if strings.Contains(body, `name="charm-dev-36"`) {
+		t.Error("Expected partial match not to select charm-dev-36")
+	}
+}
+
+func TestMetricsHandler_BadRequests(t *testing.T) {
+	app := newTestHandlerApp(t)
+
+	for _, target := range []string{
+		"/metrics?collect[]=bogus",
+		"/metrics?instance=(unclosed",
+	} {
+		code, _ := scrape(t, app.metricsHandler(), target)
+		if code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s, got %d", target, code)
+		}
+	}
+}
+
+func TestMetricsHandler_IncludesExporterMetrics(t *testing.T) {
+	app := newTestHandlerApp(t)
+
+	_, body := scrape(t, app.metricsHandler(), "/metrics")
+	if !strings.Contains(body, "multipass_instances_total") {
+		t.Error("Expected multipass metrics on /metrics")
+	}
+	if !strings.Contains(body, "go_goroutines") {
+		t.Error("Expected Go runtime metrics on /metrics by default")
+	}
+}
+
+func TestMetricsHandler_FilteredIncludesExporterMetrics(t *testing.T) {
+	app := newTestHandlerApp(t)
+
+	_, body := scrape(t, app.metricsHandler(), "/metrics?collect[]=memory")
+	if !strings.Contains(body, "go_goroutines") {
+		t.Error("Expected filtered scrape to include Go runtime metrics")
+	}
+	if strings.Contains(body, "multipass_instance_load_1m") {
+		t.Error("Expected load metrics to be filtered out")
+	}
+}
+
+// blockingRunner holds every `multipass info` until release is closed
+type blockingRunner struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b blockingRunner) Run(ctx context.Context, name string, args ...string) (collector.CommandResult, error) {
+	b.started <- struct{}{}
+	<-b.release
+	return collector.CommandResult{Stdout: []byte(testInfoJSON)}, nil
+}
+
+func TestMetricsHandler_FilteredScrapesShareInFlightLimit(t *testing.T) {
+	runner := blockingRunner{started: make(chan struct{}, 10), release: make(chan struct{})}
+	app := &App{
+		cfg:       config.DefaultConfig(),
+		collector: collector.NewMultipassCollectorWithRunner(5, runner),
+	}
+	app.cfg.Exposition.MaxRequestsInFlight = 2
+	if err := app.setupRegistries(); err != nil {
+		t.Fatalf("Failed to set up registries: %v", err)
+	}
+	handler := app.metricsHandler()
+
+	codes := make(chan int, 2)
+	for _, target := range []string{"/metrics?collect[]=memory", "/metrics?instance=coslite"} {
+		go func() {
+			code, _ := scrape(t, handler, target)
+			codes <- code
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-runner.started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for the filtered scrapes to start")
+		}
+	}
+
+	for _, target := range []string{"/metrics?collect[]=disk", "/metrics"} {
+		if code, body := scrape(t, handler, target); code != http.StatusServiceUnavailable {
+			t.Errorf("Expected status 503 for %s above the limit, got %d: %s", target, code, body)
+		}
+	}
+
+	close(runner.release)
+	for i := 0; i < 2; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("Expected status 200 for the scrapes within the limit, got %d", code)
+		}
+	}
+}
+
+func TestMetricsHandler_WithoutRuntimeCollectors(t *testing.T) {
+	app := &App{
+		cfg:       config.DefaultConfig(),
+		collector: collector.NewMultipassCollectorWithExecutor(5, echoExecutor{output: testInfoJSON}),
+	}
+	app.cfg.Exposition.GoCollector = false
+	app.cfg.Exposition.ProcessCollector = false
+	if err := app.setupRegistries(); err != nil {
+		t.Fatalf("Failed to set up registries: %v", err)
+	}
+
+	_, body := scrape(t, app.metricsHandler(), "/metrics")
+	if strings.Contains(body, "go_goroutines") || strings.Contains(body, "process_start_time_seconds") {
+		t.Error("Expected no Go or process metrics when disabled")
+	}
+	if !strings.Contains(body, "multipass_instances_total") {
+		t.Error("Expected multipass metrics on /metrics")
+	}
+}
+
+func TestExporterMetricsHandler(t *testing.T) {
+	app := newTestHandlerApp(t)
+
+	// Scrape /metrics once so the handler instrumentation has samples
+	scrape(t, app.metricsHandler(), "/metrics")
+
+	code, body := scrape(t, app.exporterMetricsHandler(), "/metrics/exporter")
+	if code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if strings.Contains(body, "multipass_instances_total") {
+		t.Error("Expected no multipass metrics on the exporter endpoint")
+	}
+	if !strings.Contains(body, "promhttp_metric_handler_requests_total") {
+		t.Error("Expected handler instrumentation on the exporter endpoint")
+	}
+	if !strings.Contains(body, "go_goroutines") {
+		t.Error("Expected Go runtime metrics on the exporter endpoint")
+	}
+}
+
+func TestMetricsHandler_OpenMetricsNegotiation(t *testing.T) {
+	app := newTestHandlerApp(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	rec := httptest.NewRecorder()
+	app.metricsHandler().ServeHTTP(rec, req)
+
+	contentType := rec.Header().Get("Content-Type")
+	if !strings.HasPrefix(contentType, "application/openmetrics-text") {
+		t.Errorf("Expected OpenMetrics content type, got %q", contentType)
+	}
+	if !strings.HasSuffix(rec.Body.String(), "# EOF\n") {
+		t.Error("Expected OpenMetrics output to end with # EOF")
+	}
+}
+
+func TestNewHandlerOpts(t *testing.T) {
+	cfg := config.DefaultConfig().Exposition
+	cfg.ErrorHandling = "continue"
+	cfg.MaxRequestsInFlight = 3
+	cfg.TimeoutSeconds = 7
+	cfg.CreatedTimestamps = true
+
+	opts, err := newHandlerOpts(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if opts.ErrorHandling != promhttp.ContinueOnError {
+		t.Errorf("Expected ContinueOnError, got %v", opts.ErrorHandling)
+	}
+	if opts.MaxRequestsInFlight != 3 {
+		t.Errorf("Expected MaxRequestsInFlight 3, got %d", opts.MaxRequestsInFlight)
+	}
+	if opts.Timeout != 7*time.Second {
+		t.Errorf("Expected Timeout 7s, got %v", opts.Timeout)
+	}
+	if !opts.EnableOpenMetricsTextCreatedSamples {
+		t.Error("Expected created samples to be enabled")
+	}
+
+	cfg.ErrorHandling = "ignore"
+	if _, err := newHandlerOpts(cfg); err == nil {
+		t.Error("Expected error for invalid error_handling")
+	}
+}
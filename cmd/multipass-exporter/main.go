@@ -1,101 +1,908 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"net"
 	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/Abuelodelanada/multipass-exporter/internal/api"
 	"github.com/Abuelodelanada/multipass-exporter/internal/collector"
 	"github.com/Abuelodelanada/multipass-exporter/internal/config"
+	"github.com/Abuelodelanada/multipass-exporter/internal/events"
+	"github.com/Abuelodelanada/multipass-exporter/internal/labels"
+	"github.com/Abuelodelanada/multipass-exporter/internal/listener"
+	"github.com/Abuelodelanada/multipass-exporter/internal/logging"
+	"github.com/Abuelodelanada/multipass-exporter/internal/notify"
+	"github.com/Abuelodelanada/multipass-exporter/internal/otlp"
+	"github.com/Abuelodelanada/multipass-exporter/internal/push"
+	"github.com/Abuelodelanada/multipass-exporter/internal/remotewrite"
+	"github.com/Abuelodelanada/multipass-exporter/internal/sd"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/sirupsen/logrus"
 )
 
 // configPath is the command line argument for configuration file path
 var configPath string
 
+// flagValues holds configuration overrides given as command line flags
+var flagValues config.FlagValues
+
+// configRequired makes a missing configuration file fatal
+var configRequired bool
+
+// configDir is the directory of *.yaml files merged on top of the
+// configuration file; empty means config.d next to it
+var configDir string
+
+// checkConfig validates the configuration and exits instead of serving
+var checkConfig bool
+
+// printConfig prints the effective configuration and exits instead of serving
+var printConfig bool
+
+// once collects a single time and exits instead of serving
+var once bool
+
+// outputFile is where --once writes metrics; empty means stdout
+var outputFile string
+
+// subcommands run instead of the exporter when named as the first
+// argument, with the arguments following them
+var subcommands = map[string]func(args []string, w io.Writer, stderr io.Writer) error{
+	"mixin": runMixin,
+	"dump":  runDump,
+}
+
 func main() {
+	if len(os.Args) > 1 && subcommands[os.Args[1]] != nil {
+		if err := subcommands[os.Args[1]](os.Args[2:], os.Stdout, os.Stderr); err != nil {
+			if !errors.Is(err, flag.ErrHelp) {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+		return
+	}
+
 	app := NewApp()
+	if app.checkConfig {
+		if err := app.CheckConfig(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if app.printConfig {
+		if err := app.PrintConfig(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if app.once {
+		if err := app.RunOnce(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	app.Run()
 }
 
 // App represents the main application
 type App struct {
-	configPath string
-	cfg        *config.Config
-	collector  *collector.MultipassCollector
+	configPath       string
+	configRequired   bool
+	configDir        string
+	checkConfig      bool
+	printConfig      bool
+	once             bool
+	outputFile       string
+	flagValues       config.FlagValues
+	lookupEnv        func(string) (string, bool)
+	cfg              *config.Config
+	sources          config.Sources
+	collector        *collector.MultipassCollector
+	registry         *prometheus.Registry
+	exporterRegistry *prometheus.Registry
+	handlerOpts      promhttp.HandlerOpts
+	broker           *events.Broker
+	pusher           *push.Pusher
+	remoteWriter     *remotewrite.Sender
+	otlpExporter     *otlp.Exporter
+	fileSD           *sd.FileWriter
+	notifier         *notify.Engine
+	simulator        *collector.Simulator
+	logger           *logrus.Logger
+	logCloser        io.Closer
+
+	// mu guards the configuration and everything derived from it, which
+	// Reload replaces while requests are being served
+	mu              sync.RWMutex
+	metrics         http.Handler
+	exporterMetrics http.Handler
+	reloadSuccess   prometheus.Gauge
+	reloadTimestamp prometheus.Gauge
+	// configDigest is the digest of the config file content last loaded
+	configDigest [sha256.Size]byte
 }
 
 func NewApp() *App {
 	// Only parse flags if they haven't been parsed already
 	if !flag.Parsed() {
 		flag.StringVar(&configPath, "config", "", "Path to configuration file (optional)")
+		flag.BoolVar(&configRequired, "config-required", false, "Fail if the configuration file does not exist")
+		flag.StringVar(&configDir, "config-dir", "", "Directory of *.yaml files merged on top of the configuration file (default config.d next to it)")
+		flag.BoolVar(&checkConfig, "check-config", false, "Validate the configuration and exit")
+		flag.BoolVar(&printConfig, "print-config", false, "Print the effective configuration, annotated with the source of each value, and exit")
+		flag.BoolVar(&once, "once", false, "Collect metrics once, write them in text format to --output-file or stdout, and exit")
+		flag.StringVar(&outputFile, "output-file", "", "File --once writes metrics to atomically, e.g. in node_exporter's textfile directory (implies --once)")
+		flagValues = config.RegisterFlags(flag.CommandLine)
 		flag.Parse()
 	}
 
 	return &App{
-		configPath: configPath,
+		configPath:     configPath,
+		configRequired: configRequired,
+		configDir:      configDir,
+		checkConfig:    checkConfig,
+		printConfig:    printConfig,
+		once:           once || outputFile != "",
+		outputFile:     outputFile,
+		flagValues:     flagValues,
+		lookupEnv:      os.LookupEnv,
 	}
 }
 
+// LoadConfiguration builds the configuration from defaults, the YAML file,
+// the include directory, MULTIPASS_EXPORTER_* environment variables and command line flags, in
+// increasing order of precedence
 func (a *App) LoadConfiguration() error {
-	var err error
+	result, err := config.Load(a.loadOptions())
+	if err != nil {
+		if a.configPath != "" {
+			return fmt.Errorf("failed to load config from %s: %w", a.configPath, err)
+		}
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	if err := a.configureLogging(result.Config); err != nil {
+		return err
+	}
+	a.cfg = result.Config
+	a.sources = result.Sources
+	a.configDigest, _ = configDigest(a.loadOptions())
+
+	switch {
+	case a.configPath == "":
+		a.logger.Infof("No configuration file given, using defaults with environment and flag overrides")
+	case result.Loaded:
+		a.logger.Infof("Loaded configuration from %s", a.configPath)
+	default:
+		a.logger.Warnf("Configuration file %s not found, using defaults with environment and flag overrides", a.configPath)
+	}
+	for _, include := range result.Includes {
+		a.logger.Infof("Merged configuration from %s", include)
+	}
 
-	if a.configPath == "" {
-		// Use default configuration
-		a.cfg = config.DefaultConfig()
-		log.Printf("Using default configuration: port=%d, metrics_path=%s, timeout_seconds=%d, log_level=%s",
-			a.cfg.Port, a.cfg.MetricsPath, a.cfg.TimeoutSeconds, a.cfg.LogLevel)
-		return nil
+	for _, setting := range config.Effective(a.cfg, a.sources) {
+		a.logger.WithField("source", setting.Source).Infof("Config %s=%v", setting.Key, setting.Value)
 	}
+	return nil
+}
 
-	var loaded bool
-	a.cfg, loaded, err = config.LoadConfig(a.configPath)
+// configureLogging points the application logger, shared by every
+// component, at the format, level and output of cfg
+func (a *App) configureLogging(cfg *config.Config) error {
+	if a.logger == nil {
+		a.logger = logging.New()
+	}
+
+	closer, err := logging.Configure(a.logger, logging.Options{
+		Level:  cfg.LogLevel,
+		Format: cfg.LogFormat,
+		Output: cfg.LogOutput,
+		File: logging.FileOptions{
+			Path:         cfg.LogFile.Path,
+			MaxSizeBytes: int64(cfg.LogFile.MaxSizeMB) * 1024 * 1024,
+			MaxBackups:   cfg.LogFile.MaxBackups,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to configure logging: %w", err)
+	}
+
+	if a.logCloser != nil {
+		a.logCloser.Close()
+	}
+	a.logCloser = closer
+	return nil
+}
+
+// loadOptions returns the layers LoadConfiguration and Reload combine
+func (a *App) loadOptions() config.LoadOptions {
+	return config.LoadOptions{
+		Path:       a.configPath,
+		Required:   a.configRequired,
+		IncludeDir: a.configDir,
+		Flags:      a.flagValues,
+		LookupEnv:  a.lookupEnv,
+	}
+}
+
+// CheckConfig loads and validates the configuration without starting the
+// exporter. A configuration file, when given, must exist.
+func (a *App) CheckConfig(w io.Writer) error {
+	a.configRequired = a.configRequired || a.configPath != ""
+	if err := a.LoadConfiguration(); err != nil {
+		return err
+	}
+	if _, err := newHandlerOpts(a.cfg.Exposition); err != nil {
+		return err
+	}
+	if _, err := newLabeler(a.cfg.Labels); err != nil {
+		return err
+	}
+	if _, err := a.newPusher(a.cfg.Push); err != nil {
+		return err
+	}
+	if _, err := a.newRemoteWriter(a.cfg.RemoteWrite); err != nil {
+		return err
+	}
+	exporter, err := a.newOTLPExporter(a.cfg.OTLP)
+	if err != nil {
+		return err
+	}
+	if exporter != nil {
+		exporter.Close()
+	}
+	if _, err := a.newFileSD(a.cfg.FileSD); err != nil {
+		return err
+	}
+	if _, err := a.newNotifier(a.cfg.Notifications); err != nil {
+		return err
+	}
+
+	if a.configPath != "" {
+		fmt.Fprintf(w, "Configuration %s is valid\n", a.configPath)
+	} else {
+		fmt.Fprintln(w, "Configuration is valid")
+	}
+	return nil
+}
+
+// PrintConfig writes the effective configuration as YAML, each value
+// annotated with the layer or file line it came from
+func (a *App) PrintConfig(w io.Writer) error {
+	result, err := config.Load(a.loadOptions())
+	if err != nil {
+		if a.configPath != "" {
+			return fmt.Errorf("failed to load config from %s: %w", a.configPath, err)
+		}
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	out, err := result.Annotated()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
 
+// RunOnce collects the Multipass metrics a single time and writes them in
+// the Prometheus text format to the output file, through a temporary file
+// renamed into place, or to w when no file is set. A failed collection is
+// still written, so the error metrics reach the file, and then returned.
+func (a *App) RunOnce(w io.Writer) error {
+	if err := a.LoadConfiguration(); err != nil {
+		return err
+	}
+	c, err := a.newCollector(a.cfg)
 	if err != nil {
-		return fmt.Errorf("failed to load config from %s: %w", a.configPath, err)
+		return err
 	}
+	var collectErr error
+	c.AddErrorObserver(func(err error) {
+		collectErr = err
+	})
 
-	if loaded {
-		log.Printf("Loaded configuration from %s: port=%d, metrics_path=%s, timeout_seconds=%d, log_level=%s",
-			a.configPath, a.cfg.Port, a.cfg.MetricsPath, a.cfg.TimeoutSeconds, a.cfg.LogLevel)
-		return nil
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(c); err != nil {
+		return fmt.Errorf("failed to register multipass collector: %w", err)
+	}
+
+	if a.outputFile != "" {
+		err = prometheus.WriteToTextfile(a.outputFile, registry)
+	} else {
+		err = writeText(w, registry)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write metrics: %w", err)
+	}
+	if collectErr != nil {
+		return fmt.Errorf("failed to collect metrics: %w", collectErr)
 	}
+	return nil
+}
 
-	log.Printf("Configuration file %s not found, using defaults: port=%d, metrics_path=%s, timeout_seconds=%d, log_level=%s", a.configPath, a.cfg.Port, a.cfg.MetricsPath, a.cfg.TimeoutSeconds, a.cfg.LogLevel)
+// writeText writes what gatherer collects in the Prometheus text format
+func writeText(w io.Writer, gatherer prometheus.Gatherer) error {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToText(w, family); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (a *App) InitializeCollector() error {
-	a.collector = collector.NewMultipassCollector(a.cfg.TimeoutSeconds)
+	a.broker = events.NewBroker(a.cfg.Events.ReplayBufferSize)
+
+	var err error
+	if a.fileSD, err = a.newFileSD(a.cfg.FileSD); err != nil {
+		return err
+	}
+	if a.notifier, err = a.newNotifier(a.cfg.Notifications); err != nil {
+		return err
+	}
+
+	c, err := a.newCollector(a.cfg)
+	if err != nil {
+		return err
+	}
+	a.collector = c
+
+	if err := a.setupRegistries(); err != nil {
+		return err
+	}
+
+	if a.pusher, err = a.newPusher(a.cfg.Push); err != nil {
+		return err
+	}
+	if a.pusher != nil {
+		for _, c := range a.pusher.Collectors() {
+			if err := a.exporterRegistry.Register(c); err != nil {
+				return fmt.Errorf("failed to register push metrics: %w", err)
+			}
+		}
+	}
+
+	if a.remoteWriter, err = a.newRemoteWriter(a.cfg.RemoteWrite); err != nil {
+		return err
+	}
+	if a.remoteWriter != nil {
+		for _, c := range a.remoteWriter.Collectors() {
+			if err := a.exporterRegistry.Register(c); err != nil {
+				return fmt.Errorf("failed to register remote-write metrics: %w", err)
+			}
+		}
+	}
+
+	if a.otlpExporter, err = a.newOTLPExporter(a.cfg.OTLP); err != nil {
+		return err
+	}
+	if a.otlpExporter != nil {
+		for _, c := range a.otlpExporter.Collectors() {
+			if err := a.exporterRegistry.Register(c); err != nil {
+				return fmt.Errorf("failed to register OTLP metrics: %w", err)
+			}
+		}
+	}
+
+	if a.notifier != nil {
+		for _, c := range a.notifier.Collectors() {
+			if err := a.exporterRegistry.Register(c); err != nil {
+				return fmt.Errorf("failed to register notification metrics: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// newPusher builds the Pushgateway pusher for cfg, or returns nil when
+// pushing is disabled. It pushes the current Multipass registry, so pushes
+// follow reloads.
+func (a *App) newPusher(cfg config.PushConfig) (*push.Pusher, error) {
+	if cfg.URL == "" {
+		return nil, nil
+	}
+
+	grouping := cfg.Grouping
+	if len(grouping) == 0 {
+		var err error
+		if grouping, err = push.DefaultGrouping(); err != nil {
+			return nil, err
+		}
+	}
+
+	password, err := readPasswordFile(cfg.PasswordFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read push password file: %w", err)
+	}
+
+	pusher := push.New(push.Options{
+		URL:        cfg.URL,
+		Job:        cfg.Job,
+		Grouping:   grouping,
+		Interval:   time.Duration(cfg.IntervalSeconds) * time.Second,
+		Timeout:    time.Duration(cfg.TimeoutSeconds) * time.Second,
+		Username:   cfg.Username,
+		Password:   password,
+		MaxRetries: cfg.MaxRetries,
+		Backoff:    time.Duration(cfg.RetryBackoffSeconds) * time.Second,
+	}, a.multipassGatherer())
+	if a.logger != nil {
+		pusher.SetLogger(a.logger)
+	}
+	return pusher, nil
+}
+
+// newRemoteWriter builds the remote-write sender for cfg, or returns nil
+// when remote write is disabled. Like the pusher, it follows reloads.
+func (a *App) newRemoteWriter(cfg config.RemoteWriteConfig) (*remotewrite.Sender, error) {
+	if cfg.URL == "" {
+		return nil, nil
+	}
+
+	password, err := readPasswordFile(cfg.PasswordFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read remote-write password file: %w", err)
+	}
+
+	externalLabels := map[string]string{"job": "multipass_exporter"}
+	if hostname, err := os.Hostname(); err == nil {
+		externalLabels["instance"] = hostname
+	}
+	for name, value := range cfg.ExternalLabels {
+		externalLabels[name] = value
+	}
+
+	queue, err := remotewrite.NewQueue(cfg.QueueDir, cfg.MaxQueuedRequests)
+	if err != nil {
+		return nil, err
+	}
+
+	sender := remotewrite.New(remotewrite.Options{
+		URL:            cfg.URL,
+		Headers:        cfg.Headers,
+		Username:       cfg.Username,
+		Password:       password,
+		ExternalLabels: externalLabels,
+		Interval:       time.Duration(cfg.IntervalSeconds) * time.Second,
+		Timeout:        time.Duration(cfg.TimeoutSeconds) * time.Second,
+	}, a.multipassGatherer(), queue)
+	if a.logger != nil {
+		sender.SetLogger(a.logger)
+	}
+	return sender, nil
+}
+
+// newOTLPExporter builds the OTLP exporter for cfg, or returns nil when
+// OTLP export is disabled. It exports the instances selected by the
+// current instance filters, so it follows reloads.
+func (a *App) newOTLPExporter(cfg config.OTLPConfig) (*otlp.Exporter, error) {
+	if cfg.Endpoint == "" {
+		return nil, nil
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hostname: %w", err)
+	}
+
+	exporter, err := otlp.New(otlp.Options{
+		Endpoint:           cfg.Endpoint,
+		Protocol:           cfg.Protocol,
+		Insecure:           cfg.Insecure,
+		Headers:            cfg.Headers,
+		ResourceAttributes: cfg.ResourceAttributes,
+		Hostname:           hostname,
+		Interval:           time.Duration(cfg.IntervalSeconds) * time.Second,
+		Timeout:            time.Duration(cfg.TimeoutSeconds) * time.Second,
+	}, selectedInfoSource{a})
+	if err != nil {
+		return nil, err
+	}
+	if a.logger != nil {
+		exporter.SetLogger(a.logger)
+	}
+	return exporter, nil
+}
+
+// selectedInfoSource runs `multipass info` with the current collector and
+// keeps the instances selected by the instance filters
+type selectedInfoSource struct {
+	app *App
+}
+
+func (s selectedInfoSource) Info() (collector.MultipassInfoResponse, error) {
+	s.app.mu.RLock()
+	c := s.app.collector
+	s.app.mu.RUnlock()
+	return c.SelectedInfo()
+}
+
+// newFileSD builds the file service discovery writer for cfg, or returns
+// nil when it is disabled
+func (a *App) newFileSD(cfg config.FileSDConfig) (*sd.FileWriter, error) {
+	if cfg.Path == "" {
+		return nil, nil
+	}
+	writer, err := sd.NewFileWriter(sd.FileOptions{
+		Options: sd.Options{Ports: cfg.Ports, States: cfg.States, AllAddresses: cfg.AllAddresses},
+		Path:    cfg.Path,
+		Labels:  cfg.Labels,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if a.logger != nil {
+		writer.SetLogger(a.logger)
+	}
+	return writer, nil
+}
+
+// newNotifier builds the threshold notification engine for cfg, or returns
+// nil when no rules are configured
+func (a *App) newNotifier(cfg config.NotificationsConfig) (*notify.Engine, error) {
+	if len(cfg.Rules) == 0 {
+		return nil, nil
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hostname: %w", err)
+	}
+
+	rules := make([]notify.Rule, 0, len(cfg.Rules))
+	for _, rule := range cfg.Rules {
+		rules = append(rules, notify.Rule{
+			Name:             rule.Name,
+			Metric:           rule.Metric,
+			Threshold:        rule.Threshold,
+			ResolveThreshold: rule.ResolveThreshold,
+		})
+	}
+	webhooks := make([]notify.Webhook, 0, len(cfg.Webhooks))
+	for _, webhook := range cfg.Webhooks {
+		webhooks = append(webhooks, notify.Webhook{URL: webhook.URL, Headers: webhook.Headers, Body: webhook.Body})
+	}
+
+	engine, err := notify.New(notify.Options{
+		Rules:          rules,
+		Webhooks:       webhooks,
+		RepeatInterval: time.Duration(cfg.RepeatIntervalSeconds) * time.Second,
+		Timeout:        time.Duration(cfg.TimeoutSeconds) * time.Second,
+		Hostname:       hostname,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if a.logger != nil {
+		engine.SetLogger(a.logger)
+	}
+	return engine, nil
+}
+
+// serviceDiscoveryHandler serves Prometheus HTTP service discovery targets
+// for the instances selected by the instance filters, following reloads
+func (a *App) serviceDiscoveryHandler() http.Handler {
+	return sd.NewHandler(selectedInfoSource{app: a}, func() sd.Options {
+		a.mu.RLock()
+		defer a.mu.RUnlock()
+		cfg := a.cfg.ServiceDiscovery
+		return sd.Options{Ports: cfg.Ports, States: cfg.States, AllAddresses: cfg.AllAddresses}
+	})
+}
+
+// multipassGatherer gathers the current Multipass registry, which Reload
+// replaces
+func (a *App) multipassGatherer() prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		a.mu.RLock()
+		registry := a.registry
+		a.mu.RUnlock()
+		return registry.Gather()
+	})
+}
+
+// readPasswordFile returns the trimmed content of path, or "" when path is empty
+func readPasswordFile(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// newSimulator builds the simulated fleet of cfg
+func newSimulator(cfg *config.Config) *collector.Simulator {
+	s := cfg.Simulator
+	return collector.NewSimulator(collector.SimulatorOptions{
+		Instances:       cfg.Simulate,
+		States:          s.States,
+		Releases:        s.Releases,
+		CPUs:            s.CPUs,
+		MemoryMB:        s.MemoryMB,
+		Disks:           s.Disks,
+		Seed:            s.Seed,
+		SlowRate:        s.Faults.SlowRate,
+		SlowDelay:       time.Duration(s.Faults.SlowSeconds) * time.Second,
+		MalformedRate:   s.Faults.MalformedRate,
+		DaemonErrorRate: s.Faults.DaemonErrorRate,
+	})
+}
+
+// newCollector builds a Multipass collector for cfg that reports every
+// `multipass info` response to the event broker and the file service
+// discovery writer
+func (a *App) newCollector(cfg *config.Config) (*collector.MultipassCollector, error) {
+	executor := collector.RealCommandExecutor{
+		Options: collector.CommandOptions{
+			Binary: cfg.Multipass.Binary,
+			Args:   cfg.Multipass.Args,
+			Env:    cfg.Multipass.Env,
+			Dir:    cfg.Multipass.WorkDir,
+		},
+	}
+	var runner collector.CommandRunner = collector.ExecRunner{Executor: executor}
+	if cfg.Simulate > 0 {
+		// The fleet outlives reloads, which cannot change its settings, so
+		// its values and injected faults carry on
+		if a.simulator == nil {
+			a.simulator = newSimulator(cfg)
+		}
+		runner = a.simulator
+	}
+	switch {
+	case cfg.ReplayDir != "":
+		replay, err := collector.NewReplayRunner(cfg.ReplayDir)
+		if err != nil {
+			return nil, err
+		}
+		runner = replay
+	case cfg.RecordDir != "":
+		recorder, err := collector.NewRecordingRunner(runner, cfg.RecordDir, cfg.RecordMaxRecordings)
+		if err != nil {
+			return nil, err
+		}
+		if a.logger != nil {
+			recorder.SetLogger(a.logger)
+		}
+		runner = recorder
+	}
+	c := collector.NewMultipassCollectorWithRunner(cfg.TimeoutSeconds, runner)
+
+	if a.logger != nil {
+		c.SetLogger(a.logger)
+	}
 
-	if err := a.collector.SetLogLevel(a.cfg.LogLevel); err != nil {
-		log.Printf("Warning: Invalid log level '%s', using info level: %v", a.cfg.LogLevel, err)
+	if err := c.SetSchema(cfg.Namespace, collector.Schema(cfg.MetricsSchema)); err != nil {
+		return nil, err
 	}
 
-	prometheus.MustRegister(a.collector)
+	instances := cfg.Instances
+	selector, err := collector.NewInstanceSelector(instances.Include, instances.Exclude, instances.Releases, instances.States, instances.CountFiltered)
+	if err != nil {
+		return nil, fmt.Errorf("invalid instance filters: %w", err)
+	}
+	c.SetInstanceSelector(selector)
+
+	labeler, err := newLabeler(cfg.Labels)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.SetLabels(cfg.Labels.Constant, labeler); err != nil {
+		return nil, fmt.Errorf("invalid labels: %w", err)
+	}
+
+	if a.broker != nil {
+		c.AddInfoObserver(a.broker.Observe)
+	}
+	if a.fileSD != nil {
+		c.AddInfoObserver(func(data collector.MultipassInfoResponse) {
+			a.fileSD.Observe(c.Select(data))
+		})
+	}
+	if a.notifier != nil {
+		c.AddInfoObserver(func(data collector.MultipassInfoResponse) {
+			a.notifier.Observe(c.Select(data))
+		})
+	}
+	return c, nil
+}
+
+// newLabeler builds the instance labeler from the label rules and the
+// optional mapping file
+func newLabeler(cfg config.LabelsConfig) (*labels.Labeler, error) {
+	var mapping labels.Mapping
+	if cfg.MappingFile != "" {
+		var err error
+		if mapping, err = labels.LoadMapping(cfg.MappingFile); err != nil {
+			return nil, err
+		}
+	}
+
+	labeler, err := labels.New(cfg.Rules, mapping)
+	if err != nil {
+		return nil, fmt.Errorf("invalid labels: %w", err)
+	}
+	return labeler, nil
+}
+
+// setupRegistries registers the Multipass collector on a dedicated registry
+// and the exporter's own metrics on a second one, so each can be served alone
+func (a *App) setupRegistries() error {
+	opts, err := newHandlerOpts(a.cfg.Exposition)
+	if err != nil {
+		return err
+	}
+
+	a.registry = prometheus.NewRegistry()
+	a.exporterRegistry = prometheus.NewRegistry()
+
+	if err := a.registry.Register(a.collector); err != nil {
+		return fmt.Errorf("failed to register multipass collector: %w", err)
+	}
+	if a.cfg.Exposition.GoCollector {
+		if err := a.exporterRegistry.Register(collectors.NewGoCollector()); err != nil {
+			return fmt.Errorf("failed to register Go collector: %w", err)
+		}
+	}
+	if a.cfg.Exposition.ProcessCollector {
+		if err := a.exporterRegistry.Register(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{})); err != nil {
+			return fmt.Errorf("failed to register process collector: %w", err)
+		}
+	}
+
+	a.reloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "multipass_exporter_config_last_reload_successful",
+		Help: "Whether the last configuration reload attempt was successful",
+	})
+	a.reloadTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "multipass_exporter_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful configuration reload",
+	})
+	if err := a.exporterRegistry.Register(a.reloadSuccess); err != nil {
+		return fmt.Errorf("failed to register reload metrics: %w", err)
+	}
+	if err := a.exporterRegistry.Register(a.reloadTimestamp); err != nil {
+		return fmt.Errorf("failed to register reload metrics: %w", err)
+	}
+	a.recordReload(true)
+
+	opts.Registry = a.exporterRegistry
+	opts.ErrorLog = a.errorLog()
+	a.handlerOpts = opts
+	a.metrics = a.newMetricsHandler(a.collector, a.registry, opts)
+	a.exporterMetrics = promhttp.HandlerFor(a.exporterRegistry, opts)
 	return nil
 }
 
+// OpenListeners returns the sockets handed over by systemd socket activation,
+// or opens the configured listen addresses when not socket-activated
+func (a *App) OpenListeners() ([]net.Listener, error) {
+	listeners, err := listener.SystemdListeners()
+	if err != nil {
+		return nil, fmt.Errorf("systemd socket activation failed: %w", err)
+	}
+	if len(listeners) > 0 {
+		a.logger.Infof("Using %d socket(s) passed by systemd", len(listeners))
+		return listeners, nil
+	}
+
+	return listener.Listen(a.cfg.Addresses())
+}
+
 func (a *App) StartServer() error {
-	addr := fmt.Sprintf(":%d", a.cfg.Port)
-	http.Handle(a.cfg.MetricsPath, promhttp.Handler())
+	listeners, err := a.OpenListeners()
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(a.cfg.MetricsPath, a.metricsHandler())
+	if a.cfg.Exposition.ExporterMetricsPath != "" {
+		mux.Handle(a.cfg.Exposition.ExporterMetricsPath, a.exporterMetricsHandler())
+	}
+	mux.Handle("/api/v1/", api.NewHandler(a))
+	mux.Handle("GET /api/v1/events", a.broker)
+	if a.cfg.ServiceDiscovery.Path != "" {
+		mux.Handle(a.cfg.ServiceDiscovery.Path, a.serviceDiscoveryHandler())
+	}
+	if a.simulator != nil {
+		mux.Handle("GET "+simulatorFaultsPath, a.simulatorFaultsHandler())
+		mux.Handle("POST "+simulatorFaultsPath, a.simulatorFaultsHandler())
+	}
+
+	if a.cfg.Events.RefreshIntervalSeconds > 0 {
+		interval := time.Duration(a.cfg.Events.RefreshIntervalSeconds) * time.Second
+		go a.broker.Run(context.Background(), a, interval)
+	}
+	if a.pusher != nil {
+		a.logger.WithField("interval", time.Duration(a.cfg.Push.IntervalSeconds)*time.Second).Infof("Pushing metrics to %s", a.cfg.Push.URL)
+		go a.pusher.Run(context.Background())
+	}
+	if a.remoteWriter != nil {
+		a.logger.WithField("interval", time.Duration(a.cfg.RemoteWrite.IntervalSeconds)*time.Second).Infof("Sending metrics with remote write to %s", a.cfg.RemoteWrite.URL)
+		go a.remoteWriter.Run(context.Background())
+	}
+	if a.otlpExporter != nil {
+		a.logger.WithField("interval", time.Duration(a.cfg.OTLP.IntervalSeconds)*time.Second).Infof("Exporting metrics with OTLP over %s to %s", a.cfg.OTLP.Protocol, a.cfg.OTLP.Endpoint)
+		go a.otlpExporter.Run(context.Background())
+	}
+	if a.fileSD != nil {
+		a.logger.Infof("Writing service discovery targets to %s", a.cfg.FileSD.Path)
+		if a.cfg.FileSD.RefreshIntervalSeconds > 0 {
+			go a.fileSD.Run(context.Background(), selectedInfoSource{a}, time.Duration(a.cfg.FileSD.RefreshIntervalSeconds)*time.Second)
+		}
+	}
+	if a.notifier != nil {
+		a.logger.Infof("Sending notifications for %d rules to %d webhooks", len(a.cfg.Notifications.Rules), len(a.cfg.Notifications.Webhooks))
+		go a.notifier.Run(context.Background())
+	}
+	if a.simulator != nil {
+		a.logger.Warnf("Simulating %d instances instead of running multipass; inject faults at %s", a.cfg.Simulate, simulatorFaultsPath)
+	}
+	if a.cfg.ReplayDir != "" {
+		a.logger.Warnf("Replaying recorded multipass output from %s instead of running multipass", a.cfg.ReplayDir)
+	} else if a.cfg.RecordDir != "" {
+		a.logger.Infof("Recording multipass commands to %s", a.cfg.RecordDir)
+	}
+	if a.configPath != "" {
+		go a.watchConfig(context.Background(), time.Duration(a.cfg.ReloadIntervalSeconds)*time.Second)
+	}
+	server := &http.Server{Handler: mux}
+
+	addrs := make([]string, 0, len(listeners))
+	for _, l := range listeners {
+		addrs = append(addrs, l.Addr().Network()+":"+l.Addr().String())
+	}
+	a.logger.WithField("path", a.cfg.MetricsPath).Infof("Multipass Exporter is running on %s", strings.Join(addrs, ", "))
+
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errs <- server.Serve(l)
+		}(l)
+	}
 
-	log.Printf("Multipass Exporter is running on %s%s", addr, a.cfg.MetricsPath)
-	return http.ListenAndServe(addr, nil)
+	// The first listener to fail stops the whole server
+	err = <-errs
+	server.Close()
+	return err
 }
 
 func (a *App) Run() {
 	if err := a.LoadConfiguration(); err != nil {
-		log.Fatalf("Configuration error: %v", err)
+		// Logging is configured by the configuration that failed to load
+		logging.New().Fatalf("Configuration error: %v", err)
 	}
 
 	if err := a.InitializeCollector(); err != nil {
-		log.Fatalf("Collector initialization error: %v", err)
+		a.logger.Fatalf("Collector initialization error: %v", err)
 	}
 
 	if err := a.StartServer(); err != nil {
-		log.Fatalf("Server error: %v", err)
+		a.logger.Fatalf("Server error: %v", err)
 	}
 }
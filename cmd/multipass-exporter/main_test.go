@@ -1,10 +1,28 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/Abuelodelanada/multipass-exporter/internal/collector"
 	"github.com/Abuelodelanada/multipass-exporter/internal/config"
+	"github.com/Abuelodelanada/multipass-exporter/internal/sd"
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestConfigValidation(t *testing.T) {
@@ -53,50 +71,83 @@ func TestConfigDefaults(t *testing.T) {
 }
 
 func TestEnvironmentVariablePrecedence(t *testing.T) {
-	// Set environment variable
-	testLogLevel := "debug"
-	os.Setenv("LOG_LEVEL", testLogLevel)
-	defer os.Unsetenv("LOG_LEVEL")
-
-	// Create config with different log level
-	cfg := &config.Config{
-		Port:           9090,
-		MetricsPath:    "/metrics",
-		TimeoutSeconds: 10,
-		LogLevel:       "warn", // This should be overridden by env var
+	// Create a config file with a different log level
+	tmpFile := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(tmpFile, []byte("port: 9090\nlog_level: warn\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
 	}
 
-	// Simulate the logic from main()
-	logLevel := os.Getenv("LOG_LEVEL")
-	if logLevel == "" {
-		logLevel = cfg.LogLevel
+	t.Setenv("MULTIPASS_EXPORTER_LOG_LEVEL", "debug")
+
+	app := createTestApp(tmpFile)
+	if err := app.LoadConfiguration(); err != nil {
+		t.Fatalf("LoadConfiguration failed: %v", err)
 	}
 
-	if logLevel != testLogLevel {
-		t.Errorf("Expected log level from environment (%s), got %s", testLogLevel, logLevel)
+	if app.cfg.LogLevel != "debug" {
+		t.Errorf("Expected log level from environment (debug), got %s", app.cfg.LogLevel)
+	}
+	if app.sources.Get("log_level") != config.SourceEnv {
+		t.Errorf("Expected log_level source env, got %s", app.sources.Get("log_level"))
+	}
+	if app.cfg.Port != 9090 || app.sources.Get("port") != config.SourceFile {
+		t.Errorf("Expected port 9090 from file, got %d from %s", app.cfg.Port, app.sources.Get("port"))
 	}
 }
 
 func TestEnvironmentVariableFallback(t *testing.T) {
 	// Ensure environment variable is not set
-	os.Unsetenv("LOG_LEVEL")
+	os.Unsetenv("MULTIPASS_EXPORTER_LOG_LEVEL")
 
-	// Create config
-	cfg := &config.Config{
-		Port:           9090,
-		MetricsPath:    "/metrics",
-		TimeoutSeconds: 10,
-		LogLevel:       "info",
+	tmpFile := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(tmpFile, []byte("log_level: warn\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
 	}
 
-	// Simulate the logic from main()
-	logLevel := os.Getenv("LOG_LEVEL")
-	if logLevel == "" {
-		logLevel = cfg.LogLevel
+	app := createTestApp(tmpFile)
+	if err := app.LoadConfiguration(); err != nil {
+		t.Fatalf("LoadConfiguration failed: %v", err)
 	}
 
-	if logLevel != cfg.LogLevel {
-		t.Errorf("Expected log level from config (%s), got %s", cfg.LogLevel, logLevel)
+	if app.cfg.LogLevel != "warn" {
+		t.Errorf("Expected log level from config (warn), got %s", app.cfg.LogLevel)
+	}
+}
+
+func TestFlagPrecedence(t *testing.T) {
+	tmpFile := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(tmpFile, []byte("port: 9090\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	t.Setenv("MULTIPASS_EXPORTER_PORT", "9191")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	values := config.RegisterFlags(fs)
+	if err := fs.Parse([]string{"--port=9292", "--exposition.go-collector=false"}); err != nil {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
+
+	app := createTestApp(tmpFile)
+	app.flagValues = values
+	if err := app.LoadConfiguration(); err != nil {
+		t.Fatalf("LoadConfiguration failed: %v", err)
+	}
+
+	if app.cfg.Port != 9292 || app.sources.Get("port") != config.SourceFlag {
+		t.Errorf("Expected port 9292 from flag, got %d from %s", app.cfg.Port, app.sources.Get("port"))
+	}
+	if app.cfg.Exposition.GoCollector {
+		t.Error("Expected go collector to be disabled by flag")
+	}
+}
+
+func TestInvalidEnvironmentValue(t *testing.T) {
+	t.Setenv("MULTIPASS_EXPORTER_PORT", "not-a-port")
+
+	app := createTestApp("")
+	if err := app.LoadConfiguration(); err == nil {
+		t.Fatal("Expected error for invalid MULTIPASS_EXPORTER_PORT")
 	}
 }
 
@@ -240,3 +291,635 @@ func TestAppInitializeCollector(t *testing.T) {
 func TestAppRunIntegration(t *testing.T) {
 	t.Skip("Skipping integration test due to prometheus registration conflicts")
 }
+
+func TestCheckConfig(t *testing.T) {
+	tmpFile := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(tmpFile, []byte("port: 9090\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := createTestApp(tmpFile).CheckConfig(&out); err != nil {
+		t.Fatalf("Expected valid configuration, got %v", err)
+	}
+	if !strings.Contains(out.String(), "is valid") {
+		t.Errorf("Expected success message, got %q", out.String())
+	}
+}
+
+func TestCheckConfigInvalid(t *testing.T) {
+	tmpFile := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(tmpFile, []byte("port: 0\nmetrics_path: nope\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	err := createTestApp(tmpFile).CheckConfig(io.Discard)
+	if err == nil {
+		t.Fatal("Expected invalid configuration error")
+	}
+	if !strings.Contains(err.Error(), "line 1: port") || !strings.Contains(err.Error(), "line 2: metrics_path") {
+		t.Errorf("Expected all problems with line numbers, got %v", err)
+	}
+}
+
+func TestCheckConfigMissingFile(t *testing.T) {
+	err := createTestApp(filepath.Join(t.TempDir(), "missing.yaml")).CheckConfig(io.Discard)
+	if err == nil {
+		t.Fatal("Expected error for missing configuration file in check mode")
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	dir := t.TempDir()
+	tmpFile := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(tmpFile, []byte("port: 9090\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	includeDir := filepath.Join(dir, "overrides")
+	if err := os.Mkdir(includeDir, 0755); err != nil {
+		t.Fatalf("Failed to create include directory: %v", err)
+	}
+	include := filepath.Join(includeDir, "host.yaml")
+	if err := os.WriteFile(include, []byte("timeout_seconds: 12\n"), 0644); err != nil {
+		t.Fatalf("Failed to write include file: %v", err)
+	}
+
+	app := createTestApp(tmpFile)
+	app.configDir = includeDir
+	var out bytes.Buffer
+	if err := app.PrintConfig(&out); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	for _, want := range []string{
+		"port: 9090 # " + tmpFile + ":1",
+		"timeout_seconds: 12 # " + include + ":1",
+		"metrics_path: /metrics # default",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected output to contain %q, got:\n%s", want, out.String())
+		}
+	}
+}
+
+// fakeMultipass writes a multipass stand-in script printing output and
+// exiting with code, and returns a config file using it
+func fakeMultipass(t *testing.T, output string, code int) string {
+	t.Helper()
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "multipass")
+	script := fmt.Sprintf("#!/bin/sh\ncat <<'EOF'\n%s\nEOF\nexit %d\n", output, code)
+	if err := os.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to write fake multipass: %v", err)
+	}
+	configFile := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(configFile, []byte("multipass:\n  binary: "+binary+"\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return configFile
+}
+
+func TestRunOnce_OutputFile(t *testing.T) {
+	app := createTestApp(fakeMultipass(t, testInfoJSON, 0))
+	app.outputFile = filepath.Join(t.TempDir(), "multipass.prom")
+
+	if err := app.RunOnce(io.Discard); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	data, err := os.ReadFile(app.outputFile)
+	if err != nil {
+		t.Fatalf("Expected output file, got %v", err)
+	}
+	if !strings.Contains(string(data), `multipass_instance_memory_bytes{name="charm-dev-36"`) {
+		t.Errorf("Expected instance metrics in text format, got:\n%s", data)
+	}
+	if strings.Contains(string(data), "go_goroutines") {
+		t.Error("Expected only multipass metrics in the output file")
+	}
+	entries, _ := os.ReadDir(filepath.Dir(app.outputFile))
+	if len(entries) != 1 {
+		t.Errorf("Expected no temporary files left behind, got %d entries", len(entries))
+	}
+}
+
+func TestRunOnce_Stdout(t *testing.T) {
+	app := createTestApp(fakeMultipass(t, testInfoJSON, 0))
+
+	var out bytes.Buffer
+	if err := app.RunOnce(&out); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !strings.Contains(out.String(), "# TYPE multipass_instances_total gauge") {
+		t.Errorf("Expected text format on stdout, got:\n%s", out.String())
+	}
+}
+
+func TestRunOnce_CollectionFailure(t *testing.T) {
+	app := createTestApp(fakeMultipass(t, "multipassd is not running", 1))
+	app.outputFile = filepath.Join(t.TempDir(), "multipass.prom")
+
+	if err := app.RunOnce(io.Discard); err == nil {
+		t.Fatal("Expected an error when collection fails")
+	}
+	data, err := os.ReadFile(app.outputFile)
+	if err != nil {
+		t.Fatalf("Expected the failure to be written, got %v", err)
+	}
+	if !strings.Contains(string(data), "multipass_error 1") {
+		t.Errorf("Expected the error metric in the output file, got:\n%s", data)
+	}
+}
+
+func TestUnifiedLogging(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "exporter.log")
+	tmpFile := filepath.Join(dir, "config.yaml")
+	content := "log_level: debug\nlog_format: json\nlog_output: file\nlog_file:\n  path: " + logFile + "\n"
+	if err := os.WriteFile(tmpFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	app := createTestApp(tmpFile)
+	if err := app.LoadConfiguration(); err != nil {
+		t.Fatalf("LoadConfiguration failed: %v", err)
+	}
+	if err := app.InitializeCollector(); err != nil {
+		t.Fatalf("InitializeCollector failed: %v", err)
+	}
+	defer app.logCloser.Close()
+
+	// The collector must log through the application logger
+	app.collector.Collect(make(chan prometheus.Metric, 100))
+
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("Failed to read log file: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var sawConfig, sawCollector bool
+	for _, line := range lines {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Expected only JSON log lines, got %q", line)
+		}
+		msg, _ := entry["msg"].(string)
+		sawConfig = sawConfig || strings.HasPrefix(msg, "Config log_format=json")
+		sawCollector = sawCollector || msg == "Starting metrics collection"
+	}
+	if !sawConfig || !sawCollector {
+		t.Errorf("Expected both application and collector logs in the file, got %v", lines)
+	}
+}
+
+func TestInitializeCollector_FileSD(t *testing.T) {
+	configFile := fakeMultipass(t, testInfoJSON, 0)
+	targets := filepath.Join(t.TempDir(), "multipass.json")
+	f, err := os.OpenFile(configFile, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("Failed to open config file: %v", err)
+	}
+	fmt.Fprintf(f, "file_sd:\n  path: %s\n  labels:\n    release: '{{ .Release }}'\n", targets)
+	f.Close()
+
+	app := createTestApp(configFile)
+	if err := app.LoadConfiguration(); err != nil {
+		t.Fatalf("Failed to load configuration: %v", err)
+	}
+	if err := app.InitializeCollector(); err != nil {
+		t.Fatalf("Failed to initialize collector: %v", err)
+	}
+	if _, err := app.Info(); err != nil {
+		t.Fatalf("Expected multipass info to succeed, got %v", err)
+	}
+
+	data, err := os.ReadFile(targets)
+	if err != nil {
+		t.Fatalf("Expected the targets file to be written, got %v", err)
+	}
+	for _, want := range []string{`"10.0.0.2:9100"`, `"release": "Ubuntu 24.04 LTS"`} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("Expected %s in the targets file, got:\n%s", want, data)
+		}
+	}
+	if strings.Contains(string(data), "coslite") {
+		t.Errorf("Expected only running instances, got:\n%s", data)
+	}
+}
+
+func TestInitializeCollector_Notifications(t *testing.T) {
+	bodies := make(chan string, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- string(body)
+	}))
+	defer receiver.Close()
+
+	configFile := fakeMultipass(t, testInfoJSON, 0)
+	f, err := os.OpenFile(configFile, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("Failed to open config file: %v", err)
+	}
+	fmt.Fprintf(f, "notifications:\n  rules:\n    - name: memory_high\n      metric: memory_usage\n      threshold: 0.4\n  webhooks:\n    - url: %s\n      body: '{\"text\": {{ .Summary | json }}}'\n", receiver.URL)
+	f.Close()
+
+	app := createTestApp(configFile)
+	if err := app.LoadConfiguration(); err != nil {
+		t.Fatalf("Failed to load configuration: %v", err)
+	}
+	if err := app.InitializeCollector(); err != nil {
+		t.Fatalf("Failed to initialize collector: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.notifier.Run(ctx)
+
+	if _, err := app.Info(); err != nil {
+		t.Fatalf("Expected multipass info to succeed, got %v", err)
+	}
+	select {
+	case body := <-bodies:
+		if want := `{"text": "Memory of charm-dev-36 is at 50% (threshold 40%)"}`; body != want {
+			t.Errorf("Expected %s, got %s", want, body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the notification")
+	}
+
+	// The alert keeps firing on the next collection without notifying again
+	if _, err := app.Info(); err != nil {
+		t.Fatalf("Expected multipass info to succeed, got %v", err)
+	}
+	select {
+	case body := <-bodies:
+		t.Errorf("Expected a single notification, got %s", body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// newTestReceiver starts a stub receiver that hands every request and its
+// body to handle, and returns its URL
+func newTestReceiver(t *testing.T, handle func(r *http.Request, body []byte)) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		handle(r, body)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestNewPusher_PushesMultipassMetrics(t *testing.T) {
+	var (
+		path string
+		body []byte
+		user string
+		pass string
+	)
+	url := newTestReceiver(t, func(r *http.Request, b []byte) {
+		path = r.URL.Path
+		user, pass, _ = r.BasicAuth()
+		body = b
+	})
+
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatalf("Failed to write password file: %v", err)
+	}
+
+	app := newTestHandlerApp(t)
+	cfg := app.cfg.Push
+	cfg.URL = url
+	cfg.Username = "laptop"
+	cfg.PasswordFile = passwordFile
+	pusher, err := app.newPusher(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if err := pusher.Push(context.Background()); err != nil {
+		t.Fatalf("Expected push to succeed, got %v", err)
+	}
+
+	hostname, _ := os.Hostname()
+	if want := "/metrics/job/multipass_exporter/instance/" + hostname; path != want {
+		t.Errorf("Expected path %s, got %s", want, path)
+	}
+	if user != "laptop" || pass != "secret" {
+		t.Errorf("Expected basic auth laptop:secret, got %s:%s", user, pass)
+	}
+	if !bytes.Contains(body, []byte("multipass_instance_memory_bytes")) {
+		t.Error("Expected multipass metrics in the push")
+	}
+}
+
+func TestNewPusher_Disabled(t *testing.T) {
+	pusher, err := newTestHandlerApp(t).newPusher(config.DefaultConfig().Push)
+	if err != nil || pusher != nil {
+		t.Errorf("Expected no pusher without a URL, got %v, %v", pusher, err)
+	}
+}
+
+func TestNewRemoteWriter_SendsMultipassMetrics(t *testing.T) {
+	var (
+		body   []byte
+		header http.Header
+	)
+	url := newTestReceiver(t, func(r *http.Request, compressed []byte) {
+		header = r.Header
+		body, _ = snappy.Decode(nil, compressed)
+	})
+
+	app := newTestHandlerApp(t)
+	cfg := app.cfg.RemoteWrite
+	cfg.URL = url
+	cfg.Headers = map[string]string{"X-Scope-OrgID": "laptops"}
+	cfg.ExternalLabels = map[string]string{"site": "madrid"}
+	cfg.QueueDir = filepath.Join(t.TempDir(), "queue")
+	sender, err := app.newRemoteWriter(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if err := sender.Send(context.Background()); err != nil {
+		t.Fatalf("Expected send to succeed, got %v", err)
+	}
+
+	if header.Get("X-Scope-OrgID") != "laptops" {
+		t.Errorf("Expected configured headers, got %v", header)
+	}
+	hostname, _ := os.Hostname()
+	for _, want := range []string{"multipass_instance_memory_bytes", "multipass_exporter", hostname, "madrid"} {
+		if !bytes.Contains(body, []byte(want)) {
+			t.Errorf("Expected %q in the write request", want)
+		}
+	}
+}
+
+func TestNewRemoteWriter_Disabled(t *testing.T) {
+	sender, err := newTestHandlerApp(t).newRemoteWriter(config.DefaultConfig().RemoteWrite)
+	if err != nil || sender != nil {
+		t.Errorf("Expected no remote writer without a URL, got %v, %v", sender, err)
+	}
+}
+
+func TestNewOTLPExporter_ExportsSelectedInstances(t *testing.T) {
+	var req colmetricpb.ExportMetricsServiceRequest
+	url := newTestReceiver(t, func(r *http.Request, body []byte) {
+		if err := proto.Unmarshal(body, &req); err != nil {
+			t.Errorf("Failed to decode the export request: %v", err)
+		}
+	})
+
+	app := newTestHandlerApp(t)
+	selector, err := collector.NewInstanceSelector(nil, []string{"coslite"}, nil, nil, false)
+	if err != nil {
+		t.Fatalf("Failed to create instance selector: %v", err)
+	}
+	app.collector.SetInstanceSelector(selector)
+
+	cfg := app.cfg.OTLP
+	cfg.Endpoint = url
+	cfg.Protocol = "http/protobuf"
+	exporter, err := app.newOTLPExporter(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer exporter.Close()
+
+	if err := exporter.Export(context.Background()); err != nil {
+		t.Fatalf("Expected export to succeed, got %v", err)
+	}
+
+	hosts := make(map[string]bool)
+	for _, rm := range req.GetResourceMetrics() {
+		for _, kv := range rm.GetResource().GetAttributes() {
+			if kv.GetKey() == "host.name" {
+				hosts[kv.GetValue().GetStringValue()] = true
+			}
+		}
+	}
+	if !hosts["charm-dev-36"] {
+		t.Errorf("Expected charm-dev-36 to be exported, got %v", hosts)
+	}
+	if hosts["coslite"] {
+		t.Error("Expected coslite to be excluded by the instance filters")
+	}
+}
+
+func TestNewOTLPExporter_Disabled(t *testing.T) {
+	exporter, err := newTestHandlerApp(t).newOTLPExporter(config.DefaultConfig().OTLP)
+	if err != nil || exporter != nil {
+		t.Errorf("Expected no exporter without an endpoint, got %v, %v", exporter, err)
+	}
+}
+
+func TestServiceDiscoveryHandler_FollowsConfig(t *testing.T) {
+	app := newTestHandlerApp(t)
+	handler := app.serviceDiscoveryHandler()
+
+	code, body := scrape(t, handler, "/sd")
+	if code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", code, body)
+	}
+	var groups []sd.TargetGroup
+	if err := json.Unmarshal([]byte(body), &groups); err != nil {
+		t.Fatalf("Failed to decode targets: %v", err)
+	}
+	if len(groups) != 1 || groups[0].Targets[0] != "10.0.0.2:9100" || groups[0].Labels[sd.LabelRelease] != "Ubuntu 24.04 LTS" {
+		t.Fatalf("Expected the running instance on port 9100, got %+v", groups)
+	}
+
+	// A reloaded configuration applies to the next request
+	app.mu.Lock()
+	app.cfg.ServiceDiscovery.Ports = []int{8080}
+	app.mu.Unlock()
+	if _, body := scrape(t, handler, "/sd"); !strings.Contains(body, `"10.0.0.2:8080"`) {
+		t.Errorf("Expected targets on the reloaded port, got %s", body)
+	}
+}
+
+func TestRunDump(t *testing.T) {
+	configFile := fakeMultipass(t, testInfoJSON, 0)
+
+	for format, want := range map[string]*regexp.Regexp{
+		"text":        regexp.MustCompile(`(?m)^multipass_instance_cpu_total\{name="charm-dev-36",release="Ubuntu 24.04 LTS"\} 2$`),
+		"openmetrics": regexp.MustCompile(`multipass_instance_cpu_total\{.*\} 2.0\n(.*\n)*# EOF\n$`),
+		"table":       regexp.MustCompile(`^NAME +STATE +RELEASE +IPV4 +CPUS +MEMORY +DISK\ncharm-dev-36 +Running +Ubuntu 24.04 LTS +10.0.0.2 +2 +1.0GiB/2.0GiB +1.0GiB/10.0GiB\ncoslite +Stopped +Ubuntu 22.04 LTS +- +1 +256.0MiB/1.0GiB +512.0MiB/8.0GiB\n$`),
+	} {
+		var out bytes.Buffer
+		if err := runDump([]string{"--config", configFile, "--format", format}, &out, io.Discard); err != nil {
+			t.Fatalf("Expected no error for %s, got %v", format, err)
+		}
+		if !want.MatchString(out.String()) {
+			t.Errorf("Expected %s in the %s output, got:\n%s", want, format, out.String())
+		}
+	}
+
+	var out bytes.Buffer
+	if err := runDump([]string{"--config", configFile, "--format", "json", "--metrics-schema", "v2", "--collectors", "cpu"}, &out, io.Discard); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	var families []dumpFamily
+	if err := json.Unmarshal(out.Bytes(), &families); err != nil {
+		t.Fatalf("Expected JSON output, got %v:\n%s", err, out.String())
+	}
+	names := make([]string, 0, len(families))
+	for _, family := range families {
+		names = append(names, family.Name)
+	}
+	if strings.Join(names, ",") != "multipass_instance_cpus,multipass_up" {
+		t.Errorf("Expected only the CPU and up metrics, got %v", names)
+	}
+	if len(families[0].Samples) != 2 || families[0].Type != "gauge" {
+		t.Errorf("Expected 2 gauge samples, got %+v", families[0])
+	}
+
+	out.Reset()
+	if err := runDump([]string{"--config", configFile, "--format", "table", "--instance", "^cos"}, &out, io.Discard); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[1], "coslite ") {
+		t.Errorf("Expected only the coslite row, got:\n%s", out.String())
+	}
+
+	if err := runDump([]string{"--config", configFile, "--format", "xml"}, io.Discard, io.Discard); err == nil {
+		t.Error("Expected error for an unknown format")
+	}
+}
+
+func TestRunDump_Debug(t *testing.T) {
+	var out, stderr bytes.Buffer
+	err := runDump([]string{"--config", fakeMultipass(t, testInfoJSON, 0), "--debug", "--instance", "charm"}, &out, &stderr)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, want := range []string{
+		"info --format=json\n### stdout\n{",
+		"instance=coslite: Skipping instance - does not match instance filter",
+	} {
+		if !strings.Contains(stderr.String(), want) {
+			t.Errorf("Expected %q in the debug report, got:\n%s", want, stderr.String())
+		}
+	}
+	if strings.Contains(out.String(), "###") || strings.Contains(out.String(), "coslite") {
+		t.Errorf("Expected only charm-dev-36 metrics on stdout, got:\n%s", out.String())
+	}
+
+	// A failing multipass is reported after printing the error metric
+	out.Reset()
+	stderr.Reset()
+	err = runDump([]string{"--config", fakeMultipass(t, "multipassd is not running", 2), "--debug"}, &out, &stderr)
+	if err == nil || !strings.Contains(out.String(), "multipass_error 1") {
+		t.Errorf("Expected the error metric and an error, got %v:\n%s", err, out.String())
+	}
+	if !strings.Contains(stderr.String(), "### errors") {
+		t.Errorf("Expected the collector errors in the debug report, got:\n%s", stderr.String())
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	recordings := filepath.Join(t.TempDir(), "recordings")
+	var recorded bytes.Buffer
+	if err := runDump([]string{"--config", fakeMultipass(t, testInfoJSON, 0), "--record-dir", recordings}, &recorded, io.Discard); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(recordings, "0001-multipass-info.json")); err != nil {
+		t.Fatalf("Expected a recording, got %v", err)
+	}
+
+	// Replaying needs no multipass at all
+	var replayed bytes.Buffer
+	if err := runDump([]string{"--multipass.binary", "/nonexistent/multipass", "--replay-dir", recordings}, &replayed, io.Discard); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if replayed.String() != recorded.String() {
+		t.Errorf("Expected the replay to reproduce the metrics, got:\n%s\nwant:\n%s", replayed.String(), recorded.String())
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	// A seeded fleet needs no multipass and is the same on every run
+	args := []string{"--multipass.binary", "/nonexistent/multipass", "--simulate", "20", "--simulator.seed", "7"}
+	var first, second bytes.Buffer
+	if err := runDump(args, &first, io.Discard); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := runDump(args, &second, io.Discard); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if first.String() != second.String() {
+		t.Error("Expected the same metrics for the same seed")
+	}
+	if !strings.Contains(first.String(), "multipass_instances_total 20") {
+		t.Errorf("Expected simulated instances, got:\n%s", first.String())
+	}
+
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configFile, []byte("simulate: 3\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	app := createTestApp(configFile)
+	if err := app.LoadConfiguration(); err != nil {
+		t.Fatalf("Failed to load configuration: %v", err)
+	}
+	if err := app.InitializeCollector(); err != nil {
+		t.Fatalf("Failed to initialize collector: %v", err)
+	}
+
+	handler := app.simulatorFaultsHandler()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, simulatorFaultsPath+"?fault=daemon_error&count=2", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"daemon_error":2`) {
+		t.Fatalf("Expected the faults to be injected, got %d %s", rec.Code, rec.Body.String())
+	}
+	if _, err := app.Info(); err == nil || !strings.Contains(err.Error(), "multipass socket") {
+		t.Errorf("Expected the injected daemon error, got %v", err)
+	}
+
+	// A reload keeps the fleet and its pending faults
+	if err := app.Reload(); err != nil {
+		t.Fatalf("Expected the reload to succeed, got %v", err)
+	}
+	if _, err := app.Info(); err == nil {
+		t.Error("Expected the second injected fault to survive the reload")
+	}
+	if data, err := app.Info(); err != nil || len(data.Info) != 3 {
+		t.Errorf("Expected the simulated fleet back, got %d instances, %v", len(data.Info), err)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, simulatorFaultsPath+"?fault=power_cut", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown fault to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestRunMixin(t *testing.T) {
+	var out bytes.Buffer
+	if err := runMixin([]string{"--namespace", "lab", "--metrics-schema", "v2", "--disk-usage-threshold", "0.8", "alerts"}, &out, io.Discard); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, want := range []string{"lab_up{job=\"multipass\"} == 0", "lab:instance_disk_usage:ratio{job=\"multipass\"} > 0.8"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected %s in the alerts, got:\n%s", want, out.String())
+		}
+	}
+
+	dir := t.TempDir()
+	if err := runMixin([]string{"--output-dir", dir}, io.Discard, io.Discard); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, name := range []string{"prometheus_alerts.yaml", "prometheus_rules.yaml", "dashboards_out/multipass.json"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Expected %s to be written, got %v", name, err)
+		}
+	}
+
+	if err := runMixin([]string{"runbooks"}, io.Discard, io.Discard); err == nil {
+		t.Error("Expected error for an unknown artifact")
+	}
+	if err := runMixin([]string{"--disk-usage-threshold", "90", "alerts"}, io.Discard, io.Discard); err == nil {
+		t.Error("Expected error for a disk usage threshold above 1")
+	}
+}
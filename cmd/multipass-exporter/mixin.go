@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/Abuelodelanada/multipass-exporter/internal/collector"
+	"github.com/Abuelodelanada/multipass-exporter/internal/config"
+	"github.com/Abuelodelanada/multipass-exporter/internal/mixin"
+	"gopkg.in/yaml.v3" //nolint:typecheck
+)
+
+// mixinUsage describes the mixin subcommand
+const mixinUsage = `Usage: multipass-exporter mixin [flags] alerts|rules|dashboard
+       multipass-exporter mixin [flags] --output-dir DIR
+
+Generates Prometheus alerting and recording rules and a Grafana dashboard
+for the metric names of the configured namespace and metrics_schema.
+
+Flags:
+`
+
+// generatedHeader starts every generated rule file
+const generatedHeader = "# Generated by multipass-exporter mixin, do not edit.\n"
+
+// mixinFiles are the files --output-dir writes, in the layout of
+// monitoring mixins
+var mixinFiles = map[string]string{
+	"alerts":    "prometheus_alerts.yaml",
+	"rules":     "prometheus_rules.yaml",
+	"dashboard": filepath.Join("dashboards_out", "multipass.json"),
+}
+
+// runMixin runs `multipass-exporter mixin` with the arguments following
+// the subcommand, printing the requested artifact to w
+func runMixin(args []string, w io.Writer, stderr io.Writer) error {
+	fs := flag.NewFlagSet("mixin", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), mixinUsage)
+		fs.PrintDefaults()
+	}
+
+	defaults := mixin.DefaultOptions()
+	opts := defaults
+	path := fs.String("config", "", "Path to configuration file, for namespace and metrics_schema (optional)")
+	dir := fs.String("config-dir", "", "Directory of *.yaml files merged on top of the configuration file (default config.d next to it)")
+	namespace := fs.String("namespace", "", "Override the namespace of the configuration")
+	schema := fs.String("metrics-schema", "", "Override the metrics_schema of the configuration: v1, v2 or both")
+	outputDir := fs.String("output-dir", "", "Write the alerts, the rules and the dashboard to this directory")
+	fs.StringVar(&opts.Job, "job", defaults.Job, "Scrape job of the exporter")
+	fs.Float64Var(&opts.DiskUsageThreshold, "disk-usage-threshold", defaults.DiskUsageThreshold, "Disk usage ratio above which a disk is almost full")
+	fs.Float64Var(&opts.LoadPerCPUThreshold, "load-per-cpu-threshold", defaults.LoadPerCPUThreshold, "1 minute load per CPU above which an instance is overloaded")
+	fs.DurationVar(&opts.ExporterDownFor, "exporter-down-for", defaults.ExporterDownFor, "How long the exporter or multipass info must fail before alerting")
+	fs.DurationVar(&opts.UnknownFor, "unknown-for", defaults.UnknownFor, "How long an instance may stay in an unknown state before alerting")
+	fs.DurationVar(&opts.For, "for", defaults.For, "How long the disk and load alerts must hold before firing")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if opts.DiskUsageThreshold <= 0 || opts.DiskUsageThreshold > 1 {
+		return fmt.Errorf("--disk-usage-threshold must be above 0 and at most 1, got %g", opts.DiskUsageThreshold)
+	}
+	if opts.LoadPerCPUThreshold <= 0 {
+		return fmt.Errorf("--load-per-cpu-threshold must be positive, got %g", opts.LoadPerCPUThreshold)
+	}
+	if opts.Job == "" {
+		return errors.New("--job must not be empty")
+	}
+
+	flags := make(config.FlagValues)
+	if *namespace != "" {
+		flags["namespace"] = *namespace
+	}
+	if *schema != "" {
+		flags["metrics_schema"] = *schema
+	}
+	result, err := config.Load(config.LoadOptions{Path: *path, IncludeDir: *dir, Flags: flags, LookupEnv: os.LookupEnv})
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	c := collector.NewMultipassCollector(result.Config.TimeoutSeconds)
+	if err := c.SetSchema(result.Config.Namespace, collector.Schema(result.Config.MetricsSchema)); err != nil {
+		return err
+	}
+	metrics := mixin.NewMetrics(c.Metrics())
+
+	if *outputDir != "" {
+		if fs.NArg() > 0 {
+			return errors.New("--output-dir writes every artifact, so no artifact may be named")
+		}
+		for artifact, name := range mixinFiles {
+			content, err := renderMixin(artifact, metrics, opts)
+			if err != nil {
+				return err
+			}
+			target := filepath.Join(*outputDir, name)
+			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				return err
+			}
+			if err := os.WriteFile(target, content, 0o644); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected exactly one of alerts, rules or dashboard")
+	}
+	content, err := renderMixin(fs.Arg(0), metrics, opts)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(content)
+	return err
+}
+
+// renderMixin encodes one artifact: rule files as YAML, the dashboard as JSON
+func renderMixin(artifact string, metrics mixin.Metrics, opts mixin.Options) ([]byte, error) {
+	var rules mixin.RuleFile
+	switch artifact {
+	case "alerts":
+		rules = mixin.Alerts(metrics, opts)
+	case "rules":
+		rules = mixin.Rules(metrics, opts)
+	case "dashboard":
+		content, err := json.MarshalIndent(mixin.Dashboard(metrics, opts), "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(content, '\n'), nil
+	default:
+		return nil, fmt.Errorf("unknown artifact %q: must be alerts, rules or dashboard", artifact)
+	}
+
+	buf := bytes.NewBufferString(generatedHeader)
+	encoder := yaml.NewEncoder(buf) //nolint:typecheck
+	encoder.SetIndent(2)
+	if err := encoder.Encode(rules); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
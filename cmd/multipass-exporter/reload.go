@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/Abuelodelanada/multipass-exporter/internal/collector"
+	"github.com/Abuelodelanada/multipass-exporter/internal/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// restartKeys are the settings a reload cannot apply, because they shape
+// the listeners, the routes or long-lived components. Reloads keep their
+// running values and log that a restart is needed.
+var restartKeys = []string{
+	"port",
+	"listen_addresses",
+	"metrics_path",
+	"reload_interval_seconds",
+	"exposition.exporter_metrics_path",
+	"exposition.go_collector",
+	"exposition.process_collector",
+	"events.refresh_interval_seconds",
+	"events.replay_buffer_size",
+	"push.url",
+	"push.job",
+	"push.grouping",
+	"push.interval_seconds",
+	"push.timeout_seconds",
+	"push.username",
+	"push.password_file",
+	"push.max_retries",
+	"push.retry_backoff_seconds",
+	"remote_write.url",
+	"remote_write.interval_seconds",
+	"remote_write.timeout_seconds",
+	"remote_write.headers",
+	"remote_write.username",
+	"remote_write.password_file",
+	"remote_write.external_labels",
+	"remote_write.queue_dir",
+	"remote_write.max_queued_requests",
+	"otlp.endpoint",
+	"otlp.protocol",
+	"otlp.insecure",
+	"otlp.headers",
+	"otlp.resource_attributes",
+	"otlp.interval_seconds",
+	"otlp.timeout_seconds",
+	"service_discovery.path",
+	"file_sd.path",
+	"file_sd.ports",
+	"file_sd.states",
+	"file_sd.all_addresses",
+	"file_sd.labels",
+	"file_sd.refresh_interval_seconds",
+	"notifications.rules",
+	"notifications.webhooks",
+	"notifications.repeat_interval_seconds",
+	"notifications.timeout_seconds",
+	"simulate",
+	"simulator.states",
+	"simulator.releases",
+	"simulator.cpus",
+	"simulator.memory_mb",
+	"simulator.disks",
+	"simulator.seed",
+	"simulator.faults.slow_rate",
+	"simulator.faults.slow_seconds",
+	"simulator.faults.malformed_rate",
+	"simulator.faults.daemon_error_rate",
+}
+
+// Info runs `multipass info` with the current collector, so the API and the
+// event broker follow reloads
+func (a *App) Info() (collector.MultipassInfoResponse, error) {
+	a.mu.RLock()
+	c := a.collector
+	a.mu.RUnlock()
+	return c.Info()
+}
+
+// Reload loads and validates the configuration again and, when it is valid,
+// atomically replaces the collector and handlers built from it. On failure
+// the running configuration stays in effect.
+func (a *App) Reload() error {
+	err := a.reload()
+	a.recordReload(err == nil)
+	return err
+}
+
+func (a *App) reload() error {
+	opts := a.loadOptions()
+	// Falling back to defaults because the file vanished would wipe the
+	// running configuration
+	opts.Required = opts.Required || a.configPath != ""
+
+	digest, _ := configDigest(opts)
+	result, err := config.Load(opts)
+	if err != nil {
+		return fmt.Errorf("failed to load config from %s: %w", a.configPath, err)
+	}
+	cfg := result.Config
+
+	a.mu.RLock()
+	oldCfg, oldSources := a.cfg, a.sources
+	a.mu.RUnlock()
+
+	for _, key := range config.Preserve(cfg, oldCfg, restartKeys) {
+		a.logger.Warnf("%s changed, restart the exporter to apply it", key)
+		result.Sources[key] = oldSources.Get(key)
+	}
+
+	c, err := a.newCollector(cfg)
+	if err != nil {
+		return err
+	}
+	handlerOpts, err := newHandlerOpts(cfg.Exposition)
+	if err != nil {
+		return err
+	}
+	handlerOpts.Registry = a.exporterRegistry
+	handlerOpts.ErrorLog = a.errorLog()
+
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(c); err != nil {
+		return fmt.Errorf("failed to register multipass collector: %w", err)
+	}
+	metrics := a.newMetricsHandler(c, registry, handlerOpts)
+	exporterMetrics := promhttp.HandlerFor(a.exporterRegistry, handlerOpts)
+
+	// Logging is reconfigured last, as it changes the shared logger in place
+	if err := a.configureLogging(cfg); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.cfg = cfg
+	a.sources = result.Sources
+	a.collector = c
+	a.registry = registry
+	a.handlerOpts = handlerOpts
+	a.metrics = metrics
+	a.exporterMetrics = exporterMetrics
+	a.configDigest = digest
+	a.mu.Unlock()
+
+	a.logger.Infof("Reloaded configuration from %s", a.configPath)
+	a.logChanges(oldCfg, oldSources, cfg, result.Sources)
+	return nil
+}
+
+// logChanges logs the settings whose value or source differ between two
+// configurations
+func (a *App) logChanges(oldCfg *config.Config, oldSources config.Sources, cfg *config.Config, sources config.Sources) {
+	old := make(map[string]config.Setting)
+	for _, setting := range config.Effective(oldCfg, oldSources) {
+		old[setting.Key] = setting
+	}
+	for _, setting := range config.Effective(cfg, sources) {
+		previous := old[setting.Key]
+		if !reflect.DeepEqual(previous.Value, setting.Value) || previous.Source != setting.Source {
+			a.logger.WithField("source", setting.Source).Infof("Config %s=%v", setting.Key, setting.Value)
+		}
+	}
+}
+
+// recordReload updates the reload metrics after an attempt
+func (a *App) recordReload(success bool) {
+	if a.reloadSuccess == nil {
+		return
+	}
+	if !success {
+		a.reloadSuccess.Set(0)
+		return
+	}
+	a.reloadSuccess.Set(1)
+	a.reloadTimestamp.SetToCurrentTime()
+}
+
+// watchConfig reloads the configuration when SIGHUP is received and, when
+// interval is positive, whenever the content of the config file or of its
+// include files changes.
+// Content is compared rather than modification times so that files
+// replaced through renames or symlinks, as editors and Kubernetes
+// ConfigMaps do, are picked up too.
+func (a *App) watchConfig(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	// attempted stops an invalid file from being reloaded on every tick
+	var attempted [sha256.Size]byte
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			a.logger.Info("Received SIGHUP, reloading configuration")
+		case <-tick:
+			digest, err := configDigest(a.loadOptions())
+			a.mu.RLock()
+			unchanged := digest == a.configDigest || digest == attempted
+			a.mu.RUnlock()
+			// A missing file is usually an editor halfway through a save
+			if err != nil || unchanged {
+				continue
+			}
+			attempted = digest
+			a.logger.Infof("Configuration file %s changed, reloading", a.configPath)
+		}
+
+		if err := a.Reload(); err != nil {
+			a.logger.WithError(err).Error("Configuration reload failed, keeping the running configuration")
+		}
+	}
+}
+
+// configDigest returns the SHA-256 of the config file content followed by
+// the name and content of every include file, so adding, removing or
+// editing an include changes it
+func configDigest(opts config.LoadOptions) ([sha256.Size]byte, error) {
+	data, err := os.ReadFile(opts.Path)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	hash := sha256.New()
+	hash.Write(data)
+
+	includes, err := config.IncludeFiles(opts)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	for _, include := range includes {
+		data, err := os.ReadFile(include)
+		if err != nil {
+			return [sha256.Size]byte{}, err
+		}
+		fmt.Fprintf(hash, "\x00%s\x00%d\x00", include, len(data))
+		hash.Write(data)
+	}
+
+	var digest [sha256.Size]byte
+	copy(digest[:], hash.Sum(nil))
+	return digest, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newReloadTestApp starts an App from a config file with the given content
+func newReloadTestApp(t *testing.T, content string) (*App, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, content)
+
+	app := createTestApp(path)
+	if err := app.LoadConfiguration(); err != nil {
+		t.Fatalf("LoadConfiguration failed: %v", err)
+	}
+	if err := app.InitializeCollector(); err != nil {
+		t.Fatalf("InitializeCollector failed: %v", err)
+	}
+	return app, path
+}
+
+func writeConfig(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+}
+
+func TestReload_AppliesChanges(t *testing.T) {
+	app, path := newReloadTestApp(t, "port: 9090\nlog_level: info\n")
+	oldCollector := app.collector
+	oldTimestamp := testutil.ToFloat64(app.reloadTimestamp)
+
+	writeConfig(t, path, "port: 9191\nlog_level: debug\nmetrics_schema: v2\n")
+	if err := app.Reload(); err != nil {
+		t.Fatalf("Expected reload to succeed, got %v", err)
+	}
+
+	if app.cfg.LogLevel != "debug" || app.cfg.MetricsSchema != "v2" {
+		t.Errorf("Expected reloaded log level and schema, got %s and %s", app.cfg.LogLevel, app.cfg.MetricsSchema)
+	}
+	if app.collector == oldCollector {
+		t.Error("Expected the collector to be replaced")
+	}
+	// The port needs a restart, so the running value is kept
+	if app.cfg.Port != 9090 {
+		t.Errorf("Expected port to stay 9090 until restart, got %d", app.cfg.Port)
+	}
+
+	if got := testutil.ToFloat64(app.reloadSuccess); got != 1 {
+		t.Errorf("Expected last reload successful, got %v", got)
+	}
+	if got := testutil.ToFloat64(app.reloadTimestamp); got < oldTimestamp {
+		t.Errorf("Expected reload timestamp to advance from %v, got %v", oldTimestamp, got)
+	}
+}
+
+func TestReload_InvalidKeepsRunningConfig(t *testing.T) {
+	app, path := newReloadTestApp(t, "log_level: info\n")
+	oldCollector := app.collector
+	oldTimestamp := testutil.ToFloat64(app.reloadTimestamp)
+
+	writeConfig(t, path, "log_level: loud\n")
+	if err := app.Reload(); err == nil {
+		t.Fatal("Expected reload of an invalid config to fail")
+	}
+
+	if app.cfg.LogLevel != "info" || app.collector != oldCollector {
+		t.Error("Expected the running configuration to be kept")
+	}
+	if got := testutil.ToFloat64(app.reloadSuccess); got != 0 {
+		t.Errorf("Expected last reload unsuccessful, got %v", got)
+	}
+	if got := testutil.ToFloat64(app.reloadTimestamp); got != oldTimestamp {
+		t.Errorf("Expected success timestamp to stay %v, got %v", oldTimestamp, got)
+	}
+
+	// A deleted file must not reset the configuration to defaults
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("Failed to remove config file: %v", err)
+	}
+	if err := app.Reload(); err == nil {
+		t.Error("Expected reload without the config file to fail")
+	}
+}
+
+func TestWatchConfig_ReloadsOnChange(t *testing.T) {
+	app, path := newReloadTestApp(t, "log_level: info\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.watchConfig(ctx, 5*time.Millisecond)
+
+	writeConfig(t, path, "log_level: warn\n")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		app.mu.RLock()
+		level := app.cfg.LogLevel
+		app.mu.RUnlock()
+		if level == "warn" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected config change to be picked up, log level is still %s", level)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWatchConfig_ReloadsOnIncludeChange(t *testing.T) {
+	app, path := newReloadTestApp(t, "log_level: info\n")
+	includeDir := filepath.Join(filepath.Dir(path), "config.d")
+	if err := os.Mkdir(includeDir, 0755); err != nil {
+		t.Fatalf("Failed to create include directory: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.watchConfig(ctx, 5*time.Millisecond)
+
+	writeConfig(t, filepath.Join(includeDir, "host.yaml"), "log_level: warn\n")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		app.mu.RLock()
+		level := app.cfg.LogLevel
+		app.mu.RUnlock()
+		if level == "warn" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected include file to be picked up, log level is still %s", level)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,217 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Abuelodelanada/multipass-exporter/internal/collector"
+)
+
+// InfoSource provides the parsed output of `multipass info`
+type InfoSource interface {
+	Info() (collector.MultipassInfoResponse, error)
+}
+
+// Instance is the normalised view of a Multipass instance served by the API
+type Instance struct {
+	Name         string       `json:"name"`
+	State        string       `json:"state"`
+	IPv4         []string     `json:"ipv4"`
+	Release      string       `json:"release"`
+	ImageHash    string       `json:"image_hash"`
+	ImageRelease string       `json:"image_release"`
+	CPUCount     *int         `json:"cpu_count"`
+	Load         *LoadAverage `json:"load"`
+	Memory       Usage        `json:"memory"`
+	Disks        []Disk       `json:"disks"`
+}
+
+// LoadAverage holds the 1, 5 and 15 minute load averages
+type LoadAverage struct {
+	Load1m  float64 `json:"1m"`
+	Load5m  float64 `json:"5m"`
+	Load15m float64 `json:"15m"`
+}
+
+// Usage holds used and total bytes. Utilisation is used/total and is
+// omitted when the total is unknown.
+type Usage struct {
+	TotalBytes  int64    `json:"total_bytes"`
+	UsedBytes   int64    `json:"used_bytes"`
+	Utilisation *float64 `json:"utilisation,omitempty"`
+}
+
+// Disk is the usage of a single instance disk
+type Disk struct {
+	Name string `json:"name"`
+	Usage
+}
+
+// InstanceList is the response body of the instance collection endpoint
+type InstanceList struct {
+	Instances []Instance `json:"instances"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// NewInstances converts multipass info output to API instances sorted by name
+func NewInstances(data collector.MultipassInfoResponse) []Instance {
+	instances := make([]Instance, 0, len(data.Info))
+	for name, info := range data.Info {
+		instances = append(instances, NewInstance(name, info))
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].Name < instances[j].Name
+	})
+	return instances
+}
+
+// NewInstance normalises a single instance, parsing the string encoded
+// numbers from multipass and deriving utilisation ratios
+func NewInstance(name string, info collector.MultipassInfoOutput) Instance {
+	instance := Instance{
+		Name:         name,
+		State:        info.State,
+		IPv4:         info.IPv4,
+		Release:      info.Release,
+		ImageHash:    info.ImageHash,
+		ImageRelease: info.ImageRelease,
+		Memory:       newUsage(info.Memory.Total, info.Memory.Used),
+		Disks:        []Disk{},
+	}
+	if instance.IPv4 == nil {
+		instance.IPv4 = []string{}
+	}
+
+	if cpuCount, err := strconv.Atoi(info.CPUCount); err == nil {
+		instance.CPUCount = &cpuCount
+	}
+
+	if len(info.Load) == 3 {
+		instance.Load = &LoadAverage{
+			Load1m:  info.Load[0],
+			Load5m:  info.Load[1],
+			Load15m: info.Load[2],
+		}
+	}
+
+	for diskName, disk := range info.Disks {
+		total, _ := strconv.ParseInt(disk.Total, 10, 64)
+		used, _ := strconv.ParseInt(disk.Used, 10, 64)
+		instance.Disks = append(instance.Disks, Disk{Name: diskName, Usage: newUsage(total, used)})
+	}
+	sort.Slice(instance.Disks, func(i, j int) bool {
+		return instance.Disks[i].Name < instance.Disks[j].Name
+	})
+
+	return instance
+}
+
+func newUsage(total, used int64) Usage {
+	usage := Usage{TotalBytes: total, UsedBytes: used}
+	if total > 0 {
+		ratio := float64(used) / float64(total)
+		usage.Utilisation = &ratio
+	}
+	return usage
+}
+
+// NewHandler returns the read-only instance inventory API:
+//
+//	GET /api/v1/instances?state=<state>&release=<release>
+//	GET /api/v1/instances/{name}
+//
+// Responses carry an ETag so clients can poll with If-None-Match.
+func NewHandler(source InfoSource) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /api/v1/instances", func(w http.ResponseWriter, r *http.Request) {
+		data, err := source.Info()
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err)
+			return
+		}
+
+		state := r.URL.Query().Get("state")
+		release := r.URL.Query().Get("release")
+
+		list := InstanceList{Instances: []Instance{}}
+		for _, instance := range NewInstances(data) {
+			if state != "" && !strings.EqualFold(instance.State, state) {
+				continue
+			}
+			if release != "" && !strings.EqualFold(instance.Release, release) {
+				continue
+			}
+			list.Instances = append(list.Instances, instance)
+		}
+
+		writeJSON(w, r, list)
+	})
+
+	mux.HandleFunc("GET /api/v1/instances/{name}", func(w http.ResponseWriter, r *http.Request) {
+		data, err := source.Info()
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err)
+			return
+		}
+
+		name := r.PathValue("name")
+		info, ok := data.Info[name]
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("instance %q not found", name))
+			return
+		}
+
+		writeJSON(w, r, NewInstance(name, info))
+	})
+
+	return mux
+}
+
+// writeJSON encodes v and answers 304 Not Modified when the client already
+// holds the same representation
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(body, '\n'))
+}
+
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: err.Error()})
+}
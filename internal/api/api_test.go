@@ -0,0 +1,219 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Abuelodelanada/multipass-exporter/internal/collector"
+)
+
+// staticSource serves fixed multipass info data
+type staticSource struct {
+	data collector.MultipassInfoResponse
+	err  error
+}
+
+func (s *staticSource) Info() (collector.MultipassInfoResponse, error) {
+	return s.data, s.err
+}
+
+func testData() collector.MultipassInfoResponse {
+	return collector.MultipassInfoResponse{
+		Info: map[string]collector.MultipassInfoOutput{
+			"charm-dev-36": {
+				Name:     "charm-dev-36",
+				State:    "Running",
+				IPv4:     []string{"10.0.0.2"},
+				Release:  "Ubuntu 24.04 LTS",
+				CPUCount: "2",
+				Load:     []float64{0.1, 0.2, 0.3},
+				Memory:   collector.MemoryInfo{Total: 4000, Used: 1000},
+				Disks: map[string]collector.DiskInfo{
+					"sda1": {Total: "10000", Used: "9000"},
+				},
+			},
+			"coslite": {
+				Name:    "coslite",
+				State:   "Stopped",
+				Release: "Ubuntu 22.04 LTS",
+			},
+		},
+	}
+}
+
+func get(t *testing.T, handler http.Handler, target string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestNewInstance_Normalises(t *testing.T) {
+	data := testData()
+	instance := NewInstance("charm-dev-36", data.Info["charm-dev-36"])
+
+	if instance.CPUCount == nil || *instance.CPUCount != 2 {
+		t.Errorf("Expected cpu_count 2, got %v", instance.CPUCount)
+	}
+	if instance.Load == nil || instance.Load.Load15m != 0.3 {
+		t.Errorf("Expected load 15m 0.3, got %v", instance.Load)
+	}
+	if instance.Memory.Utilisation == nil || *instance.Memory.Utilisation != 0.25 {
+		t.Errorf("Expected memory utilisation 0.25, got %v", instance.Memory.Utilisation)
+	}
+	if len(instance.Disks) != 1 {
+		t.Fatalf("Expected 1 disk, got %d", len(instance.Disks))
+	}
+	disk := instance.Disks[0]
+	if disk.TotalBytes != 10000 || disk.UsedBytes != 9000 {
+		t.Errorf("Expected disk 9000/10000 bytes, got %d/%d", disk.UsedBytes, disk.TotalBytes)
+	}
+	if disk.Utilisation == nil || *disk.Utilisation != 0.9 {
+		t.Errorf("Expected disk utilisation 0.9, got %v", disk.Utilisation)
+	}
+}
+
+func TestNewInstance_MissingValues(t *testing.T) {
+	data := testData()
+	instance := NewInstance("coslite", data.Info["coslite"])
+
+	if instance.CPUCount != nil {
+		t.Errorf("Expected no cpu_count, got %d", *instance.CPUCount)
+	}
+	if instance.Load != nil {
+		t.Error("Expected no load for stopped instance")
+	}
+	if instance.Memory.Utilisation != nil {
+		t.Error("Expected no memory utilisation without a total")
+	}
+	if instance.IPv4 == nil || instance.Disks == nil {
+		t.Error("Expected empty slices rather than nil")
+	}
+}
+
+func TestHandler_ListInstances(t *testing.T) {
+	handler := NewHandler(&staticSource{data: testData()})
+
+	rec := get(t, handler, "/api/v1/instances", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	if rec.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Expected JSON content type, got %q", rec.Header().Get("Content-Type"))
+	}
+
+	var list InstanceList
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(list.Instances) != 2 {
+		t.Fatalf("Expected 2 instances, got %d", len(list.Instances))
+	}
+	if list.Instances[0].Name != "charm-dev-36" || list.Instances[1].Name != "coslite" {
+		t.Errorf("Expected instances sorted by name, got %s, %s", list.Instances[0].Name, list.Instances[1].Name)
+	}
+}
+
+func TestHandler_ListInstancesFilters(t *testing.T) {
+	handler := NewHandler(&staticSource{data: testData()})
+
+	tests := []struct {
+		target string
+		want   int
+	}{
+		{"/api/v1/instances?state=running", 1},
+		{"/api/v1/instances?state=Stopped", 1},
+		{"/api/v1/instances?state=Suspended", 0},
+		{"/api/v1/instances?release=Ubuntu%2022.04%20LTS", 1},
+		{"/api/v1/instances?state=Running&release=Ubuntu%2022.04%20LTS", 0},
+	}
+
+	for _, tt := range tests {
+		rec := get(t, handler, tt.target, nil)
+		var list InstanceList
+		if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+			t.Fatalf("%s: failed to decode response: %v", tt.target, err)
+		}
+		if len(list.Instances) != tt.want {
+			t.Errorf("%s: expected %d instances, got %d", tt.target, tt.want, len(list.Instances))
+		}
+	}
+}
+
+func TestHandler_GetInstance(t *testing.T) {
+	handler := NewHandler(&staticSource{data: testData()})
+
+	rec := get(t, handler, "/api/v1/instances/charm-dev-36", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+
+	var instance Instance
+	if err := json.Unmarshal(rec.Body.Bytes(), &instance); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if instance.Name != "charm-dev-36" || instance.State != "Running" {
+		t.Errorf("Unexpected instance %+v", instance)
+	}
+
+	rec = get(t, handler, "/api/v1/instances/missing", nil)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for missing instance, got %d", rec.Code)
+	}
+}
+
+func TestHandler_ETag(t *testing.T) {
+	source := &staticSource{data: testData()}
+	handler := NewHandler(source)
+
+	rec := get(t, handler, "/api/v1/instances", nil)
+	etag := rec.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("Expected an ETag header")
+	}
+
+	rec = get(t, handler, "/api/v1/instances", http.Header{"If-None-Match": {etag}})
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("Expected status 304 for matching ETag, got %d", rec.Code)
+	}
+	if rec.Body.Len() != 0 {
+		t.Error("Expected empty body for 304 response")
+	}
+
+	// Changing the inventory must change the ETag
+	info := source.data.Info["coslite"]
+	info.State = "Running"
+	source.data.Info["coslite"] = info
+
+	rec = get(t, handler, "/api/v1/instances", http.Header{"If-None-Match": {etag}})
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected status 200 after inventory change, got %d", rec.Code)
+	}
+	if rec.Header().Get("ETag") == etag {
+		t.Error("Expected ETag to change with the inventory")
+	}
+}
+
+func TestHandler_SourceError(t *testing.T) {
+	handler := NewHandler(&staticSource{err: fmt.Errorf("multipass info failed")})
+
+	rec := get(t, handler, "/api/v1/instances", nil)
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("Expected status 502, got %d", rec.Code)
+	}
+
+	var body errorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Failed to decode error response: %v", err)
+	}
+	if body.Error != "multipass info failed" {
+		t.Errorf("Expected error message, got %q", body.Error)
+	}
+}
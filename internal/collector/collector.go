@@ -5,10 +5,18 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"os"
 	"os/exec"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/Abuelodelanada/multipass-exporter/internal/labels"
+	"github.com/Abuelodelanada/multipass-exporter/internal/logging"
+	"github.com/Abuelodelanada/multipass-exporter/internal/match"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
@@ -65,11 +73,87 @@ type CommandExecutor interface {
 	CommandContext(ctx context.Context, name string, args ...string) *exec.Cmd
 }
 
+// CommandOptions configures how RealCommandExecutor runs commands.
+// The zero value runs them as given, resolved through PATH.
+type CommandOptions struct {
+	// Binary replaces the command name, e.g. /snap/bin/multipass or a wrapper
+	Binary string
+	// Args are global arguments inserted before the command's own arguments
+	Args []string
+	// Env is added to the exporter's environment, e.g. MULTIPASS_SERVER_ADDRESS
+	Env map[string]string
+	// Dir is the working directory; empty means the exporter's
+	Dir string
+}
+
 // RealCommandExecutor implements CommandExecutor using os/exec
-type RealCommandExecutor struct{}
+type RealCommandExecutor struct {
+	Options CommandOptions
+}
 
 func (r RealCommandExecutor) CommandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
-	return exec.CommandContext(ctx, name, args...)
+	if r.Options.Binary != "" {
+		name = r.Options.Binary
+	}
+	if len(r.Options.Args) > 0 {
+		args = append(append([]string{}, r.Options.Args...), args...)
+	}
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = r.Options.Dir
+	if len(r.Options.Env) > 0 {
+		keys := make([]string, 0, len(r.Options.Env))
+		for key := range r.Options.Env {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		cmd.Env = os.Environ()
+		for _, key := range keys {
+			cmd.Env = append(cmd.Env, key+"="+r.Options.Env[key])
+		}
+	}
+	return cmd
+}
+
+// CommandResult is the outcome of a finished command
+type CommandResult struct {
+	// Args is the command line that ran, after executor options applied
+	Args   []string
+	Stdout []byte
+	Stderr []byte
+	// ExitCode is -1 when the command did not exit normally, e.g. when it
+	// could not be started or was killed
+	ExitCode int
+	Duration time.Duration
+}
+
+// CommandRunner runs commands to completion. The error is non-nil when the
+// command could not run or exited with a non-zero status.
+type CommandRunner interface {
+	Run(ctx context.Context, name string, args ...string) (CommandResult, error)
+}
+
+// ExecRunner runs the commands of a CommandExecutor
+type ExecRunner struct {
+	Executor CommandExecutor
+}
+
+func (r ExecRunner) Run(ctx context.Context, name string, args ...string) (CommandResult, error) {
+	cmd := r.Executor.CommandContext(ctx, name, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	start := time.Now()
+	err := cmd.Run()
+	return CommandResult{
+		Args:     cmd.Args,
+		Stdout:   stdout.Bytes(),
+		Stderr:   stderr.Bytes(),
+		ExitCode: cmd.ProcessState.ExitCode(),
+		Duration: time.Since(start),
+	}, err
 }
 
 // MultipassCollector implements Prometheus collector
@@ -86,9 +170,35 @@ type MultipassCollector struct {
 	instanceLoad15m     *prometheus.Desc
 	instanceDiskUsed    *prometheus.Desc
 	instanceDiskTotal   *prometheus.Desc
-	timeout             time.Duration
-	executor            CommandExecutor
-	logger              *logrus.Logger
+	// v2 schema
+	up                      *prometheus.Desc
+	instances               *prometheus.Desc
+	instanceMemoryUsedBytes *prometheus.Desc
+	instanceCPUs            *prometheus.Desc
+	instanceLoad1           *prometheus.Desc
+	instanceLoad5           *prometheus.Desc
+	instanceLoad15          *prometheus.Desc
+	instanceDiskSizeBytes   *prometheus.Desc
+	// errorDesc is only sent when collection fails, so it is not described
+	errorDesc *prometheus.Desc
+	// metrics describes every enabled metric, in the order it was built
+	metrics []MetricDesc
+
+	namespace       string
+	schema          Schema
+	timeout         time.Duration
+	runner          CommandRunner
+	logger          *logrus.Logger
+	filter          Filter
+	selector        *InstanceSelector
+	infoObservers   []func(MultipassInfoResponse)
+	errorObservers  []func(error)
+	outputObservers []func(args []string, stdout, stderr []byte)
+	// sequence is shared with filtered copies, so their responses are
+	// observed in order too
+	sequence    *infoSequence
+	constLabels prometheus.Labels
+	labeler     *labels.Labeler
 }
 
 type instanceMetric struct {
@@ -97,84 +207,247 @@ type instanceMetric struct {
 	desc  *prometheus.Desc
 }
 
+// Sub-collector names, as accepted by Filter.Collectors
+const (
+	CollectorInstances = "instances"
+	CollectorMemory    = "memory"
+	CollectorCPU       = "cpu"
+	CollectorLoad      = "load"
+	CollectorDisk      = "disk"
+)
+
+// CollectorNames lists every sub-collector in collection order
+var CollectorNames = []string{
+	CollectorInstances,
+	CollectorMemory,
+	CollectorCPU,
+	CollectorLoad,
+	CollectorDisk,
+}
+
+// DefaultNamespace prefixes every metric name unless configured otherwise
+const DefaultNamespace = "multipass"
+
+// Schema selects the metric names the collector emits
+type Schema string
+
+const (
+	// SchemaV1 is the original set of metric names
+	SchemaV1 Schema = "v1"
+	// SchemaV2 follows the Prometheus naming conventions, e.g.
+	// multipass_instance_cpus, multipass_instances{state} and multipass_up
+	SchemaV2 Schema = "v2"
+	// SchemaBoth emits both sets of names while migrating
+	SchemaBoth Schema = "both"
+)
+
+// Schemas lists the accepted schemas
+var Schemas = []Schema{SchemaV1, SchemaV2, SchemaBoth}
+
+// knownStates are always reported by the v2 instances metric, even with no
+// instance in that state
+var knownStates = []string{"Running", "Stopped", "Deleted", "Suspended"}
+
+// Filter restricts a collection to a subset of sub-collectors and instances.
+// The zero value collects everything.
+type Filter struct {
+	// Collectors holds the sub-collectors to run; empty means all
+	Collectors []string
+	// Instance, when set, must match an instance name for it to be reported
+	Instance *regexp.Regexp
+}
+
+// InstanceSelector decides, from configuration, which instances get
+// per-instance metrics. Patterns are globs or /regexes/ as understood by
+// the match package; empty lists select everything.
+type InstanceSelector struct {
+	include  []match.Matcher
+	exclude  []match.Matcher
+	releases []match.Matcher
+	states   []match.Matcher
+	// CountFiltered keeps filtered instances in the aggregate state counts
+	CountFiltered bool
+}
+
+// NewInstanceSelector compiles the include, exclude, release and state patterns
+func NewInstanceSelector(include, exclude, releases, states []string, countFiltered bool) (*InstanceSelector, error) {
+	var s InstanceSelector
+	var err error
+
+	if s.include, err = match.CompileAll(include); err != nil {
+		return nil, fmt.Errorf("include: %w", err)
+	}
+	if s.exclude, err = match.CompileAll(exclude); err != nil {
+		return nil, fmt.Errorf("exclude: %w", err)
+	}
+	if s.releases, err = match.CompileAll(releases); err != nil {
+		return nil, fmt.Errorf("releases: %w", err)
+	}
+	if s.states, err = match.CompileAll(states); err != nil {
+		return nil, fmt.Errorf("states: %w", err)
+	}
+	s.CountFiltered = countFiltered
+	return &s, nil
+}
+
+// Selects reports whether an instance passes every configured filter
+func (s *InstanceSelector) Selects(name string, info MultipassInfoOutput) bool {
+	if len(s.include) > 0 && !match.Any(s.include, name) {
+		return false
+	}
+	if match.Any(s.exclude, name) {
+		return false
+	}
+	if len(s.releases) > 0 && !match.Any(s.releases, info.Release) {
+		return false
+	}
+	if len(s.states) > 0 && !match.Any(s.states, info.State) {
+		return false
+	}
+	return true
+}
+
+// subCollector is one group of metrics produced from multipass info data
+type subCollector struct {
+	name    string
+	errMsg  string
+	collect func(ch chan<- prometheus.Metric, data MultipassInfoResponse) error
+}
+
 func NewMultipassCollector(timeoutSeconds int) *MultipassCollector {
 	return NewMultipassCollectorWithExecutor(timeoutSeconds, RealCommandExecutor{})
 }
 
 func NewMultipassCollectorWithExecutor(timeoutSeconds int, executor CommandExecutor) *MultipassCollector {
-	logger := logrus.New()
-	logger.SetFormatter(&logrus.TextFormatter{
-		FullTimestamp:          true,
-		DisableLevelTruncation: true,
-		PadLevelText:           true,
-	})
-	logger.SetLevel(logrus.InfoLevel)
-
-	return &MultipassCollector{
-		instanceTotal: prometheus.NewDesc(
-			"multipass_instances_total",
-			"Total number of Multipass instances",
-			nil, nil,
-		),
-		instanceRunning: prometheus.NewDesc(
-			"multipass_instances_running",
-			"Total number of Multipass running instances",
-			nil, nil,
-		),
-		instanceStopped: prometheus.NewDesc(
-			"multipass_instances_stopped",
-			"Total number of Multipass stopped instances",
-			nil, nil,
-		),
-		instanceDeleted: prometheus.NewDesc(
-			"multipass_instances_deleted",
-			"Total number of Multipass deleted instances",
-			nil, nil,
-		),
-		instanceSuspended: prometheus.NewDesc(
-			"multipass_instances_suspended",
-			"Total number of Multipass suspended instances",
-			nil, nil,
-		),
-		instanceMemoryBytes: prometheus.NewDesc(
-			"multipass_instance_memory_bytes",
-			"Memory usage of Multipass instances in bytes",
-			[]string{"name", "release"}, nil,
-		),
-		instanceCPUTotal: prometheus.NewDesc(
-			"multipass_instance_cpu_total",
-			"Total number of CPUs  in Multipass instances",
-			[]string{"name", "release"}, nil,
-		),
-		instanceLoad1m: prometheus.NewDesc(
-			"multipass_instance_load_1m",
-			"Average number of processes running on the CPU or in queue waiting for CPU time in the last minute",
-			[]string{"name", "release"}, nil,
-		),
-		instanceLoad5m: prometheus.NewDesc(
-			"multipass_instance_load_5m",
-			"Average number of processes running on the CPU or in queue waiting for CPU time in the last 5 minutes",
-			[]string{"name", "release"}, nil,
-		),
-		instanceLoad15m: prometheus.NewDesc(
-			"multipass_instance_load_15m",
-			"Average number of processes running on the CPU or in queue waiting for CPU time in the last 15 minutes",
-			[]string{"name", "release"}, nil,
-		),
-		instanceDiskUsed: prometheus.NewDesc(
-			"multipass_instance_disk_used_bytes",
-			"Disk usage in bytes in Multipass instances",
-			[]string{"name", "disk", "release"}, nil,
-		),
-		instanceDiskTotal: prometheus.NewDesc(
-			"multipass_instance_disk_total_bytes",
-			"Total disk space in bytes in Multipass instances",
-			[]string{"name", "disk", "release"}, nil,
-		),
-		timeout:  time.Duration(timeoutSeconds) * time.Second,
-		executor: executor,
-		logger:   logger,
+	return NewMultipassCollectorWithRunner(timeoutSeconds, ExecRunner{Executor: executor})
+}
+
+// NewMultipassCollectorWithRunner creates a collector running multipass
+// through runner, e.g. a RecordingRunner or a ReplayRunner
+func NewMultipassCollectorWithRunner(timeoutSeconds int, runner CommandRunner) *MultipassCollector {
+	c := &MultipassCollector{
+		namespace: DefaultNamespace,
+		schema:    SchemaV1,
+		timeout:   time.Duration(timeoutSeconds) * time.Second,
+		runner:    runner,
+		logger:    logging.New(),
+		sequence:  &infoSequence{},
+	}
+	c.buildDescs()
+	return c
+}
+
+// MetricDesc describes a metric the collector emits with its configuration
+type MetricDesc struct {
+	// Name is the metric name without the namespace, e.g. instance_cpus
+	Name string
+	// FQName is the full metric name, e.g. multipass_instance_cpus
+	FQName string
+	Help   string
+	// Labels are the variable labels
+	Labels []string
+}
+
+// buildDescs (re)creates the metric descriptions of the enabled schemas,
+// adding the constant labels to all of them and the labeler's labels to
+// per-instance ones. Descriptions of disabled schemas are left nil.
+func (c *MultipassCollector) buildDescs() {
+	instanceLabels := append([]string{"name", "release"}, c.labeler.Names()...)
+	diskLabels := append([]string{"name", "disk", "release"}, c.labeler.Names()...)
+	v1 := c.schema != SchemaV2
+	v2 := c.schema != SchemaV1
+
+	c.metrics = nil
+	newDesc := func(enabled bool, name, help string, variableLabels []string) *prometheus.Desc {
+		if !enabled {
+			return nil
+		}
+		fqName := prometheus.BuildFQName(c.namespace, "", name)
+		c.metrics = append(c.metrics, MetricDesc{Name: name, FQName: fqName, Help: help, Labels: variableLabels})
+		return prometheus.NewDesc(fqName, help, variableLabels, c.constLabels)
 	}
+
+	c.instanceTotal = newDesc(v1, "instances_total", "Total number of Multipass instances", nil)
+	c.instanceRunning = newDesc(v1, "instances_running", "Total number of Multipass running instances", nil)
+	c.instanceStopped = newDesc(v1, "instances_stopped", "Total number of Multipass stopped instances", nil)
+	c.instanceDeleted = newDesc(v1, "instances_deleted", "Total number of Multipass deleted instances", nil)
+	c.instanceSuspended = newDesc(v1, "instances_suspended", "Total number of Multipass suspended instances", nil)
+	c.instanceMemoryBytes = newDesc(v1, "instance_memory_bytes", "Memory usage of Multipass instances in bytes", instanceLabels)
+	c.instanceCPUTotal = newDesc(v1, "instance_cpu_total", "Total number of CPUs  in Multipass instances", instanceLabels)
+	c.instanceLoad1m = newDesc(v1, "instance_load_1m",
+		"Average number of processes running on the CPU or in queue waiting for CPU time in the last minute", instanceLabels)
+	c.instanceLoad5m = newDesc(v1, "instance_load_5m",
+		"Average number of processes running on the CPU or in queue waiting for CPU time in the last 5 minutes", instanceLabels)
+	c.instanceLoad15m = newDesc(v1, "instance_load_15m",
+		"Average number of processes running on the CPU or in queue waiting for CPU time in the last 15 minutes", instanceLabels)
+	c.instanceDiskTotal = newDesc(v1, "instance_disk_total_bytes", "Total disk space in bytes in Multipass instances", diskLabels)
+
+	// Shared by both schemas, as the v1 name already follows the conventions
+	c.instanceDiskUsed = newDesc(true, "instance_disk_used_bytes", "Disk usage in bytes in Multipass instances", diskLabels)
+
+	c.up = newDesc(v2, "up", "Whether the last `multipass info` succeeded", nil)
+	c.instances = newDesc(v2, "instances", "Number of Multipass instances by state", []string{"state"})
+	c.instanceMemoryUsedBytes = newDesc(v2, "instance_memory_used_bytes", "Memory used by Multipass instances in bytes", instanceLabels)
+	c.instanceCPUs = newDesc(v2, "instance_cpus", "Number of CPUs of Multipass instances", instanceLabels)
+	c.instanceLoad1 = newDesc(v2, "instance_load1", "1 minute load average of Multipass instances", instanceLabels)
+	c.instanceLoad5 = newDesc(v2, "instance_load5", "5 minute load average of Multipass instances", instanceLabels)
+	c.instanceLoad15 = newDesc(v2, "instance_load15", "15 minute load average of Multipass instances", instanceLabels)
+	c.instanceDiskSizeBytes = newDesc(v2, "instance_disk_size_bytes", "Disk size in bytes of Multipass instances", diskLabels)
+
+	c.errorDesc = newDesc(v1, "error", "Error collecting metrics from Multipass", nil)
+}
+
+// Metrics describes the metrics of the enabled schemas, including the v1
+// error metric that is only reported when collection fails. Tooling such as
+// generated alerting rules uses it to follow the configured names.
+func (c *MultipassCollector) Metrics() []MetricDesc {
+	return append([]MetricDesc(nil), c.metrics...)
+}
+
+// descs returns the descriptions of the enabled schemas
+func (c *MultipassCollector) descs() []*prometheus.Desc {
+	var descs []*prometheus.Desc
+	for _, desc := range []*prometheus.Desc{
+		c.instanceTotal,
+		c.instanceRunning,
+		c.instanceStopped,
+		c.instanceDeleted,
+		c.instanceSuspended,
+		c.instanceMemoryBytes,
+		c.instanceCPUTotal,
+		c.instanceLoad1m,
+		c.instanceLoad5m,
+		c.instanceLoad15m,
+		c.instanceDiskUsed,
+		c.instanceDiskTotal,
+		c.up,
+		c.instances,
+		c.instanceMemoryUsedBytes,
+		c.instanceCPUs,
+		c.instanceLoad1,
+		c.instanceLoad5,
+		c.instanceLoad15,
+		c.instanceDiskSizeBytes,
+	} {
+		if desc != nil {
+			descs = append(descs, desc)
+		}
+	}
+	return descs
+}
+
+// sendGauge sends a gauge sample for desc, unless its schema is disabled
+func sendGauge(ch chan<- prometheus.Metric, desc *prometheus.Desc, value float64, labelValues ...string) {
+	if desc == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labelValues...)
+}
+
+// SetLogger replaces the collector's own logger, so the collector logs with
+// the same format, level and output as the rest of the application
+func (c *MultipassCollector) SetLogger(logger *logrus.Logger) {
+	c.logger = logger
 }
 
 // SetLogLevel allows configuring the log level
@@ -189,18 +462,71 @@ func (c *MultipassCollector) SetLogLevel(level string) error {
 
 // Describe sends metrics descriptions
 func (c *MultipassCollector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- c.instanceTotal
-	ch <- c.instanceRunning
-	ch <- c.instanceStopped
-	ch <- c.instanceDeleted
-	ch <- c.instanceSuspended
-	ch <- c.instanceMemoryBytes
-	ch <- c.instanceCPUTotal
-	ch <- c.instanceLoad1m
-	ch <- c.instanceLoad5m
-	ch <- c.instanceLoad15m
-	ch <- c.instanceDiskUsed
-	ch <- c.instanceDiskTotal
+	for _, desc := range c.descs() {
+		ch <- desc
+	}
+}
+
+// SetInstanceSelector restricts per-instance metrics to the instances
+// selected by s; nil selects every instance
+func (c *MultipassCollector) SetInstanceSelector(s *InstanceSelector) {
+	c.selector = s
+}
+
+// SetSchema sets the metric namespace and the schema of metric names. Like
+// SetLabels, it must be called before the collector is registered.
+func (c *MultipassCollector) SetSchema(namespace string, schema Schema) error {
+	valid := false
+	for _, known := range Schemas {
+		valid = valid || schema == known
+	}
+	if !valid {
+		return fmt.Errorf("unknown metrics schema %q", schema)
+	}
+
+	c.namespace = namespace
+	c.schema = schema
+	c.buildDescs()
+	return nil
+}
+
+// SetLabels adds constant labels to every metric and the labels derived by
+// labeler to per-instance metrics. It must be called before the collector
+// is registered, as it changes the metric descriptions.
+func (c *MultipassCollector) SetLabels(constant map[string]string, labeler *labels.Labeler) error {
+	if err := labels.ValidateConstant(constant); err != nil {
+		return err
+	}
+	for _, name := range labeler.Names() {
+		if _, ok := constant[name]; ok {
+			return fmt.Errorf("label %q is both constant and derived from instance names", name)
+		}
+	}
+
+	c.constLabels = constant
+	c.labeler = labeler
+	c.buildDescs()
+	return nil
+}
+
+// instanceLabelValues returns the variable label values of a per-instance
+// metric: the leading values given, followed by the labeler's values
+func (c *MultipassCollector) instanceLabelValues(name string, values ...string) []string {
+	return append([]string{name}, append(values, c.labeler.Values(name)...)...)
+}
+
+// Filtered returns a copy of the collector that only reports the
+// sub-collectors and instances selected by filter
+func (c *MultipassCollector) Filtered(filter Filter) (*MultipassCollector, error) {
+	for _, name := range filter.Collectors {
+		if !isCollectorName(name) {
+			return nil, fmt.Errorf("unknown collector %q", name)
+		}
+	}
+
+	filtered := *c
+	filtered.filter = filter
+	return &filtered, nil
 }
 
 // Collect fetches instance count and sends to Prometheus
@@ -215,6 +541,98 @@ func (c *MultipassCollector) Collect(ch chan<- prometheus.Metric) {
 		return
 	}
 
+	data = c.filterInstances(data)
+	counted := data
+	selected := c.selectInstances(data)
+	if c.selector == nil || !c.selector.CountFiltered {
+		counted = selected
+	}
+
+	for _, sub := range c.subCollectors() {
+		if !c.collectorEnabled(sub.name) {
+			c.logger.WithField("collector", sub.name).Debug("Skipping disabled collector")
+			continue
+		}
+		input := selected
+		if sub.name == CollectorInstances {
+			input = counted
+		}
+		if err := sub.collect(ch, input); err != nil {
+			c.logger.WithError(err).Error(sub.errMsg)
+			c.collectError(ch, err)
+			return
+		}
+	}
+	sendGauge(ch, c.up, 1)
+}
+
+func (c *MultipassCollector) subCollectors() []subCollector {
+	return []subCollector{
+		{CollectorInstances, "Failed to collect instance counts", c.collectInstanceCountsWithData},
+		{CollectorMemory, "Failed to collect instance memory bytes", c.collectInstanceMemoryBytesWithData},
+		{CollectorCPU, "Failed to collect instance CPUs", c.collectInstanceCPUTotalWithData},
+		{CollectorLoad, "Failed to collect instance Load", c.collectInstanceLoadWithData},
+		{CollectorDisk, "Failed to collect instance Disk used", c.collectInstanceDiskUsedWithData},
+		{CollectorDisk, "Failed to collect instance Disk total", c.collectInstanceDiskTotalWithData},
+	}
+}
+
+func (c *MultipassCollector) collectorEnabled(name string) bool {
+	if len(c.filter.Collectors) == 0 {
+		return true
+	}
+	for _, enabled := range c.filter.Collectors {
+		if enabled == name {
+			return true
+		}
+	}
+	return false
+}
+
+// filterInstances drops instances whose name does not match the instance filter
+func (c *MultipassCollector) filterInstances(data MultipassInfoResponse) MultipassInfoResponse {
+	if c.filter.Instance == nil {
+		return data
+	}
+
+	filtered := MultipassInfoResponse{Info: make(map[string]MultipassInfoOutput, len(data.Info))}
+	for name, info := range data.Info {
+		if c.filter.Instance.MatchString(name) {
+			filtered.Info[name] = info
+		} else {
+			c.logger.WithField("instance", name).Debug("Skipping instance - does not match instance filter")
+		}
+	}
+	return filtered
+}
+
+// selectInstances drops instances rejected by the configured instance selector
+func (c *MultipassCollector) selectInstances(data MultipassInfoResponse) MultipassInfoResponse {
+	if c.selector == nil {
+		return data
+	}
+
+	selected := MultipassInfoResponse{Info: make(map[string]MultipassInfoOutput, len(data.Info))}
+	for name, info := range data.Info {
+		if c.selector.Selects(name, info) {
+			selected.Info[name] = info
+		} else {
+			c.logger.WithField("instance", name).Debug("Skipping instance - excluded by instance filters")
+		}
+	}
+	return selected
+}
+
+func isCollectorName(name string) bool {
+	for _, known := range CollectorNames {
+		if known == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *MultipassCollector) collectInstanceCountsWithData(ch chan<- prometheus.Metric, data MultipassInfoResponse) error {
 	instanceMetrics := []instanceMetric{
 		{"total", "", c.instanceTotal},
 		{"running", "Running", c.instanceRunning},
@@ -225,40 +643,45 @@ func (c *MultipassCollector) Collect(ch chan<- prometheus.Metric) {
 
 	for _, metric := range instanceMetrics {
 		if err := c.collectInstanceMetric(ch, data, metric); err != nil {
-			c.logger.WithError(err).Errorf("Failed to collect instance %s", metric.name)
-			c.collectError(ch, err)
-			return
+			return fmt.Errorf("instance %s: %w", metric.name, err)
 		}
 	}
 
-	if err := c.collectInstanceMemoryBytesWithData(ch, data); err != nil {
-		c.logger.WithError(err).Error("Failed to collect instance memory bytes")
-		c.collectError(ch, err)
-		return
+	if c.instances != nil {
+		c.collectInstancesByState(ch, data)
 	}
+	return nil
+}
 
-	if err := c.collectInstanceCPUTotalWithData(ch, data); err != nil {
-		c.logger.WithError(err).Error("Failed to collect instance CPUs")
-		c.collectError(ch, err)
-		return
+// collectInstancesByState reports the v2 instances metric, labelling each
+// state in lower case with spaces replaced, e.g. "delayed_shutdown"
+func (c *MultipassCollector) collectInstancesByState(ch chan<- prometheus.Metric, data MultipassInfoResponse) {
+	// Count by label, so states differing only in case or spacing share a
+	// series instead of colliding
+	counts := make(map[string]int)
+	for _, state := range knownStates {
+		counts[stateLabel(state)] = 0
 	}
-	if err := c.collectInstanceLoadWithData(ch, data); err != nil {
-		c.logger.WithError(err).Error("Failed to collect instance Load")
-		c.collectError(ch, err)
-		return
+	for _, info := range data.Info {
+		counts[stateLabel(info.State)]++
 	}
-	if err := c.collectInstanceDiskUsedWithData(ch, data); err != nil {
-		c.logger.WithError(err).Error("Failed to collect instance Disk used")
-		c.collectError(ch, err)
-		return
+
+	labels := make([]string, 0, len(counts))
+	for label := range counts {
+		labels = append(labels, label)
 	}
-	if err := c.collectInstanceDiskTotalWithData(ch, data); err != nil {
-		c.logger.WithError(err).Error("Failed to collect instance Disk total")
-		c.collectError(ch, err)
-		return
+	sort.Strings(labels)
+
+	for _, label := range labels {
+		sendGauge(ch, c.instances, float64(counts[label]), label)
 	}
 }
 
+// stateLabel is the state label value of state
+func stateLabel(state string) string {
+	return strings.ReplaceAll(strings.ToLower(state), " ", "_")
+}
+
 func (c *MultipassCollector) collectInstanceMetric(ch chan<- prometheus.Metric, data MultipassInfoResponse, metric instanceMetric) error {
 	var count int
 
@@ -275,11 +698,7 @@ func (c *MultipassCollector) collectInstanceMetric(ch chan<- prometheus.Metric,
 		"count":  count,
 	}).Debug("Collecting instance metric")
 
-	ch <- prometheus.MustNewConstMetric(
-		metric.desc,
-		prometheus.GaugeValue,
-		float64(count),
-	)
+	sendGauge(ch, metric.desc, float64(count))
 
 	return nil
 }
@@ -299,12 +718,9 @@ func (c *MultipassCollector) collectInstanceMemoryBytesWithData(ch chan<- promet
 			"memory_bytes": info.Memory.Used,
 			"release":      info.Release,
 		}).Debug("Adding memory metric")
-		ch <- prometheus.MustNewConstMetric(
-			c.instanceMemoryBytes,
-			prometheus.GaugeValue,
-			float64(info.Memory.Used),
-			name, info.Release,
-		)
+		labelValues := c.instanceLabelValues(name, info.Release)
+		sendGauge(ch, c.instanceMemoryBytes, float64(info.Memory.Used), labelValues...)
+		sendGauge(ch, c.instanceMemoryUsedBytes, float64(info.Memory.Used), labelValues...)
 		metricsCollected++
 	}
 
@@ -332,12 +748,9 @@ func (c *MultipassCollector) collectInstanceCPUTotalWithData(ch chan<- prometheu
 			"instance":  name,
 			"cpu_count": cpuCount,
 		}).Debug("Adding CPU metric")
-		ch <- prometheus.MustNewConstMetric(
-			c.instanceCPUTotal,
-			prometheus.GaugeValue,
-			float64(cpuCount),
-			name, info.Release,
-		)
+		labelValues := c.instanceLabelValues(name, info.Release)
+		sendGauge(ch, c.instanceCPUTotal, float64(cpuCount), labelValues...)
+		sendGauge(ch, c.instanceCPUs, float64(cpuCount), labelValues...)
 		metricsCollected++
 	}
 
@@ -345,7 +758,6 @@ func (c *MultipassCollector) collectInstanceCPUTotalWithData(ch chan<- prometheu
 	return nil
 }
 
-
 func (c *MultipassCollector) collectInstanceLoadWithData(ch chan<- prometheus.Metric, data MultipassInfoResponse) error {
 	c.logger.WithField("instance_count", len(data.Info)).Info("Collecting CPU Load metrics")
 	metricsCollected := 0
@@ -372,24 +784,13 @@ func (c *MultipassCollector) collectInstanceLoadWithData(ch chan<- prometheus.Me
 			"load15m":  load15m,
 		}).Debug("Adding Load 15m")
 
-		ch <- prometheus.MustNewConstMetric(
-			c.instanceLoad1m,
-			prometheus.GaugeValue,
-			float64(load1m),
-			name, info.Release,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.instanceLoad5m,
-			prometheus.GaugeValue,
-			float64(load5m),
-			name, info.Release,
-		)
-		ch <- prometheus.MustNewConstMetric(
-			c.instanceLoad15m,
-			prometheus.GaugeValue,
-			float64(load15m),
-			name, info.Release,
-		)
+		labelValues := c.instanceLabelValues(name, info.Release)
+		sendGauge(ch, c.instanceLoad1m, load1m, labelValues...)
+		sendGauge(ch, c.instanceLoad5m, load5m, labelValues...)
+		sendGauge(ch, c.instanceLoad15m, load15m, labelValues...)
+		sendGauge(ch, c.instanceLoad1, load1m, labelValues...)
+		sendGauge(ch, c.instanceLoad5, load5m, labelValues...)
+		sendGauge(ch, c.instanceLoad15, load15m, labelValues...)
 		metricsCollected++
 	}
 
@@ -442,18 +843,13 @@ func (c *MultipassCollector) collectInstanceDiskUsedWithData(ch chan<- prometheu
 			}
 
 			c.logger.WithFields(logrus.Fields{
-				"instance":     name,
-				"disk":         diskName,
-				"disk_used":    diskUsed,
-				"release":      info.Release,
+				"instance":  name,
+				"disk":      diskName,
+				"disk_used": diskUsed,
+				"release":   info.Release,
 			}).Debug("Adding disk metric")
 
-			ch <- prometheus.MustNewConstMetric(
-				c.instanceDiskUsed,
-				prometheus.GaugeValue,
-				float64(diskUsed),
-				name, diskName, info.Release,
-			)
+			sendGauge(ch, c.instanceDiskUsed, float64(diskUsed), c.instanceLabelValues(name, diskName, info.Release)...)
 			metricsCollected++
 		}
 	}
@@ -507,18 +903,15 @@ func (c *MultipassCollector) collectInstanceDiskTotalWithData(ch chan<- promethe
 			}
 
 			c.logger.WithFields(logrus.Fields{
-				"instance":      name,
-				"disk":          diskName,
-				"disk_total":    diskTotal,
-				"release":       info.Release,
+				"instance":   name,
+				"disk":       diskName,
+				"disk_total": diskTotal,
+				"release":    info.Release,
 			}).Debug("Adding disk total metric")
 
-			ch <- prometheus.MustNewConstMetric(
-				c.instanceDiskTotal,
-				prometheus.GaugeValue,
-				float64(diskTotal),
-				name, diskName, info.Release,
-			)
+			labelValues := c.instanceLabelValues(name, diskName, info.Release)
+			sendGauge(ch, c.instanceDiskTotal, float64(diskTotal), labelValues...)
+			sendGauge(ch, c.instanceDiskSizeBytes, float64(diskTotal), labelValues...)
 			metricsCollected++
 		}
 	}
@@ -528,10 +921,53 @@ func (c *MultipassCollector) collectInstanceDiskTotalWithData(ch chan<- promethe
 }
 
 func (c *MultipassCollector) collectError(ch chan<- prometheus.Metric, err error) {
-	ch <- prometheus.MustNewConstMetric(
-		prometheus.NewDesc("multipass_error", "Error collecting metrics from Multipass", nil, nil),
-		prometheus.GaugeValue, 1,
-	)
+	sendGauge(ch, c.errorDesc, 1)
+	sendGauge(ch, c.up, 0)
+	for _, observe := range c.errorObservers {
+		observe(err)
+	}
+}
+
+// AddInfoObserver registers fn to be called with every successfully parsed
+// `multipass info` response, whether triggered by a scrape or by Info.
+// Observers must be added before the collector is in use.
+func (c *MultipassCollector) AddInfoObserver(fn func(MultipassInfoResponse)) {
+	c.infoObservers = append(c.infoObservers, fn)
+}
+
+// AddErrorObserver registers fn to be called with the error of every
+// collection that failed. Observers must be added before the collector is
+// in use.
+func (c *MultipassCollector) AddErrorObserver(fn func(error)) {
+	c.errorObservers = append(c.errorObservers, fn)
+}
+
+// AddOutputObserver registers fn to be called with the command line and
+// the raw output of every `multipass info` run, whether it succeeded or
+// not. Observers must be added before the collector is in use.
+func (c *MultipassCollector) AddOutputObserver(fn func(args []string, stdout, stderr []byte)) {
+	c.outputObservers = append(c.outputObservers, fn)
+}
+
+// Info runs `multipass info` and returns the parsed, unfiltered response
+func (c *MultipassCollector) Info() (MultipassInfoResponse, error) {
+	return c.multipassInfo()
+}
+
+// SelectedInfo runs `multipass info` and returns the parsed response
+// limited to the instances selected by the instance filters
+func (c *MultipassCollector) SelectedInfo() (MultipassInfoResponse, error) {
+	data, err := c.multipassInfo()
+	if err != nil {
+		return data, err
+	}
+	return c.selectInstances(data), nil
+}
+
+// Select limits data, such as a response passed to an info observer, to
+// the instances selected by the instance filters
+func (c *MultipassCollector) Select(data MultipassInfoResponse) MultipassInfoResponse {
+	return c.selectInstances(data)
 }
 
 func (c *MultipassCollector) multipassInfo() (MultipassInfoResponse, error) {
@@ -539,13 +975,13 @@ func (c *MultipassCollector) multipassInfo() (MultipassInfoResponse, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
 	defer cancel()
 
-	cmd := c.executor.CommandContext(ctx, "multipass", "info", "--format=json")
-	var out bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
-
-	if err := cmd.Run(); err != nil {
+	seq := c.sequence.start()
+	result, err := c.runner.Run(ctx, "multipass", "info", "--format=json")
+	out, stderr := bytes.NewBuffer(result.Stdout), bytes.NewBuffer(result.Stderr)
+	for _, observe := range c.outputObservers {
+		observe(result.Args, result.Stdout, result.Stderr)
+	}
+	if err != nil {
 		if ctx.Err() == context.DeadlineExceeded {
 			c.logger.WithField("timeout", c.timeout).Error("multipass info command timed out")
 			return MultipassInfoResponse{}, fmt.Errorf("multipass info timed out after %v", c.timeout)
@@ -562,9 +998,79 @@ func (c *MultipassCollector) multipassInfo() (MultipassInfoResponse, error) {
 	}
 
 	c.logger.WithField("instance_count", len(data.Info)).Info("Successfully parsed multipass info")
+	if !c.sequence.observe(seq, data, c.notifyInfoObservers) {
+		c.logger.Debug("Not observing a multipass info response older than the last one observed")
+	}
 	return data, nil
 }
 
+// notifyInfoObservers passes a `multipass info` response to every observer
+func (c *MultipassCollector) notifyInfoObservers(data MultipassInfoResponse) {
+	for _, observe := range c.infoObservers {
+		observe(data)
+	}
+}
+
+// infoSequence orders concurrent `multipass info` runs, e.g. from a scrape
+// and the API, so observers never see an older response after a newer one
+// and report changes that undo themselves
+type infoSequence struct {
+	mu       sync.Mutex
+	started  uint64
+	observed uint64
+	// delivering is set while a run calls the observers; pending holds the
+	// latest response handed over to it meanwhile
+	delivering bool
+	pending    *pendingInfo
+}
+
+// pendingInfo is a response waiting for its observers
+type pendingInfo struct {
+	data   MultipassInfoResponse
+	notify func(MultipassInfoResponse)
+}
+
+// start numbers a run before its command starts
+func (s *infoSequence) start() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.started++
+	return s.started
+}
+
+// observe passes data of run seq to notify unless a later run was observed
+// already. Observers are called one response at a time and outside the
+// lock: while a run calls them, later responses are handed over to it,
+// replacing each other, and their runs return without waiting.
+func (s *infoSequence) observe(seq uint64, data MultipassInfoResponse, notify func(MultipassInfoResponse)) bool {
+	s.mu.Lock()
+	if seq < s.observed {
+		s.mu.Unlock()
+		return false
+	}
+	s.observed = seq
+	s.pending = &pendingInfo{data: data, notify: notify}
+	if s.delivering {
+		s.mu.Unlock()
+		return true
+	}
+	s.delivering = true
+	s.mu.Unlock()
+
+	for {
+		s.mu.Lock()
+		next := s.pending
+		s.pending = nil
+		if next == nil {
+			s.delivering = false
+			s.mu.Unlock()
+			return true
+		}
+		s.mu.Unlock()
+		next.notify(next.data)
+	}
+}
+
 func (c *MultipassCollector) getInstanceCountByStateWithData(data MultipassInfoResponse, state string) int {
 	instanceCount := 0
 	for _, instance := range data.Info {
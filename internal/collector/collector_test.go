@@ -5,11 +5,17 @@ import (
 	"encoding/json"
 	"fmt"
 	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/Abuelodelanada/multipass-exporter/internal/labels"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	dto "github.com/prometheus/client_model/go"
 )
 
@@ -157,8 +163,8 @@ func TestNewMultipassCollector(t *testing.T) {
 		t.Error("Expected instanceStopped descriptor to be set, got nil")
 	}
 
-	if collector.executor == nil {
-		t.Error("Expected executor to be set, got nil")
+	if collector.runner == nil {
+		t.Error("Expected runner to be set, got nil")
 	}
 }
 
@@ -171,7 +177,7 @@ func TestNewMultipassCollectorWithExecutor(t *testing.T) {
 		t.Fatal("Expected collector to be created, got nil")
 	}
 
-	if collector.executor != mockExecutor {
+	if collector.runner != (ExecRunner{Executor: mockExecutor}) {
 		t.Error("Expected custom executor to be set")
 	}
 }
@@ -435,6 +441,8 @@ func TestCollectInstanceTotalCPU_WithMock(t *testing.T) {
 		}
 	}
 
+	sortByName(t, names, values)
+
 	if metricCount != 2 {
 		t.Errorf("Expected 2 metrics, got %d", metricCount)
 	}
@@ -537,6 +545,8 @@ func TestCollectInstanceLoad_WithMock(t *testing.T) {
 		}
 	}
 
+	sortByName(t, names, values)
+
 	if metricCount != 6 {
 		t.Errorf("Expected 6 metrics, got %d", metricCount)
 	}
@@ -569,6 +579,26 @@ func TestCollectInstanceLoad_WithMock(t *testing.T) {
 	}
 }
 
+// sortByName orders values by the instance name of their metric, keeping the
+// order of each instance's metrics, since instances are collected in map order
+func sortByName(t *testing.T, names []string, values []float64) {
+	t.Helper()
+	if len(names) != len(values) {
+		t.Fatalf("Expected a name for each of the %d values, got %d", len(values), len(names))
+	}
+	order := make([]int, len(values))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return names[order[a]] < names[order[b]] })
+	sortedNames, sortedValues := make([]string, len(names)), make([]float64, len(values))
+	for i, j := range order {
+		sortedNames[i], sortedValues[i] = names[j], values[j]
+	}
+	copy(names, sortedNames)
+	copy(values, sortedValues)
+}
+
 func TestCollectInstanceMemoryBytes_WithError(t *testing.T) {
 	mockExecutor := &MockCommandExecutor{err: fmt.Errorf("command failed")}
 
@@ -899,3 +929,591 @@ func TestCollectInstanceMemoryBytesWithDataEdgeCases(t *testing.T) {
 		// Expected behavior
 	}
 }
+
+func TestFiltered_UnknownCollector(t *testing.T) {
+	collector := NewMultipassCollector(5)
+
+	if _, err := collector.Filtered(Filter{Collectors: []string{"memory", "bogus"}}); err == nil {
+		t.Fatal("Expected error for unknown collector name")
+	}
+}
+
+func TestFiltered_DoesNotModifyOriginal(t *testing.T) {
+	collector := NewMultipassCollector(5)
+
+	filtered, err := collector.Filtered(Filter{Collectors: []string{CollectorMemory}})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if !collector.collectorEnabled(CollectorDisk) {
+		t.Error("Expected original collector to keep all collectors enabled")
+	}
+	if filtered.collectorEnabled(CollectorDisk) {
+		t.Error("Expected disk collector to be disabled in filtered collector")
+	}
+	if !filtered.collectorEnabled(CollectorMemory) {
+		t.Error("Expected memory collector to be enabled in filtered collector")
+	}
+}
+
+func TestCollect_WithFilter(t *testing.T) {
+	mockJSON := `{
+		"info": {
+			"ci-1": {"name": "ci-1", "state": "Running", "release": "22.04 LTS", "memory": {"total": 1073741824, "used": 536870912}, "cpu_count": "2", "load": [0.1, 0.2, 0.3]},
+			"dev": {"name": "dev", "state": "Running", "release": "22.04 LTS", "memory": {"total": 1073741824, "used": 268435456}, "cpu_count": "1", "load": [0.0, 0.0, 0.0]}
+		}
+	}`
+	collector := NewMultipassCollectorWithExecutor(5, &MockCommandExecutor{output: mockJSON})
+
+	filtered, err := collector.Filtered(Filter{
+		Collectors: []string{CollectorMemory},
+		Instance:   regexp.MustCompile("^ci-.*$"),
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	ch := make(chan prometheus.Metric, 20)
+	filtered.Collect(ch)
+	close(ch)
+
+	var metrics []prometheus.Metric
+	for metric := range ch {
+		metrics = append(metrics, metric)
+	}
+
+	if len(metrics) != 1 {
+		t.Fatalf("Expected 1 metric, got %d", len(metrics))
+	}
+
+	pb := &dto.Metric{}
+	if err := metrics[0].Write(pb); err != nil {
+		t.Fatalf("Failed to write metric: %v", err)
+	}
+	if *pb.Gauge.Value != 536870912 {
+		t.Errorf("Expected memory of ci-1 (536870912), got %f", *pb.Gauge.Value)
+	}
+}
+
+func TestInfo_NotifiesObservers(t *testing.T) {
+	mockJSON := `{"info": {"dev": {"name": "dev", "state": "Running"}}}`
+	collector := NewMultipassCollectorWithExecutor(5, &MockCommandExecutor{output: mockJSON})
+
+	var observed []MultipassInfoResponse
+	collector.AddInfoObserver(func(data MultipassInfoResponse) {
+		observed = append(observed, data)
+	})
+
+	data, err := collector.Info()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if data.Info["dev"].State != "Running" {
+		t.Errorf("Expected dev to be Running, got %q", data.Info["dev"].State)
+	}
+	if len(observed) != 1 {
+		t.Fatalf("Expected observer to be called once, got %d", len(observed))
+	}
+	if _, ok := observed[0].Info["dev"]; !ok {
+		t.Error("Expected observer to receive the parsed response")
+	}
+}
+
+func TestErrorObserver(t *testing.T) {
+	collector := NewMultipassCollectorWithExecutor(5, &MockCommandExecutor{err: fmt.Errorf("boom")})
+
+	var observed []error
+	collector.AddErrorObserver(func(err error) {
+		observed = append(observed, err)
+	})
+
+	collectValues(t, collector)
+	if len(observed) != 1 {
+		t.Fatalf("Expected observer to be called once, got %d", len(observed))
+	}
+}
+
+func TestOutputObserver(t *testing.T) {
+	collector := NewMultipassCollectorWithExecutor(5, &MockCommandExecutor{output: "not json"})
+
+	var args []string
+	var stdout string
+	collector.AddOutputObserver(func(a []string, out, _ []byte) {
+		args, stdout = a, string(out)
+	})
+
+	// The raw output is observed even when it cannot be parsed
+	if _, err := collector.Info(); err == nil {
+		t.Fatal("Expected a parse error")
+	}
+	if stdout != "not json\n" {
+		t.Errorf("Expected the raw output, got %q", stdout)
+	}
+	if len(args) != 2 || args[0] != "echo" {
+		t.Errorf("Expected the command line that ran, got %v", args)
+	}
+}
+
+// blockingRunner answers the first run only once release is closed, and
+// every later run right away with another state
+type blockingRunner struct {
+	started chan struct{}
+	release chan struct{}
+	runs    int32
+}
+
+func (r *blockingRunner) Run(ctx context.Context, name string, args ...string) (CommandResult, error) {
+	if atomic.AddInt32(&r.runs, 1) == 1 {
+		close(r.started)
+		<-r.release
+		return CommandResult{Stdout: []byte(`{"info": {"dev": {"name": "dev", "state": "Stopped"}}}`)}, nil
+	}
+	return CommandResult{Stdout: []byte(`{"info": {"dev": {"name": "dev", "state": "Running"}}}`)}, nil
+}
+
+func TestInfo_DropsStaleResponses(t *testing.T) {
+	runner := &blockingRunner{started: make(chan struct{}), release: make(chan struct{})}
+	collector := NewMultipassCollectorWithRunner(5, runner)
+	var observed []string
+	collector.AddInfoObserver(func(data MultipassInfoResponse) {
+		observed = append(observed, data.Info["dev"].State)
+	})
+
+	slow := make(chan MultipassInfoResponse)
+	go func() {
+		data, _ := collector.Info()
+		slow <- data
+	}()
+	<-runner.started
+	if _, err := collector.Info(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	close(runner.release)
+
+	// The slow caller still gets its response, but observers do not
+	if data := <-slow; data.Info["dev"].State != "Stopped" {
+		t.Errorf("Expected the slow response to be returned, got %+v", data)
+	}
+	if len(observed) != 1 || observed[0] != "Running" {
+		t.Errorf("Expected only the newer response to be observed, got %v", observed)
+	}
+}
+
+func TestInfo_SlowObserverDoesNotBlockRuns(t *testing.T) {
+	collector := NewMultipassCollectorWithExecutor(5, &MockCommandExecutor{output: `{"info": {"dev": {"name": "dev", "state": "Running"}}}`})
+	entered := make(chan struct{}, 10)
+	release := make(chan struct{})
+	var observed int32
+	collector.AddInfoObserver(func(data MultipassInfoResponse) {
+		entered <- struct{}{}
+		<-release
+		atomic.AddInt32(&observed, 1)
+	})
+
+	first := make(chan error)
+	go func() {
+		_, err := collector.Info()
+		first <- err
+	}()
+	<-entered
+
+	// The observer is still busy with the first response, so the second is
+	// handed over to it and its run returns right away
+	done := make(chan error)
+	go func() {
+		_, err := collector.Info()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the run not to wait for a busy observer")
+	}
+
+	close(release)
+	if err := <-first; err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got := atomic.LoadInt32(&observed); got != 2 {
+		t.Errorf("Expected both responses to be observed, got %d", got)
+	}
+}
+
+func collectValues(t *testing.T, collector *MultipassCollector) map[string]float64 {
+	t.Helper()
+	ch := make(chan prometheus.Metric, 100)
+	collector.Collect(ch)
+	close(ch)
+
+	values := make(map[string]float64)
+	for metric := range ch {
+		pb := &dto.Metric{}
+		if err := metric.Write(pb); err != nil {
+			t.Fatalf("Failed to write metric: %v", err)
+		}
+		key := metric.Desc().String()
+		for _, label := range pb.GetLabel() {
+			if label.GetName() == "name" {
+				key = label.GetValue() + " " + key
+			}
+		}
+		values[key] = pb.GetGauge().GetValue()
+	}
+	return values
+}
+
+func TestInstanceSelector_Selects(t *testing.T) {
+	selector, err := NewInstanceSelector(
+		[]string{"charm-*", "/^ci-[0-9]+$/", "dev"},
+		[]string{"charm-tmp-*"},
+		[]string{"*24.04*"},
+		[]string{"Running", "Stopped"},
+		false,
+	)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	tests := []struct {
+		name string
+		info MultipassInfoOutput
+		want bool
+	}{
+		{"charm-dev-36", MultipassInfoOutput{State: "Running", Release: "Ubuntu 24.04.3 LTS"}, true},
+		{"charm-tmp-1", MultipassInfoOutput{State: "Running", Release: "Ubuntu 24.04.3 LTS"}, false},
+		{"ci-42", MultipassInfoOutput{State: "Stopped", Release: "Ubuntu 24.04 LTS"}, true},
+		{"ci-abc", MultipassInfoOutput{State: "Running", Release: "Ubuntu 24.04 LTS"}, false},
+		{"dev", MultipassInfoOutput{State: "Running", Release: "Ubuntu 22.04 LTS"}, false},
+		{"dev", MultipassInfoOutput{State: "Suspended", Release: "Ubuntu 24.04 LTS"}, false},
+		{"other", MultipassInfoOutput{State: "Running", Release: "Ubuntu 24.04 LTS"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := selector.Selects(tt.name, tt.info); got != tt.want {
+			t.Errorf("Selects(%s, %s, %s) = %v, expected %v", tt.name, tt.info.State, tt.info.Release, got, tt.want)
+		}
+	}
+}
+
+func TestNewInstanceSelector_InvalidPattern(t *testing.T) {
+	if _, err := NewInstanceSelector(nil, []string{"/(bad/"}, nil, nil, false); err == nil {
+		t.Fatal("Expected error for invalid regex")
+	}
+}
+
+func TestCollect_WithInstanceSelector(t *testing.T) {
+	mockJSON := `{
+		"info": {
+			"ci-1": {"name": "ci-1", "state": "Running", "release": "22.04 LTS", "memory": {"total": 1073741824, "used": 536870912}},
+			"ci-2": {"name": "ci-2", "state": "Stopped", "release": "22.04 LTS", "memory": {"total": 1073741824, "used": 1}},
+			"dev": {"name": "dev", "state": "Running", "release": "22.04 LTS", "memory": {"total": 1073741824, "used": 268435456}}
+		}
+	}`
+
+	for _, countFiltered := range []bool{false, true} {
+		collector := NewMultipassCollectorWithExecutor(5, &MockCommandExecutor{output: mockJSON})
+		selector, err := NewInstanceSelector(nil, []string{"ci-*"}, nil, nil, countFiltered)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		collector.SetInstanceSelector(selector)
+
+		values := collectValues(t, collector)
+
+		for key := range values {
+			if strings.HasPrefix(key, "ci-") {
+				t.Errorf("count_filtered=%v: expected no per-instance metrics for ci instances, got %s", countFiltered, key)
+			}
+		}
+		if _, ok := values["dev "+collector.instanceMemoryBytes.String()]; !ok {
+			t.Errorf("count_filtered=%v: expected memory metric for dev", countFiltered)
+		}
+
+		wantTotal := 1.0
+		if countFiltered {
+			wantTotal = 3
+		}
+		if got := values[collector.instanceTotal.String()]; got != wantTotal {
+			t.Errorf("count_filtered=%v: expected instances total %v, got %v", countFiltered, wantTotal, got)
+		}
+	}
+}
+
+func TestCollect_WithLabels(t *testing.T) {
+	mockJSON := `{
+		"info": {
+			"charm-dev": {"name": "charm-dev", "state": "Running", "release": "24.04 LTS", "memory": {"total": 1073741824, "used": 536870912}, "disks": {"sda1": {"total": "100", "used": "50"}}},
+			"standalone": {"name": "standalone", "state": "Running", "release": "24.04 LTS", "memory": {"total": 1073741824, "used": 268435456}}
+		}
+	}`
+
+	collector := NewMultipassCollectorWithExecutor(5, &MockCommandExecutor{output: mockJSON})
+	labeler, err := labels.New([]string{`(?P<team>[a-z]+)-(?P<purpose>.*)`}, labels.Mapping{
+		"standalone": {"team": "platform"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := collector.SetLabels(map[string]string{"host": "lab-1"}, labeler); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	collector.Collect(ch)
+	close(ch)
+
+	got := make(map[string]map[string]string)
+	for metric := range ch {
+		pb := &dto.Metric{}
+		if err := metric.Write(pb); err != nil {
+			t.Fatalf("Failed to write metric: %v", err)
+		}
+		metricLabels := make(map[string]string)
+		for _, label := range pb.GetLabel() {
+			metricLabels[label.GetName()] = label.GetValue()
+		}
+		if metricLabels["host"] != "lab-1" {
+			t.Errorf("Expected constant host label on %s, got %v", metric.Desc(), metricLabels)
+		}
+		if metric.Desc() == collector.instanceMemoryBytes {
+			got[metricLabels["name"]] = metricLabels
+		}
+		if metric.Desc() == collector.instanceDiskUsed && metricLabels["team"] != "charm" {
+			t.Errorf("Expected team label on disk metric, got %v", metricLabels)
+		}
+	}
+
+	if got["charm-dev"]["team"] != "charm" || got["charm-dev"]["purpose"] != "dev" {
+		t.Errorf("Expected rule labels for charm-dev, got %v", got["charm-dev"])
+	}
+	if got["standalone"]["team"] != "platform" || got["standalone"]["purpose"] != "" {
+		t.Errorf("Expected mapping labels for standalone, got %v", got["standalone"])
+	}
+}
+
+func TestSetLabels_Conflicts(t *testing.T) {
+	collector := NewMultipassCollector(5)
+	labeler, err := labels.New([]string{`(?P<team>.*)`}, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if err := collector.SetLabels(map[string]string{"team": "x"}, labeler); err == nil {
+		t.Error("Expected error for label both constant and derived")
+	}
+	if err := collector.SetLabels(map[string]string{"name": "x"}, nil); err == nil {
+		t.Error("Expected error for reserved constant label")
+	}
+}
+
+// collectNames returns the names of the metrics a collection emits
+func collectNames(t *testing.T, collector *MultipassCollector) map[string]int {
+	t.Helper()
+	ch := make(chan prometheus.Metric, 100)
+	collector.Collect(ch)
+	close(ch)
+
+	names := make(map[string]int)
+	nameRE := regexp.MustCompile(`fqName: "([^"]+)"`)
+	for metric := range ch {
+		names[nameRE.FindStringSubmatch(metric.Desc().String())[1]]++
+	}
+	return names
+}
+
+const schemaTestJSON = `{
+	"info": {
+		"dev": {"name": "dev", "state": "Running", "release": "24.04 LTS", "memory": {"total": 1073741824, "used": 536870912}, "cpu_count": "2", "load": [0.1, 0.2, 0.3], "disks": {"sda1": {"total": "100", "used": "50"}}},
+		"old": {"name": "old", "state": "Delayed Shutdown", "release": "22.04 LTS"}
+	}
+}`
+
+func TestSetSchema_V2(t *testing.T) {
+	collector := NewMultipassCollectorWithExecutor(5, &MockCommandExecutor{output: schemaTestJSON})
+	if err := collector.SetSchema("lab", SchemaV2); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	names := collectNames(t, collector)
+	for _, name := range []string{"lab_up", "lab_instance_cpus", "lab_instance_memory_used_bytes", "lab_instance_load1", "lab_instance_disk_size_bytes", "lab_instance_disk_used_bytes"} {
+		if names[name] == 0 {
+			t.Errorf("Expected %s in v2 output, got %v", name, names)
+		}
+	}
+	for _, name := range []string{"lab_instances_total", "lab_instance_cpu_total", "multipass_up"} {
+		if names[name] != 0 {
+			t.Errorf("Expected no %s in v2 output", name)
+		}
+	}
+
+	// The four known states plus the delayed_shutdown state seen
+	if names["lab_instances"] != 5 {
+		t.Errorf("Expected 5 lab_instances series, got %d", names["lab_instances"])
+	}
+
+	values := collectValues(t, collector)
+	if got := values[collector.up.String()]; got != 1 {
+		t.Errorf("Expected up 1, got %v", got)
+	}
+}
+
+func TestSetSchema_Both(t *testing.T) {
+	collector := NewMultipassCollectorWithExecutor(5, &MockCommandExecutor{output: schemaTestJSON})
+	if err := collector.SetSchema(DefaultNamespace, SchemaBoth); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	names := collectNames(t, collector)
+	for _, name := range []string{"multipass_instance_cpu_total", "multipass_instance_cpus", "multipass_instances_running", "multipass_instances"} {
+		if names[name] == 0 {
+			t.Errorf("Expected %s in both output, got %v", name, names)
+		}
+	}
+	// The disk used name is shared, so it must only be emitted once per disk
+	if names["multipass_instance_disk_used_bytes"] != 1 {
+		t.Errorf("Expected a single disk used series, got %d", names["multipass_instance_disk_used_bytes"])
+	}
+
+	// Both schemas together must still be registrable
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(collector); err != nil {
+		t.Errorf("Expected collector to register, got %v", err)
+	}
+}
+
+func TestSetSchema_Unknown(t *testing.T) {
+	if err := NewMultipassCollector(5).SetSchema(DefaultNamespace, "v3"); err == nil {
+		t.Error("Expected error for unknown schema")
+	}
+}
+
+func TestCollect_V2UpOnError(t *testing.T) {
+	collector := NewMultipassCollectorWithExecutor(5, &MockCommandExecutor{err: fmt.Errorf("boom")})
+	if err := collector.SetSchema(DefaultNamespace, SchemaV2); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	values := collectValues(t, collector)
+	if len(values) != 1 {
+		t.Errorf("Expected only the up metric, got %v", values)
+	}
+	if got, ok := values[collector.up.String()]; !ok || got != 0 {
+		t.Errorf("Expected up 0, got %v", values)
+	}
+}
+
+func TestCollectInstancesByState_NormalizesCase(t *testing.T) {
+	mockJSON := `{"info": {"a": {"name": "a", "state": "Running"}, "b": {"name": "b", "state": "RUNNING"}, "c": {"name": "c", "state": "Delayed Shutdown"}, "d": {"name": "d", "state": "delayed shutdown"}}}`
+	collector := NewMultipassCollectorWithExecutor(5, &MockCommandExecutor{output: mockJSON})
+	if err := collector.SetSchema(DefaultNamespace, SchemaV2); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	expected := `
+# HELP multipass_instances Number of Multipass instances by state
+# TYPE multipass_instances gauge
+multipass_instances{state="delayed_shutdown"} 2
+multipass_instances{state="deleted"} 0
+multipass_instances{state="running"} 2
+multipass_instances{state="stopped"} 0
+multipass_instances{state="suspended"} 0
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "multipass_instances"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSetSchema_V2PassesLint(t *testing.T) {
+	collector := NewMultipassCollectorWithExecutor(5, &MockCommandExecutor{output: schemaTestJSON})
+	if err := collector.SetSchema(DefaultNamespace, SchemaV2); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	problems, err := testutil.CollectAndLint(collector)
+	if err != nil {
+		t.Fatalf("Failed to lint metrics: %v", err)
+	}
+	for _, problem := range problems {
+		t.Errorf("Lint problem in %s: %s", problem.Metric, problem.Text)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	collector := NewMultipassCollectorWithExecutor(5, &MockCommandExecutor{output: schemaTestJSON})
+	if err := collector.SetSchema("lab", SchemaV2); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	metrics := make(map[string]MetricDesc)
+	for _, metric := range collector.Metrics() {
+		metrics[metric.Name] = metric
+	}
+	if up := metrics["up"]; up.FQName != "lab_up" || up.Help == "" {
+		t.Errorf("Expected lab_up, got %+v", up)
+	}
+	if disk := metrics["instance_disk_used_bytes"]; len(disk.Labels) != 3 || disk.Labels[1] != "disk" {
+		t.Errorf("Expected disk labels, got %+v", disk)
+	}
+	if _, ok := metrics["error"]; ok {
+		t.Error("Expected no error metric in the v2 schema")
+	}
+
+	// Every described metric is listed
+	ch := make(chan *prometheus.Desc, 100)
+	collector.Describe(ch)
+	close(ch)
+	if len(ch) != len(metrics) {
+		t.Errorf("Expected %d metrics, got %d", len(ch), len(metrics))
+	}
+
+	if err := collector.SetSchema("lab", SchemaV1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	found := false
+	for _, metric := range collector.Metrics() {
+		found = found || metric.FQName == "lab_error"
+		if metric.Name == "up" {
+			t.Error("Expected no up metric in the v1 schema")
+		}
+	}
+	if !found {
+		t.Error("Expected the error metric in the v1 schema")
+	}
+}
+
+func TestRealCommandExecutor_Options(t *testing.T) {
+	dir := t.TempDir()
+	executor := RealCommandExecutor{Options: CommandOptions{
+		Binary: "sh",
+		Args:   []string{"-c", `echo "$MULTIPASS_SERVER_ADDRESS $(pwd) $1 $2"`, "sh"},
+		Env:    map[string]string{"MULTIPASS_SERVER_ADDRESS": "unix:/tmp/multipass.sock"},
+		Dir:    dir,
+	}}
+
+	out, err := executor.CommandContext(context.Background(), "multipass", "info", "--format=json").Output()
+	if err != nil {
+		t.Fatalf("Expected command to run, got %v", err)
+	}
+
+	want := "unix:/tmp/multipass.sock " + dir + " info --format=json"
+	if got := strings.TrimSpace(string(out)); got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestRealCommandExecutor_ZeroValue(t *testing.T) {
+	cmd := RealCommandExecutor{}.CommandContext(context.Background(), "echo", "hello")
+
+	if cmd.Dir != "" || cmd.Env != nil {
+		t.Errorf("Expected inherited directory and environment, got %q and %v", cmd.Dir, cmd.Env)
+	}
+	if len(cmd.Args) != 2 || cmd.Args[1] != "hello" {
+		t.Errorf("Expected arguments to be passed through, got %v", cmd.Args)
+	}
+}
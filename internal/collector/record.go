@@ -0,0 +1,290 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Abuelodelanada/multipass-exporter/internal/logging"
+	"github.com/sirupsen/logrus"
+)
+
+// Recording is a command run saved by RecordingRunner as one JSON file,
+// named after its sequence number and command, e.g.
+// 0001-multipass-info.json. Stdout and Stderr are saved byte for byte next
+// to it, e.g. in 0001-multipass-info.stdout, since JSON strings would
+// replace invalid UTF-8 such as truncated output; empty ones are left out.
+type Recording struct {
+	// Command and Args are what the collector asked to run, which replay
+	// matches on
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	// CommandLine is what actually ran, e.g. with multipass.binary applied
+	CommandLine []string `json:"command_line"`
+	Stdout      []byte   `json:"-"`
+	Stderr      []byte   `json:"-"`
+	ExitCode    int      `json:"exit_code"`
+	// Error is set when the command did not exit normally, e.g. when it
+	// could not be started
+	Error string `json:"error,omitempty"`
+	// TimedOut is set when the command was killed at the timeout
+	TimedOut        bool      `json:"timed_out,omitempty"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Time            time.Time `json:"time"`
+}
+
+// recordingNameRE matches recording file names and captures the sequence
+var recordingNameRE = regexp.MustCompile(`^(\d+)-.*\.json$`)
+
+// unsafeNameRE matches what is replaced in the command part of file names
+var unsafeNameRE = regexp.MustCompile(`[^a-z0-9]+`)
+
+// RecordingRunner runs commands with another CommandRunner and saves every
+// run to a directory, for ReplayRunner to serve back
+type RecordingRunner struct {
+	runner        CommandRunner
+	dir           string
+	maxRecordings int
+	logger        *logrus.Logger
+
+	mu  sync.Mutex
+	seq int
+	// saved lists the recordings in dir by sequence, without extension
+	saved []string
+}
+
+// NewRecordingRunner records the commands of runner, e.g. an ExecRunner or
+// a Simulator, to dir, creating it if needed. Numbering continues after the
+// recordings already in dir. Once there are more than maxRecordings, the
+// oldest are removed; 0 keeps them all.
+func NewRecordingRunner(runner CommandRunner, dir string, maxRecordings int) (*RecordingRunner, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create record directory: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read record directory: %w", err)
+	}
+
+	r := &RecordingRunner{runner: runner, dir: dir, maxRecordings: maxRecordings, logger: logging.New()}
+	names := recordingNames(entries)
+	for _, name := range names {
+		r.saved = append(r.saved, filepath.Join(dir, strings.TrimSuffix(name, ".json")))
+	}
+	if len(names) > 0 {
+		r.seq = recordingSeq(names[len(names)-1])
+	}
+	return r, nil
+}
+
+// recordingNames returns the names of the recordings among entries, sorted
+// by sequence, which may outgrow its zero padding
+func recordingNames(entries []os.DirEntry) []string {
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() && recordingNameRE.MatchString(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.SliceStable(names, func(i, j int) bool {
+		return recordingSeq(names[i]) < recordingSeq(names[j])
+	})
+	return names
+}
+
+// recordingSeq returns the sequence number of a recording file name
+func recordingSeq(name string) int {
+	seq, _ := strconv.Atoi(recordingNameRE.FindStringSubmatch(name)[1])
+	return seq
+}
+
+// SetLogger replaces the executor's own logger
+func (r *RecordingRunner) SetLogger(logger *logrus.Logger) {
+	r.logger = logger
+}
+
+// Run runs the command and saves it. Failing to save is logged rather than
+// returned, so recording never changes what the collector sees.
+func (r *RecordingRunner) Run(ctx context.Context, name string, args ...string) (CommandResult, error) {
+	result, err := r.runner.Run(ctx, name, args...)
+
+	recording := Recording{
+		Command:         name,
+		Args:            args,
+		CommandLine:     result.Args,
+		Stdout:          result.Stdout,
+		Stderr:          result.Stderr,
+		ExitCode:        result.ExitCode,
+		TimedOut:        ctx.Err() == context.DeadlineExceeded,
+		DurationSeconds: result.Duration.Seconds(),
+		Time:            time.Now().UTC(),
+	}
+	if err != nil && result.ExitCode < 0 {
+		recording.Error = err.Error()
+	}
+	if path, saveErr := r.save(recording); saveErr != nil {
+		r.logger.WithError(saveErr).Error("Failed to save command recording")
+	} else {
+		r.logger.WithField("path", path).Debug("Recorded command")
+	}
+	return result, err
+}
+
+func (r *RecordingRunner) save(recording Recording) (string, error) {
+	data, err := json.MarshalIndent(recording, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	words := append([]string{recording.Command}, recording.Args...)
+	for i, word := range words {
+		if strings.HasPrefix(word, "-") {
+			words = words[:i]
+			break
+		}
+	}
+	slug := strings.Trim(unsafeNameRE.ReplaceAllString(strings.ToLower(strings.Join(words, "-")), "-"), "-")
+	base := filepath.Join(r.dir, fmt.Sprintf("%04d-%s", r.seq, slug))
+	// The output goes first, so a JSON file always has its output in place
+	for ext, output := range map[string][]byte{".stdout": recording.Stdout, ".stderr": recording.Stderr} {
+		if len(output) == 0 {
+			continue
+		}
+		if err := os.WriteFile(base+ext, output, 0o644); err != nil {
+			return "", err
+		}
+	}
+	path := base + ".json"
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return "", err
+	}
+	r.saved = append(r.saved, base)
+	return path, r.prune()
+}
+
+// prune removes the oldest recordings beyond maxRecordings. r.mu must be
+// held.
+func (r *RecordingRunner) prune() error {
+	for r.maxRecordings > 0 && len(r.saved) > r.maxRecordings {
+		// The JSON file goes first, so its output is never missing
+		for _, ext := range []string{".json", ".stdout", ".stderr"} {
+			if err := os.Remove(r.saved[0] + ext); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove old recording: %w", err)
+			}
+		}
+		r.saved = r.saved[1:]
+	}
+	return nil
+}
+
+// ReplayRunner serves the recordings of a directory instead of running
+// commands. Recordings of the same command are served in the order they
+// were made, and the last one is repeated once they are used up.
+type ReplayRunner struct {
+	dir string
+
+	mu         sync.Mutex
+	recordings map[string][]Recording
+	next       map[string]int
+}
+
+// NewReplayRunner loads the recordings of dir
+func NewReplayRunner(dir string) (*ReplayRunner, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read replay directory: %w", err)
+	}
+
+	names := recordingNames(entries)
+	r := &ReplayRunner{dir: dir, recordings: make(map[string][]Recording), next: make(map[string]int)}
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		var recording Recording
+		if err := json.Unmarshal(data, &recording); err != nil {
+			return nil, fmt.Errorf("invalid recording %s: %w", name, err)
+		}
+		base := filepath.Join(dir, strings.TrimSuffix(name, ".json"))
+		if recording.Stdout, err = readOutput(base + ".stdout"); err != nil {
+			return nil, err
+		}
+		if recording.Stderr, err = readOutput(base + ".stderr"); err != nil {
+			return nil, err
+		}
+		key := replayKey(recording.Command, recording.Args)
+		r.recordings[key] = append(r.recordings[key], recording)
+	}
+	if len(r.recordings) == 0 {
+		return nil, fmt.Errorf("no recordings found in %s", dir)
+	}
+	return r, nil
+}
+
+// readOutput reads the output saved next to a recording; a missing file is
+// an empty output
+func readOutput(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func replayKey(name string, args []string) string {
+	return strings.Join(append([]string{name}, args...), "\x00")
+}
+
+// Run serves the next recording of the command. A recording that timed
+// out blocks until ctx is done, so the timeout is reproduced.
+func (r *ReplayRunner) Run(ctx context.Context, name string, args ...string) (CommandResult, error) {
+	key := replayKey(name, args)
+	r.mu.Lock()
+	recordings := r.recordings[key]
+	if len(recordings) == 0 {
+		r.mu.Unlock()
+		return CommandResult{ExitCode: -1}, fmt.Errorf("no recording of %q in %s", strings.Join(append([]string{name}, args...), " "), r.dir)
+	}
+	recording := recordings[r.next[key]]
+	if r.next[key] < len(recordings)-1 {
+		r.next[key]++
+	}
+	r.mu.Unlock()
+
+	commandLine := recording.CommandLine
+	if len(commandLine) == 0 {
+		commandLine = append([]string{name}, args...)
+	}
+	result := CommandResult{
+		Args:     commandLine,
+		Stdout:   recording.Stdout,
+		Stderr:   recording.Stderr,
+		ExitCode: recording.ExitCode,
+		Duration: time.Duration(recording.DurationSeconds * float64(time.Second)),
+	}
+
+	switch {
+	case recording.TimedOut:
+		<-ctx.Done()
+		result.ExitCode = -1
+		return result, ctx.Err()
+	case recording.Error != "":
+		return result, errors.New(recording.Error)
+	case recording.ExitCode != 0:
+		return result, fmt.Errorf("exit status %d", recording.ExitCode)
+	}
+	return result, nil
+}
@@ -0,0 +1,204 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "recordings")
+	mockJSON := `{"info": {"dev": {"name": "dev", "state": "Running"}}}`
+
+	recorder, err := NewRecordingRunner(ExecRunner{Executor: &MockCommandExecutor{output: mockJSON}}, dir, 0)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := NewMultipassCollectorWithRunner(5, recorder).Info(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// A second recorder continues the numbering of the directory
+	failing, err := NewRecordingRunner(ExecRunner{Executor: &MockCommandExecutor{err: os.ErrNotExist}}, dir, 0)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := NewMultipassCollectorWithRunner(5, failing).Info(); err == nil {
+		t.Fatal("Expected the failing command to fail")
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "0001-multipass-info.json"))
+	if err != nil {
+		t.Fatalf("Expected the first recording, got %v", err)
+	}
+	var recording Recording
+	if err := json.Unmarshal(data, &recording); err != nil {
+		t.Fatalf("Failed to decode recording: %v", err)
+	}
+	if recording.Command != "multipass" || strings.Join(recording.Args, " ") != "info --format=json" ||
+		recording.ExitCode != 0 || recording.CommandLine[0] != "echo" {
+		t.Errorf("Unexpected recording %+v", recording)
+	}
+	if stdout, err := os.ReadFile(filepath.Join(dir, "0001-multipass-info.stdout")); err != nil || string(stdout) != mockJSON+"\n" {
+		t.Errorf("Expected the output next to the recording, got %q, %v", stdout, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "0002-multipass-info.json")); err != nil {
+		t.Fatalf("Expected the second recording, got %v", err)
+	}
+
+	replay, err := NewReplayRunner(dir)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	c := NewMultipassCollectorWithRunner(5, replay)
+	if data, err := c.Info(); err != nil || data.Info["dev"].State != "Running" {
+		t.Errorf("Expected the first recording to be replayed, got %+v, %v", data, err)
+	}
+	// The last recording is repeated once the others are used up
+	for i := 0; i < 2; i++ {
+		if _, err := c.Info(); err == nil || !strings.Contains(err.Error(), "exit status 1") {
+			t.Errorf("Expected the recorded failure, got %v", err)
+		}
+	}
+
+	if _, err := replay.Run(context.Background(), "multipass", "list"); err == nil {
+		t.Error("Expected error for a command without recording")
+	}
+}
+
+func TestRecordAndReplay_InvalidUTF8(t *testing.T) {
+	dir := t.TempDir()
+	stdout := []byte("{\"info\": {\"d\xff\xfe")
+	recorder, err := NewRecordingRunner(staticRunner{CommandResult{Stdout: stdout, Stderr: []byte("\xc3\n")}}, dir, 0)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := recorder.Run(context.Background(), "multipass", "info", "--format=json"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	replay, err := NewReplayRunner(dir)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	result, err := replay.Run(context.Background(), "multipass", "info", "--format=json")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !bytes.Equal(result.Stdout, stdout) || string(result.Stderr) != "\xc3\n" {
+		t.Errorf("Expected the output byte for byte, got %q and %q", result.Stdout, result.Stderr)
+	}
+}
+
+func TestRecord_RemovesOldest(t *testing.T) {
+	dir := t.TempDir()
+	runner := staticRunner{CommandResult{Stdout: []byte("{}\n")}}
+	recorder, err := NewRecordingRunner(runner, dir, 3)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		recorder.Run(context.Background(), "multipass", "info", "--format=json")
+	}
+	// A new recorder counts the recordings already there
+	recorder, err = NewRecordingRunner(runner, dir, 3)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	recorder.Run(context.Background(), "multipass", "info", "--format=json")
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to read recordings: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	want := "0003-multipass-info.json 0003-multipass-info.stdout 0004-multipass-info.json 0004-multipass-info.stdout 0005-multipass-info.json 0005-multipass-info.stdout"
+	if got := strings.Join(names, " "); got != want {
+		t.Errorf("Expected the 3 newest recordings, got %s", got)
+	}
+}
+
+// staticRunner returns the same result for every command
+type staticRunner struct {
+	result CommandResult
+}
+
+func (r staticRunner) Run(ctx context.Context, name string, args ...string) (CommandResult, error) {
+	return r.result, nil
+}
+
+func TestReplay_TimedOut(t *testing.T) {
+	dir := t.TempDir()
+	data, _ := json.Marshal(Recording{Command: "multipass", Args: []string{"info", "--format=json"}, ExitCode: -1, TimedOut: true})
+	if err := os.WriteFile(filepath.Join(dir, "0001-multipass-info.json"), data, 0o644); err != nil {
+		t.Fatalf("Failed to write recording: %v", err)
+	}
+	replay, err := NewReplayRunner(dir)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := replay.Run(ctx, "multipass", "info", "--format=json"); err != context.DeadlineExceeded {
+		t.Errorf("Expected the timeout to be reproduced, got %v", err)
+	}
+}
+
+func TestNewReplayRunner_Empty(t *testing.T) {
+	if _, err := NewReplayRunner(t.TempDir()); err == nil {
+		t.Error("Expected error for a directory without recordings")
+	}
+	if _, err := NewReplayRunner(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("Expected error for a missing directory")
+	}
+}
+
+// TestReplay_StartingInstance replays a recording from a host where an
+// instance was still starting: it is counted, but has no usage data yet
+func TestReplay_StartingInstance(t *testing.T) {
+	replay, err := NewReplayRunner(filepath.Join("testdata", "replay"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	c := NewMultipassCollectorWithRunner(5, replay)
+	if err := c.SetSchema(DefaultNamespace, SchemaV2); err != nil {
+		t.Fatalf("Failed to set schema: %v", err)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c)
+	for name, want := range map[string]int{
+		"multipass_up":                         1,
+		"multipass_instance_memory_used_bytes": 1,
+		"multipass_instance_cpus":              1,
+		"multipass_instance_disk_used_bytes":   1,
+	} {
+		if got, err := testutil.GatherAndCount(registry, name); err != nil || got != want {
+			t.Errorf("Expected %d %s series, got %d (%v)", want, name, got, err)
+		}
+	}
+	expected := `
+# HELP multipass_instances Number of Multipass instances by state
+# TYPE multipass_instances gauge
+multipass_instances{state="deleted"} 0
+multipass_instances{state="running"} 1
+multipass_instances{state="starting"} 1
+multipass_instances{state="stopped"} 0
+multipass_instances{state="suspended"} 0
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "multipass_instances"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,366 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Faults a Simulator can inject into its responses
+const (
+	// FaultSlow delays the response by SimulatorOptions.SlowDelay, which
+	// times the command out when it exceeds the collector's timeout
+	FaultSlow = "slow"
+	// FaultMalformed truncates the JSON output
+	FaultMalformed = "malformed"
+	// FaultDaemonError fails the command as if the daemon were unreachable
+	FaultDaemonError = "daemon_error"
+)
+
+// SimulatorFaults lists the faults a Simulator can inject
+var SimulatorFaults = []string{FaultSlow, FaultMalformed, FaultDaemonError}
+
+// Defaults used for the SimulatorOptions that are left empty
+var (
+	DefaultSimulatorStates   = map[string]float64{"Running": 0.8, "Stopped": 0.15, "Suspended": 0.05}
+	DefaultSimulatorReleases = []string{"Ubuntu 24.04 LTS", "Ubuntu 22.04 LTS"}
+	DefaultSimulatorCPUs     = []int{1, 2, 4}
+	DefaultSimulatorMemoryMB = []int{1024, 2048, 4096}
+	DefaultSimulatorDisks    = []map[string]int{{"sda1": 5}, {"sda1": 20}}
+)
+
+// simulatorStepInterval is the wall time of one random walk step
+const simulatorStepInterval = 15 * time.Second
+
+// maxSimulatorSteps bounds the steps taken by a single run, so a run after a
+// long pause does not replay all of it
+const maxSimulatorSteps = 240
+
+// simulatorDiskHighWater is the share of a disk at which it is cleaned up,
+// back to its initial usage, so disks fill up again and again rather than
+// all ending full
+const simulatorDiskHighWater = 0.95
+
+// daemonErrorMessage is what multipass prints when it cannot reach multipassd
+const daemonErrorMessage = "info failed: cannot connect to the multipass socket\n"
+
+// SimulatorOptions configures a Simulator. Each instance gets a state,
+// weighted by States, and a release, CPU count, memory size and disk layout
+// picked at random from the lists. Disk layouts map disk names to sizes in
+// GB. The fault rates are the probability of each fault on every run.
+type SimulatorOptions struct {
+	Instances int
+	States    map[string]float64
+	Releases  []string
+	CPUs      []int
+	MemoryMB  []int
+	Disks     []map[string]int
+	// Seed makes the fleet and its values reproducible; 0 picks one at random
+	Seed int64
+
+	SlowRate        float64
+	SlowDelay       time.Duration
+	MalformedRate   float64
+	DaemonErrorRate float64
+}
+
+// Simulator is a CommandRunner that synthesises `multipass info` output for
+// a fleet of fake instances, for load testing and demos without VMs. The
+// load, memory and disk usage of running instances follow a random walk,
+// one step per simulatorStepInterval of wall time, so they change at the
+// same pace however often the fleet is collected, and disks slowly fill up.
+type Simulator struct {
+	opts SimulatorOptions
+	now  func() time.Time
+
+	mu        sync.Mutex
+	rng       *rand.Rand
+	instances []*simulatedInstance
+	// stepped is the wall time the fleet has been walked up to
+	stepped time.Time
+	// pending counts the faults injected on demand, which are served before
+	// the random ones
+	pending map[string]int
+}
+
+type simulatedInstance struct {
+	name      string
+	state     string
+	release   string
+	ipv4      string
+	cpus      int
+	memory    int64
+	memUsed   int64
+	load      [3]float64
+	diskNames []string
+	diskSize  map[string]int64
+	diskUsed  map[string]int64
+	// diskBase is the initial usage, which a cleanup returns to
+	diskBase map[string]int64
+}
+
+// NewSimulator builds the fleet described by opts, using the
+// DefaultSimulator values for the lists left empty. opts are not checked
+// here: config.Validate reports invalid simulator settings.
+func NewSimulator(opts SimulatorOptions) *Simulator {
+	if len(opts.States) == 0 {
+		opts.States = DefaultSimulatorStates
+	}
+	if len(opts.Releases) == 0 {
+		opts.Releases = DefaultSimulatorReleases
+	}
+	if len(opts.CPUs) == 0 {
+		opts.CPUs = DefaultSimulatorCPUs
+	}
+	if len(opts.MemoryMB) == 0 {
+		opts.MemoryMB = DefaultSimulatorMemoryMB
+	}
+	if len(opts.Disks) == 0 {
+		opts.Disks = DefaultSimulatorDisks
+	}
+	if opts.Seed == 0 {
+		opts.Seed = time.Now().UnixNano()
+	}
+
+	// Sort the states so a seed always gives the same fleet
+	states := make([]string, 0, len(opts.States))
+	var total float64
+	for state, weight := range opts.States {
+		states = append(states, state)
+		total += weight
+	}
+	sort.Strings(states)
+
+	s := &Simulator{opts: opts, now: time.Now, rng: rand.New(rand.NewSource(opts.Seed)), pending: make(map[string]int)}
+	s.stepped = s.now()
+	width := len(strconv.Itoa(opts.Instances))
+	for i := 0; i < opts.Instances; i++ {
+		pick := s.rng.Float64() * total
+		state := states[len(states)-1]
+		for _, candidate := range states {
+			if pick < opts.States[candidate] {
+				state = candidate
+				break
+			}
+			pick -= opts.States[candidate]
+		}
+
+		instance := &simulatedInstance{
+			name:     fmt.Sprintf("sim-%0*d", width, i+1),
+			state:    state,
+			release:  opts.Releases[s.rng.Intn(len(opts.Releases))],
+			ipv4:     fmt.Sprintf("10.%d.%d.%d", 100+i/62500, i/250%250, i%250+2),
+			cpus:     opts.CPUs[s.rng.Intn(len(opts.CPUs))],
+			memory:   int64(opts.MemoryMB[s.rng.Intn(len(opts.MemoryMB))]) << 20,
+			diskSize: make(map[string]int64),
+			diskUsed: make(map[string]int64),
+			diskBase: make(map[string]int64),
+		}
+		instance.memUsed = int64(float64(instance.memory) * (0.2 + 0.4*s.rng.Float64()))
+		load := s.rng.Float64() * float64(instance.cpus)
+		instance.load = [3]float64{load, load, load}
+		for name, size := range opts.Disks[s.rng.Intn(len(opts.Disks))] {
+			instance.diskNames = append(instance.diskNames, name)
+			instance.diskSize[name] = int64(size) << 30
+		}
+		sort.Strings(instance.diskNames)
+		for _, name := range instance.diskNames {
+			instance.diskUsed[name] = int64(float64(instance.diskSize[name]) * (0.1 + 0.5*s.rng.Float64()))
+			instance.diskBase[name] = instance.diskUsed[name]
+		}
+		s.instances = append(s.instances, instance)
+	}
+	return s
+}
+
+// Inject makes the next count runs fail with fault, ahead of the random
+// faults
+func (s *Simulator) Inject(fault string, count int) error {
+	if !slices.Contains(SimulatorFaults, fault) {
+		return fmt.Errorf("unknown fault %q, must be one of %s", fault, strings.Join(SimulatorFaults, ", "))
+	}
+	if count <= 0 {
+		return fmt.Errorf("fault count must be positive, got %d", count)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending[fault] += count
+	return nil
+}
+
+// Pending returns how many runs each fault injected on demand still affects
+func (s *Simulator) Pending() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := make(map[string]int, len(SimulatorFaults))
+	for _, fault := range SimulatorFaults {
+		pending[fault] = s.pending[fault]
+	}
+	return pending
+}
+
+// Run answers `multipass info` with the current state of the fleet, after
+// walking it to the current time. Other commands fail as unsupported.
+func (s *Simulator) Run(ctx context.Context, name string, args ...string) (CommandResult, error) {
+	result := CommandResult{Args: append([]string{name}, args...)}
+	if len(args) == 0 || args[0] != "info" {
+		result.ExitCode = 2
+		result.Stderr = []byte(fmt.Sprintf("%q is not supported by the simulator\n", strings.Join(result.Args, " ")))
+		return result, fmt.Errorf("exit status %d", result.ExitCode)
+	}
+	start := time.Now()
+
+	s.mu.Lock()
+	fault := s.nextFault()
+	s.walk()
+	stdout, err := s.info()
+	s.mu.Unlock()
+	if err != nil {
+		result.ExitCode = -1
+		return result, err
+	}
+
+	switch fault {
+	case FaultSlow:
+		select {
+		case <-time.After(s.opts.SlowDelay):
+		case <-ctx.Done():
+			result.ExitCode = -1
+			result.Duration = time.Since(start)
+			return result, ctx.Err()
+		}
+	case FaultMalformed:
+		stdout = stdout[:len(stdout)/2]
+	case FaultDaemonError:
+		result.ExitCode = 2
+		result.Stderr = []byte(daemonErrorMessage)
+		result.Duration = time.Since(start)
+		return result, fmt.Errorf("exit status %d", result.ExitCode)
+	}
+	result.Stdout = stdout
+	result.Duration = time.Since(start)
+	return result, nil
+}
+
+// nextFault returns the fault of the current run, if any. s.mu must be held.
+func (s *Simulator) nextFault() string {
+	for _, fault := range SimulatorFaults {
+		if s.pending[fault] > 0 {
+			s.pending[fault]--
+			return fault
+		}
+	}
+	pick := s.rng.Float64()
+	for i, rate := range []float64{s.opts.SlowRate, s.opts.MalformedRate, s.opts.DaemonErrorRate} {
+		if pick < rate {
+			return SimulatorFaults[i]
+		}
+		pick -= rate
+	}
+	return ""
+}
+
+// walk takes a step for every simulatorStepInterval elapsed since the last
+// one, up to maxSimulatorSteps. s.mu must be held.
+func (s *Simulator) walk() {
+	now := s.now()
+	steps := int(now.Sub(s.stepped) / simulatorStepInterval)
+	if steps <= 0 {
+		return
+	}
+	if steps > maxSimulatorSteps {
+		s.stepped = now
+		steps = maxSimulatorSteps
+	} else {
+		s.stepped = s.stepped.Add(time.Duration(steps) * simulatorStepInterval)
+	}
+	for i := 0; i < steps; i++ {
+		s.step()
+	}
+}
+
+// step moves the usage of running instances one random walk step. The one
+// minute load wanders around, and the five and fifteen minute loads follow
+// it more slowly. Disks drift upwards until they reach the high-water mark
+// and are cleaned up. s.mu must be held.
+func (s *Simulator) step() {
+	for _, instance := range s.instances {
+		if instance.state != "Running" {
+			continue
+		}
+		cpus := float64(instance.cpus)
+		instance.load[0] = clamp(instance.load[0]+s.rng.NormFloat64()*0.1*cpus, 0, 2*cpus)
+		instance.load[1] += (instance.load[0] - instance.load[1]) / 5
+		instance.load[2] += (instance.load[0] - instance.load[2]) / 15
+
+		memory := float64(instance.memory)
+		instance.memUsed = int64(clamp(float64(instance.memUsed)+s.rng.NormFloat64()*0.02*memory, 0.05*memory, 0.98*memory))
+
+		for _, name := range instance.diskNames {
+			size := float64(instance.diskSize[name])
+			used := float64(instance.diskUsed[name]) + (0.001+s.rng.NormFloat64()*0.003)*size
+			if used >= simulatorDiskHighWater*size {
+				used = float64(instance.diskBase[name])
+			}
+			instance.diskUsed[name] = int64(clamp(used, 0.02*size, size))
+		}
+	}
+}
+
+// info renders the fleet the way `multipass info --format=json` does:
+// instances that are not running have no address, usage or load. s.mu must
+// be held.
+func (s *Simulator) info() ([]byte, error) {
+	response := MultipassInfoResponse{Info: make(map[string]MultipassInfoOutput, len(s.instances))}
+	for _, instance := range s.instances {
+		hash := fnv.New64a()
+		hash.Write([]byte(instance.release))
+		output := MultipassInfoOutput{
+			Name:         instance.name,
+			State:        instance.state,
+			IPv4:         []string{},
+			Release:      instance.release,
+			ImageHash:    fmt.Sprintf("%016x", hash.Sum64()),
+			ImageRelease: strings.TrimPrefix(instance.release, "Ubuntu "),
+			Load:         []float64{},
+			Disks:        make(map[string]DiskInfo, len(instance.diskNames)),
+			Mounts:       map[string]interface{}{},
+		}
+		for _, name := range instance.diskNames {
+			output.Disks[name] = DiskInfo{}
+		}
+		if instance.state == "Running" {
+			output.IPv4 = []string{instance.ipv4}
+			output.CPUCount = strconv.Itoa(instance.cpus)
+			output.Memory = MemoryInfo{Total: instance.memory, Used: instance.memUsed}
+			for i := range instance.load {
+				output.Load = append(output.Load, math.Round(instance.load[i]*100)/100)
+			}
+			for _, name := range instance.diskNames {
+				output.Disks[name] = DiskInfo{
+					Total: strconv.FormatInt(instance.diskSize[name], 10),
+					Used:  strconv.FormatInt(instance.diskUsed[name], 10),
+				}
+			}
+		}
+		response.Info[instance.name] = output
+	}
+	data, err := json.MarshalIndent(response, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func clamp(value, low, high float64) float64 {
+	return math.Max(low, math.Min(high, value))
+}
@@ -0,0 +1,178 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSimulator_Fleet(t *testing.T) {
+	opts := SimulatorOptions{
+		Instances: 200,
+		States:    map[string]float64{"Running": 3, "Stopped": 1},
+		Releases:  []string{"Ubuntu 24.04 LTS"},
+		Disks:     []map[string]int{{"sda1": 10, "sdb1": 100}},
+		Seed:      42,
+	}
+	data, err := NewMultipassCollectorWithRunner(5, NewSimulator(opts)).Info()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(data.Info) != 200 {
+		t.Fatalf("Expected 200 instances, got %d", len(data.Info))
+	}
+
+	states := make(map[string]int)
+	for name, info := range data.Info {
+		states[info.State]++
+		if !strings.HasPrefix(name, "sim-") || info.Release != "Ubuntu 24.04 LTS" || info.ImageRelease != "24.04 LTS" {
+			t.Errorf("Unexpected instance %+v", info)
+		}
+		if len(info.Disks) != 2 {
+			t.Errorf("Expected the disk layout on %s, got %v", name, info.Disks)
+		}
+		if info.State != "Running" {
+			if info.Memory.Total != 0 || len(info.Load) != 0 || len(info.IPv4) != 0 || info.Disks["sda1"].Used != "" {
+				t.Errorf("Expected no usage for %s instance %s, got %+v", info.State, name, info)
+			}
+			continue
+		}
+		if info.Memory.Used <= 0 || info.Memory.Used > info.Memory.Total || len(info.Load) != 3 || info.CPUCount == "" {
+			t.Errorf("Unexpected usage of %s: %+v", name, info)
+		}
+		total, _ := strconv.ParseInt(info.Disks["sdb1"].Total, 10, 64)
+		used, _ := strconv.ParseInt(info.Disks["sdb1"].Used, 10, 64)
+		if total != 100<<30 || used <= 0 || used > total {
+			t.Errorf("Unexpected disk usage of %s: %d of %d", name, used, total)
+		}
+	}
+	if len(states) != 2 || states["Running"] < 120 || states["Stopped"] < 20 {
+		t.Errorf("Expected roughly 3 running instances for 1 stopped, got %v", states)
+	}
+
+	// The same seed gives the same fleet
+	a, _ := NewSimulator(opts).Run(context.Background(), "multipass", "info", "--format=json")
+	b, _ := NewSimulator(opts).Run(context.Background(), "multipass", "info", "--format=json")
+	if len(a.Stdout) == 0 || !bytes.Equal(a.Stdout, b.Stdout) {
+		t.Error("Expected the same output for the same seed")
+	}
+}
+
+func TestSimulator_RandomWalk(t *testing.T) {
+	simulator := NewSimulator(SimulatorOptions{Instances: 1, States: map[string]float64{"Running": 1}, Seed: 1})
+	now := time.Now()
+	simulator.now = func() time.Time { return now }
+	c := NewMultipassCollectorWithRunner(5, simulator)
+
+	first, err := c.Info()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	// Runs closer together than a step see the same values
+	now = now.Add(simulatorStepInterval / 2)
+	if again, err := c.Info(); err != nil || again.Info["sim-1"].Memory.Used != first.Info["sim-1"].Memory.Used {
+		t.Errorf("Expected no step within the step interval, got %+v, %v", again.Info["sim-1"], err)
+	}
+
+	changed := false
+	for i := 0; i < 100; i++ {
+		now = now.Add(simulatorStepInterval)
+		data, err := c.Info()
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		info := data.Info["sim-1"]
+		if info.Memory.Used != first.Info["sim-1"].Memory.Used || info.Load[0] != first.Info["sim-1"].Load[0] {
+			changed = true
+		}
+		if info.Memory.Used > info.Memory.Total || info.Load[0] < 0 {
+			t.Fatalf("Expected the walk to stay in bounds, got %+v", info)
+		}
+	}
+	if !changed {
+		t.Error("Expected the usage to change between runs")
+	}
+}
+
+func TestSimulator_DisksDoNotAllFillUp(t *testing.T) {
+	simulator := NewSimulator(SimulatorOptions{Instances: 50, States: map[string]float64{"Running": 1}, Seed: 1})
+	now := time.Now()
+	simulator.now = func() time.Time { return now }
+
+	// Two days of steps, an hour at a time
+	for hour := 0; hour < 48; hour++ {
+		now = now.Add(time.Hour)
+		simulator.walk()
+	}
+
+	var disks, nearlyFull int
+	for _, instance := range simulator.instances {
+		for _, name := range instance.diskNames {
+			disks++
+			size, used := instance.diskSize[name], instance.diskUsed[name]
+			if used >= size {
+				t.Errorf("Expected %s of %s not to be full, got %d of %d", name, instance.name, used, size)
+			}
+			if float64(used) >= 0.9*float64(size) {
+				nearlyFull++
+			}
+		}
+	}
+	if nearlyFull*2 > disks {
+		t.Errorf("Expected most disks below 90%%, got %d of %d above", nearlyFull, disks)
+	}
+}
+
+func TestSimulator_Faults(t *testing.T) {
+	simulator := NewSimulator(SimulatorOptions{Instances: 3, Seed: 1, SlowDelay: time.Hour})
+	c := NewMultipassCollectorWithRunner(5, simulator)
+
+	if err := simulator.Inject(FaultMalformed, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := simulator.Inject(FaultDaemonError, 2); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got := simulator.Pending(); got[FaultMalformed] != 1 || got[FaultDaemonError] != 2 || got[FaultSlow] != 0 {
+		t.Errorf("Unexpected pending faults %v", got)
+	}
+	if _, err := c.Info(); err == nil || !strings.Contains(err.Error(), "error parsing JSON") {
+		t.Errorf("Expected malformed JSON, got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := c.Info(); err == nil || !strings.Contains(err.Error(), "cannot connect to the multipass socket") {
+			t.Errorf("Expected a daemon error, got %v", err)
+		}
+	}
+	if _, err := c.Info(); err != nil {
+		t.Errorf("Expected the faults to be used up, got %v", err)
+	}
+
+	if err := simulator.Inject(FaultSlow, 1); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := simulator.Run(ctx, "multipass", "info", "--format=json"); err != context.DeadlineExceeded {
+		t.Errorf("Expected the slow response to time out, got %v", err)
+	}
+
+	if err := simulator.Inject("power_cut", 1); err == nil {
+		t.Error("Expected error for an unknown fault")
+	}
+	if _, err := simulator.Run(context.Background(), "multipass", "list"); err == nil {
+		t.Error("Expected error for an unsupported command")
+	}
+}
+
+func TestSimulator_FaultRates(t *testing.T) {
+	simulator := NewSimulator(SimulatorOptions{Instances: 1, Seed: 1, DaemonErrorRate: 1})
+	for i := 0; i < 3; i++ {
+		if _, err := simulator.Run(context.Background(), "multipass", "info", "--format=json"); err == nil {
+			t.Error("Expected every run to fail")
+		}
+	}
+}
@@ -1,44 +1,489 @@
 package config
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
 
 	"gopkg.in/yaml.v3" //nolint:typecheck
 )
 
 // Config holds exporter settings
 type Config struct {
-	Port           int    `yaml:"port"`
-	MetricsPath    string `yaml:"metrics_path"`
-	TimeoutSeconds int    `yaml:"timeout_seconds"`
-	LogLevel       string `yaml:"log_level"`
+	Port                  int                    `yaml:"port"`
+	ListenAddresses       []string               `yaml:"listen_addresses"`
+	MetricsPath           string                 `yaml:"metrics_path"`
+	TimeoutSeconds        int                    `yaml:"timeout_seconds"`
+	ReloadIntervalSeconds int                    `yaml:"reload_interval_seconds"`
+	LogLevel              string                 `yaml:"log_level"`
+	LogFormat             string                 `yaml:"log_format"`
+	LogOutput             string                 `yaml:"log_output"`
+	LogFile               LogFileConfig          `yaml:"log_file"`
+	Multipass             MultipassConfig        `yaml:"multipass"`
+	RecordDir             string                 `yaml:"record_dir"`
+	RecordMaxRecordings   int                    `yaml:"record_max_recordings"`
+	ReplayDir             string                 `yaml:"replay_dir"`
+	Simulate              int                    `yaml:"simulate"`
+	Simulator             SimulatorConfig        `yaml:"simulator"`
+	Namespace             string                 `yaml:"namespace"`
+	MetricsSchema         string                 `yaml:"metrics_schema"`
+	Exposition            ExpositionConfig       `yaml:"exposition"`
+	Events                EventsConfig           `yaml:"events"`
+	Instances             InstancesConfig        `yaml:"instances"`
+	Labels                LabelsConfig           `yaml:"labels"`
+	Push                  PushConfig             `yaml:"push"`
+	RemoteWrite           RemoteWriteConfig      `yaml:"remote_write"`
+	OTLP                  OTLPConfig             `yaml:"otlp"`
+	ServiceDiscovery      ServiceDiscoveryConfig `yaml:"service_discovery"`
+	FileSD                FileSDConfig           `yaml:"file_sd"`
+	Notifications         NotificationsConfig    `yaml:"notifications"`
+}
+
+// LogFileConfig is the log file used when log_output is file. It is rotated
+// once it would grow past MaxSizeMB, keeping MaxBackups old files.
+type LogFileConfig struct {
+	Path       string `yaml:"path"`
+	MaxSizeMB  int    `yaml:"max_size_mb"`
+	MaxBackups int    `yaml:"max_backups"`
+}
+
+// MultipassConfig controls how multipass commands are run. Args are
+// inserted before every command's own arguments and Env is added to the
+// exporter's environment.
+type MultipassConfig struct {
+	Binary  string            `yaml:"binary"`
+	Args    []string          `yaml:"args"`
+	Env     map[string]string `yaml:"env"`
+	WorkDir string            `yaml:"work_dir"`
+}
+
+// SimulatorConfig shapes the fleet simulated when simulate is set to a
+// number of instances. States maps states to their share of the instances
+// and Disks lists disk layouts, each mapping disk names to sizes in GB;
+// empty values use the simulator's defaults. Each instance picks a release,
+// CPU count, memory size and disk layout at random. Seed makes the fleet
+// reproducible, and 0 picks a random one.
+type SimulatorConfig struct {
+	States   map[string]float64 `yaml:"states"`
+	Releases []string           `yaml:"releases"`
+	CPUs     []int              `yaml:"cpus"`
+	MemoryMB []int              `yaml:"memory_mb"`
+	Disks    []map[string]int   `yaml:"disks"`
+	Seed     int64              `yaml:"seed"`
+	Faults   SimulatorFaults    `yaml:"faults"`
+}
+
+// SimulatorFaults are the probabilities of the faults injected into each
+// simulated `multipass info`. A slow response takes SlowSeconds, which
+// times it out when that exceeds timeout_seconds.
+type SimulatorFaults struct {
+	SlowRate        float64 `yaml:"slow_rate"`
+	SlowSeconds     int     `yaml:"slow_seconds"`
+	MalformedRate   float64 `yaml:"malformed_rate"`
+	DaemonErrorRate float64 `yaml:"daemon_error_rate"`
+}
+
+// ExpositionConfig controls how metrics are served over HTTP.
+// ErrorHandling is one of http_error, continue or panic.
+type ExpositionConfig struct {
+	ExporterMetricsPath string `yaml:"exporter_metrics_path"`
+	GoCollector         bool   `yaml:"go_collector"`
+	ProcessCollector    bool   `yaml:"process_collector"`
+	OpenMetrics         bool   `yaml:"openmetrics"`
+	CreatedTimestamps   bool   `yaml:"created_timestamps"`
+	DisableCompression  bool   `yaml:"disable_compression"`
+	ErrorHandling       string `yaml:"error_handling"`
+	MaxRequestsInFlight int    `yaml:"max_requests_in_flight"`
+	TimeoutSeconds      int    `yaml:"timeout_seconds"`
+}
+
+// EventsConfig controls the instance change event stream.
+// A zero RefreshIntervalSeconds disables background refreshes, so events
+// are only produced when scrapes or API calls run `multipass info`.
+type EventsConfig struct {
+	RefreshIntervalSeconds int `yaml:"refresh_interval_seconds"`
+	ReplayBufferSize       int `yaml:"replay_buffer_size"`
+}
+
+// InstancesConfig selects the instances that get per-instance metrics.
+// Patterns are globs, or regular expressions when wrapped in slashes.
+// Empty lists select everything. With CountFiltered, the aggregate
+// state counts still include instances that were filtered out.
+type InstancesConfig struct {
+	Include       []string `yaml:"include"`
+	Exclude       []string `yaml:"exclude"`
+	Releases      []string `yaml:"releases"`
+	States        []string `yaml:"states"`
+	CountFiltered bool     `yaml:"count_filtered"`
+}
+
+// LabelsConfig adds extra labels to metrics. Constant labels go on every
+// metric. Rules are regular expressions matched against the whole instance
+// name, whose named groups become labels of that instance's metrics;
+// MappingFile is a YAML file of instance name to label set and takes
+// precedence over the rules.
+type LabelsConfig struct {
+	Constant    map[string]string `yaml:"constant"`
+	Rules       []string          `yaml:"rules"`
+	MappingFile string            `yaml:"mapping_file"`
+}
+
+// PushConfig periodically pushes the collected metrics to a Prometheus
+// Pushgateway, for hosts that cannot be scraped. Pushing is enabled when
+// URL is set. Grouping labels identify this host's metric group and
+// default to instance=<hostname>. A failed push is retried MaxRetries
+// times, waiting RetryBackoffSeconds and doubling the wait after each try.
+type PushConfig struct {
+	URL                 string            `yaml:"url"`
+	Job                 string            `yaml:"job"`
+	Grouping            map[string]string `yaml:"grouping"`
+	IntervalSeconds     int               `yaml:"interval_seconds"`
+	TimeoutSeconds      int               `yaml:"timeout_seconds"`
+	Username            string            `yaml:"username"`
+	PasswordFile        string            `yaml:"password_file"`
+	MaxRetries          int               `yaml:"max_retries"`
+	RetryBackoffSeconds int               `yaml:"retry_backoff_seconds"`
+}
+
+// RemoteWriteConfig ships the collected metrics with the Prometheus
+// remote-write protocol, for example to Mimir. Sending is enabled when URL
+// is set. ExternalLabels are added to every series, after instance=<hostname>
+// and job=multipass_exporter. Requests that cannot be sent are kept in
+// QueueDir, or in memory when it is empty, up to MaxQueuedRequests.
+type RemoteWriteConfig struct {
+	URL               string            `yaml:"url"`
+	IntervalSeconds   int               `yaml:"interval_seconds"`
+	TimeoutSeconds    int               `yaml:"timeout_seconds"`
+	Headers           map[string]string `yaml:"headers"`
+	Username          string            `yaml:"username"`
+	PasswordFile      string            `yaml:"password_file"`
+	ExternalLabels    map[string]string `yaml:"external_labels"`
+	QueueDir          string            `yaml:"queue_dir"`
+	MaxQueuedRequests int               `yaml:"max_queued_requests"`
+}
+
+// OTLPConfig exports instance metrics as OpenTelemetry gauges to an OTLP
+// receiver such as the OpenTelemetry Collector. Exporting is enabled when
+// Endpoint is set. Protocol is grpc or http/protobuf; Insecure disables TLS
+// for gRPC endpoints given as host:port.
+type OTLPConfig struct {
+	Endpoint           string            `yaml:"endpoint"`
+	Protocol           string            `yaml:"protocol"`
+	Insecure           bool              `yaml:"insecure"`
+	Headers            map[string]string `yaml:"headers"`
+	ResourceAttributes map[string]string `yaml:"resource_attributes"`
+	IntervalSeconds    int               `yaml:"interval_seconds"`
+	TimeoutSeconds     int               `yaml:"timeout_seconds"`
+}
+
+// ServiceDiscoveryConfig serves Prometheus HTTP service discovery targets
+// for exporters running inside the instances, on Path; an empty Path
+// disables it. Every instance in one of States becomes a target group of
+// its first IPv4 address, or of all of them with AllAddresses, combined
+// with each of Ports.
+type ServiceDiscoveryConfig struct {
+	Path         string   `yaml:"path"`
+	Ports        []int    `yaml:"ports"`
+	States       []string `yaml:"states"`
+	AllAddresses bool     `yaml:"all_addresses"`
+}
+
+// FileSDConfig writes the service discovery targets to Path, a .json, .yml
+// or .yaml file for Prometheus file_sd_configs, whenever `multipass info`
+// runs and at least every RefreshIntervalSeconds, unless that is 0; an
+// empty Path disables it. Instances are selected as for
+// ServiceDiscoveryConfig. Labels are Go templates executed with each
+// instance's `multipass info` fields, e.g. {{ .Release }}.
+type FileSDConfig struct {
+	Path                   string            `yaml:"path"`
+	Ports                  []int             `yaml:"ports"`
+	States                 []string          `yaml:"states"`
+	AllAddresses           bool              `yaml:"all_addresses"`
+	Labels                 map[string]string `yaml:"labels"`
+	RefreshIntervalSeconds int               `yaml:"refresh_interval_seconds"`
+}
+
+// NotificationsConfig evaluates threshold rules against every `multipass
+// info` response and sends firing and resolved notifications to webhooks,
+// for setups without Alertmanager. It is enabled when Rules are set. While
+// an alert fires it is notified again every RepeatIntervalSeconds, unless
+// that is 0.
+type NotificationsConfig struct {
+	Rules                 []NotificationRule `yaml:"rules"`
+	Webhooks              []WebhookConfig    `yaml:"webhooks"`
+	RepeatIntervalSeconds int                `yaml:"repeat_interval_seconds"`
+	TimeoutSeconds        int                `yaml:"timeout_seconds"`
+}
+
+// NotificationRule fires for an instance, or one of its disks, once Metric
+// reaches Threshold, and resolves once it drops below ResolveThreshold.
+// A ResolveThreshold of 0 means Threshold, i.e. no hysteresis.
+type NotificationRule struct {
+	Name             string  `yaml:"name"`
+	Metric           string  `yaml:"metric"`
+	Threshold        float64 `yaml:"threshold"`
+	ResolveThreshold float64 `yaml:"resolve_threshold"`
+}
+
+// WebhookConfig receives notifications as a POST request. Body is a Go
+// template rendering the JSON body; empty means the notification as JSON.
+type WebhookConfig struct {
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	Body    string            `yaml:"body"`
 }
 
 // DefaultConfig returns a new Config with default values
 func DefaultConfig() *Config {
 	return &Config{
-		Port:           1986,
-		MetricsPath:    "/metrics",
-		TimeoutSeconds: 5,
-		LogLevel:       "info",
+		Port:                  1986,
+		MetricsPath:           "/metrics",
+		TimeoutSeconds:        5,
+		ReloadIntervalSeconds: 5,
+		RecordMaxRecordings:   1000,
+		LogLevel:              "info",
+		LogFormat:             "text",
+		LogOutput:             "stderr",
+		LogFile: LogFileConfig{
+			MaxSizeMB:  100,
+			MaxBackups: 5,
+		},
+		Namespace:     "multipass",
+		MetricsSchema: "v1",
+		Multipass: MultipassConfig{
+			Binary: "multipass",
+		},
+		Simulator: SimulatorConfig{
+			Faults: SimulatorFaults{
+				SlowSeconds: 3,
+			},
+		},
+		Exposition: ExpositionConfig{
+			ExporterMetricsPath: "/metrics/exporter",
+			GoCollector:         true,
+			ProcessCollector:    true,
+			OpenMetrics:         true,
+			ErrorHandling:       "http_error",
+		},
+		Events: EventsConfig{
+			RefreshIntervalSeconds: 15,
+			ReplayBufferSize:       100,
+		},
+		Push: PushConfig{
+			Job:                 "multipass_exporter",
+			IntervalSeconds:     60,
+			TimeoutSeconds:      10,
+			MaxRetries:          3,
+			RetryBackoffSeconds: 1,
+		},
+		RemoteWrite: RemoteWriteConfig{
+			IntervalSeconds:   60,
+			TimeoutSeconds:    30,
+			MaxQueuedRequests: 10080,
+		},
+		OTLP: OTLPConfig{
+			Protocol:        "grpc",
+			IntervalSeconds: 60,
+			TimeoutSeconds:  10,
+		},
+		ServiceDiscovery: ServiceDiscoveryConfig{
+			Path:   "/sd",
+			Ports:  []int{9100},
+			States: []string{"Running"},
+		},
+		FileSD: FileSDConfig{
+			Ports:                  []int{9100},
+			States:                 []string{"Running"},
+			RefreshIntervalSeconds: 60,
+		},
+		Notifications: NotificationsConfig{
+			RepeatIntervalSeconds: 14400,
+			TimeoutSeconds:        10,
+		},
 	}
 }
 
+// Addresses returns the addresses the HTTP server should listen on.
+// When no listen_addresses are configured, all interfaces on Port are used.
+func (c *Config) Addresses() []string {
+	if len(c.ListenAddresses) > 0 {
+		return c.ListenAddresses
+	}
+	return []string{fmt.Sprintf(":%d", c.Port)}
+}
+
+// LoadOptions selects the layers Load combines
+type LoadOptions struct {
+	// Path is the YAML file; empty means no file
+	Path string
+	// Required makes a missing file an error instead of falling back to defaults
+	Required bool
+	// IncludeDir holds *.yaml files merged on top of the file in lexical
+	// order; empty means the config.d directory next to Path
+	IncludeDir string
+	// Flags holds command line overrides
+	Flags FlagValues
+	// LookupEnv finds environment overrides; nil means os.LookupEnv
+	LookupEnv func(string) (string, bool)
+}
+
+// Result is the effective configuration and where each value came from
+type Result struct {
+	Config  *Config
+	Sources Sources
+	// Files maps keys set in a file to the file that last set them
+	Files map[string]string
+	// Lines maps keys set in a file to their line number in that file
+	Lines map[string]int
+	// Loaded reports whether the file was read
+	Loaded bool
+	// Includes lists the include files merged, in order
+	Includes []string
+}
+
 // LoadConfig loads YAML file or returns defaults
 // Returns a boolean indicating if the file was actually loaded
 func LoadConfig(path string) (*Config, bool, error) {
-	cfg := DefaultConfig()
+	result, err := Load(LoadOptions{Path: path, LookupEnv: noEnv})
+	if err != nil {
+		return nil, false, err
+	}
+	return result.Config, result.Loaded, nil
+}
+
+// Load builds the effective configuration from every layer:
+// defaults < YAML file (when a path is set) < include files < environment <
+// command line flags. Files are decoded strictly, so unknown keys are
+// errors, and the result is validated once all layers are applied.
+//
+// Each include file is merged on top of the previous ones: scalars it sets
+// replace earlier values, maps are merged key by key and lists replace the
+// earlier list as a whole. Keys it does not mention are left untouched.
+func Load(opts LoadOptions) (*Result, error) {
+	result := &Result{
+		Config:  DefaultConfig(),
+		Sources: make(Sources),
+		Files:   make(map[string]string),
+		Lines:   make(map[string]int),
+	}
+
+	if opts.Path != "" {
+		if err := loadFile(opts.Path, opts.Required, result); err != nil {
+			return nil, err
+		}
+	}
+
+	includes, err := IncludeFiles(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := loadIncludes(includes, result); err != nil {
+		return nil, err
+	}
+
+	lookupEnv := opts.LookupEnv
+	if lookupEnv == nil {
+		lookupEnv = os.LookupEnv
+	}
+	if err := ApplyEnv(result.Config, result.Sources, lookupEnv); err != nil {
+		return nil, err
+	}
+
+	if err := ApplyOverrides(result.Config, result.Sources, opts.Flags, SourceFlag); err != nil {
+		return nil, fmt.Errorf("invalid command line flag: %w", err)
+	}
+
+	if err := Validate(result.Config, result.Sources, result.Lines); err != nil {
+		var validationErr *ValidationError
+		if errors.As(err, &validationErr) {
+			for i, problem := range validationErr.Problems {
+				if file := result.Files[problem.Key]; problem.Line > 0 && file != opts.Path {
+					validationErr.Problems[i].File = file
+				}
+			}
+		}
+		return nil, err
+	}
 
+	return result, nil
+}
+
+func loadFile(path string, required bool, result *Result) error {
 	data, err := os.ReadFile(path)
 	if err != nil {
+		if required || !os.IsNotExist(err) {
+			return fmt.Errorf("error reading config file: %w", err)
+		}
 		// File missing? Use defaults
-		return cfg, false, nil
+		return nil
+	}
+
+	if err := mergeFile(path, data, result); err != nil {
+		return err
+	}
+	result.Loaded = true
+	return nil
+}
+
+// IncludeFiles lists the *.yaml files of the include directory of opts in
+// the lexical order Load merges them. A missing directory yields no files.
+func IncludeFiles(opts LoadOptions) ([]string, error) {
+	dir := opts.IncludeDir
+	if dir == "" {
+		if opts.Path == "" {
+			return nil, nil
+		}
+		dir = filepath.Join(filepath.Dir(opts.Path), "config.d")
 	}
 
-	if err := yaml.Unmarshal(data, cfg); err != nil { //nolint:typecheck
-		return nil, false, fmt.Errorf("error parsing YAML: %w", err)
+	paths, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, fmt.Errorf("error listing include directory: %w", err)
 	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// loadIncludes merges the include files in order
+func loadIncludes(paths []string, result *Result) error {
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("error reading include file: %w", err)
+		}
+		if err := mergeFile(path, data, result); err != nil {
+			return err
+		}
+		result.Includes = append(result.Includes, path)
+	}
+	return nil
+}
+
+// mergeFile decodes a YAML document on top of result.Config and records
+// the file and line of every key it sets
+func mergeFile(path string, data []byte, result *Result) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(data)) //nolint:typecheck
+	decoder.KnownFields(true)
+	if err := decoder.Decode(result.Config); err != nil && err != io.EOF {
+		return fmt.Errorf("error parsing YAML in %s: %w", path, err)
+	}
+
+	lines, err := keyLines(data)
+	if err != nil {
+		return fmt.Errorf("error parsing YAML in %s: %w", path, err)
+	}
+	for key, line := range lines {
+		result.Sources[key] = SourceFile
+		result.Files[key] = path
+		result.Lines[key] = line
+	}
+	return nil
+}
 
-	return cfg, true, nil
+func noEnv(string) (string, bool) {
+	return "", false
 }
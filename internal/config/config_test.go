@@ -3,6 +3,8 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -171,3 +173,163 @@ func TestDefaultConfig(t *testing.T) {
 		t.Errorf("Expected default log level info, got %s", cfg.LogLevel)
 	}
 }
+
+func TestConfig_Addresses(t *testing.T) {
+	cfg := DefaultConfig()
+
+	addrs := cfg.Addresses()
+	if len(addrs) != 1 || addrs[0] != ":1986" {
+		t.Errorf("Expected default addresses [:1986], got %v", addrs)
+	}
+
+	cfg.ListenAddresses = []string{"127.0.0.1:9090", "unix:/run/exporter.sock"}
+	addrs = cfg.Addresses()
+	if len(addrs) != 2 || addrs[0] != "127.0.0.1:9090" || addrs[1] != "unix:/run/exporter.sock" {
+		t.Errorf("Expected configured addresses, got %v", addrs)
+	}
+}
+
+func TestLoadConfig_ListenAddresses(t *testing.T) {
+	configContent := `
+listen_addresses:
+  - 127.0.0.1:9090
+  - "[::1]:9090"
+  - unix:/run/multipass-exporter.sock
+`
+
+	tempFile := filepath.Join(t.TempDir(), "listen_config.yaml")
+	err := os.WriteFile(tempFile, []byte(configContent), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test config file: %v", err)
+	}
+
+	cfg, _, err := LoadConfig(tempFile)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if len(cfg.ListenAddresses) != 3 {
+		t.Fatalf("Expected 3 listen addresses, got %d", len(cfg.ListenAddresses))
+	}
+	if cfg.ListenAddresses[1] != "[::1]:9090" {
+		t.Errorf("Expected IPv6 address [::1]:9090, got %s", cfg.ListenAddresses[1])
+	}
+}
+
+func TestLoadConfig_PartialExposition(t *testing.T) {
+	configContent := `
+exposition:
+  go_collector: false
+  max_requests_in_flight: 4
+`
+
+	tempFile := filepath.Join(t.TempDir(), "exposition_config.yaml")
+	err := os.WriteFile(tempFile, []byte(configContent), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test config file: %v", err)
+	}
+
+	cfg, _, err := LoadConfig(tempFile)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if cfg.Exposition.GoCollector {
+		t.Error("Expected go_collector to be disabled")
+	}
+	if cfg.Exposition.MaxRequestsInFlight != 4 {
+		t.Errorf("Expected max_requests_in_flight 4, got %d", cfg.Exposition.MaxRequestsInFlight)
+	}
+	if !cfg.Exposition.ProcessCollector {
+		t.Error("Expected process_collector to keep its default")
+	}
+	if cfg.Exposition.ExporterMetricsPath != "/metrics/exporter" {
+		t.Errorf("Expected default exporter metrics path, got %s", cfg.Exposition.ExporterMetricsPath)
+	}
+}
+
+func TestLoad_IncludeDirectory(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	base := `port: 9090
+timeout_seconds: 5
+instances:
+  include: ["web-*", "db-*"]
+labels:
+  constant:
+    site: madrid
+    team: infra
+`
+	if err := os.WriteFile(path, []byte(base), 0644); err != nil {
+		t.Fatalf("Failed to create test config file: %v", err)
+	}
+	includeDir := filepath.Join(dir, "config.d")
+	if err := os.Mkdir(includeDir, 0755); err != nil {
+		t.Fatalf("Failed to create include directory: %v", err)
+	}
+	includes := map[string]string{
+		"20-host.yaml":   "timeout_seconds: 12\nlabels:\n  constant:\n    host: node1\n",
+		"10-site.yaml":   "timeout_seconds: 8\ninstances:\n  include: [\"ci-*\"]\n",
+		"30-ignored.yml": "port: 1\n",
+	}
+	for name, content := range includes {
+		if err := os.WriteFile(filepath.Join(includeDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create include file: %v", err)
+		}
+	}
+
+	result, err := Load(LoadOptions{Path: path, LookupEnv: lookupFrom(nil)})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	cfg := result.Config
+
+	if cfg.Port != 9090 {
+		t.Errorf("Expected port 9090 from the main file, got %d", cfg.Port)
+	}
+	if cfg.TimeoutSeconds != 12 {
+		t.Errorf("Expected the lexically last include to win with timeout 12, got %d", cfg.TimeoutSeconds)
+	}
+	if !reflect.DeepEqual(cfg.Instances.Include, []string{"ci-*"}) {
+		t.Errorf("Expected lists to be replaced as a whole, got %v", cfg.Instances.Include)
+	}
+	wantLabels := map[string]string{"site": "madrid", "team": "infra", "host": "node1"}
+	if !reflect.DeepEqual(cfg.Labels.Constant, wantLabels) {
+		t.Errorf("Expected maps to be merged key by key, got %v", cfg.Labels.Constant)
+	}
+
+	wantIncludes := []string{filepath.Join(includeDir, "10-site.yaml"), filepath.Join(includeDir, "20-host.yaml")}
+	if !reflect.DeepEqual(result.Includes, wantIncludes) {
+		t.Errorf("Expected includes %v, got %v", wantIncludes, result.Includes)
+	}
+	if got := result.Files["timeout_seconds"]; got != wantIncludes[1] {
+		t.Errorf("Expected timeout_seconds to come from %s, got %s", wantIncludes[1], got)
+	}
+	if got := result.Files["port"]; got != path {
+		t.Errorf("Expected port to come from %s, got %s", path, got)
+	}
+}
+
+func TestLoad_IncludeValidationNamesFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte("port: 9090\n"), 0644); err != nil {
+		t.Fatalf("Failed to create test config file: %v", err)
+	}
+	includeDir := filepath.Join(dir, "overrides")
+	if err := os.Mkdir(includeDir, 0755); err != nil {
+		t.Fatalf("Failed to create include directory: %v", err)
+	}
+	include := filepath.Join(includeDir, "host.yaml")
+	if err := os.WriteFile(include, []byte("port: 9090\ntimeout_seconds: 0\n"), 0644); err != nil {
+		t.Fatalf("Failed to create include file: %v", err)
+	}
+
+	_, err := Load(LoadOptions{Path: path, IncludeDir: includeDir, LookupEnv: lookupFrom(nil)})
+	if err == nil {
+		t.Fatal("Expected validation error")
+	}
+	if want := include + " line 2: timeout_seconds"; !strings.Contains(err.Error(), want) {
+		t.Errorf("Expected %q in error, got:\n%v", want, err)
+	}
+}
@@ -0,0 +1,290 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3" //nolint:typecheck
+)
+
+// EnvPrefix is prepended to every configuration environment variable
+const EnvPrefix = "MULTIPASS_EXPORTER_"
+
+// Source identifies the layer an effective configuration value came from.
+// Layers are applied in order: defaults < file < env < flag.
+type Source string
+
+const (
+	SourceDefault Source = "default"
+	SourceFile    Source = "file"
+	SourceEnv     Source = "env"
+	SourceFlag    Source = "flag"
+)
+
+// Sources maps configuration keys, such as "exposition.go_collector",
+// to the layer that last set them. Keys absent from the map are defaults.
+type Sources map[string]Source
+
+// Get returns the source of key, defaulting to SourceDefault
+func (s Sources) Get(key string) Source {
+	if source, ok := s[key]; ok {
+		return source
+	}
+	return SourceDefault
+}
+
+// Setting is one effective configuration value and where it came from
+type Setting struct {
+	Key    string
+	Value  interface{}
+	Source Source
+}
+
+// field is a leaf configuration value addressed by its dotted YAML key
+type field struct {
+	key   string
+	value reflect.Value
+}
+
+// fields walks cfg and returns every leaf field in declaration order.
+// Nested structs contribute their fields as "parent.child" keys.
+func fields(cfg *Config) []field {
+	var result []field
+	walkFields(reflect.ValueOf(cfg).Elem(), "", &result)
+	return result
+}
+
+func walkFields(v reflect.Value, prefix string, result *[]field) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		key := prefix + tag
+		if t.Field(i).Type.Kind() == reflect.Struct {
+			walkFields(v.Field(i), key+".", result)
+			continue
+		}
+		*result = append(*result, field{key: key, value: v.Field(i)})
+	}
+}
+
+// Keys returns every configuration key in declaration order
+func Keys() []string {
+	var keys []string
+	for _, f := range fields(DefaultConfig()) {
+		keys = append(keys, f.key)
+	}
+	return keys
+}
+
+// EnvName returns the environment variable overriding key, e.g.
+// exposition.go_collector becomes MULTIPASS_EXPORTER_EXPOSITION_GO_COLLECTOR
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// FlagName returns the command line flag overriding key, e.g.
+// exposition.go_collector becomes exposition.go-collector
+func FlagName(key string) string {
+	return strings.ReplaceAll(key, "_", "-")
+}
+
+// Effective lists every configuration value of cfg with its source
+func Effective(cfg *Config, sources Sources) []Setting {
+	var settings []Setting
+	for _, f := range fields(cfg) {
+		settings = append(settings, Setting{
+			Key:    f.key,
+			Value:  f.value.Interface(),
+			Source: sources.Get(f.key),
+		})
+	}
+	return settings
+}
+
+// Preserve copies the values of keys from old into cfg and returns the keys
+// whose values differed. Reloads use it to keep settings that only take
+// effect on restart.
+func Preserve(cfg, old *Config, keys []string) []string {
+	oldFields := make(map[string]reflect.Value)
+	for _, f := range fields(old) {
+		oldFields[f.key] = f.value
+	}
+
+	var changed []string
+	for _, f := range fields(cfg) {
+		oldValue, ok := oldFields[f.key]
+		if !ok || !contains(keys, f.key) {
+			continue
+		}
+		if !reflect.DeepEqual(f.value.Interface(), oldValue.Interface()) {
+			changed = append(changed, f.key)
+			f.value.Set(oldValue)
+		}
+	}
+	return changed
+}
+
+// ApplyEnv overrides cfg with MULTIPASS_EXPORTER_* variables found by lookup
+func ApplyEnv(cfg *Config, sources Sources, lookup func(string) (string, bool)) error {
+	values := make(map[string]string)
+	for _, key := range Keys() {
+		if raw, ok := lookup(EnvName(key)); ok {
+			values[key] = raw
+		}
+	}
+	if err := ApplyOverrides(cfg, sources, values, SourceEnv); err != nil {
+		return fmt.Errorf("invalid environment: %w", err)
+	}
+	return nil
+}
+
+// ApplyOverrides sets the raw string values, keyed by configuration key,
+// on cfg and records source for each of them. Lists are comma separated;
+// maps and lists of objects are parsed as inline YAML.
+func ApplyOverrides(cfg *Config, sources Sources, values map[string]string, source Source) error {
+	for _, f := range fields(cfg) {
+		raw, ok := values[f.key]
+		if !ok {
+			continue
+		}
+		if err := setValue(f.value, raw); err != nil {
+			return fmt.Errorf("%s: %w", f.key, err)
+		}
+		sources[f.key] = source
+	}
+	return nil
+}
+
+func setValue(v reflect.Value, raw string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", raw)
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", raw)
+		}
+		v.SetFloat(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", raw)
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		elem := v.Type().Elem().Kind()
+		if (elem == reflect.String || elem == reflect.Int) && !strings.HasPrefix(strings.TrimSpace(raw), "[") {
+			list := reflect.MakeSlice(v.Type(), 0, 0)
+			for _, item := range strings.Split(raw, ",") {
+				if item = strings.TrimSpace(item); item == "" {
+					continue
+				}
+				value := reflect.New(v.Type().Elem()).Elem()
+				if err := setValue(value, item); err != nil {
+					return err
+				}
+				list = reflect.Append(list, value)
+			}
+			v.Set(list)
+			return nil
+		}
+		return setYAML(v, raw)
+	default:
+		return setYAML(v, raw)
+	}
+	return nil
+}
+
+func setYAML(v reflect.Value, raw string) error {
+	target := reflect.New(v.Type())
+	if err := yaml.Unmarshal([]byte(raw), target.Interface()); err != nil { //nolint:typecheck
+		return fmt.Errorf("invalid value %q: %w", raw, err)
+	}
+	v.Set(target.Elem())
+	return nil
+}
+
+// keyLines returns the line of every configuration key present in a YAML
+// document. Unknown keys are ignored; strict decoding reports them.
+func keyLines(data []byte) (map[string]int, error) {
+	lines := make(map[string]int)
+
+	var doc yaml.Node                                  //nolint:typecheck
+	if err := yaml.Unmarshal(data, &doc); err != nil { //nolint:typecheck
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return lines, nil
+	}
+
+	known := make(map[string]bool)
+	for _, key := range Keys() {
+		known[key] = true
+	}
+
+	var walk func(node *yaml.Node, prefix string) //nolint:typecheck
+	walk = func(node *yaml.Node, prefix string) { //nolint:typecheck
+		if node.Kind != yaml.MappingNode { //nolint:typecheck
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := prefix + node.Content[i].Value
+			if known[key] {
+				lines[key] = node.Content[i].Line
+				continue
+			}
+			walk(node.Content[i+1], key+".")
+		}
+	}
+	walk(doc.Content[0], "")
+	return lines, nil
+}
+
+// FlagValues collects configuration overrides given on the command line,
+// keyed by configuration key
+type FlagValues map[string]string
+
+// RegisterFlags adds one flag per configuration key to fs. Only flags
+// actually given on the command line end up in the returned FlagValues.
+func RegisterFlags(fs *flag.FlagSet) FlagValues {
+	values := make(FlagValues)
+	for _, f := range fields(DefaultConfig()) {
+		fv := &flagValue{key: f.key, values: values, isBool: f.value.Kind() == reflect.Bool}
+		fs.Var(fv, FlagName(f.key), fmt.Sprintf("Override %s (env %s)", f.key, EnvName(f.key)))
+	}
+	return values
+}
+
+type flagValue struct {
+	key    string
+	values FlagValues
+	isBool bool
+}
+
+func (f *flagValue) String() string {
+	if f == nil || f.values == nil {
+		return ""
+	}
+	return f.values[f.key]
+}
+
+func (f *flagValue) Set(raw string) error {
+	f.values[f.key] = raw
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	return f.isBool
+}
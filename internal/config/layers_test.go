@@ -0,0 +1,217 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func lookupFrom(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+}
+
+func TestKeys(t *testing.T) {
+	keys := Keys()
+
+	want := map[string]bool{
+		"port":                            false,
+		"listen_addresses":                false,
+		"exposition.go_collector":         false,
+		"events.replay_buffer_size":       false,
+		"exposition.error_handling":       false,
+		"events.refresh_interval_seconds": false,
+	}
+	for _, key := range keys {
+		if _, ok := want[key]; ok {
+			want[key] = true
+		}
+		if key == "exposition" || key == "events" {
+			t.Errorf("Expected nested struct %q to be expanded", key)
+		}
+	}
+	for key, found := range want {
+		if !found {
+			t.Errorf("Expected key %q in Keys()", key)
+		}
+	}
+}
+
+func TestEnvAndFlagNames(t *testing.T) {
+	if got := EnvName("exposition.go_collector"); got != "MULTIPASS_EXPORTER_EXPOSITION_GO_COLLECTOR" {
+		t.Errorf("Unexpected env name %s", got)
+	}
+	if got := FlagName("exposition.go_collector"); got != "exposition.go-collector" {
+		t.Errorf("Unexpected flag name %s", got)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	cfg := DefaultConfig()
+	sources := make(Sources)
+
+	err := ApplyEnv(cfg, sources, lookupFrom(map[string]string{
+		"MULTIPASS_EXPORTER_PORT":                      "9100",
+		"MULTIPASS_EXPORTER_LISTEN_ADDRESSES":          "127.0.0.1:9100, unix:/run/exporter.sock",
+		"MULTIPASS_EXPORTER_EXPOSITION_GO_COLLECTOR":   "false",
+		"MULTIPASS_EXPORTER_EVENTS_REPLAY_BUFFER_SIZE": "5",
+		"MULTIPASS_EXPORTER_SERVICE_DISCOVERY_PORTS":   "9100, 8080",
+	}))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if cfg.Port != 9100 {
+		t.Errorf("Expected port 9100, got %d", cfg.Port)
+	}
+	if len(cfg.ListenAddresses) != 2 || cfg.ListenAddresses[1] != "unix:/run/exporter.sock" {
+		t.Errorf("Expected two listen addresses, got %v", cfg.ListenAddresses)
+	}
+	if cfg.Exposition.GoCollector {
+		t.Error("Expected go collector to be disabled")
+	}
+	if cfg.Events.ReplayBufferSize != 5 {
+		t.Errorf("Expected replay buffer size 5, got %d", cfg.Events.ReplayBufferSize)
+	}
+	if ports := cfg.ServiceDiscovery.Ports; len(ports) != 2 || ports[1] != 8080 {
+		t.Errorf("Expected service discovery ports [9100 8080], got %v", ports)
+	}
+	if sources.Get("port") != SourceEnv || sources.Get("metrics_path") != SourceDefault {
+		t.Errorf("Unexpected sources %v", sources)
+	}
+}
+
+func TestApplyEnv_InvalidValue(t *testing.T) {
+	cfg := DefaultConfig()
+
+	for name, value := range map[string]string{
+		"MULTIPASS_EXPORTER_PORT":                    "abc",
+		"MULTIPASS_EXPORTER_EXPOSITION_GO_COLLECTOR": "maybe",
+	} {
+		err := ApplyEnv(cfg, make(Sources), lookupFrom(map[string]string{name: value}))
+		if err == nil {
+			t.Errorf("Expected error for %s=%s", name, value)
+		}
+	}
+}
+
+func TestRegisterFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	values := RegisterFlags(fs)
+
+	if err := fs.Parse([]string{"--metrics-path=/m", "--exposition.openmetrics=false", "--exposition.process-collector"}); err != nil {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
+
+	if len(values) != 3 {
+		t.Fatalf("Expected only given flags to be recorded, got %v", values)
+	}
+	if values["metrics_path"] != "/m" {
+		t.Errorf("Expected metrics_path /m, got %q", values["metrics_path"])
+	}
+	if values["exposition.process_collector"] != "true" {
+		t.Errorf("Expected bare boolean flag to be true, got %q", values["exposition.process_collector"])
+	}
+}
+
+func TestLoad_Precedence(t *testing.T) {
+	configContent := `
+port: 9090
+metrics_path: /file-metrics
+log_level: warn
+exposition:
+  max_requests_in_flight: 2
+`
+	tempFile := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(tempFile, []byte(configContent), 0644); err != nil {
+		t.Fatalf("Failed to create test config file: %v", err)
+	}
+
+	env := lookupFrom(map[string]string{
+		"MULTIPASS_EXPORTER_PORT":         "9191",
+		"MULTIPASS_EXPORTER_METRICS_PATH": "/env-metrics",
+	})
+	flags := FlagValues{"port": "9292"}
+
+	result, err := Load(LoadOptions{Path: tempFile, Flags: flags, LookupEnv: env})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	cfg, sources := result.Config, result.Sources
+	if !result.Loaded {
+		t.Error("Expected file to be loaded")
+	}
+
+	tests := []struct {
+		key    string
+		value  interface{}
+		source Source
+	}{
+		{"port", 9292, SourceFlag},
+		{"metrics_path", "/env-metrics", SourceEnv},
+		{"log_level", "warn", SourceFile},
+		{"exposition.max_requests_in_flight", 2, SourceFile},
+		{"timeout_seconds", 5, SourceDefault},
+	}
+
+	settings := make(map[string]Setting)
+	for _, setting := range Effective(cfg, sources) {
+		settings[setting.Key] = setting
+	}
+	for _, tt := range tests {
+		setting := settings[tt.key]
+		if setting.Value != tt.value || setting.Source != tt.source {
+			t.Errorf("%s: expected %v from %s, got %v from %s", tt.key, tt.value, tt.source, setting.Value, setting.Source)
+		}
+	}
+}
+
+func TestLoad_NoFile(t *testing.T) {
+	result, err := Load(LoadOptions{LookupEnv: lookupFrom(nil)})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.Loaded {
+		t.Error("Expected no file to be loaded")
+	}
+	if result.Config.Port != 1986 || len(result.Sources) != 0 {
+		t.Errorf("Expected pure defaults, got port %d and sources %v", result.Config.Port, result.Sources)
+	}
+}
+
+func TestApplyEnv_ConstantLabels(t *testing.T) {
+	cfg := DefaultConfig()
+	sources := make(Sources)
+	err := ApplyEnv(cfg, sources, lookupFrom(map[string]string{
+		"MULTIPASS_EXPORTER_LABELS_CONSTANT": "{host: lab-1, site: madrid}",
+	}))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if cfg.Labels.Constant["host"] != "lab-1" || cfg.Labels.Constant["site"] != "madrid" {
+		t.Errorf("Expected constant labels from environment, got %v", cfg.Labels.Constant)
+	}
+}
+
+func TestPreserve(t *testing.T) {
+	old := DefaultConfig()
+	cfg := DefaultConfig()
+	cfg.Port = 9100
+	cfg.LogLevel = "debug"
+	cfg.ListenAddresses = []string{"127.0.0.1:9100"}
+
+	changed := Preserve(cfg, old, []string{"port", "listen_addresses", "metrics_path"})
+
+	if len(changed) != 2 || changed[0] != "port" || changed[1] != "listen_addresses" {
+		t.Errorf("Expected port and listen_addresses to be reported, got %v", changed)
+	}
+	if cfg.Port != old.Port || len(cfg.ListenAddresses) != 0 {
+		t.Errorf("Expected preserved values, got port %d and %v", cfg.Port, cfg.ListenAddresses)
+	}
+	if cfg.LogLevel != "debug" {
+		t.Errorf("Expected other values to be kept, got log level %s", cfg.LogLevel)
+	}
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+
+	"gopkg.in/yaml.v3" //nolint:typecheck
+)
+
+// Annotated renders the effective configuration as YAML, with a comment
+// on every value naming where it came from: the default, a file and line,
+// an environment variable or a command line flag
+func (r *Result) Annotated() ([]byte, error) {
+	var doc yaml.Node //nolint:typecheck
+	if err := doc.Encode(r.Config); err != nil {
+		return nil, fmt.Errorf("error encoding configuration: %w", err)
+	}
+
+	known := make(map[string]bool)
+	for _, key := range Keys() {
+		known[key] = true
+	}
+
+	var walk func(node *yaml.Node, prefix string) //nolint:typecheck
+	walk = func(node *yaml.Node, prefix string) { //nolint:typecheck
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keyNode, valueNode := node.Content[i], node.Content[i+1]
+			key := prefix + keyNode.Value
+			if !known[key] {
+				walk(valueNode, key+".")
+				continue
+			}
+			// Comments on block maps and lists read best on the key's line
+			if valueNode.Kind == yaml.ScalarNode || valueNode.Style&yaml.FlowStyle != 0 || len(valueNode.Content) == 0 { //nolint:typecheck
+				valueNode.LineComment = r.origin(key)
+			} else {
+				keyNode.LineComment = r.origin(key)
+			}
+		}
+	}
+	walk(&doc, "")
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf) //nolint:typecheck
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return nil, fmt.Errorf("error encoding configuration: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, fmt.Errorf("error encoding configuration: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// origin describes where the value of key came from
+func (r *Result) origin(key string) string {
+	switch r.Sources.Get(key) {
+	case SourceFile:
+		return fmt.Sprintf("%s:%d", r.Files[key], r.Lines[key])
+	case SourceEnv:
+		return "env " + EnvName(key)
+	case SourceFlag:
+		return "flag --" + FlagName(key)
+	default:
+		return string(SourceDefault)
+	}
+}
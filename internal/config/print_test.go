@@ -0,0 +1,43 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAnnotated(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte("port: 9090\nlabels:\n  constant:\n    site: madrid\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	result, err := Load(LoadOptions{
+		Path:      path,
+		Flags:     FlagValues{"log_level": "debug"},
+		LookupEnv: lookupFrom(map[string]string{"MULTIPASS_EXPORTER_TIMEOUT_SECONDS": "9"}),
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	out, err := result.Annotated()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	text := string(out)
+
+	for _, want := range []string{
+		"port: 9090 # " + path + ":1",
+		"timeout_seconds: 9 # env MULTIPASS_EXPORTER_TIMEOUT_SECONDS",
+		"log_level: debug # flag --log-level",
+		"metrics_path: /metrics # default",
+		"  constant: # " + path + ":3\n    site: madrid",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Expected output to contain %q, got:\n%s", want, text)
+		}
+	}
+}
@@ -0,0 +1,491 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/Abuelodelanada/multipass-exporter/internal/labels"
+	"github.com/Abuelodelanada/multipass-exporter/internal/listener"
+	"github.com/Abuelodelanada/multipass-exporter/internal/logging"
+	"github.com/Abuelodelanada/multipass-exporter/internal/match"
+	"github.com/Abuelodelanada/multipass-exporter/internal/notify/notifyspec"
+	"github.com/Abuelodelanada/multipass-exporter/internal/otlp/otlpspec"
+	"github.com/Abuelodelanada/multipass-exporter/internal/sd/sdspec"
+)
+
+// logLevels are the levels accepted by log_level
+var logLevels = []string{"panic", "fatal", "error", "warn", "warning", "info", "debug", "trace"}
+
+// errorHandlings are the values accepted by exposition.error_handling
+var errorHandlings = []string{"http_error", "continue", "panic"}
+
+// metricsSchemas are the values accepted by metrics_schema
+var metricsSchemas = []string{"v1", "v2", "both"}
+
+// namespaceRE matches metric namespaces that form valid metric names
+var namespaceRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// labelNameRE matches valid Prometheus label names
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Problem is a single invalid configuration value
+type Problem struct {
+	Key     string
+	Message string
+	Source  Source
+	// Line is the line in the config file, or 0 when the value did not come from it
+	Line int
+	// File is the include file the value came from; empty for the main file
+	File string
+}
+
+func (p Problem) String() string {
+	switch {
+	case p.Line > 0 && p.File != "":
+		return fmt.Sprintf("%s line %d: %s: %s", p.File, p.Line, p.Key, p.Message)
+	case p.Line > 0:
+		return fmt.Sprintf("line %d: %s: %s", p.Line, p.Key, p.Message)
+	case p.Source == SourceEnv:
+		return fmt.Sprintf("%s (from %s): %s", p.Key, EnvName(p.Key), p.Message)
+	case p.Source == SourceFlag:
+		return fmt.Sprintf("%s (from --%s): %s", p.Key, FlagName(p.Key), p.Message)
+	default:
+		return fmt.Sprintf("%s: %s", p.Key, p.Message)
+	}
+}
+
+// ValidationError lists every problem found in a configuration
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, 0, len(e.Problems))
+	for _, problem := range e.Problems {
+		lines = append(lines, "  "+problem.String())
+	}
+	return fmt.Sprintf("invalid configuration (%d problems):\n%s", len(e.Problems), strings.Join(lines, "\n"))
+}
+
+// validator accumulates problems, locating each through sources and lines
+type validator struct {
+	sources  Sources
+	lines    map[string]int
+	problems []Problem
+}
+
+func (v *validator) addf(key, format string, args ...interface{}) {
+	v.problems = append(v.problems, Problem{
+		Key:     key,
+		Message: fmt.Sprintf(format, args...),
+		Source:  v.sources.Get(key),
+		Line:    v.lineOf(key),
+	})
+}
+
+// patterns checks that every glob or regex in a list compiles
+func (v *validator) patterns(key string, patterns []string) {
+	for _, pattern := range patterns {
+		if _, err := match.Compile(pattern); err != nil {
+			v.addf(key, "%v", err)
+		}
+	}
+}
+
+// reservedPaths are routes the server registers besides the configured
+// paths: the API, whose subtree includes the event stream, and the
+// simulator's fault injection. Registering one twice makes the server panic.
+var reservedPaths = []string{"/api/v1/", "/simulator/faults"}
+
+// notReserved checks that an HTTP path neither is nor falls under a
+// reserved route
+func (v *validator) notReserved(key, path string) {
+	for _, reserved := range reservedPaths {
+		if path == reserved || (strings.HasSuffix(reserved, "/") && strings.HasPrefix(path, reserved)) {
+			v.addf(key, "must not use %s, which the exporter serves itself, got %q", reserved, path)
+			return
+		}
+	}
+}
+
+// targets checks the ports and states selecting service discovery targets
+// of the section at prefix
+func (v *validator) targets(prefix string, ports []int, states []string) {
+	for _, port := range ports {
+		if port < 1 || port > 65535 {
+			v.addf(prefix+".ports", "must be between 1 and 65535, got %d", port)
+		}
+	}
+	for _, state := range states {
+		if strings.TrimSpace(state) == "" {
+			v.addf(prefix+".states", "must not contain empty states")
+		}
+	}
+}
+
+// lineOf only reports file lines for values the file actually provided
+func (v *validator) lineOf(key string) int {
+	if v.sources.Get(key) != SourceFile {
+		return 0
+	}
+	return v.lines[key]
+}
+
+// Validate checks cfg for semantic errors and returns them all at once as a
+// *ValidationError. sources and lines, as returned by Load, locate each
+// problem; both may be nil.
+func Validate(cfg *Config, sources Sources, lines map[string]int) error {
+	v := &validator{sources: sources, lines: lines}
+
+	if cfg.Port < 1 || cfg.Port > 65535 {
+		v.addf("port", "must be between 1 and 65535, got %d", cfg.Port)
+	}
+
+	for _, addr := range cfg.ListenAddresses {
+		if _, _, err := listener.ParseAddress(addr); err != nil {
+			v.addf("listen_addresses", "%v", err)
+		}
+	}
+
+	if !strings.HasPrefix(cfg.MetricsPath, "/") {
+		v.addf("metrics_path", "must start with /, got %q", cfg.MetricsPath)
+	} else {
+		v.notReserved("metrics_path", cfg.MetricsPath)
+	}
+
+	if cfg.TimeoutSeconds <= 0 {
+		v.addf("timeout_seconds", "must be positive, got %d", cfg.TimeoutSeconds)
+	}
+
+	if cfg.ReloadIntervalSeconds < 0 {
+		v.addf("reload_interval_seconds", "must not be negative, got %d", cfg.ReloadIntervalSeconds)
+	}
+
+	if !contains(logLevels, strings.ToLower(cfg.LogLevel)) {
+		v.addf("log_level", "must be one of %s, got %q", strings.Join(logLevels, ", "), cfg.LogLevel)
+	}
+
+	if !contains(logging.Formats, cfg.LogFormat) {
+		v.addf("log_format", "must be one of %s, got %q", strings.Join(logging.Formats, ", "), cfg.LogFormat)
+	}
+	if !contains(logging.Outputs, cfg.LogOutput) {
+		v.addf("log_output", "must be one of %s, got %q", strings.Join(logging.Outputs, ", "), cfg.LogOutput)
+	}
+	if cfg.LogOutput == logging.OutputFile && cfg.LogFile.Path == "" {
+		v.addf("log_file.path", "must be set when log_output is file")
+	}
+	if cfg.LogFile.MaxSizeMB < 0 {
+		v.addf("log_file.max_size_mb", "must not be negative, got %d", cfg.LogFile.MaxSizeMB)
+	}
+	if cfg.LogFile.MaxBackups < 0 {
+		v.addf("log_file.max_backups", "must not be negative, got %d", cfg.LogFile.MaxBackups)
+	}
+
+	if cfg.Multipass.Binary == "" {
+		v.addf("multipass.binary", "must not be empty")
+	}
+	for name := range cfg.Multipass.Env {
+		if name == "" || strings.ContainsAny(name, "=\x00") {
+			v.addf("multipass.env", "invalid environment variable name %q", name)
+		}
+	}
+	if dir := cfg.Multipass.WorkDir; dir != "" {
+		if info, err := os.Stat(dir); err != nil {
+			v.addf("multipass.work_dir", "%v", err)
+		} else if !info.IsDir() {
+			v.addf("multipass.work_dir", "%s is not a directory", dir)
+		}
+	}
+	if cfg.RecordMaxRecordings < 0 {
+		v.addf("record_max_recordings", "must not be negative, got %d", cfg.RecordMaxRecordings)
+	}
+	if dir := cfg.ReplayDir; dir != "" {
+		if info, err := os.Stat(dir); err != nil {
+			v.addf("replay_dir", "%v", err)
+		} else if !info.IsDir() {
+			v.addf("replay_dir", "%s is not a directory", dir)
+		}
+		if cfg.RecordDir != "" {
+			v.addf("replay_dir", "cannot be combined with record_dir")
+		}
+	}
+	if cfg.Simulate < 0 {
+		v.addf("simulate", "must not be negative, got %d", cfg.Simulate)
+	} else if cfg.Simulate > 0 && cfg.ReplayDir != "" {
+		v.addf("simulate", "cannot be combined with replay_dir")
+	}
+	simulator := cfg.Simulator
+	var weights float64
+	for state, weight := range simulator.States {
+		if weight < 0 {
+			v.addf("simulator.states", "weight of %s must not be negative, got %v", state, weight)
+		}
+		weights += weight
+	}
+	if len(simulator.States) > 0 && weights <= 0 {
+		v.addf("simulator.states", "weights must not all be 0")
+	}
+	for _, release := range simulator.Releases {
+		if release == "" {
+			v.addf("simulator.releases", "must not contain empty releases")
+		}
+	}
+	for _, n := range simulator.CPUs {
+		if n <= 0 {
+			v.addf("simulator.cpus", "must be positive, got %d", n)
+		}
+	}
+	for _, n := range simulator.MemoryMB {
+		if n <= 0 {
+			v.addf("simulator.memory_mb", "must be positive, got %d", n)
+		}
+	}
+	for i, layout := range simulator.Disks {
+		if len(layout) == 0 {
+			v.addf("simulator.disks", "layout %d has no disks", i)
+		}
+		for name, size := range layout {
+			if size <= 0 {
+				v.addf("simulator.disks", "size of %s in layout %d must be positive, got %d", name, i, size)
+			}
+		}
+	}
+	faults := simulator.Faults
+	rates := []struct {
+		key  string
+		rate float64
+	}{
+		{"simulator.faults.slow_rate", faults.SlowRate},
+		{"simulator.faults.malformed_rate", faults.MalformedRate},
+		{"simulator.faults.daemon_error_rate", faults.DaemonErrorRate},
+	}
+	for _, r := range rates {
+		if r.rate < 0 || r.rate > 1 {
+			v.addf(r.key, "must be between 0 and 1, got %v", r.rate)
+		}
+	}
+	if sum := faults.SlowRate + faults.MalformedRate + faults.DaemonErrorRate; sum > 1 {
+		v.addf("simulator.faults.slow_rate", "fault rates must not add up to more than 1, got %v", sum)
+	}
+	if faults.SlowSeconds < 0 {
+		v.addf("simulator.faults.slow_seconds", "must not be negative, got %d", faults.SlowSeconds)
+	}
+
+	if !namespaceRE.MatchString(cfg.Namespace) {
+		v.addf("namespace", "must be a valid metric name prefix, got %q", cfg.Namespace)
+	}
+
+	if !contains(metricsSchemas, cfg.MetricsSchema) {
+		v.addf("metrics_schema", "must be one of %s, got %q", strings.Join(metricsSchemas, ", "), cfg.MetricsSchema)
+	}
+
+	exposition := cfg.Exposition
+	if exposition.ExporterMetricsPath != "" {
+		if !strings.HasPrefix(exposition.ExporterMetricsPath, "/") {
+			v.addf("exposition.exporter_metrics_path", "must start with /, got %q", exposition.ExporterMetricsPath)
+		} else if exposition.ExporterMetricsPath == cfg.MetricsPath {
+			v.addf("exposition.exporter_metrics_path", "must differ from metrics_path %q", cfg.MetricsPath)
+		} else {
+			v.notReserved("exposition.exporter_metrics_path", exposition.ExporterMetricsPath)
+		}
+	}
+	if exposition.ErrorHandling != "" && !contains(errorHandlings, exposition.ErrorHandling) {
+		v.addf("exposition.error_handling", "must be one of %s, got %q", strings.Join(errorHandlings, ", "), exposition.ErrorHandling)
+	}
+	if exposition.MaxRequestsInFlight < 0 {
+		v.addf("exposition.max_requests_in_flight", "must not be negative, got %d", exposition.MaxRequestsInFlight)
+	}
+	if exposition.TimeoutSeconds < 0 {
+		v.addf("exposition.timeout_seconds", "must not be negative, got %d", exposition.TimeoutSeconds)
+	}
+
+	if cfg.Events.RefreshIntervalSeconds < 0 {
+		v.addf("events.refresh_interval_seconds", "must not be negative, got %d", cfg.Events.RefreshIntervalSeconds)
+	}
+	if cfg.Events.ReplayBufferSize < 0 {
+		v.addf("events.replay_buffer_size", "must not be negative, got %d", cfg.Events.ReplayBufferSize)
+	}
+
+	v.patterns("instances.include", cfg.Instances.Include)
+	v.patterns("instances.exclude", cfg.Instances.Exclude)
+	v.patterns("instances.releases", cfg.Instances.Releases)
+	v.patterns("instances.states", cfg.Instances.States)
+
+	if err := labels.ValidateConstant(cfg.Labels.Constant); err != nil {
+		v.addf("labels.constant", "%v", err)
+	}
+	for _, rule := range cfg.Labels.Rules {
+		re, err := labels.CompileRule(rule)
+		if err != nil {
+			v.addf("labels.rules", "%v", err)
+			continue
+		}
+		for _, name := range re.SubexpNames() {
+			if _, ok := cfg.Labels.Constant[name]; ok && name != "" {
+				v.addf("labels.rules", "label %q is also a constant label", name)
+			}
+		}
+	}
+
+	push := cfg.Push
+	if push.URL != "" {
+		if u, err := url.Parse(push.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.addf("push.url", "must be an http or https URL, got %q", push.URL)
+		}
+		if push.Job == "" {
+			v.addf("push.job", "must not be empty")
+		}
+		if push.IntervalSeconds <= 0 {
+			v.addf("push.interval_seconds", "must be positive, got %d", push.IntervalSeconds)
+		}
+	}
+	for name := range push.Grouping {
+		if !labelNameRE.MatchString(name) || name == "job" {
+			v.addf("push.grouping", "invalid grouping label name %q", name)
+		}
+	}
+	if push.TimeoutSeconds < 0 {
+		v.addf("push.timeout_seconds", "must not be negative, got %d", push.TimeoutSeconds)
+	}
+	if push.PasswordFile != "" && push.Username == "" {
+		v.addf("push.password_file", "requires push.username")
+	}
+	if push.MaxRetries < 0 {
+		v.addf("push.max_retries", "must not be negative, got %d", push.MaxRetries)
+	}
+	if push.RetryBackoffSeconds < 0 {
+		v.addf("push.retry_backoff_seconds", "must not be negative, got %d", push.RetryBackoffSeconds)
+	}
+
+	remoteWrite := cfg.RemoteWrite
+	if remoteWrite.URL != "" {
+		if u, err := url.Parse(remoteWrite.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.addf("remote_write.url", "must be an http or https URL, got %q", remoteWrite.URL)
+		}
+		if remoteWrite.IntervalSeconds <= 0 {
+			v.addf("remote_write.interval_seconds", "must be positive, got %d", remoteWrite.IntervalSeconds)
+		}
+	}
+	if remoteWrite.TimeoutSeconds < 0 {
+		v.addf("remote_write.timeout_seconds", "must not be negative, got %d", remoteWrite.TimeoutSeconds)
+	}
+	if remoteWrite.PasswordFile != "" && remoteWrite.Username == "" {
+		v.addf("remote_write.password_file", "requires remote_write.username")
+	}
+	for name := range remoteWrite.ExternalLabels {
+		if !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__") {
+			v.addf("remote_write.external_labels", "invalid label name %q", name)
+		}
+	}
+	if remoteWrite.MaxQueuedRequests < 0 {
+		v.addf("remote_write.max_queued_requests", "must not be negative, got %d", remoteWrite.MaxQueuedRequests)
+	}
+
+	otlpConfig := cfg.OTLP
+	if !contains(otlpspec.Protocols, otlpConfig.Protocol) {
+		v.addf("otlp.protocol", "must be one of %s, got %q", strings.Join(otlpspec.Protocols, ", "), otlpConfig.Protocol)
+	}
+	if otlpConfig.Endpoint != "" {
+		if otlpConfig.Protocol == otlpspec.ProtocolHTTPProtobuf {
+			if u, err := url.Parse(otlpConfig.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				v.addf("otlp.endpoint", "must be an http or https URL, got %q", otlpConfig.Endpoint)
+			}
+		}
+		if otlpConfig.IntervalSeconds <= 0 {
+			v.addf("otlp.interval_seconds", "must be positive, got %d", otlpConfig.IntervalSeconds)
+		}
+	}
+	if otlpConfig.TimeoutSeconds < 0 {
+		v.addf("otlp.timeout_seconds", "must not be negative, got %d", otlpConfig.TimeoutSeconds)
+	}
+	for _, key := range otlpspec.IdentityAttributes {
+		if _, ok := otlpConfig.ResourceAttributes[key]; ok {
+			v.addf("otlp.resource_attributes", "must not set %s, which identifies each resource", key)
+		}
+	}
+
+	discovery := cfg.ServiceDiscovery
+	if discovery.Path != "" {
+		if !strings.HasPrefix(discovery.Path, "/") {
+			v.addf("service_discovery.path", "must start with /, got %q", discovery.Path)
+		} else if discovery.Path == cfg.MetricsPath || discovery.Path == cfg.Exposition.ExporterMetricsPath {
+			v.addf("service_discovery.path", "must differ from the metrics paths, got %q", discovery.Path)
+		} else {
+			v.notReserved("service_discovery.path", discovery.Path)
+		}
+	}
+	v.targets("service_discovery", discovery.Ports, discovery.States)
+
+	fileSD := cfg.FileSD
+	if fileSD.Path != "" && !contains(sdspec.FileExtensions, strings.ToLower(filepath.Ext(fileSD.Path))) {
+		v.addf("file_sd.path", "must end in %s, got %q", strings.Join(sdspec.FileExtensions, ", "), fileSD.Path)
+	}
+	v.targets("file_sd", fileSD.Ports, fileSD.States)
+	for name := range fileSD.Labels {
+		if !labelNameRE.MatchString(name) {
+			v.addf("file_sd.labels", "invalid label name %q", name)
+		}
+	}
+	if _, err := sdspec.ParseLabels(fileSD.Labels); err != nil {
+		v.addf("file_sd.labels", "%v", err)
+	}
+	if fileSD.RefreshIntervalSeconds < 0 {
+		v.addf("file_sd.refresh_interval_seconds", "must not be negative, got %d", fileSD.RefreshIntervalSeconds)
+	}
+
+	notifications := cfg.Notifications
+	ruleNames := make(map[string]bool)
+	for _, rule := range notifications.Rules {
+		switch {
+		case rule.Name == "":
+			v.addf("notifications.rules", "every rule needs a name")
+		case ruleNames[rule.Name]:
+			v.addf("notifications.rules", "duplicate rule name %q", rule.Name)
+		}
+		ruleNames[rule.Name] = true
+		if !contains(notifyspec.Metrics, rule.Metric) {
+			v.addf("notifications.rules", "rule %q: metric must be one of %s, got %q", rule.Name, strings.Join(notifyspec.Metrics, ", "), rule.Metric)
+		}
+		if rule.Threshold <= 0 {
+			v.addf("notifications.rules", "rule %q: threshold must be positive, got %g", rule.Name, rule.Threshold)
+		}
+		if rule.ResolveThreshold < 0 || rule.ResolveThreshold > rule.Threshold {
+			v.addf("notifications.rules", "rule %q: resolve_threshold must be between 0 and the threshold, got %g", rule.Name, rule.ResolveThreshold)
+		}
+	}
+	if len(notifications.Rules) > 0 && len(notifications.Webhooks) == 0 {
+		v.addf("notifications.webhooks", "must not be empty when rules are set")
+	}
+	for _, webhook := range notifications.Webhooks {
+		if u, err := url.Parse(webhook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.addf("notifications.webhooks", "url must be an http or https URL, got %q", webhook.URL)
+		}
+		if _, err := notifyspec.ParseBody(webhook.Body); err != nil {
+			v.addf("notifications.webhooks", "%v", err)
+		}
+	}
+	if notifications.RepeatIntervalSeconds < 0 {
+		v.addf("notifications.repeat_interval_seconds", "must not be negative, got %d", notifications.RepeatIntervalSeconds)
+	}
+	if notifications.TimeoutSeconds < 0 {
+		v.addf("notifications.timeout_seconds", "must not be negative, got %d", notifications.TimeoutSeconds)
+	}
+
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+	return nil
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,399 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidate_Defaults(t *testing.T) {
+	if err := Validate(DefaultConfig(), nil, nil); err != nil {
+		t.Fatalf("Expected default config to be valid, got %v", err)
+	}
+}
+
+func TestValidate_ReportsAllProblems(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Port = -1
+	cfg.MetricsPath = "metrics"
+	cfg.TimeoutSeconds = 0
+	cfg.LogLevel = "verbose"
+	cfg.ListenAddresses = []string{"127.0.0.1:9100", "nonsense"}
+	cfg.Exposition.ErrorHandling = "ignore"
+	cfg.Events.ReplayBufferSize = -5
+
+	err := Validate(cfg, nil, nil)
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("Expected *ValidationError, got %v", err)
+	}
+
+	wantKeys := []string{
+		"port", "listen_addresses", "metrics_path", "timeout_seconds",
+		"log_level", "exposition.error_handling", "events.replay_buffer_size",
+	}
+	if len(validationErr.Problems) != len(wantKeys) {
+		t.Fatalf("Expected %d problems, got %d: %v", len(wantKeys), len(validationErr.Problems), err)
+	}
+	for i, key := range wantKeys {
+		if validationErr.Problems[i].Key != key {
+			t.Errorf("Problem %d: expected key %s, got %s", i, key, validationErr.Problems[i].Key)
+		}
+	}
+}
+
+func TestValidate_ExporterPathMustDiffer(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Exposition.ExporterMetricsPath = cfg.MetricsPath
+
+	if err := Validate(cfg, nil, nil); err == nil {
+		t.Fatal("Expected error when exporter metrics path equals metrics path")
+	}
+}
+
+func TestLoad_ValidationLineNumbers(t *testing.T) {
+	configContent := `port: -1
+metrics_path: metrics
+timeout_seconds: 0
+`
+	tempFile := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(tempFile, []byte(configContent), 0644); err != nil {
+		t.Fatalf("Failed to create test config file: %v", err)
+	}
+
+	_, err := Load(LoadOptions{Path: tempFile, LookupEnv: lookupFrom(nil)})
+	if err == nil {
+		t.Fatal("Expected validation error")
+	}
+
+	for _, want := range []string{"line 1: port", "line 2: metrics_path", "line 3: timeout_seconds"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q in error, got:\n%v", want, err)
+		}
+	}
+}
+
+func TestLoad_ValidationNamesEnvSource(t *testing.T) {
+	_, err := Load(LoadOptions{LookupEnv: lookupFrom(map[string]string{
+		"MULTIPASS_EXPORTER_TIMEOUT_SECONDS": "0",
+	})})
+	if err == nil {
+		t.Fatal("Expected validation error")
+	}
+	if !strings.Contains(err.Error(), "MULTIPASS_EXPORTER_TIMEOUT_SECONDS") {
+		t.Errorf("Expected error to name the environment variable, got %v", err)
+	}
+}
+
+func TestLoad_UnknownField(t *testing.T) {
+	configContent := `port: 9090
+metric_path: /typo
+exposition:
+  go_colector: false
+`
+	tempFile := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(tempFile, []byte(configContent), 0644); err != nil {
+		t.Fatalf("Failed to create test config file: %v", err)
+	}
+
+	_, err := Load(LoadOptions{Path: tempFile, LookupEnv: lookupFrom(nil)})
+	if err == nil {
+		t.Fatal("Expected error for unknown fields")
+	}
+	for _, want := range []string{"line 2", "metric_path", "line 4", "go_colector"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q in error, got:\n%v", want, err)
+		}
+	}
+}
+
+func TestLoad_RequiredMissingFile(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.yaml")
+
+	if _, err := Load(LoadOptions{Path: missing, LookupEnv: lookupFrom(nil)}); err != nil {
+		t.Errorf("Expected missing optional file to fall back to defaults, got %v", err)
+	}
+
+	if _, err := Load(LoadOptions{Path: missing, Required: true, LookupEnv: lookupFrom(nil)}); err == nil {
+		t.Error("Expected error for missing required file")
+	}
+}
+
+func TestValidate_InstancePatterns(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Instances.Include = []string{"ci-*", "/^dev-[0-9]+$/"}
+	if err := Validate(cfg, nil, nil); err != nil {
+		t.Fatalf("Expected valid patterns, got %v", err)
+	}
+
+	cfg.Instances.Exclude = []string{"/(unclosed/"}
+	cfg.Instances.States = []string{"[Running"}
+	err := Validate(cfg, nil, nil)
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || len(validationErr.Problems) != 2 {
+		t.Fatalf("Expected 2 pattern problems, got %v", err)
+	}
+}
+
+func TestValidate_Labels(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Labels.Constant = map[string]string{"host": "lab-1", "site": "madrid"}
+	cfg.Labels.Rules = []string{`(?P<team>[a-z]+)-(?P<purpose>.*)`}
+	if err := Validate(cfg, nil, nil); err != nil {
+		t.Fatalf("Expected valid labels, got %v", err)
+	}
+
+	cfg.Labels.Constant = map[string]string{"release": "x", "team": "y"}
+	cfg.Labels.Rules = []string{`(?P<team>[a-z]+)-.*`, `no-groups`}
+	err := Validate(cfg, nil, nil)
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || len(validationErr.Problems) != 3 {
+		t.Fatalf("Expected 3 label problems, got %v", err)
+	}
+}
+
+func TestValidate_NamespaceAndSchema(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Namespace = "lab_multipass"
+	cfg.MetricsSchema = "both"
+	if err := Validate(cfg, nil, nil); err != nil {
+		t.Fatalf("Expected valid namespace and schema, got %v", err)
+	}
+
+	cfg.Namespace = "9-multipass"
+	cfg.MetricsSchema = "v3"
+	err := Validate(cfg, nil, nil)
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || len(validationErr.Problems) != 2 {
+		t.Fatalf("Expected 2 problems, got %v", err)
+	}
+}
+
+func TestValidate_Multipass(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Multipass.Binary = "/snap/bin/multipass"
+	cfg.Multipass.Env = map[string]string{"MULTIPASS_SERVER_ADDRESS": "unix:/var/snap/multipass/common/multipass_socket"}
+	cfg.Multipass.WorkDir = t.TempDir()
+	if err := Validate(cfg, nil, nil); err != nil {
+		t.Fatalf("Expected valid multipass settings, got %v", err)
+	}
+
+	cfg.Multipass.Binary = ""
+	cfg.Multipass.Env = map[string]string{"BAD=NAME": "x"}
+	cfg.Multipass.WorkDir = filepath.Join(t.TempDir(), "missing")
+	err := Validate(cfg, nil, nil)
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || len(validationErr.Problems) != 3 {
+		t.Fatalf("Expected 3 problems, got %v", err)
+	}
+}
+
+func TestValidate_Logging(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.LogFormat = "json"
+	cfg.LogOutput = "file"
+	cfg.LogFile.Path = "/var/log/multipass-exporter.log"
+	if err := Validate(cfg, nil, nil); err != nil {
+		t.Fatalf("Expected valid logging settings, got %v", err)
+	}
+
+	cfg.LogFormat = "xml"
+	cfg.LogOutput = "file"
+	cfg.LogFile.Path = ""
+	cfg.LogFile.MaxBackups = -1
+	err := Validate(cfg, nil, nil)
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || len(validationErr.Problems) != 3 {
+		t.Fatalf("Expected 3 problems, got %v", err)
+	}
+}
+
+func TestValidate_Push(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Push.URL = "https://pushgateway.example.com:9091"
+	cfg.Push.Grouping = map[string]string{"instance": "laptop-1", "site": "madrid"}
+	cfg.Push.Username = "laptop-1"
+	cfg.Push.PasswordFile = "/etc/multipass-exporter/push-password"
+	if err := Validate(cfg, nil, nil); err != nil {
+		t.Fatalf("Expected valid push settings, got %v", err)
+	}
+
+	cfg.Push.URL = "pushgateway:9091"
+	cfg.Push.Grouping = map[string]string{"job": "other"}
+	cfg.Push.Username = ""
+	cfg.Push.IntervalSeconds = 0
+	cfg.Push.MaxRetries = -1
+	err := Validate(cfg, nil, nil)
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || len(validationErr.Problems) != 5 {
+		t.Fatalf("Expected 5 problems, got %v", err)
+	}
+}
+
+func TestValidate_RemoteWrite(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RemoteWrite.URL = "https://mimir.example.com/api/v1/push"
+	cfg.RemoteWrite.ExternalLabels = map[string]string{"site": "madrid"}
+	if err := Validate(cfg, nil, nil); err != nil {
+		t.Fatalf("Expected valid remote-write settings, got %v", err)
+	}
+
+	cfg.RemoteWrite.URL = "mimir/api/v1/push"
+	cfg.RemoteWrite.IntervalSeconds = 0
+	cfg.RemoteWrite.PasswordFile = "/etc/multipass-exporter/mimir-password"
+	cfg.RemoteWrite.ExternalLabels = map[string]string{"__name__": "x"}
+	err := Validate(cfg, nil, nil)
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || len(validationErr.Problems) != 4 {
+		t.Fatalf("Expected 4 problems, got %v", err)
+	}
+}
+
+func TestValidate_OTLP(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.OTLP.Endpoint = "otel-collector:4317"
+	if err := Validate(cfg, nil, nil); err != nil {
+		t.Fatalf("Expected valid OTLP settings, got %v", err)
+	}
+
+	cfg.OTLP.Protocol = "http/protobuf"
+	cfg.OTLP.IntervalSeconds = 0
+	err := Validate(cfg, nil, nil)
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || len(validationErr.Problems) != 2 {
+		t.Fatalf("Expected 2 problems, got %v", err)
+	}
+
+	cfg = DefaultConfig()
+	cfg.OTLP.Protocol = "http/json"
+	if err := Validate(cfg, nil, nil); err == nil {
+		t.Error("Expected unsupported protocol to be rejected")
+	}
+
+	cfg = DefaultConfig()
+	cfg.OTLP.ResourceAttributes = map[string]string{"host.name": "lab", "deployment.environment": "dev"}
+	if err := Validate(cfg, nil, nil); err == nil || !strings.Contains(err.Error(), "otlp.resource_attributes") {
+		t.Errorf("Expected host.name to be rejected as a resource attribute, got %v", err)
+	}
+}
+
+func TestValidate_ServiceDiscovery(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ServiceDiscovery.Path = "/metrics"
+	cfg.ServiceDiscovery.Ports = []int{9100, 0}
+	err := Validate(cfg, nil, nil)
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || len(validationErr.Problems) != 2 {
+		t.Fatalf("Expected 2 problems, got %v", err)
+	}
+
+	cfg = DefaultConfig()
+	cfg.ServiceDiscovery.Path = ""
+	if err := Validate(cfg, nil, nil); err != nil {
+		t.Errorf("Expected disabled service discovery to be valid, got %v", err)
+	}
+
+	for _, path := range []string{"/api/v1/", "/api/v1/events", "/simulator/faults"} {
+		cfg = DefaultConfig()
+		cfg.ServiceDiscovery.Path = path
+		if err := Validate(cfg, nil, nil); err == nil || !strings.Contains(err.Error(), "service_discovery.path") {
+			t.Errorf("Expected the server route %s to be rejected, got %v", path, err)
+		}
+	}
+	cfg = DefaultConfig()
+	cfg.Exposition.ExporterMetricsPath = "/api/v1/metrics"
+	if err := Validate(cfg, nil, nil); err == nil || !strings.Contains(err.Error(), "exposition.exporter_metrics_path") {
+		t.Errorf("Expected a path under the API to be rejected, got %v", err)
+	}
+}
+
+func TestValidate_ReplayDir(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ReplayDir = t.TempDir()
+	if err := Validate(cfg, nil, nil); err != nil {
+		t.Fatalf("Expected an existing replay directory to be valid, got %v", err)
+	}
+
+	cfg.RecordDir = t.TempDir()
+	if err := Validate(cfg, nil, nil); err == nil || !strings.Contains(err.Error(), "cannot be combined with record_dir") {
+		t.Errorf("Expected recording while replaying to be rejected, got %v", err)
+	}
+
+	cfg.RecordDir = ""
+	cfg.ReplayDir = filepath.Join(cfg.ReplayDir, "missing")
+	if err := Validate(cfg, nil, nil); err == nil || !strings.Contains(err.Error(), "replay_dir") {
+		t.Errorf("Expected a missing replay directory to be rejected, got %v", err)
+	}
+}
+
+func TestValidate_Simulator(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Simulate = 500
+	cfg.Simulator.States = map[string]float64{"Running": 0.9, "Stopped": 0.1}
+	cfg.Simulator.Faults = SimulatorFaults{SlowRate: 0.05, SlowSeconds: 10, MalformedRate: 0.01, DaemonErrorRate: 0.01}
+	if err := Validate(cfg, nil, nil); err != nil {
+		t.Fatalf("Expected valid simulator settings, got %v", err)
+	}
+
+	cfg.ReplayDir = t.TempDir()
+	cfg.Simulator.CPUs = []int{0}
+	cfg.Simulator.Disks = []map[string]int{{}}
+	cfg.Simulator.Faults.SlowRate = 0.99
+	err := Validate(cfg, nil, nil)
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || len(validationErr.Problems) != 4 {
+		t.Fatalf("Expected 4 problems, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "cannot be combined with replay_dir") || !strings.Contains(err.Error(), "add up to more than 1") {
+		t.Errorf("Expected the replay conflict and the fault rates to be reported, got %v", err)
+	}
+
+	cfg = DefaultConfig()
+	cfg.Simulator.States = map[string]float64{"Running": 0}
+	if err := Validate(cfg, nil, nil); err == nil || !strings.Contains(err.Error(), "weights must not all be 0") {
+		t.Errorf("Expected zero state weights to be rejected, got %v", err)
+	}
+}
+
+func TestValidate_Notifications(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Notifications.Rules = []NotificationRule{{Name: "disk_full", Metric: "disk_usage", Threshold: 0.9, ResolveThreshold: 0.85}}
+	cfg.Notifications.Webhooks = []WebhookConfig{{URL: "https://hooks.slack.com/services/T0/B0/X", Body: `{"text": {{ .Summary | json }}}`}}
+	if err := Validate(cfg, nil, nil); err != nil {
+		t.Fatalf("Expected valid notification settings, got %v", err)
+	}
+
+	cfg.Notifications.Rules = append(cfg.Notifications.Rules,
+		NotificationRule{Name: "disk_full", Metric: "cpu_usage", Threshold: 0.5, ResolveThreshold: 0.6})
+	cfg.Notifications.Webhooks = []WebhookConfig{{URL: "hooks.slack.com", Body: "{{ .Summary"}}
+	err := Validate(cfg, nil, nil)
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || len(validationErr.Problems) != 5 {
+		t.Fatalf("Expected 5 problems, got %v", err)
+	}
+
+	cfg.Notifications.Webhooks = nil
+	cfg.Notifications.Rules = cfg.Notifications.Rules[:1]
+	if err := Validate(cfg, nil, nil); err == nil || !strings.Contains(err.Error(), "notifications.webhooks") {
+		t.Errorf("Expected rules without webhooks to be rejected, got %v", err)
+	}
+}
+
+func TestValidate_FileSD(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.FileSD.Path = "/etc/prometheus/targets/multipass.yml"
+	cfg.FileSD.Labels = map[string]string{"release": "{{ .Release }}"}
+	if err := Validate(cfg, nil, nil); err != nil {
+		t.Fatalf("Expected valid file_sd settings, got %v", err)
+	}
+
+	cfg.FileSD.Path = "/etc/prometheus/targets/multipass.txt"
+	cfg.FileSD.Labels = map[string]string{"release": "{{ .Release"}
+	err := Validate(cfg, nil, nil)
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || len(validationErr.Problems) != 2 {
+		t.Fatalf("Expected 2 problems, got %v", err)
+	}
+}
@@ -0,0 +1,280 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Abuelodelanada/multipass-exporter/internal/collector"
+)
+
+// Event types sent on the stream
+const (
+	InstanceAdded   = "instance_added"
+	InstanceRemoved = "instance_removed"
+	StateChanged    = "state_changed"
+	IPv4Changed     = "ipv4_changed"
+)
+
+// subscriberBuffer is how many events a slow client may lag behind before
+// it is disconnected; it can then reconnect and catch up from the replay buffer
+const subscriberBuffer = 64
+
+// InfoSource provides the parsed output of `multipass info`
+type InfoSource interface {
+	Info() (collector.MultipassInfoResponse, error)
+}
+
+// Event describes a change between two consecutive `multipass info` refreshes
+type Event struct {
+	ID            uint64    `json:"id"`
+	Type          string    `json:"type"`
+	Instance      string    `json:"instance"`
+	Time          time.Time `json:"time"`
+	State         string    `json:"state,omitempty"`
+	PreviousState string    `json:"previous_state,omitempty"`
+	IPv4          []string  `json:"ipv4,omitempty"`
+	PreviousIPv4  []string  `json:"previous_ipv4,omitempty"`
+}
+
+// Broker turns `multipass info` refreshes into instance change events and
+// streams them to Server-Sent Events clients
+type Broker struct {
+	mu          sync.Mutex
+	previous    map[string]collector.MultipassInfoOutput
+	nextID      uint64
+	replay      []Event
+	replaySize  int
+	subscribers map[chan Event]struct{}
+
+	// KeepAlive is the interval between comment lines sent to idle clients
+	KeepAlive time.Duration
+	now       func() time.Time
+}
+
+// NewBroker creates a broker keeping the last replaySize events for
+// clients reconnecting with Last-Event-ID
+func NewBroker(replaySize int) *Broker {
+	return &Broker{
+		nextID:      1,
+		replaySize:  replaySize,
+		subscribers: make(map[chan Event]struct{}),
+		KeepAlive:   30 * time.Second,
+		now:         time.Now,
+	}
+}
+
+// Observe compares a refresh with the previous one and publishes an event
+// for every change. The first refresh only records the baseline.
+func (b *Broker) Observe(data collector.MultipassInfoResponse) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	current := make(map[string]collector.MultipassInfoOutput, len(data.Info))
+	for name, info := range data.Info {
+		current[name] = info
+	}
+
+	if b.previous == nil {
+		b.previous = current
+		return
+	}
+
+	for _, event := range diff(b.previous, current) {
+		b.publish(event)
+	}
+	b.previous = current
+}
+
+// diff returns the changes from previous to current, ordered by instance name
+func diff(previous, current map[string]collector.MultipassInfoOutput) []Event {
+	var changes []Event
+
+	for name, info := range current {
+		before, existed := previous[name]
+		if !existed {
+			changes = append(changes, Event{Type: InstanceAdded, Instance: name, State: info.State, IPv4: info.IPv4})
+			continue
+		}
+		if before.State != info.State {
+			changes = append(changes, Event{
+				Type: StateChanged, Instance: name,
+				State: info.State, PreviousState: before.State,
+			})
+		}
+		if !equalStrings(before.IPv4, info.IPv4) {
+			changes = append(changes, Event{
+				Type: IPv4Changed, Instance: name,
+				IPv4: info.IPv4, PreviousIPv4: before.IPv4,
+			})
+		}
+	}
+
+	for name, info := range previous {
+		if _, exists := current[name]; !exists {
+			changes = append(changes, Event{Type: InstanceRemoved, Instance: name, PreviousState: info.State, PreviousIPv4: info.IPv4})
+		}
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Instance < changes[j].Instance
+	})
+	return changes
+}
+
+// publish assigns an ID, stores the event for replay and fans it out.
+// Callers must hold b.mu.
+func (b *Broker) publish(event Event) {
+	event.ID = b.nextID
+	event.Time = b.now()
+	b.nextID++
+
+	if b.replaySize > 0 {
+		if len(b.replay) >= b.replaySize {
+			b.replay = b.replay[1:]
+		}
+		b.replay = append(b.replay, event)
+	}
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// Client is too slow; drop it so it reconnects and replays
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe registers a client and returns the buffered events after lastID
+func (b *Broker) subscribe(lastID uint64, hasLastID bool) ([]Event, chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var missed []Event
+	// IDs at or beyond nextID come from before a restart and cannot be replayed
+	if hasLastID && lastID < b.nextID {
+		for _, event := range b.replay {
+			if event.ID > lastID {
+				missed = append(missed, event)
+			}
+		}
+	}
+
+	ch := make(chan Event, subscriberBuffer)
+	b.subscribers[ch] = struct{}{}
+	return missed, ch
+}
+
+func (b *Broker) unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Run refreshes `multipass info` every interval until ctx is done. Refreshes
+// reach the broker through the collector's info observers.
+func (b *Broker) Run(ctx context.Context, source InfoSource, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// Errors are already logged by the collector
+			source.Info()
+		}
+	}
+}
+
+// ServeHTTP streams events as Server-Sent Events
+func (b *Broker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	var lastID uint64
+	lastEventID := r.Header.Get("Last-Event-ID")
+	hasLastID := lastEventID != ""
+	if hasLastID {
+		parsed, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid Last-Event-ID %q", lastEventID), http.StatusBadRequest)
+			return
+		}
+		lastID = parsed
+	}
+
+	missed, ch := b.subscribe(lastID, hasLastID)
+	defer b.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	for _, event := range missed {
+		if err := writeEvent(w, event); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(b.KeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, open := <-ch:
+			if !open {
+				return
+			}
+			if err := writeEvent(w, event); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,224 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Abuelodelanada/multipass-exporter/internal/collector"
+)
+
+func snapshot(instances ...collector.MultipassInfoOutput) collector.MultipassInfoResponse {
+	data := collector.MultipassInfoResponse{Info: make(map[string]collector.MultipassInfoOutput)}
+	for _, instance := range instances {
+		data.Info[instance.Name] = instance
+	}
+	return data
+}
+
+func TestObserve_FirstRefreshIsBaseline(t *testing.T) {
+	broker := NewBroker(10)
+	broker.Observe(snapshot(collector.MultipassInfoOutput{Name: "dev", State: "Running"}))
+
+	if len(broker.replay) != 0 {
+		t.Errorf("Expected no events for the first refresh, got %d", len(broker.replay))
+	}
+}
+
+func TestObserve_DetectsChanges(t *testing.T) {
+	broker := NewBroker(10)
+	broker.Observe(snapshot(
+		collector.MultipassInfoOutput{Name: "charm-dev-36", State: "Running", IPv4: []string{"10.0.0.2"}},
+		collector.MultipassInfoOutput{Name: "coslite", State: "Running"},
+		collector.MultipassInfoOutput{Name: "old", State: "Stopped"},
+	))
+	broker.Observe(snapshot(
+		collector.MultipassInfoOutput{Name: "charm-dev-36", State: "Stopped", IPv4: []string{}},
+		collector.MultipassInfoOutput{Name: "coslite", State: "Running"},
+		collector.MultipassInfoOutput{Name: "new", State: "Starting"},
+	))
+
+	want := []struct {
+		eventType string
+		instance  string
+	}{
+		{StateChanged, "charm-dev-36"},
+		{IPv4Changed, "charm-dev-36"},
+		{InstanceAdded, "new"},
+		{InstanceRemoved, "old"},
+	}
+
+	if len(broker.replay) != len(want) {
+		t.Fatalf("Expected %d events, got %d: %+v", len(want), len(broker.replay), broker.replay)
+	}
+	for i, w := range want {
+		event := broker.replay[i]
+		if event.Type != w.eventType || event.Instance != w.instance {
+			t.Errorf("Event %d: expected %s for %s, got %s for %s", i, w.eventType, w.instance, event.Type, event.Instance)
+		}
+		if event.ID != uint64(i+1) {
+			t.Errorf("Event %d: expected ID %d, got %d", i, i+1, event.ID)
+		}
+	}
+
+	stateChange := broker.replay[0]
+	if stateChange.State != "Stopped" || stateChange.PreviousState != "Running" {
+		t.Errorf("Expected Running -> Stopped, got %s -> %s", stateChange.PreviousState, stateChange.State)
+	}
+}
+
+func TestObserve_ReplayBufferIsBounded(t *testing.T) {
+	broker := NewBroker(2)
+	states := []string{"Running", "Stopped", "Running", "Stopped", "Running"}
+	for _, state := range states {
+		broker.Observe(snapshot(collector.MultipassInfoOutput{Name: "dev", State: state}))
+	}
+
+	if len(broker.replay) != 2 {
+		t.Fatalf("Expected replay buffer of 2, got %d", len(broker.replay))
+	}
+	if broker.replay[0].ID != 3 || broker.replay[1].ID != 4 {
+		t.Errorf("Expected the two most recent events (3, 4), got %d, %d", broker.replay[0].ID, broker.replay[1].ID)
+	}
+}
+
+func TestSubscribe_Replay(t *testing.T) {
+	broker := NewBroker(10)
+	for _, state := range []string{"Running", "Stopped", "Running", "Stopped"} {
+		broker.Observe(snapshot(collector.MultipassInfoOutput{Name: "dev", State: state}))
+	}
+
+	missed, ch := broker.subscribe(1, true)
+	defer broker.unsubscribe(ch)
+	if len(missed) != 2 || missed[0].ID != 2 {
+		t.Errorf("Expected events 2 and 3 to be replayed, got %+v", missed)
+	}
+
+	missed, ch2 := broker.subscribe(0, false)
+	defer broker.unsubscribe(ch2)
+	if len(missed) != 0 {
+		t.Errorf("Expected no replay without Last-Event-ID, got %d", len(missed))
+	}
+
+	// An ID from before a restart cannot be matched
+	missed, ch3 := broker.subscribe(500, true)
+	defer broker.unsubscribe(ch3)
+	if len(missed) != 0 {
+		t.Errorf("Expected no replay for an unknown ID, got %d", len(missed))
+	}
+}
+
+// readEvent reads one SSE event, skipping keep-alive comments
+func readEvent(t *testing.T, reader *bufio.Reader) (string, Event) {
+	t.Helper()
+	var id, data string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read event stream: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		case line == "" && data != "":
+			var event Event
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				t.Fatalf("Failed to decode event data: %v", err)
+			}
+			return id, event
+		}
+	}
+}
+
+func TestServeHTTP_StreamsAndReplays(t *testing.T) {
+	broker := NewBroker(10)
+	broker.Observe(snapshot(collector.MultipassInfoOutput{Name: "charm-dev-36", State: "Running"}))
+	broker.Observe(snapshot(collector.MultipassInfoOutput{Name: "charm-dev-36", State: "Stopped"}))
+
+	server := httptest.NewServer(broker)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	req.Header.Set("Last-Event-ID", "0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Expected text/event-stream, got %q", resp.Header.Get("Content-Type"))
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	id, event := readEvent(t, reader)
+	if id != "1" || event.Type != StateChanged || event.State != "Stopped" {
+		t.Errorf("Expected replayed event 1 (state_changed to Stopped), got %s %+v", id, event)
+	}
+
+	broker.Observe(snapshot())
+	id, event = readEvent(t, reader)
+	if id != "2" || event.Type != InstanceRemoved || event.Instance != "charm-dev-36" {
+		t.Errorf("Expected live event 2 (instance_removed), got %s %+v", id, event)
+	}
+}
+
+func TestServeHTTP_InvalidLastEventID(t *testing.T) {
+	broker := NewBroker(10)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/events", nil)
+	req.Header.Set("Last-Event-ID", "abc")
+	rec := httptest.NewRecorder()
+	broker.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", rec.Code)
+	}
+}
+
+type countingSource struct {
+	calls chan struct{}
+}
+
+func (s *countingSource) Info() (collector.MultipassInfoResponse, error) {
+	s.calls <- struct{}{}
+	return collector.MultipassInfoResponse{}, nil
+}
+
+func TestRun_RefreshesUntilCancelled(t *testing.T) {
+	broker := NewBroker(10)
+	source := &countingSource{calls: make(chan struct{}, 10)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		broker.Run(ctx, source, 5*time.Millisecond)
+		close(done)
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-source.calls:
+		case <-time.After(time.Second):
+			t.Fatal("Expected periodic refreshes")
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected Run to return after cancel")
+	}
+}
@@ -0,0 +1,169 @@
+package labels
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3" //nolint:typecheck
+)
+
+// Reserved are the labels the collector already sets on instance metrics
+var Reserved = []string{"name", "release", "disk", "state"}
+
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Mapping assigns a label set to instance names
+type Mapping map[string]map[string]string
+
+// Labeler derives extra labels for an instance from its name, using regex
+// rules with named capture groups and an explicit name-to-labels mapping
+type Labeler struct {
+	rules   []*regexp.Regexp
+	mapping Mapping
+	names   []string
+}
+
+// ValidateName checks that name is a usable, non-reserved label name
+func ValidateName(name string) error {
+	if !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__") {
+		return fmt.Errorf("invalid label name %q", name)
+	}
+	for _, reserved := range Reserved {
+		if name == reserved {
+			return fmt.Errorf("label name %q is reserved", name)
+		}
+	}
+	return nil
+}
+
+// ValidateConstant checks the names of constant labels
+func ValidateConstant(constant map[string]string) error {
+	for name := range constant {
+		if err := ValidateName(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CompileRule parses a rule. Rules match the whole instance name and must
+// have at least one named capture group, such as
+// (?P<team>[a-z]+)-(?P<purpose>.*).
+func CompileRule(rule string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile("^(?:" + rule + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid label rule %q: %w", rule, err)
+	}
+
+	named := 0
+	for _, name := range re.SubexpNames() {
+		if name == "" {
+			continue
+		}
+		if err := ValidateName(name); err != nil {
+			return nil, fmt.Errorf("label rule %q: %w", rule, err)
+		}
+		named++
+	}
+	if named == 0 {
+		return nil, fmt.Errorf("label rule %q has no named capture groups", rule)
+	}
+	return re, nil
+}
+
+// New compiles the rules and combines their label names with the mapping's
+func New(rules []string, mapping Mapping) (*Labeler, error) {
+	l := &Labeler{mapping: mapping}
+	seen := make(map[string]bool)
+
+	for _, rule := range rules {
+		re, err := CompileRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		l.rules = append(l.rules, re)
+		for _, name := range re.SubexpNames() {
+			if name != "" {
+				seen[name] = true
+			}
+		}
+	}
+
+	for instance, set := range mapping {
+		for name := range set {
+			if err := ValidateName(name); err != nil {
+				return nil, fmt.Errorf("mapping for %q: %w", instance, err)
+			}
+			seen[name] = true
+		}
+	}
+
+	for name := range seen {
+		l.names = append(l.names, name)
+	}
+	sort.Strings(l.names)
+	return l, nil
+}
+
+// LoadMapping reads a YAML (or JSON) file mapping instance names to label sets:
+//
+//	charm-dev-36:
+//	  team: observability
+//	  owner: jose
+func LoadMapping(path string) (Mapping, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading label mapping: %w", err)
+	}
+
+	mapping := make(Mapping)
+	if err := yaml.Unmarshal(data, &mapping); err != nil { //nolint:typecheck
+		return nil, fmt.Errorf("error parsing label mapping %s: %w", path, err)
+	}
+	return mapping, nil
+}
+
+// Names returns the extra label names in sorted order
+func (l *Labeler) Names() []string {
+	if l == nil {
+		return nil
+	}
+	return l.names
+}
+
+// Values returns the label values for an instance in Names order. Earlier
+// rules take precedence over later ones and the mapping over all rules;
+// labels nothing provides are empty.
+func (l *Labeler) Values(instance string) []string {
+	if l == nil || len(l.names) == 0 {
+		return nil
+	}
+
+	found := make(map[string]string, len(l.names))
+	for _, re := range l.rules {
+		match := re.FindStringSubmatch(instance)
+		if match == nil {
+			continue
+		}
+		for i, name := range re.SubexpNames() {
+			if name == "" || match[i] == "" {
+				continue
+			}
+			if _, ok := found[name]; !ok {
+				found[name] = match[i]
+			}
+		}
+	}
+	for name, value := range l.mapping[instance] {
+		found[name] = value
+	}
+
+	values := make([]string, len(l.names))
+	for i, name := range l.names {
+		values[i] = found[name]
+	}
+	return values
+}
@@ -0,0 +1,116 @@
+package labels
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLabeler_Rules(t *testing.T) {
+	labeler, err := New([]string{`(?P<team>[a-z]+)-(?P<purpose>.*)`}, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if names := labeler.Names(); !reflect.DeepEqual(names, []string{"purpose", "team"}) {
+		t.Errorf("Expected names [purpose team], got %v", names)
+	}
+
+	if values := labeler.Values("charm-dev-36"); !reflect.DeepEqual(values, []string{"dev-36", "charm"}) {
+		t.Errorf("Expected [dev-36 charm], got %v", values)
+	}
+
+	// The rule is anchored, so a name it cannot fully match gets empty labels
+	if values := labeler.Values("UPPER"); !reflect.DeepEqual(values, []string{"", ""}) {
+		t.Errorf("Expected empty labels, got %v", values)
+	}
+}
+
+func TestLabeler_RulePrecedenceAndMapping(t *testing.T) {
+	mapping := Mapping{
+		"charm-dev-36": {"team": "observability", "owner": "jose"},
+	}
+	labeler, err := New([]string{
+		`ci-(?P<purpose>.*)`,
+		`(?P<team>[a-z]+)-(?P<purpose>.*)`,
+	}, mapping)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if names := labeler.Names(); !reflect.DeepEqual(names, []string{"owner", "purpose", "team"}) {
+		t.Fatalf("Expected names [owner purpose team], got %v", names)
+	}
+
+	tests := []struct {
+		instance string
+		want     []string
+	}{
+		{"ci-build-7", []string{"", "build-7", "ci"}},
+		{"charm-dev-36", []string{"jose", "dev-36", "observability"}},
+		{"standalone", []string{"", "", ""}},
+	}
+	for _, tt := range tests {
+		if values := labeler.Values(tt.instance); !reflect.DeepEqual(values, tt.want) {
+			t.Errorf("Values(%s) = %v, expected %v", tt.instance, values, tt.want)
+		}
+	}
+}
+
+func TestNew_InvalidRules(t *testing.T) {
+	for _, rule := range []string{
+		`(?P<team>[a-z]+`,
+		`[a-z]+-.*`,
+		`(?P<name>.*)`,
+		`(?P<__meta>.*)`,
+	} {
+		if _, err := New([]string{rule}, nil); err == nil {
+			t.Errorf("Expected error for rule %q", rule)
+		}
+	}
+}
+
+func TestNew_InvalidMappingLabel(t *testing.T) {
+	if _, err := New(nil, Mapping{"dev": {"release": "x"}}); err == nil {
+		t.Fatal("Expected error for reserved label in mapping")
+	}
+}
+
+func TestValidateConstant(t *testing.T) {
+	if err := ValidateConstant(map[string]string{"host": "a", "site": "b"}); err != nil {
+		t.Errorf("Expected valid constant labels, got %v", err)
+	}
+	if err := ValidateConstant(map[string]string{"disk": "a"}); err == nil {
+		t.Error("Expected error for reserved constant label")
+	}
+	if err := ValidateConstant(map[string]string{"bad-name": "a"}); err == nil {
+		t.Error("Expected error for invalid constant label name")
+	}
+}
+
+func TestLoadMapping(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "labels.yaml")
+	content := `
+charm-dev-36:
+  team: observability
+coslite:
+  team: cos
+  owner: jose
+`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write mapping: %v", err)
+	}
+
+	mapping, err := LoadMapping(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if mapping["coslite"]["owner"] != "jose" {
+		t.Errorf("Expected owner jose for coslite, got %v", mapping["coslite"])
+	}
+
+	if _, err := LoadMapping(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("Expected error for missing mapping file")
+	}
+}
@@ -0,0 +1,155 @@
+package listener
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// unixPrefix marks a listen address as a unix domain socket path
+const unixPrefix = "unix:"
+
+// systemdFirstFD is the first file descriptor passed by systemd (SD_LISTEN_FDS_START)
+const systemdFirstFD = 3
+
+// ParseAddress splits a listen address into a network and an address
+// suitable for net.Listen. Supported forms are "host:port", "[ipv6]:port",
+// ":port" and "unix:/path/to/socket".
+func ParseAddress(addr string) (string, string, error) {
+	if strings.HasPrefix(addr, unixPrefix) {
+		path := strings.TrimPrefix(addr, unixPrefix)
+		if path == "" {
+			return "", "", fmt.Errorf("invalid listen address %q: empty unix socket path", addr)
+		}
+		return "unix", path, nil
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+
+	portNumber, err := strconv.Atoi(port)
+	if err != nil || portNumber < 0 || portNumber > 65535 {
+		return "", "", fmt.Errorf("invalid listen address %q: invalid port %q", addr, port)
+	}
+
+	// Bracketed hosts must be IPv6 literals, optionally with a zone
+	ipHost, _, _ := strings.Cut(host, "%")
+	if strings.HasPrefix(addr, "[") && net.ParseIP(ipHost) == nil {
+		return "", "", fmt.Errorf("invalid listen address %q: invalid IPv6 host %q", addr, host)
+	}
+
+	return "tcp", net.JoinHostPort(host, port), nil
+}
+
+// Listen opens a listener for every address. Stale unix sockets left over
+// from a previous run are removed before binding. If any address fails,
+// listeners opened so far are closed.
+func Listen(addrs []string) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(addrs))
+
+	for _, addr := range addrs {
+		network, address, err := ParseAddress(addr)
+		if err != nil {
+			closeAll(listeners)
+			return nil, err
+		}
+
+		if network == "unix" {
+			if err := removeStaleSocket(address); err != nil {
+				closeAll(listeners)
+				return nil, err
+			}
+		}
+
+		l, err := net.Listen(network, address)
+		if err != nil {
+			closeAll(listeners)
+			return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
+
+// SystemdListeners returns the sockets passed by systemd socket activation.
+// It returns nil when LISTEN_FDS is not set or is addressed to another process.
+// The LISTEN_* variables are unset so child processes do not inherit them.
+func SystemdListeners() ([]net.Listener, error) {
+	pid := os.Getenv("LISTEN_PID")
+	fds := os.Getenv("LISTEN_FDS")
+	if fds == "" {
+		return nil, nil
+	}
+
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(fds)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS value %q", fds)
+	}
+
+	listeners := make([]net.Listener, 0, count)
+	for fd := systemdFirstFD; fd < systemdFirstFD+count; fd++ {
+		syscall.CloseOnExec(fd)
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			closeAll(listeners)
+			return nil, fmt.Errorf("file descriptor %d is not a listening socket: %w", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
+
+// removeStaleSocket removes a unix socket left behind by a process that no
+// longer listens on it. A socket that still accepts connections belongs to a
+// running process, so it is reported as in use rather than taken over.
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat unix socket %s: %w", path, err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("refusing to replace %s: not a unix socket", path)
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("unix socket %s: address already in use", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("failed to check unix socket %s: %w", path, err)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove stale unix socket %s: %w", path, err)
+	}
+	return nil
+}
+
+func closeAll(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
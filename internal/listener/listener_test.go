@@ -0,0 +1,175 @@
+package listener
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		addr        string
+		wantNetwork string
+		wantAddress string
+		wantErr     bool
+	}{
+		{":1986", "tcp", ":1986", false},
+		{"127.0.0.1:1986", "tcp", "127.0.0.1:1986", false},
+		{"localhost:9100", "tcp", "localhost:9100", false},
+		{"[::1]:1986", "tcp", "[::1]:1986", false},
+		{"[fe80::1]:0", "tcp", "[fe80::1]:0", false},
+		{"unix:/run/multipass-exporter.sock", "unix", "/run/multipass-exporter.sock", false},
+		{"unix:", "", "", true},
+		{"1986", "", "", true},
+		{"127.0.0.1", "", "", true},
+		{"127.0.0.1:http", "", "", true},
+		{"127.0.0.1:70000", "", "", true},
+		{"[not-ipv6]:1986", "", "", true},
+	}
+
+	for _, tt := range tests {
+		network, address, err := ParseAddress(tt.addr)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseAddress(%q): expected error, got none", tt.addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseAddress(%q): unexpected error: %v", tt.addr, err)
+			continue
+		}
+		if network != tt.wantNetwork || address != tt.wantAddress {
+			t.Errorf("ParseAddress(%q) = (%q, %q), expected (%q, %q)",
+				tt.addr, network, address, tt.wantNetwork, tt.wantAddress)
+		}
+	}
+}
+
+func TestListen_TCPAndUnix(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "exporter.sock")
+
+	listeners, err := Listen([]string{"127.0.0.1:0", "unix:" + socketPath})
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer closeAll(listeners)
+
+	if len(listeners) != 2 {
+		t.Fatalf("Expected 2 listeners, got %d", len(listeners))
+	}
+
+	if listeners[0].Addr().Network() != "tcp" {
+		t.Errorf("Expected first listener to be tcp, got %s", listeners[0].Addr().Network())
+	}
+	if listeners[1].Addr().Network() != "unix" {
+		t.Errorf("Expected second listener to be unix, got %s", listeners[1].Addr().Network())
+	}
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to connect to unix socket: %v", err)
+	}
+	conn.Close()
+}
+
+func TestListen_ReplacesStaleSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "stale.sock")
+
+	first, err := Listen([]string{"unix:" + socketPath})
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	// Leave the socket file behind, as a crashed process would
+	first[0].(*net.UnixListener).SetUnlinkOnClose(false)
+	closeAll(first)
+
+	second, err := Listen([]string{"unix:" + socketPath})
+	if err != nil {
+		t.Fatalf("Expected stale socket to be replaced, got %v", err)
+	}
+	closeAll(second)
+}
+
+func TestListen_RefusesLiveSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "live.sock")
+
+	first, err := Listen([]string{"unix:" + socketPath})
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer closeAll(first)
+
+	if second, err := Listen([]string{"unix:" + socketPath}); err == nil || !strings.Contains(err.Error(), "address already in use") {
+		closeAll(second)
+		t.Fatalf("Expected the socket of a running listener to be in use, got %v", err)
+	}
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Expected the running listener to keep its socket, got %v", err)
+	}
+	conn.Close()
+}
+
+func TestListen_RefusesRegularFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "not-a-socket")
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	if _, err := Listen([]string{"unix:" + path}); err == nil {
+		t.Fatal("Expected error when unix path is a regular file")
+	}
+}
+
+func TestListen_InvalidAddressClosesOthers(t *testing.T) {
+	listeners, err := Listen([]string{"127.0.0.1:0", "bogus"})
+	if err == nil {
+		closeAll(listeners)
+		t.Fatal("Expected error for invalid address")
+	}
+	if listeners != nil {
+		t.Errorf("Expected no listeners on error, got %d", len(listeners))
+	}
+}
+
+func TestSystemdListeners_NotActivated(t *testing.T) {
+	t.Setenv("LISTEN_FDS", "")
+	t.Setenv("LISTEN_PID", "")
+
+	listeners, err := SystemdListeners()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if listeners != nil {
+		t.Errorf("Expected no listeners, got %d", len(listeners))
+	}
+}
+
+func TestSystemdListeners_OtherProcess(t *testing.T) {
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+
+	listeners, err := SystemdListeners()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if listeners != nil {
+		t.Errorf("Expected no listeners for another PID, got %d", len(listeners))
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("Expected LISTEN_FDS to be unset")
+	}
+}
+
+func TestSystemdListeners_InvalidCount(t *testing.T) {
+	t.Setenv("LISTEN_FDS", "abc")
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+
+	if _, err := SystemdListeners(); err == nil {
+		t.Fatal("Expected error for invalid LISTEN_FDS")
+	}
+}
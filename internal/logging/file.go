@@ -0,0 +1,111 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// FileOptions configures a log file. Once writing would grow the file past
+// MaxSizeBytes, it is renamed to Path.1, older files shift to Path.2 and so
+// on, and files beyond MaxBackups are removed. A zero MaxSizeBytes never
+// rotates.
+type FileOptions struct {
+	Path         string
+	MaxSizeBytes int64
+	MaxBackups   int
+}
+
+// RotatingFile is a log file rotated by size
+type RotatingFile struct {
+	mu   sync.Mutex
+	opts FileOptions
+	file *os.File
+	size int64
+}
+
+// OpenRotatingFile opens, or creates, the log file for appending
+func OpenRotatingFile(opts FileOptions) (*RotatingFile, error) {
+	if opts.Path == "" {
+		return nil, fmt.Errorf("log file path is empty")
+	}
+	f := &RotatingFile{opts: opts}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.opts.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("error opening log file: %w", err)
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.opts.MaxSizeBytes > 0 && f.size > 0 && f.size+int64(len(p)) > f.opts.MaxSizeBytes {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups, moves the current file to Path.1 and starts a
+// new one
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+
+	path := f.opts.Path
+	if f.opts.MaxBackups <= 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return f.open()
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", path, f.opts.MaxBackups))
+	for i := f.opts.MaxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(path, path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return f.open()
+}
+
+// Close closes the file; later writes fail
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
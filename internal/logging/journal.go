@@ -0,0 +1,112 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// journalSocket is where journald receives native protocol datagrams
+var journalSocket = "/run/systemd/journal/socket"
+
+// journalIdentifier is sent as SYSLOG_IDENTIFIER with every entry
+const journalIdentifier = "multipass-exporter"
+
+// journalHook sends every entry to journald with its fields as journal
+// fields, using the native protocol
+type journalHook struct {
+	conn *net.UnixConn
+}
+
+func newJournalHook(socket string) (*journalHook, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to journald: %w", err)
+	}
+	return &journalHook{conn: conn}, nil
+}
+
+func (h *journalHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *journalHook) Fire(entry *logrus.Entry) error {
+	var b bytes.Buffer
+	writeJournalField(&b, "MESSAGE", entry.Message)
+	writeJournalField(&b, "PRIORITY", fmt.Sprint(journalPriority(entry.Level)))
+	writeJournalField(&b, "SYSLOG_IDENTIFIER", journalIdentifier)
+
+	keys := make([]string, 0, len(entry.Data))
+	for key := range entry.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := entry.Data[key]
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		writeJournalField(&b, journalFieldName(key), fmt.Sprint(value))
+	}
+
+	_, err := h.conn.Write(b.Bytes())
+	return err
+}
+
+func (h *journalHook) Close() error {
+	return h.conn.Close()
+}
+
+// writeJournalField encodes one field. Values containing newlines use the
+// length-prefixed binary form.
+func writeJournalField(b *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(b, "%s=%s\n", name, value)
+		return
+	}
+	b.WriteString(name + "\n")
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value + "\n")
+}
+
+// journalFieldName maps a logrus field to a journal field name, which may
+// only hold upper case letters, digits and underscores and may not start
+// with an underscore or a digit
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+	name = strings.TrimLeft(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "FIELD_" + name
+	}
+	return name
+}
+
+// journalPriority maps logrus levels to syslog priorities
+func journalPriority(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return 2
+	case logrus.ErrorLevel:
+		return 3
+	case logrus.WarnLevel:
+		return 4
+	case logrus.InfoLevel:
+		return 6
+	default:
+		return 7
+	}
+}
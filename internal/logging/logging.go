@@ -0,0 +1,122 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Log formats
+const (
+	// FormatText is human readable, coloured on a terminal
+	FormatText = "text"
+	// FormatLogfmt is key=value pairs, whether or not on a terminal
+	FormatLogfmt = "logfmt"
+	// FormatJSON is one JSON object per line
+	FormatJSON = "json"
+)
+
+// Log outputs
+const (
+	OutputStderr   = "stderr"
+	OutputFile     = "file"
+	OutputJournald = "journald"
+)
+
+// Formats lists the accepted log formats
+var Formats = []string{FormatText, FormatLogfmt, FormatJSON}
+
+// Outputs lists the accepted log outputs
+var Outputs = []string{OutputStderr, OutputFile, OutputJournald}
+
+// Options describes where and how to log
+type Options struct {
+	Level  string
+	Format string
+	Output string
+	File   FileOptions
+}
+
+// New returns a logger with the defaults: text on stderr at info level
+func New() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetFormatter(newFormatter(FormatText))
+	logger.SetLevel(logrus.InfoLevel)
+	return logger
+}
+
+// Configure applies opts to logger in place, so every component sharing
+// the logger follows. The returned closer releases the new output; the
+// caller closes the previous one once it is no longer used.
+func Configure(logger *logrus.Logger, opts Options) (io.Closer, error) {
+	level, err := logrus.ParseLevel(opts.Level)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log level: %w", err)
+	}
+
+	format := opts.Format
+	if format == "" {
+		format = FormatText
+	}
+	formatter := newFormatter(format)
+	if formatter == nil {
+		return nil, fmt.Errorf("unknown log format %q", opts.Format)
+	}
+
+	var out io.Writer
+	var closer io.Closer = nopCloser{}
+	hooks := make(logrus.LevelHooks)
+
+	switch opts.Output {
+	case "", OutputStderr:
+		out = os.Stderr
+	case OutputFile:
+		file, err := OpenRotatingFile(opts.File)
+		if err != nil {
+			return nil, err
+		}
+		out, closer = file, file
+	case OutputJournald:
+		hook, err := newJournalHook(journalSocket)
+		if err != nil {
+			return nil, err
+		}
+		// Journal entries are structured, so the formatted line is unused
+		out, closer = io.Discard, hook
+		hooks.Add(hook)
+	default:
+		return nil, fmt.Errorf("unknown log output %q", opts.Output)
+	}
+
+	logger.SetFormatter(formatter)
+	logger.SetOutput(out)
+	logger.ReplaceHooks(hooks)
+	logger.SetLevel(level)
+	return closer, nil
+}
+
+func newFormatter(format string) logrus.Formatter {
+	switch format {
+	case FormatText:
+		return &logrus.TextFormatter{
+			FullTimestamp:          true,
+			DisableLevelTruncation: true,
+			PadLevelText:           true,
+		}
+	case FormatLogfmt:
+		return &logrus.TextFormatter{
+			FullTimestamp: true,
+			DisableColors: true,
+		}
+	case FormatJSON:
+		return &logrus.JSONFormatter{}
+	default:
+		return nil
+	}
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
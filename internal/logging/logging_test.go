@@ -0,0 +1,157 @@
+package logging
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestConfigure_JSONFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "exporter.log")
+	logger := New()
+
+	closer, err := Configure(logger, Options{Level: "debug", Format: FormatJSON, Output: OutputFile, File: FileOptions{Path: path}})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	logger.WithField("instance", "charm-dev-36").Debug("Adding memory metric")
+	closer.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read log file: %v", err)
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatalf("Expected a JSON log line, got %q: %v", data, err)
+	}
+	if entry["msg"] != "Adding memory metric" || entry["instance"] != "charm-dev-36" || entry["level"] != "debug" {
+		t.Errorf("Unexpected log entry %v", entry)
+	}
+}
+
+func TestConfigure_Logfmt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "exporter.log")
+	logger := New()
+
+	closer, err := Configure(logger, Options{Level: "info", Format: FormatLogfmt, Output: OutputFile, File: FileOptions{Path: path}})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	logger.WithField("instance", "coslite").Info("Collecting")
+	logger.Debug("Hidden at info level")
+	closer.Close()
+
+	data, _ := os.ReadFile(path)
+	line := string(data)
+	if !strings.Contains(line, `level=info msg=Collecting instance=coslite`) {
+		t.Errorf("Expected logfmt line, got %q", line)
+	}
+	if strings.Contains(line, "Hidden") {
+		t.Errorf("Expected debug entries to be dropped, got %q", line)
+	}
+}
+
+func TestConfigure_Invalid(t *testing.T) {
+	tests := []Options{
+		{Level: "loud"},
+		{Level: "info", Format: "xml"},
+		{Level: "info", Output: "syslog"},
+		{Level: "info", Output: OutputFile},
+	}
+	for _, opts := range tests {
+		if _, err := Configure(New(), opts); err == nil {
+			t.Errorf("Expected error for %+v", opts)
+		}
+	}
+}
+
+func TestRotatingFile_Rotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "exporter.log")
+	file, err := OpenRotatingFile(FileOptions{Path: path, MaxSizeBytes: 10, MaxBackups: 2})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer file.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := file.Write([]byte(line)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	want := map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	}
+	for name, content := range want {
+		data, err := os.ReadFile(name)
+		if err != nil || string(data) != content {
+			t.Errorf("Expected %s to hold %q, got %q (%v)", name, content, data, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected no backup beyond max_backups, got %v", err)
+	}
+}
+
+func TestJournalHook(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "journal.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("unixgram sockets unavailable: %v", err)
+	}
+	defer conn.Close()
+
+	original := journalSocket
+	journalSocket = socket
+	defer func() { journalSocket = original }()
+
+	logger := New()
+	closer, err := Configure(logger, Options{Level: "info", Output: OutputJournald})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer closer.Close()
+
+	logger.WithField("instance-name", "charm-dev-36").Warn("multi\nline")
+
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read datagram: %v", err)
+	}
+	datagram := string(buf[:n])
+
+	for _, want := range []string{"PRIORITY=4\n", "SYSLOG_IDENTIFIER=multipass-exporter\n", "INSTANCE_NAME=charm-dev-36\n", "MESSAGE\n"} {
+		if !strings.Contains(datagram, want) {
+			t.Errorf("Expected datagram to contain %q, got %q", want, datagram)
+		}
+	}
+}
+
+func TestJournalFieldName(t *testing.T) {
+	tests := map[string]string{
+		"instance":  "INSTANCE",
+		"disk_used": "DISK_USED",
+		"_private":  "PRIVATE",
+		"1m":        "FIELD_1M",
+	}
+	for key, want := range tests {
+		if got := journalFieldName(key); got != want {
+			t.Errorf("journalFieldName(%q) = %q, expected %q", key, got, want)
+		}
+	}
+}
+
+func TestJournalPriority(t *testing.T) {
+	if journalPriority(logrus.ErrorLevel) != 3 || journalPriority(logrus.DebugLevel) != 7 {
+		t.Error("Unexpected journal priorities")
+	}
+}
@@ -0,0 +1,70 @@
+package match
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Matcher matches strings against a glob or a regular expression
+type Matcher struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+// Compile parses a pattern. Patterns wrapped in slashes, such as
+// "/^ci-[0-9]+$/", are regular expressions; anything else is a shell glob
+// as understood by path.Match, such as "ci-*".
+func Compile(pattern string) (Matcher, error) {
+	if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return Matcher{}, fmt.Errorf("invalid regex %q: %w", pattern, err)
+		}
+		return Matcher{pattern: pattern, re: re}, nil
+	}
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		return Matcher{}, fmt.Errorf("invalid glob %q: %w", pattern, err)
+	}
+	return Matcher{pattern: pattern}, nil
+}
+
+// CompileAll parses every pattern, stopping at the first error
+func CompileAll(patterns []string) ([]Matcher, error) {
+	matchers := make([]Matcher, 0, len(patterns))
+	for _, pattern := range patterns {
+		m, err := Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	return matchers, nil
+}
+
+// Match reports whether s matches the pattern. Globs must match the whole
+// string; regular expressions match anywhere unless anchored.
+func (m Matcher) Match(s string) bool {
+	if m.re != nil {
+		return m.re.MatchString(s)
+	}
+	matched, _ := path.Match(m.pattern, s)
+	return matched
+}
+
+// String returns the original pattern
+func (m Matcher) String() string {
+	return m.pattern
+}
+
+// Any reports whether s matches at least one matcher
+func Any(matchers []Matcher, s string) bool {
+	for _, m := range matchers {
+		if m.Match(s) {
+			return true
+		}
+	}
+	return false
+}
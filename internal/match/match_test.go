@@ -0,0 +1,56 @@
+package match
+
+import "testing"
+
+func TestMatcher(t *testing.T) {
+	tests := []struct {
+		pattern string
+		input   string
+		want    bool
+	}{
+		{"ci-*", "ci-1234", true},
+		{"ci-*", "dev-ci-1", false},
+		{"charm-dev-3?", "charm-dev-36", true},
+		{"Running", "Running", true},
+		{"Running", "Stopped", false},
+		{"/^ci-[0-9]+$/", "ci-42", true},
+		{"/^ci-[0-9]+$/", "ci-abc", false},
+		{"/dev/", "charm-dev-36", true},
+		{"*24.04*", "Ubuntu 24.04.3 LTS", true},
+	}
+
+	for _, tt := range tests {
+		m, err := Compile(tt.pattern)
+		if err != nil {
+			t.Fatalf("Compile(%q) failed: %v", tt.pattern, err)
+		}
+		if got := m.Match(tt.input); got != tt.want {
+			t.Errorf("%q.Match(%q) = %v, expected %v", tt.pattern, tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestCompile_Invalid(t *testing.T) {
+	for _, pattern := range []string{"/(unclosed/", "[unclosed"} {
+		if _, err := Compile(pattern); err == nil {
+			t.Errorf("Expected error for %q", pattern)
+		}
+	}
+}
+
+func TestAny(t *testing.T) {
+	matchers, err := CompileAll([]string{"ci-*", "/^tmp/"})
+	if err != nil {
+		t.Fatalf("CompileAll failed: %v", err)
+	}
+
+	if !Any(matchers, "tmp-vm") || !Any(matchers, "ci-1") {
+		t.Error("Expected match for tmp-vm and ci-1")
+	}
+	if Any(matchers, "dev") {
+		t.Error("Expected no match for dev")
+	}
+	if Any(nil, "dev") {
+		t.Error("Expected no match against no matchers")
+	}
+}
@@ -0,0 +1,162 @@
+package mixin
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DashboardUID is the uid of the generated dashboard, stable across
+// regenerations so imports replace the previous version
+const DashboardUID = "multipass-exporter"
+
+// datasource points panels at the dashboard's datasource variable
+var datasource = map[string]string{"type": "prometheus", "uid": "${datasource}"}
+
+// Panel is a Grafana panel
+type Panel struct {
+	ID          int                    `json:"id"`
+	Type        string                 `json:"type"`
+	Title       string                 `json:"title"`
+	Description string                 `json:"description,omitempty"`
+	Datasource  map[string]string      `json:"datasource"`
+	GridPos     GridPos                `json:"gridPos"`
+	Targets     []Target               `json:"targets"`
+	FieldConfig map[string]interface{} `json:"fieldConfig"`
+}
+
+// GridPos places a panel on the dashboard grid, 24 units wide
+type GridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// Target is a Prometheus query of a panel
+type Target struct {
+	RefID        string            `json:"refId"`
+	Expr         string            `json:"expr"`
+	LegendFormat string            `json:"legendFormat,omitempty"`
+	Datasource   map[string]string `json:"datasource"`
+}
+
+// Dashboard returns a Grafana dashboard of the collector's metrics, with
+// variables for the datasource, the exporter and the instance names. Panels
+// whose metrics the collector does not emit are left out.
+func Dashboard(metrics Metrics, opts Options) map[string]interface{} {
+	b := &dashboardBuilder{}
+	instance := `instance=~"$instance"`
+	name := `name=~"$name"`
+
+	if up := metrics.Name(v2Up); up != "" {
+		b.add("stat", "multipass info", "Whether the last `multipass info` succeeded", "none",
+			Target{Expr: selector(up, opts, instance), LegendFormat: "{{instance}}"})
+	} else {
+		b.add("stat", "Exporter up", "Whether Prometheus can scrape the exporter", "none",
+			Target{Expr: fmt.Sprintf("up{job=%q,%s}", opts.Job, instance), LegendFormat: "{{instance}}"})
+	}
+
+	if instances := metrics.Name(v2Instances); instances != "" {
+		b.add("timeseries", "Instances by state", "", "none",
+			Target{Expr: fmt.Sprintf("sum by (state) (%s)", selector(instances, opts, instance)), LegendFormat: "{{state}}"})
+	} else {
+		var targets []Target
+		for _, state := range []string{v1Running, v1Stopped, v1Deleted, v1Suspended} {
+			if fqName := metrics.Name(state); fqName != "" {
+				targets = append(targets, Target{Expr: fmt.Sprintf("sum(%s)", selector(fqName, opts, instance)), LegendFormat: strings.TrimPrefix(state, "instances_")})
+			}
+		}
+		if len(targets) > 0 {
+			b.add("timeseries", "Instances by state", "", "none", targets...)
+		}
+	}
+
+	if memory := metrics.Name(v2MemoryUsed, v1Memory); memory != "" {
+		b.add("timeseries", "Memory used", "", "bytes",
+			Target{Expr: selector(memory, opts, instance, name), LegendFormat: "{{name}}"})
+	}
+	if cpus := metrics.Name(v2CPUs, v1CPUs); cpus != "" {
+		b.add("timeseries", "CPUs", "", "none",
+			Target{Expr: selector(cpus, opts, instance, name), LegendFormat: "{{name}}"})
+	}
+	if metrics.Name(v2Load1, v1Load1) != "" && metrics.Name(v2CPUs, v1CPUs) != "" {
+		b.add("timeseries", "Load per CPU", "1 minute load average divided by the number of CPUs", "none",
+			Target{Expr: selector(metrics.LoadPerCPURecord(), opts, instance, name), LegendFormat: "{{name}}"})
+	}
+	if metrics.Name(diskUsed) != "" && metrics.Name(v2DiskSize, v1DiskTotal) != "" {
+		b.add("timeseries", "Disk usage", "", "percentunit",
+			Target{Expr: selector(metrics.DiskUsageRecord(), opts, instance, name), LegendFormat: "{{name}} {{disk}}"})
+	}
+	if used := metrics.Name(diskUsed); used != "" {
+		b.add("timeseries", "Disk used", "", "bytes",
+			Target{Expr: selector(used, opts, instance, name), LegendFormat: "{{name}} {{disk}}"})
+	}
+
+	// The exporter and instance name variables follow the first metric
+	// every schema emits
+	variableMetric := metrics.Name(diskUsed)
+	return map[string]interface{}{
+		"uid":           DashboardUID,
+		"title":         "Multipass",
+		"tags":          []string{"multipass"},
+		"editable":      true,
+		"schemaVersion": 39,
+		"refresh":       "1m",
+		"time":          map[string]string{"from": "now-6h", "to": "now"},
+		"panels":        b.panels,
+		"templating": map[string]interface{}{
+			"list": []map[string]interface{}{
+				{
+					"name":  "datasource",
+					"label": "Data source",
+					"type":  "datasource",
+					"query": "prometheus",
+				},
+				queryVariable("instance", "Exporter", fmt.Sprintf("label_values(%s, instance)", selector(variableMetric, opts))),
+				queryVariable("name", "Instance", fmt.Sprintf("label_values(%s, name)", selector(variableMetric, opts, instance))),
+			},
+		},
+	}
+}
+
+// dashboardBuilder lays panels out two per row
+type dashboardBuilder struct {
+	panels []Panel
+}
+
+func (b *dashboardBuilder) add(panelType, title, description, unit string, targets ...Target) {
+	n := len(b.panels)
+	for i := range targets {
+		targets[i].RefID = string(rune('A' + i))
+		targets[i].Datasource = datasource
+	}
+	b.panels = append(b.panels, Panel{
+		ID:          n + 1,
+		Type:        panelType,
+		Title:       title,
+		Description: description,
+		Datasource:  datasource,
+		GridPos:     GridPos{H: 8, W: 12, X: (n % 2) * 12, Y: (n / 2) * 8},
+		Targets:     targets,
+		FieldConfig: map[string]interface{}{
+			"defaults":  map[string]interface{}{"unit": unit},
+			"overrides": []interface{}{},
+		},
+	})
+}
+
+func queryVariable(name, label, query string) map[string]interface{} {
+	return map[string]interface{}{
+		"name":       name,
+		"label":      label,
+		"type":       "query",
+		"datasource": datasource,
+		"query":      map[string]string{"query": query, "refId": name},
+		"definition": query,
+		"refresh":    2,
+		"multi":      true,
+		"includeAll": true,
+		"current":    map[string]interface{}{"text": "All", "value": "$__all"},
+		"sort":       1,
+	}
+}
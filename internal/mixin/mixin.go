@@ -0,0 +1,266 @@
+package mixin
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Abuelodelanada/multipass-exporter/internal/collector"
+	"github.com/prometheus/common/model"
+)
+
+// Options tunes the generated rules and dashboard
+type Options struct {
+	// Job is the scrape job of the exporter, used to select its series
+	Job string
+	// DiskUsageThreshold is the used/size ratio above which a disk is
+	// almost full
+	DiskUsageThreshold float64
+	// LoadPerCPUThreshold is the 1 minute load per CPU above which an
+	// instance is overloaded
+	LoadPerCPUThreshold float64
+	// ExporterDownFor is how long the exporter or `multipass info` must
+	// fail before alerting
+	ExporterDownFor time.Duration
+	// UnknownFor is how long an instance may stay in an unknown state
+	UnknownFor time.Duration
+	// For is how long the usage alerts must hold before firing
+	For time.Duration
+}
+
+// DefaultOptions returns the thresholds used when none are given
+func DefaultOptions() Options {
+	return Options{
+		Job:                 "multipass",
+		DiskUsageThreshold:  0.9,
+		LoadPerCPUThreshold: 2,
+		ExporterDownFor:     5 * time.Minute,
+		UnknownFor:          10 * time.Minute,
+		For:                 15 * time.Minute,
+	}
+}
+
+// RuleFile is a Prometheus rule file
+type RuleFile struct {
+	Groups []RuleGroup `yaml:"groups"`
+}
+
+// RuleGroup is a named group of rules evaluated together
+type RuleGroup struct {
+	Name  string `yaml:"name"`
+	Rules []Rule `yaml:"rules"`
+}
+
+// Rule is a recording rule when Record is set and an alerting rule when
+// Alert is set
+type Rule struct {
+	Record      string            `yaml:"record,omitempty"`
+	Alert       string            `yaml:"alert,omitempty"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// Metrics finds the collector's metrics by their name without namespace
+type Metrics map[string]collector.MetricDesc
+
+// NewMetrics indexes the metrics a collector describes
+func NewMetrics(descs []collector.MetricDesc) Metrics {
+	metrics := make(Metrics)
+	for _, desc := range descs {
+		metrics[desc.Name] = desc
+	}
+	return metrics
+}
+
+// Name returns the full name of the first of names the collector emits,
+// or "" when it emits none of them. Listing the v2 name first makes the
+// mixin prefer it when both schemas are enabled.
+func (m Metrics) Name(names ...string) string {
+	for _, name := range names {
+		if desc, ok := m[name]; ok {
+			return desc.FQName
+		}
+	}
+	return ""
+}
+
+// namespace is the prefix of the collector's metric names
+func (m Metrics) namespace() string {
+	for _, desc := range m {
+		return strings.TrimSuffix(desc.FQName, "_"+desc.Name)
+	}
+	return collector.DefaultNamespace
+}
+
+// Metric names, without namespace, of both schemas
+const (
+	v2Up         = "up"
+	v1Error      = "error"
+	v2Instances  = "instances"
+	v1Total      = "instances_total"
+	v1Running    = "instances_running"
+	v1Stopped    = "instances_stopped"
+	v1Deleted    = "instances_deleted"
+	v1Suspended  = "instances_suspended"
+	v2MemoryUsed = "instance_memory_used_bytes"
+	v1Memory     = "instance_memory_bytes"
+	v2CPUs       = "instance_cpus"
+	v1CPUs       = "instance_cpu_total"
+	v2Load1      = "instance_load1"
+	v1Load1      = "instance_load_1m"
+	diskUsed     = "instance_disk_used_bytes"
+	v2DiskSize   = "instance_disk_size_bytes"
+	v1DiskTotal  = "instance_disk_total_bytes"
+)
+
+// unknownState is the v2 state label of instances in the Unknown state
+const unknownState = "unknown"
+
+// DiskUsageRecord is the recording rule of the disk usage ratio
+func (m Metrics) DiskUsageRecord() string {
+	return m.namespace() + ":instance_disk_usage:ratio"
+}
+
+// LoadPerCPURecord is the recording rule of the 1 minute load per CPU
+func (m Metrics) LoadPerCPURecord() string {
+	return m.namespace() + ":instance_load1_per_cpu:ratio"
+}
+
+// selector renders name{job="...",matchers...}
+func selector(name string, opts Options, matchers ...string) string {
+	all := []string{fmt.Sprintf("job=%q", opts.Job)}
+	return name + "{" + strings.Join(append(all, matchers...), ",") + "}"
+}
+
+// Rules returns the recording rules the alerts and the dashboard build on
+func Rules(metrics Metrics, opts Options) RuleFile {
+	var rules []Rule
+
+	used, size := metrics.Name(diskUsed), metrics.Name(v2DiskSize, v1DiskTotal)
+	if used != "" && size != "" {
+		rules = append(rules, Rule{
+			Record: metrics.DiskUsageRecord(),
+			Expr:   fmt.Sprintf("%s / (%s > 0)", selector(used, opts), selector(size, opts)),
+		})
+	}
+
+	load, cpus := metrics.Name(v2Load1, v1Load1), metrics.Name(v2CPUs, v1CPUs)
+	if load != "" && cpus != "" {
+		rules = append(rules, Rule{
+			Record: metrics.LoadPerCPURecord(),
+			Expr:   fmt.Sprintf("%s / (%s > 0)", selector(load, opts), selector(cpus, opts)),
+		})
+	}
+
+	return RuleFile{Groups: []RuleGroup{{Name: "multipass-exporter.rules", Rules: rules}}}
+}
+
+// Alerts returns the alerting rules. They use the recording rules, which
+// must be loaded as well.
+func Alerts(metrics Metrics, opts Options) RuleFile {
+	rules := []Rule{{
+		Alert: "MultipassExporterDown",
+		Expr:  fmt.Sprintf("up{job=%q} == 0", opts.Job),
+		For:   duration(opts.ExporterDownFor),
+		Labels: map[string]string{
+			"severity": "critical",
+		},
+		Annotations: map[string]string{
+			"summary":     "Multipass exporter is down",
+			"description": "Prometheus could not scrape the Multipass exporter on {{ $labels.instance }} for " + duration(opts.ExporterDownFor) + ".",
+		},
+	}}
+
+	failing := ""
+	if up := metrics.Name(v2Up); up != "" {
+		failing = selector(up, opts) + " == 0"
+	} else if errorMetric := metrics.Name(v1Error); errorMetric != "" {
+		failing = selector(errorMetric, opts) + " == 1"
+	}
+	if failing != "" {
+		rules = append(rules, Rule{
+			Alert:  "MultipassInfoFailing",
+			Expr:   failing,
+			For:    duration(opts.ExporterDownFor),
+			Labels: map[string]string{"severity": "critical"},
+			Annotations: map[string]string{
+				"summary":     "multipass info is failing",
+				"description": "The exporter on {{ $labels.instance }} cannot run `multipass info`; is multipassd running?",
+			},
+		})
+	}
+
+	if unknown := unknownInstances(metrics, opts); unknown != "" {
+		rules = append(rules, Rule{
+			Alert:  "MultipassInstanceStateUnknown",
+			Expr:   unknown + " > 0",
+			For:    duration(opts.UnknownFor),
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "Multipass instances are stuck in an unknown state",
+				"description": "{{ $value }} instances on {{ $labels.instance }} have been in an unknown state for " + duration(opts.UnknownFor) + ".",
+			},
+		})
+	}
+
+	if metrics.Name(diskUsed) != "" && metrics.Name(v2DiskSize, v1DiskTotal) != "" {
+		rules = append(rules, Rule{
+			Alert:  "MultipassInstanceDiskAlmostFull",
+			Expr:   fmt.Sprintf("%s > %s", selector(metrics.DiskUsageRecord(), opts), threshold(opts.DiskUsageThreshold)),
+			For:    duration(opts.For),
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "Multipass instance disk is almost full",
+				"description": "Disk {{ $labels.disk }} of instance {{ $labels.name }} on {{ $labels.instance }} is {{ $value | humanizePercentage }} full.",
+			},
+		})
+	}
+	if metrics.Name(v2Load1, v1Load1) != "" && metrics.Name(v2CPUs, v1CPUs) != "" {
+		rules = append(rules, Rule{
+			Alert:  "MultipassInstanceHighLoad",
+			Expr:   fmt.Sprintf("%s > %s", selector(metrics.LoadPerCPURecord(), opts), threshold(opts.LoadPerCPUThreshold)),
+			For:    duration(opts.For),
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "Multipass instance is overloaded",
+				"description": "Instance {{ $labels.name }} on {{ $labels.instance }} has a load of {{ $value | humanize }} per CPU.",
+			},
+		})
+	}
+
+	return RuleFile{Groups: []RuleGroup{{Name: "multipass-exporter.alerts", Rules: rules}}}
+}
+
+// unknownInstances counts the instances in an unknown state. The v1
+// schema only counts the known states, so it counts the instances in none
+// of them, which also covers transitional states such as starting.
+func unknownInstances(metrics Metrics, opts Options) string {
+	if instances := metrics.Name(v2Instances); instances != "" {
+		return selector(instances, opts, fmt.Sprintf("state=%q", unknownState))
+	}
+
+	total := metrics.Name(v1Total)
+	known := make([]string, 0, 4)
+	for _, name := range []string{v1Running, v1Stopped, v1Deleted, v1Suspended} {
+		if fqName := metrics.Name(name); fqName != "" {
+			known = append(known, selector(fqName, opts))
+		}
+	}
+	if total == "" || len(known) == 0 {
+		return ""
+	}
+	sort.Strings(known)
+	return fmt.Sprintf("(%s - (%s))", selector(total, opts), strings.Join(known, " + "))
+}
+
+// duration formats d as a Prometheus duration, e.g. 15m
+func duration(d time.Duration) string {
+	return model.Duration(d).String()
+}
+
+func threshold(value float64) string {
+	return fmt.Sprintf("%g", value)
+}
@@ -0,0 +1,246 @@
+package mixin
+
+import (
+	"context"
+	"encoding/json"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Abuelodelanada/multipass-exporter/internal/collector"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// infoJSON has an instance in the Unknown state, so the v2 instances
+// metric reports the state the unknown-state alert selects
+const infoJSON = `{
+	"errors": [],
+	"info": {
+		"dev": {"name": "dev", "state": "Running", "release": "24.04 LTS", "ipv4": ["10.0.0.2"], "memory": {"total": 1073741824, "used": 536870912}, "cpu_count": "2", "load": [0.1, 0.2, 0.3], "disks": {"sda1": {"total": "100", "used": "50"}}},
+		"lost": {"name": "lost", "state": "Unknown", "release": "22.04 LTS"}
+	}
+}`
+
+// commandExecutor runs a fixed shell command instead of multipass
+type commandExecutor struct {
+	name string
+	args []string
+}
+
+func (e commandExecutor) CommandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, e.name, e.args...)
+}
+
+// metricNames parses expr as PromQL and returns the metric name of each
+// of its selectors. Grafana's label_values(<selector>, <label>) variable
+// queries are parsed as their selector.
+func metricNames(expr string) ([]string, error) {
+	if inner, ok := strings.CutPrefix(expr, "label_values("); ok {
+		if i := strings.LastIndex(inner, ","); i >= 0 {
+			expr = inner[:i]
+		}
+	}
+	parsed, err := parser.ParseExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	parser.Inspect(parsed, func(node parser.Node, _ []parser.Node) error {
+		if selector, ok := node.(*parser.VectorSelector); ok {
+			names = append(names, selector.Name)
+		}
+		return nil
+	})
+	return names, nil
+}
+
+// emitted collects a schema once successfully and once failing, and
+// returns every series it produced by metric name
+func emitted(t *testing.T, namespace string, schema collector.Schema) map[string][]map[string]string {
+	t.Helper()
+	series := make(map[string][]map[string]string)
+	for _, executor := range []commandExecutor{{name: "echo", args: []string{infoJSON}}, {name: "false"}} {
+		c := collector.NewMultipassCollectorWithExecutor(5, executor)
+		if err := c.SetSchema(namespace, schema); err != nil {
+			t.Fatalf("Failed to set schema: %v", err)
+		}
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(c)
+		families, _ := registry.Gather()
+		for _, family := range families {
+			for _, metric := range family.GetMetric() {
+				labels := make(map[string]string)
+				for _, pair := range metric.GetLabel() {
+					labels[pair.GetName()] = pair.GetValue()
+				}
+				series[family.GetName()] = append(series[family.GetName()], labels)
+			}
+		}
+	}
+	return series
+}
+
+func metricsFor(t *testing.T, namespace string, schema collector.Schema) Metrics {
+	t.Helper()
+	c := collector.NewMultipassCollector(5)
+	if err := c.SetSchema(namespace, schema); err != nil {
+		t.Fatalf("Failed to set schema: %v", err)
+	}
+	return NewMetrics(c.Metrics())
+}
+
+// expressions lists every PromQL expression of the generated artifacts
+func expressions(t *testing.T, metrics Metrics, opts Options) []string {
+	t.Helper()
+	var exprs []string
+	for _, file := range []RuleFile{Rules(metrics, opts), Alerts(metrics, opts)} {
+		for _, group := range file.Groups {
+			for _, rule := range group.Rules {
+				exprs = append(exprs, rule.Expr)
+			}
+		}
+	}
+
+	dashboard := Dashboard(metrics, opts)
+	for _, panel := range dashboard["panels"].([]Panel) {
+		for _, target := range panel.Targets {
+			exprs = append(exprs, target.Expr)
+		}
+	}
+	for _, variable := range dashboard["templating"].(map[string]interface{})["list"].([]map[string]interface{}) {
+		if query, ok := variable["definition"].(string); ok {
+			exprs = append(exprs, query)
+		}
+	}
+	return exprs
+}
+
+func TestMetricNames(t *testing.T) {
+	names, err := metricNames(`label_values(multipass_up{job="multipass"}, instance)`)
+	if err != nil || len(names) != 1 || names[0] != "multipass_up" {
+		t.Errorf("Expected the selector of the variable query, got %v, %v", names, err)
+	}
+	if _, err := metricNames(`a / (b > 0`); err == nil {
+		t.Error("Expected error for an unbalanced expression")
+	}
+}
+
+func TestExpressionsUseEmittedMetrics(t *testing.T) {
+	opts := DefaultOptions()
+	for _, tc := range []struct {
+		namespace string
+		schema    collector.Schema
+	}{
+		{"multipass", collector.SchemaV1},
+		{"multipass", collector.SchemaV2},
+		{"multipass", collector.SchemaBoth},
+		{"lab", collector.SchemaV2},
+	} {
+		t.Run(tc.namespace+"_"+string(tc.schema), func(t *testing.T) {
+			series := emitted(t, tc.namespace, tc.schema)
+			metrics := metricsFor(t, tc.namespace, tc.schema)
+
+			known := map[string]bool{"up": true}
+			for name := range series {
+				known[name] = true
+			}
+			for _, group := range Rules(metrics, opts).Groups {
+				for _, rule := range group.Rules {
+					known[rule.Record] = true
+				}
+			}
+
+			// A renamed metric would silently drop the rules built on it
+			if n := len(Rules(metrics, opts).Groups[0].Rules); n != 2 {
+				t.Errorf("Expected 2 recording rules, got %d", n)
+			}
+			if n := len(Alerts(metrics, opts).Groups[0].Rules); n != 5 {
+				t.Errorf("Expected 5 alerts, got %d", n)
+			}
+
+			for _, expr := range expressions(t, metrics, opts) {
+				names, err := metricNames(expr)
+				if err != nil {
+					t.Errorf("Invalid expression %q: %v", expr, err)
+					continue
+				}
+				if len(names) == 0 {
+					t.Errorf("Expected a metric selector in %q", expr)
+				}
+				for _, name := range names {
+					if !known[name] {
+						t.Errorf("Expression %q uses %q, which is neither emitted nor recorded", expr, name)
+					}
+				}
+			}
+
+			// The selected state must be one the collector reports
+			if instances := metrics.Name(v2Instances); instances != "" {
+				found := false
+				for _, labels := range series[instances] {
+					found = found || labels["state"] == unknownState
+				}
+				if !found {
+					t.Errorf("Expected a %s series with state=%q, got %v", instances, unknownState, series[instances])
+				}
+			}
+		})
+	}
+}
+
+func TestAlerts_Thresholds(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Job = "lab"
+	opts.DiskUsageThreshold = 0.8
+	opts.For = 30 * time.Minute
+
+	alerts := make(map[string]Rule)
+	for _, rule := range Alerts(metricsFor(t, "multipass", collector.SchemaV2), opts).Groups[0].Rules {
+		alerts[rule.Alert] = rule
+	}
+
+	disk := alerts["MultipassInstanceDiskAlmostFull"]
+	if disk.Expr != `multipass:instance_disk_usage:ratio{job="lab"} > 0.8` || disk.For != "30m" {
+		t.Errorf("Expected the disk threshold and duration from options, got %+v", disk)
+	}
+	if up := alerts["MultipassInfoFailing"]; up.Expr != `multipass_up{job="lab"} == 0` {
+		t.Errorf("Expected the v2 up metric, got %q", up.Expr)
+	}
+	if unknown := alerts["MultipassInstanceStateUnknown"]; !strings.Contains(unknown.Expr, `state="unknown"`) || unknown.For != "10m" {
+		t.Errorf("Expected the unknown state alert, got %+v", unknown)
+	}
+	for _, name := range []string{"MultipassExporterDown", "MultipassInstanceHighLoad"} {
+		if _, ok := alerts[name]; !ok {
+			t.Errorf("Expected alert %s", name)
+		}
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	dashboard := Dashboard(metricsFor(t, "multipass", collector.SchemaV1), DefaultOptions())
+
+	data, err := json.Marshal(dashboard)
+	if err != nil {
+		t.Fatalf("Failed to encode dashboard: %v", err)
+	}
+	if !strings.Contains(string(data), `"uid":"multipass-exporter"`) {
+		t.Error("Expected a stable dashboard uid")
+	}
+
+	panels := dashboard["panels"].([]Panel)
+	seen := make(map[int]bool)
+	for _, panel := range panels {
+		if seen[panel.ID] {
+			t.Errorf("Expected unique panel ids, got %d twice", panel.ID)
+		}
+		seen[panel.ID] = true
+		if len(panel.Targets) == 0 {
+			t.Errorf("Expected queries in panel %q", panel.Title)
+		}
+	}
+	if len(panels) != 7 {
+		t.Errorf("Expected 7 panels, got %d", len(panels))
+	}
+}
@@ -0,0 +1,420 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/Abuelodelanada/multipass-exporter/internal/collector"
+	"github.com/Abuelodelanada/multipass-exporter/internal/logging"
+	"github.com/Abuelodelanada/multipass-exporter/internal/notify/notifyspec"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// Statuses of a Notification
+const (
+	StatusFiring   = "firing"
+	StatusResolved = "resolved"
+)
+
+// queueSize bounds the notifications waiting for delivery; further ones
+// are dropped rather than blocking collections
+const queueSize = 100
+
+// Rule fires once Metric reaches Threshold and resolves once it drops
+// below ResolveThreshold, or Threshold when ResolveThreshold is 0
+type Rule struct {
+	Name             string
+	Metric           string
+	Threshold        float64
+	ResolveThreshold float64
+}
+
+// resolveThreshold is the value below which a firing alert resolves
+func (r Rule) resolveThreshold() float64 {
+	if r.ResolveThreshold == 0 {
+		return r.Threshold
+	}
+	return r.ResolveThreshold
+}
+
+// Webhook receives every notification as a POST request
+type Webhook struct {
+	URL     string
+	Headers map[string]string
+	// Body is a template rendering the JSON body from a Notification;
+	// empty means the notification itself as JSON
+	Body string
+}
+
+// Options configures an Engine
+type Options struct {
+	Rules    []Rule
+	Webhooks []Webhook
+	// RepeatInterval is how often a firing alert is notified again; zero
+	// notifies it only once
+	RepeatInterval time.Duration
+	// Timeout bounds each webhook request; zero means no timeout
+	Timeout time.Duration
+	// Hostname names the machine running multipass
+	Hostname string
+}
+
+// Notification is sent to the webhooks when an alert fires, repeats or
+// resolves, and is the data of the body templates
+type Notification struct {
+	Status    string     `json:"status"`
+	Rule      string     `json:"rule"`
+	Metric    string     `json:"metric"`
+	Instance  string     `json:"instance"`
+	Disk      string     `json:"disk,omitempty"`
+	Value     float64    `json:"value"`
+	Threshold float64    `json:"threshold"`
+	Summary   string     `json:"summary"`
+	Hostname  string     `json:"hostname,omitempty"`
+	StartsAt  time.Time  `json:"starts_at"`
+	EndsAt    *time.Time `json:"ends_at,omitempty"`
+}
+
+// RenderBody renders the body of n, which must be valid JSON
+func RenderBody(tmpl *template.Template, n Notification) ([]byte, error) {
+	if tmpl == nil {
+		return json.Marshal(n)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, n); err != nil {
+		return nil, fmt.Errorf("failed to render webhook body: %w", err)
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("webhook body is not valid JSON: %s", buf.String())
+	}
+	return buf.Bytes(), nil
+}
+
+// webhook is a Webhook with its parsed body template
+type webhook struct {
+	Webhook
+	body *template.Template
+}
+
+// alertKey identifies an alert: a rule for an instance and, for disk
+// usage, one of its disks
+type alertKey struct {
+	rule     string
+	instance string
+	disk     string
+}
+
+// alert is the state of a firing alert
+type alert struct {
+	notification Notification
+	lastSent     time.Time
+}
+
+// Engine evaluates threshold rules against `multipass info` responses and
+// delivers the resulting notifications to webhooks
+type Engine struct {
+	opts     Options
+	webhooks []webhook
+	client   *http.Client
+	logger   *logrus.Logger
+	queue    chan Notification
+
+	mu     sync.Mutex
+	active map[alertKey]*alert
+
+	sent     *prometheus.CounterVec
+	failures prometheus.Counter
+	dropped  prometheus.Counter
+	firing   prometheus.GaugeFunc
+}
+
+// New creates an Engine for opts. opts are not checked here:
+// config.Validate reports invalid notification settings.
+func New(opts Options) (*Engine, error) {
+	e := &Engine{
+		opts:   opts,
+		client: &http.Client{},
+		logger: logging.New(),
+		queue:  make(chan Notification, queueSize),
+		active: make(map[alertKey]*alert),
+		sent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "multipass_exporter_notifications_sent_total",
+			Help: "Total number of notifications delivered to webhooks, by status",
+		}, []string{"status"}),
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "multipass_exporter_notification_failures_total",
+			Help: "Total number of notifications that could not be delivered to a webhook",
+		}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "multipass_exporter_notifications_dropped_total",
+			Help: "Total number of notifications dropped because the delivery queue was full",
+		}),
+	}
+	e.firing = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "multipass_exporter_notification_alerts_firing",
+		Help: "Number of alerts currently firing",
+	}, func() float64 {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		return float64(len(e.active))
+	})
+
+	for _, hook := range opts.Webhooks {
+		body, err := notifyspec.ParseBody(hook.Body)
+		if err != nil {
+			return nil, err
+		}
+		e.webhooks = append(e.webhooks, webhook{Webhook: hook, body: body})
+	}
+	return e, nil
+}
+
+// SetLogger replaces the engine's own logger
+func (e *Engine) SetLogger(logger *logrus.Logger) {
+	e.logger = logger
+}
+
+// Collectors returns the metrics describing the engine's own health
+func (e *Engine) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{e.sent, e.failures, e.dropped, e.firing}
+}
+
+// sample is the value of a rule's metric for an instance or a disk
+type sample struct {
+	instance string
+	disk     string
+	value    float64
+}
+
+// samples extracts metric from data, sorted by instance and disk.
+// Instances without the data, e.g. stopped ones, have no samples.
+func samples(metric string, data collector.MultipassInfoResponse) []sample {
+	var result []sample
+	for key, info := range data.Info {
+		name := info.Name
+		if name == "" {
+			name = key
+		}
+		switch metric {
+		case notifyspec.MetricDiskUsage:
+			for disk, usage := range info.Disks {
+				used, err := strconv.ParseInt(usage.Used, 10, 64)
+				if err != nil {
+					continue
+				}
+				total, err := strconv.ParseInt(usage.Total, 10, 64)
+				if err != nil || total <= 0 {
+					continue
+				}
+				result = append(result, sample{instance: name, disk: disk, value: float64(used) / float64(total)})
+			}
+		case notifyspec.MetricMemoryUsage:
+			if info.Memory.Total > 0 {
+				result = append(result, sample{instance: name, value: float64(info.Memory.Used) / float64(info.Memory.Total)})
+			}
+		case notifyspec.MetricLoadPerCPU:
+			cpus, err := strconv.Atoi(info.CPUCount)
+			if err == nil && cpus > 0 && len(info.Load) > 0 {
+				result = append(result, sample{instance: name, value: info.Load[0] / float64(cpus)})
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].instance != result[j].instance {
+			return result[i].instance < result[j].instance
+		}
+		return result[i].disk < result[j].disk
+	})
+	return result
+}
+
+// Evaluate checks every rule against data as observed at now and returns
+// the notifications to send. An alert fires once its value reaches the
+// threshold, repeats every RepeatInterval while it stays firing, and
+// resolves once its value drops below the resolve threshold or the
+// instance or disk is gone.
+func (e *Engine) Evaluate(data collector.MultipassInfoResponse, now time.Time) []Notification {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var notifications []Notification
+	seen := make(map[alertKey]bool)
+	for _, rule := range e.opts.Rules {
+		for _, s := range samples(rule.Metric, data) {
+			key := alertKey{rule: rule.Name, instance: s.instance, disk: s.disk}
+			seen[key] = true
+
+			current, firing := e.active[key]
+			switch {
+			case !firing && s.value >= rule.Threshold:
+				n := Notification{
+					Status:    StatusFiring,
+					Rule:      rule.Name,
+					Metric:    rule.Metric,
+					Instance:  s.instance,
+					Disk:      s.disk,
+					Value:     s.value,
+					Threshold: rule.Threshold,
+					Summary:   summary(rule, s),
+					Hostname:  e.opts.Hostname,
+					StartsAt:  now,
+				}
+				e.active[key] = &alert{notification: n, lastSent: now}
+				notifications = append(notifications, n)
+			case firing && s.value < rule.resolveThreshold():
+				delete(e.active, key)
+				notifications = append(notifications, resolved(current.notification, rule, s, now))
+			case firing:
+				current.notification.Value = s.value
+				current.notification.Summary = summary(rule, s)
+				if e.opts.RepeatInterval > 0 && now.Sub(current.lastSent) >= e.opts.RepeatInterval {
+					current.lastSent = now
+					notifications = append(notifications, current.notification)
+				}
+			}
+		}
+	}
+
+	// Alerts whose instance or disk disappeared resolve with their last value
+	var keys []alertKey
+	for key := range e.active {
+		if !seen[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.rule != b.rule {
+			return a.rule < b.rule
+		}
+		if a.instance != b.instance {
+			return a.instance < b.instance
+		}
+		return a.disk < b.disk
+	})
+	for _, key := range keys {
+		n := e.active[key].notification
+		delete(e.active, key)
+		n.Status = StatusResolved
+		n.EndsAt = &now
+		notifications = append(notifications, n)
+	}
+	return notifications
+}
+
+// resolved turns the firing notification of an alert into its resolution
+func resolved(n Notification, rule Rule, s sample, now time.Time) Notification {
+	n.Status = StatusResolved
+	n.Value = s.value
+	n.Summary = summary(rule, s)
+	n.EndsAt = &now
+	return n
+}
+
+// summary describes the value of s, e.g. "Disk sda1 of dev is at 92%
+// (threshold 90%)"
+func summary(rule Rule, s sample) string {
+	format := notifyspec.Percent
+	subject := "Memory"
+	switch rule.Metric {
+	case notifyspec.MetricDiskUsage:
+		subject = "Disk " + s.disk
+	case notifyspec.MetricLoadPerCPU:
+		subject = "Load per CPU"
+		format = func(value float64) string {
+			return strconv.FormatFloat(value, 'f', 2, 64)
+		}
+	}
+	return fmt.Sprintf("%s of %s is at %s (threshold %s)", subject, s.instance, format(s.value), format(rule.Threshold))
+}
+
+// Observe evaluates data and queues the resulting notifications for Run
+// to deliver, so collections never wait for webhooks. It can be used as
+// a collector info observer.
+func (e *Engine) Observe(data collector.MultipassInfoResponse) {
+	for _, n := range e.Evaluate(data, time.Now()) {
+		select {
+		case e.queue <- n:
+		default:
+			e.dropped.Inc()
+			e.logger.WithField("rule", n.Rule).Warnf("Dropped %s notification for %s: delivery queue is full", n.Status, n.Instance)
+		}
+	}
+}
+
+// Send delivers n to every webhook, returning the failures
+func (e *Engine) Send(ctx context.Context, n Notification) error {
+	var errs []error
+	for _, hook := range e.webhooks {
+		if err := e.post(ctx, hook, n); err != nil {
+			e.failures.Inc()
+			errs = append(errs, err)
+			continue
+		}
+		e.sent.WithLabelValues(n.Status).Inc()
+	}
+	return errors.Join(errs...)
+}
+
+// post sends n to a single webhook
+func (e *Engine) post(ctx context.Context, hook webhook, n Notification) error {
+	body, err := RenderBody(hook.body, n)
+	if err != nil {
+		return err
+	}
+
+	if e.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.opts.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range hook.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook %s returned %s: %s", hook.URL, resp.Status, strings.TrimSpace(string(message)))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// Run delivers queued notifications until ctx is done
+func (e *Engine) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-e.queue:
+			logger := e.logger.WithFields(logrus.Fields{"rule": n.Rule, "instance": n.Instance, "status": n.Status})
+			if err := e.Send(ctx, n); err != nil {
+				logger.WithError(err).Error("Failed to send notification")
+			} else {
+				logger.Debug("Sent notification")
+			}
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Abuelodelanada/multipass-exporter/internal/collector"
+	"github.com/Abuelodelanada/multipass-exporter/internal/notify/notifyspec"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// receiver records the webhook requests it gets
+type receiver struct {
+	mu       sync.Mutex
+	bodies   []string
+	headers  []http.Header
+	received chan struct{}
+	status   int
+}
+
+func newReceiver(t *testing.T, status int) (*receiver, *httptest.Server) {
+	t.Helper()
+	r := &receiver{received: make(chan struct{}, 10), status: status}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		r.bodies = append(r.bodies, string(body))
+		r.headers = append(r.headers, req.Header.Clone())
+		r.mu.Unlock()
+		w.WriteHeader(r.status)
+		r.received <- struct{}{}
+	}))
+	t.Cleanup(server.Close)
+	return r, server
+}
+
+// info returns a response with one running instance using the given disk
+// and memory
+func info(diskUsed, memoryUsed int64) collector.MultipassInfoResponse {
+	return collector.MultipassInfoResponse{Info: map[string]collector.MultipassInfoOutput{
+		"dev": {
+			Name:     "dev",
+			State:    "Running",
+			CPUCount: "2",
+			Load:     []float64{1, 0.5, 0.2},
+			Memory:   collector.MemoryInfo{Total: 1000, Used: memoryUsed},
+			Disks:    map[string]collector.DiskInfo{"sda1": {Total: "100", Used: fmt.Sprint(diskUsed)}},
+		},
+	}}
+}
+
+func statuses(notifications []Notification) string {
+	var result []string
+	for _, n := range notifications {
+		result = append(result, n.Status+":"+n.Rule)
+	}
+	return strings.Join(result, ",")
+}
+
+func TestEvaluate_Hysteresis(t *testing.T) {
+	engine, err := New(Options{Rules: []Rule{{Name: "disk_full", Metric: notifyspec.MetricDiskUsage, Threshold: 0.9, ResolveThreshold: 0.8}}})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	now := time.Now()
+
+	if got := engine.Evaluate(info(85, 0), now); len(got) != 0 {
+		t.Errorf("Expected nothing below the threshold, got %s", statuses(got))
+	}
+	got := engine.Evaluate(info(92, 0), now)
+	if statuses(got) != "firing:disk_full" {
+		t.Fatalf("Expected the alert to fire, got %s", statuses(got))
+	}
+	if n := got[0]; n.Instance != "dev" || n.Disk != "sda1" || n.Value != 0.92 || n.Summary != "Disk sda1 of dev is at 92% (threshold 90%)" {
+		t.Errorf("Unexpected notification %+v", n)
+	}
+
+	// Between the thresholds the alert keeps firing without notifying again
+	if got := engine.Evaluate(info(85, 0), now.Add(time.Minute)); len(got) != 0 {
+		t.Errorf("Expected no notification within the hysteresis band, got %s", statuses(got))
+	}
+	if got := engine.Evaluate(info(92, 0), now.Add(2*time.Minute)); len(got) != 0 {
+		t.Errorf("Expected a firing alert not to fire again, got %s", statuses(got))
+	}
+
+	got = engine.Evaluate(info(79, 0), now.Add(3*time.Minute))
+	if statuses(got) != "resolved:disk_full" || got[0].EndsAt == nil || !got[0].StartsAt.Equal(now) {
+		t.Errorf("Expected the alert to resolve, got %+v", got)
+	}
+}
+
+func TestEvaluate_RepeatAndDisappear(t *testing.T) {
+	engine, err := New(Options{
+		Rules: []Rule{
+			{Name: "memory_high", Metric: notifyspec.MetricMemoryUsage, Threshold: 0.9},
+			{Name: "load_high", Metric: notifyspec.MetricLoadPerCPU, Threshold: 2},
+		},
+		RepeatInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	now := time.Now()
+
+	if got := engine.Evaluate(info(0, 950), now); statuses(got) != "firing:memory_high" {
+		t.Fatalf("Expected the memory alert to fire, got %s", statuses(got))
+	}
+	if got := engine.Evaluate(info(0, 950), now.Add(30*time.Minute)); len(got) != 0 {
+		t.Errorf("Expected no repeat before the interval, got %s", statuses(got))
+	}
+	if got := engine.Evaluate(info(0, 960), now.Add(time.Hour)); statuses(got) != "firing:memory_high" || got[0].Value != 0.96 {
+		t.Errorf("Expected a repeat with the current value, got %+v", got)
+	}
+
+	// A stopped instance has no memory data, so its alert resolves
+	stopped := collector.MultipassInfoResponse{Info: map[string]collector.MultipassInfoOutput{"dev": {Name: "dev", State: "Stopped"}}}
+	if got := engine.Evaluate(stopped, now.Add(2*time.Hour)); statuses(got) != "resolved:memory_high" || got[0].Value != 0.96 {
+		t.Errorf("Expected the alert to resolve with its last value, got %+v", got)
+	}
+	if got := testutil.ToFloat64(engine.firing); got != 0 {
+		t.Errorf("Expected no firing alerts, got %v", got)
+	}
+}
+
+func TestRunDeliversToWebhooks(t *testing.T) {
+	slack, slackServer := newReceiver(t, http.StatusOK)
+	generic, genericServer := newReceiver(t, http.StatusOK)
+	engine, err := New(Options{
+		Rules: []Rule{{Name: "disk_full", Metric: notifyspec.MetricDiskUsage, Threshold: 0.9}},
+		Webhooks: []Webhook{
+			{URL: slackServer.URL, Body: `{"text": {{ printf "[%s] %s" .Status .Summary | json }}, "usage": {{ percent .Value | json }}}`},
+			{URL: genericServer.URL, Headers: map[string]string{"Authorization": "Bearer secret"}},
+		},
+		Hostname: "laptop",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go engine.Run(ctx)
+
+	engine.Observe(info(95, 0))
+	engine.Observe(info(50, 0))
+	for _, r := range []*receiver{slack, slack, generic, generic} {
+		select {
+		case <-r.received:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for the webhooks")
+		}
+	}
+
+	slack.mu.Lock()
+	defer slack.mu.Unlock()
+	var message map[string]string
+	if err := json.Unmarshal([]byte(slack.bodies[0]), &message); err != nil {
+		t.Fatalf("Expected a JSON body, got %q", slack.bodies[0])
+	}
+	if message["text"] != "[firing] Disk sda1 of dev is at 95% (threshold 90%)" || message["usage"] != "95%" {
+		t.Errorf("Unexpected templated body %v", message)
+	}
+	if !strings.Contains(slack.bodies[1], "[resolved]") {
+		t.Errorf("Expected a resolved notification, got %q", slack.bodies[1])
+	}
+
+	generic.mu.Lock()
+	defer generic.mu.Unlock()
+	var n Notification
+	if err := json.Unmarshal([]byte(generic.bodies[0]), &n); err != nil {
+		t.Fatalf("Expected the notification as JSON, got %q", generic.bodies[0])
+	}
+	if n.Status != StatusFiring || n.Hostname != "laptop" || n.Disk != "sda1" {
+		t.Errorf("Unexpected notification %+v", n)
+	}
+	if got := generic.headers[0].Get("Authorization"); got != "Bearer secret" {
+		t.Errorf("Expected the configured header, got %q", got)
+	}
+	if got := generic.headers[0].Get("Content-Type"); got != "application/json" {
+		t.Errorf("Expected a JSON content type, got %q", got)
+	}
+}
+
+func TestSend_Failures(t *testing.T) {
+	_, server := newReceiver(t, http.StatusInternalServerError)
+	_, healthy := newReceiver(t, http.StatusNoContent)
+	engine, err := New(Options{Webhooks: []Webhook{
+		{URL: server.URL},
+		{URL: server.URL, Body: `{"text": {{ .Summary }}}`},
+		{URL: healthy.URL},
+	}})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	err = engine.Send(context.Background(), Notification{Status: StatusFiring, Summary: "Memory of dev is at 95%"})
+	if err == nil || !strings.Contains(err.Error(), "500") || !strings.Contains(err.Error(), "not valid JSON") {
+		t.Errorf("Expected the status and the invalid body to be reported, got %v", err)
+	}
+	if got := testutil.ToFloat64(engine.failures); got != 2 {
+		t.Errorf("Expected 2 failures, got %v", got)
+	}
+	if got := testutil.ToFloat64(engine.sent.WithLabelValues(StatusFiring)); got != 1 {
+		t.Errorf("Expected the healthy webhook to still get the notification, got %v", got)
+	}
+}
+
+func TestNew_InvalidBody(t *testing.T) {
+	if _, err := New(Options{Webhooks: []Webhook{{URL: "http://localhost", Body: "{{ .Status"}}}); err == nil {
+		t.Error("Expected error for an invalid body template")
+	}
+}
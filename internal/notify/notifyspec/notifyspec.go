@@ -0,0 +1,50 @@
+// Package notifyspec holds the notification settings the configuration
+// checks, without the collector dependencies of package notify
+package notifyspec
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"text/template"
+)
+
+// Metrics accepted by notify.Rule.Metric
+const (
+	// MetricDiskUsage is the used/total ratio of each disk
+	MetricDiskUsage = "disk_usage"
+	// MetricMemoryUsage is the used/total ratio of the memory
+	MetricMemoryUsage = "memory_usage"
+	// MetricLoadPerCPU is the 1 minute load divided by the number of CPUs
+	MetricLoadPerCPU = "load_per_cpu"
+)
+
+// Metrics lists the metrics rules can watch
+var Metrics = []string{MetricDiskUsage, MetricMemoryUsage, MetricLoadPerCPU}
+
+// templateFuncs are available in body templates: json encodes a value,
+// so strings can be embedded safely, and percent formats a ratio
+var templateFuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+	"percent": Percent,
+}
+
+// Percent formats a ratio as a rounded percentage, e.g. 0.923 as 92%
+func Percent(ratio float64) string {
+	return strconv.FormatFloat(ratio*100, 'f', 0, 64) + "%"
+}
+
+// ParseBody parses a webhook body template; an empty body yields nil
+func ParseBody(body string) (*template.Template, error) {
+	if body == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New("body").Funcs(templateFuncs).Option("missingkey=error").Parse(body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook body template: %w", err)
+	}
+	return tmpl, nil
+}
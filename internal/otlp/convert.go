@@ -0,0 +1,240 @@
+package otlp
+
+import (
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Abuelodelanada/multipass-exporter/internal/collector"
+	"github.com/Abuelodelanada/multipass-exporter/internal/otlp/otlpspec"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+)
+
+// scopeName is the instrumentation scope of every exported metric
+const scopeName = "github.com/Abuelodelanada/multipass-exporter"
+
+// serviceName identifies the exporter in resource attributes
+const serviceName = "multipass-exporter"
+
+// states are always reported by multipass.instances, even with no instance
+// in them, matching the Prometheus metrics
+var states = []string{"Running", "Stopped", "Deleted", "Suspended"}
+
+// Request converts a `multipass info` response into an OTLP export request.
+// Each instance is its own resource, described with the host.* and os.*
+// semantic conventions, since an instance is a host of its own, and
+// identified by service.instance.id <hostname>/<name>. The instance state
+// changes, so it is not part of the resource: a multipass.instance.state
+// gauge carries it as a data point attribute. Instance-level counts go on a
+// resource for the machine running multipass, named by hostname. extra
+// attributes are added to every resource.
+func Request(data collector.MultipassInfoResponse, up bool, hostname string, extra map[string]string, now time.Time) *colmetricpb.ExportMetricsServiceRequest {
+	timestamp := uint64(now.UnixNano())
+
+	upValue := 0.0
+	if up {
+		upValue = 1
+	}
+	hostMetrics := []*metricpb.Metric{
+		gauge("multipass.up", "Whether the last `multipass info` succeeded", "1", point(timestamp, upValue)),
+	}
+	if up {
+		counts := make(map[string]int)
+		for _, info := range data.Info {
+			counts[info.State]++
+		}
+		names := append([]string(nil), states...)
+		for state := range counts {
+			if !contains(names, state) {
+				names = append(names, state)
+			}
+		}
+		sort.Strings(names)
+
+		points := make([]*metricpb.NumberDataPoint, 0, len(names))
+		for _, state := range names {
+			points = append(points, point(timestamp, float64(counts[state]), stringAttribute("multipass.instance.state", state)))
+		}
+		hostMetrics = append(hostMetrics, gauge("multipass.instances", "Number of Multipass instances by state", "{instance}", points...))
+	}
+
+	resources := []*metricpb.ResourceMetrics{
+		resourceMetrics(withExtra([]*commonpb.KeyValue{
+			stringAttribute("service.name", serviceName),
+			stringAttribute("service.instance.id", hostname),
+			stringAttribute("host.name", hostname),
+		}, extra), hostMetrics),
+	}
+
+	names := make([]string, 0, len(data.Info))
+	for name := range data.Info {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		info := data.Info[name]
+		metrics := instanceMetrics(info, timestamp)
+		if len(metrics) == 0 {
+			continue
+		}
+		metrics = append(metrics, gauge("multipass.instance.state", "State of the instance, always 1", "1", point(timestamp, 1, stringAttribute("multipass.instance.state", info.State))))
+		resources = append(resources, resourceMetrics(withExtra(instanceAttributes(name, info, hostname), extra), metrics))
+	}
+
+	return &colmetricpb.ExportMetricsServiceRequest{ResourceMetrics: resources}
+}
+
+// instanceAttributes describes an instance as a resource
+func instanceAttributes(name string, info collector.MultipassInfoOutput, hostname string) []*commonpb.KeyValue {
+	attributes := []*commonpb.KeyValue{
+		stringAttribute("service.name", serviceName),
+		stringAttribute("service.instance.id", hostname+"/"+name),
+		stringAttribute("host.name", name),
+		stringAttribute("os.type", "linux"),
+		stringAttribute("multipass.host.name", hostname),
+	}
+	if len(info.IPv4) > 0 {
+		attributes = append(attributes, stringsAttribute("host.ip", info.IPv4))
+	}
+	if info.Release != "" {
+		attributes = append(attributes, stringAttribute("os.description", info.Release))
+	}
+	if info.ImageRelease != "" {
+		attributes = append(attributes, stringAttribute("host.image.name", info.ImageRelease))
+	}
+	if info.ImageHash != "" {
+		attributes = append(attributes, stringAttribute("host.image.id", info.ImageHash))
+	}
+	return attributes
+}
+
+// instanceMetrics converts the resource usage of an instance into gauges.
+// Values multipass does not report, as for stopped instances, are left out.
+func instanceMetrics(info collector.MultipassInfoOutput, timestamp uint64) []*metricpb.Metric {
+	var metrics []*metricpb.Metric
+
+	if info.Memory.Total > 0 {
+		metrics = append(metrics,
+			gauge("multipass.instance.memory.usage", "Memory used by the instance", "By", point(timestamp, float64(info.Memory.Used))),
+			gauge("multipass.instance.memory.limit", "Memory of the instance", "By", point(timestamp, float64(info.Memory.Total))),
+		)
+	}
+
+	if cpus, err := strconv.Atoi(info.CPUCount); err == nil && cpus > 0 {
+		metrics = append(metrics, gauge("multipass.instance.cpu.count", "Number of CPUs of the instance", "{cpu}", point(timestamp, float64(cpus))))
+	}
+
+	for i, period := range []string{"1m", "5m", "15m"} {
+		if i < len(info.Load) {
+			metrics = append(metrics, gauge("multipass.instance.cpu.load_average."+period, "Load average of the instance over "+period, "{thread}", point(timestamp, info.Load[i])))
+		}
+	}
+
+	devices := make([]string, 0, len(info.Disks))
+	for device := range info.Disks {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+	var used, limit []*metricpb.NumberDataPoint
+	for _, device := range devices {
+		disk := info.Disks[device]
+		if value, err := strconv.ParseFloat(disk.Used, 64); err == nil {
+			used = append(used, point(timestamp, value, stringAttribute("system.device", device)))
+		}
+		if value, err := strconv.ParseFloat(disk.Total, 64); err == nil {
+			limit = append(limit, point(timestamp, value, stringAttribute("system.device", device)))
+		}
+	}
+	if len(used) > 0 {
+		metrics = append(metrics, gauge("multipass.instance.disk.usage", "Disk space used by the instance", "By", used...))
+	}
+	if len(limit) > 0 {
+		metrics = append(metrics, gauge("multipass.instance.disk.limit", "Disk space of the instance", "By", limit...))
+	}
+
+	return metrics
+}
+
+func resourceMetrics(attributes []*commonpb.KeyValue, metrics []*metricpb.Metric) *metricpb.ResourceMetrics {
+	return &metricpb.ResourceMetrics{
+		Resource: &resourcepb.Resource{Attributes: attributes},
+		ScopeMetrics: []*metricpb.ScopeMetrics{{
+			Scope:   &commonpb.InstrumentationScope{Name: scopeName},
+			Metrics: metrics,
+		}},
+	}
+}
+
+func gauge(name, description, unit string, points ...*metricpb.NumberDataPoint) *metricpb.Metric {
+	return &metricpb.Metric{
+		Name:        name,
+		Description: description,
+		Unit:        unit,
+		Data:        &metricpb.Metric_Gauge{Gauge: &metricpb.Gauge{DataPoints: points}},
+	}
+}
+
+func point(timestamp uint64, value float64, attributes ...*commonpb.KeyValue) *metricpb.NumberDataPoint {
+	return &metricpb.NumberDataPoint{
+		Attributes:   attributes,
+		TimeUnixNano: timestamp,
+		Value:        &metricpb.NumberDataPoint_AsDouble{AsDouble: value},
+	}
+}
+
+func stringAttribute(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{
+		Key:   key,
+		Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}},
+	}
+}
+
+func stringsAttribute(key string, values []string) *commonpb.KeyValue {
+	array := &commonpb.ArrayValue{}
+	for _, value := range values {
+		array.Values = append(array.Values, &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}})
+	}
+	return &commonpb.KeyValue{
+		Key:   key,
+		Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{ArrayValue: array}},
+	}
+}
+
+// withExtra adds the extra attributes, sorted by key, replacing existing
+// attributes of the same key other than the otlpspec.IdentityAttributes
+func withExtra(attributes []*commonpb.KeyValue, extra map[string]string) []*commonpb.KeyValue {
+	keys := make([]string, 0, len(extra))
+	for key := range extra {
+		if !slices.Contains(otlpspec.IdentityAttributes, key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		replaced := false
+		for i, attribute := range attributes {
+			if attribute.Key == key {
+				attributes[i] = stringAttribute(key, extra[key])
+				replaced = true
+			}
+		}
+		if !replaced {
+			attributes = append(attributes, stringAttribute(key, extra[key]))
+		}
+	}
+	return attributes
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,232 @@
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Abuelodelanada/multipass-exporter/internal/collector"
+	"github.com/Abuelodelanada/multipass-exporter/internal/logging"
+	"github.com/Abuelodelanada/multipass-exporter/internal/otlp/otlpspec"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// metricsPath is appended to HTTP endpoints given without a path
+const metricsPath = "/v1/metrics"
+
+// InfoSource provides the parsed output of `multipass info`
+type InfoSource interface {
+	Info() (collector.MultipassInfoResponse, error)
+}
+
+// Options configures an Exporter
+type Options struct {
+	// Endpoint is host:port or a URL for gRPC, and a URL for HTTP, where
+	// an empty path means /v1/metrics
+	Endpoint string
+	// Protocol is otlpspec.ProtocolGRPC or otlpspec.ProtocolHTTPProtobuf
+	Protocol string
+	// Insecure disables TLS for gRPC endpoints given as host:port
+	Insecure bool
+	// Headers are sent with every export, e.g. for authentication
+	Headers map[string]string
+	// ResourceAttributes are added to every resource
+	ResourceAttributes map[string]string
+	// Hostname names the machine running multipass
+	Hostname string
+	// Interval is the time between two exports
+	Interval time.Duration
+	// Timeout bounds each export; zero means no timeout
+	Timeout time.Duration
+}
+
+// Exporter periodically converts `multipass info` into OTLP gauges and
+// sends them to an OpenTelemetry Collector or any other OTLP receiver
+type Exporter struct {
+	opts   Options
+	source InfoSource
+	send   func(context.Context, *colmetricpb.ExportMetricsServiceRequest) error
+	close  func() error
+	logger *logrus.Logger
+
+	lastSuccess prometheus.Gauge
+	failures    prometheus.Counter
+}
+
+// New creates an Exporter for opts reading instances from source. opts are
+// not checked here: config.Validate reports invalid OTLP settings. gRPC
+// connections are established lazily, so an unreachable receiver is not
+// an error here.
+func New(opts Options, source InfoSource) (*Exporter, error) {
+	e := &Exporter{
+		opts:   opts,
+		source: source,
+		logger: logging.New(),
+		lastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "multipass_exporter_otlp_last_success_timestamp_seconds",
+			Help: "Timestamp of the last successful OTLP export",
+		}),
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "multipass_exporter_otlp_failures_total",
+			Help: "Total number of OTLP exports that failed",
+		}),
+	}
+
+	setup := e.dialGRPC
+	if opts.Protocol == otlpspec.ProtocolHTTPProtobuf {
+		setup = e.setupHTTP
+	}
+	if err := setup(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// dialGRPC sets up the gRPC transport. A URL endpoint selects TLS with its
+// scheme; a host:port endpoint uses TLS unless Insecure is set.
+func (e *Exporter) dialGRPC() error {
+	target, secure := e.opts.Endpoint, !e.opts.Insecure
+	if u, err := url.Parse(e.opts.Endpoint); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		target, secure = u.Host, u.Scheme == "https"
+	}
+
+	creds := insecure.NewCredentials()
+	if secure {
+		creds = credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	}
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return fmt.Errorf("invalid OTLP endpoint %q: %w", e.opts.Endpoint, err)
+	}
+
+	client := colmetricpb.NewMetricsServiceClient(conn)
+	e.send = func(ctx context.Context, req *colmetricpb.ExportMetricsServiceRequest) error {
+		if len(e.opts.Headers) > 0 {
+			ctx = metadata.NewOutgoingContext(ctx, metadata.New(e.opts.Headers))
+		}
+		resp, err := client.Export(ctx, req)
+		if err != nil {
+			return fmt.Errorf("OTLP export failed: %w", err)
+		}
+		if rejected := resp.GetPartialSuccess().GetRejectedDataPoints(); rejected > 0 {
+			return fmt.Errorf("OTLP receiver rejected %d data points: %s", rejected, resp.GetPartialSuccess().GetErrorMessage())
+		}
+		return nil
+	}
+	e.close = conn.Close
+	return nil
+}
+
+// setupHTTP sets up the HTTP/protobuf transport
+func (e *Exporter) setupHTTP() error {
+	u, err := url.Parse(e.opts.Endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid OTLP endpoint %q: %w", e.opts.Endpoint, err)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = metricsPath
+	}
+	endpoint := u.String()
+	client := &http.Client{}
+
+	e.send = func(ctx context.Context, req *colmetricpb.ExportMetricsServiceRequest) error {
+		body, err := proto.Marshal(req)
+		if err != nil {
+			return fmt.Errorf("failed to encode OTLP request: %w", err)
+		}
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("failed to create OTLP request: %w", err)
+		}
+		httpReq.Header.Set("Content-Type", "application/x-protobuf")
+		for name, value := range e.opts.Headers {
+			httpReq.Header.Set(name, value)
+		}
+
+		resp, err := client.Do(httpReq)
+		if err != nil {
+			return fmt.Errorf("OTLP export failed: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			return fmt.Errorf("OTLP receiver returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+		}
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	e.close = func() error { return nil }
+	return nil
+}
+
+// SetLogger replaces the exporter's own logger
+func (e *Exporter) SetLogger(logger *logrus.Logger) {
+	e.logger = logger
+}
+
+// Collectors returns the metrics describing the exporter's own health
+func (e *Exporter) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{e.lastSuccess, e.failures}
+}
+
+// Export reads the instances once and sends them. When `multipass info`
+// fails, multipass.up is still sent, with value 0.
+func (e *Exporter) Export(ctx context.Context) error {
+	data, err := e.source.Info()
+	up := err == nil
+	if err != nil {
+		e.logger.WithError(err).Error("Failed to get multipass info for OTLP export")
+	}
+
+	if e.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.opts.Timeout)
+		defer cancel()
+	}
+
+	req := Request(data, up, e.opts.Hostname, e.opts.ResourceAttributes, time.Now())
+	if err := e.send(ctx, req); err != nil {
+		e.failures.Inc()
+		return err
+	}
+	e.lastSuccess.SetToCurrentTime()
+	return nil
+}
+
+// Run exports right away and then every interval until ctx is done
+func (e *Exporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := e.Export(ctx); err != nil {
+			e.logger.WithError(err).Errorf("Failed to export metrics to %s", e.opts.Endpoint)
+		} else {
+			e.logger.WithField("endpoint", e.opts.Endpoint).Debug("Exported metrics with OTLP")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close releases the connection to the receiver
+func (e *Exporter) Close() error {
+	return e.close()
+}
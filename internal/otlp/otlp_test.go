@@ -0,0 +1,291 @@
+package otlp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Abuelodelanada/multipass-exporter/internal/collector"
+	"github.com/Abuelodelanada/multipass-exporter/internal/otlp/otlpspec"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// staticSource returns a fixed `multipass info` response
+type staticSource struct {
+	data collector.MultipassInfoResponse
+	err  error
+}
+
+func (s staticSource) Info() (collector.MultipassInfoResponse, error) {
+	return s.data, s.err
+}
+
+var testInfo = collector.MultipassInfoResponse{Info: map[string]collector.MultipassInfoOutput{
+	"charm-dev-36": {
+		Name:         "charm-dev-36",
+		State:        "Running",
+		IPv4:         []string{"10.0.0.2"},
+		Release:      "Ubuntu 24.04 LTS",
+		ImageRelease: "24.04 LTS",
+		ImageHash:    "a1b2c3",
+		Load:         []float64{0.1, 0.2, 0.3},
+		CPUCount:     "2",
+		Memory:       collector.MemoryInfo{Total: 2147483648, Used: 1073741824},
+		Disks:        map[string]collector.DiskInfo{"sda1": {Total: "10737418240", Used: "1073741824"}},
+	},
+	"coslite": {Name: "coslite", State: "Stopped"},
+}}
+
+// grpcReceiver is an OTLP gRPC receiver stand-in recording every request
+type grpcReceiver struct {
+	colmetricpb.UnimplementedMetricsServiceServer
+	mu       sync.Mutex
+	requests []*colmetricpb.ExportMetricsServiceRequest
+	headers  []metadata.MD
+}
+
+func (r *grpcReceiver) Export(ctx context.Context, req *colmetricpb.ExportMetricsServiceRequest) (*colmetricpb.ExportMetricsServiceResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req)
+	r.headers = append(r.headers, md)
+	return &colmetricpb.ExportMetricsServiceResponse{}, nil
+}
+
+func startGRPCReceiver(t *testing.T) (*grpcReceiver, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	receiver := &grpcReceiver{}
+	server := grpc.NewServer()
+	colmetricpb.RegisterMetricsServiceServer(server, receiver)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return receiver, listener.Addr().String()
+}
+
+// attributes flattens string attributes into a map
+func attributes(kvs []*commonpb.KeyValue) map[string]string {
+	values := make(map[string]string)
+	for _, kv := range kvs {
+		values[kv.GetKey()] = kv.GetValue().GetStringValue()
+	}
+	return values
+}
+
+// resourceFor finds the resource whose host.name is name
+func resourceFor(req *colmetricpb.ExportMetricsServiceRequest, name string) *metricpb.ResourceMetrics {
+	for _, rm := range req.GetResourceMetrics() {
+		if attributes(rm.GetResource().GetAttributes())["host.name"] == name {
+			return rm
+		}
+	}
+	return nil
+}
+
+// gaugeValues maps the metric names of a resource to their first data point
+func gaugeValues(rm *metricpb.ResourceMetrics) map[string]float64 {
+	values := make(map[string]float64)
+	for _, sm := range rm.GetScopeMetrics() {
+		for _, metric := range sm.GetMetrics() {
+			if points := metric.GetGauge().GetDataPoints(); len(points) > 0 {
+				values[metric.GetName()] = points[0].GetAsDouble()
+			}
+		}
+	}
+	return values
+}
+
+func TestRequest(t *testing.T) {
+	req := Request(testInfo, true, "lab-1", map[string]string{"deployment.environment": "dev"}, time.Now())
+
+	instance := resourceFor(req, "charm-dev-36")
+	if instance == nil {
+		t.Fatalf("Expected a resource for charm-dev-36, got %v", req)
+	}
+	attrs := attributes(instance.GetResource().GetAttributes())
+	for key, want := range map[string]string{
+		"os.type":                "linux",
+		"os.description":         "Ubuntu 24.04 LTS",
+		"host.image.name":        "24.04 LTS",
+		"host.image.id":          "a1b2c3",
+		"service.instance.id":    "lab-1/charm-dev-36",
+		"multipass.host.name":    "lab-1",
+		"deployment.environment": "dev",
+	} {
+		if attrs[key] != want {
+			t.Errorf("Expected resource attribute %s=%q, got %q", key, want, attrs[key])
+		}
+	}
+	for _, kv := range instance.GetResource().GetAttributes() {
+		if kv.GetKey() == "host.ip" && kv.GetValue().GetArrayValue().GetValues()[0].GetStringValue() != "10.0.0.2" {
+			t.Errorf("Expected host.ip [10.0.0.2], got %v", kv.GetValue())
+		}
+	}
+
+	values := gaugeValues(instance)
+	for name, want := range map[string]float64{
+		"multipass.instance.memory.usage":         1073741824,
+		"multipass.instance.memory.limit":         2147483648,
+		"multipass.instance.cpu.count":            2,
+		"multipass.instance.cpu.load_average.15m": 0.3,
+		"multipass.instance.disk.usage":           1073741824,
+		"multipass.instance.disk.limit":           10737418240,
+		"multipass.instance.state":                1,
+	} {
+		if values[name] != want {
+			t.Errorf("Expected %s %v, got %v", name, want, values[name])
+		}
+	}
+	if _, ok := attrs["multipass.instance.state"]; ok {
+		t.Error("Expected the instance state not to be a resource attribute")
+	}
+	for _, metric := range instance.GetScopeMetrics()[0].GetMetrics() {
+		if metric.GetName() != "multipass.instance.state" {
+			continue
+		}
+		if state := attributes(metric.GetGauge().GetDataPoints()[0].GetAttributes())["multipass.instance.state"]; state != "Running" {
+			t.Errorf("Expected the state Running on the data point, got %q", state)
+		}
+	}
+
+	// A stopped instance reports no usage, so it has no resource
+	if resourceFor(req, "coslite") != nil {
+		t.Error("Expected no resource for an instance without metrics")
+	}
+
+	host := resourceFor(req, "lab-1")
+	if host == nil {
+		t.Fatal("Expected a resource for the multipass host")
+	}
+	if up := gaugeValues(host)["multipass.up"]; up != 1 {
+		t.Errorf("Expected multipass.up 1, got %v", up)
+	}
+}
+
+func TestRequest_ExtraKeepsIdentity(t *testing.T) {
+	req := Request(testInfo, true, "lab-1", map[string]string{"host.name": "lab", "service.name": "lab", "service.instance.id": "lab", "os.type": "ubuntu"}, time.Now())
+
+	instance := resourceFor(req, "charm-dev-36")
+	if instance == nil {
+		t.Fatalf("Expected the instance to keep its host.name, got %v", req)
+	}
+	attrs := attributes(instance.GetResource().GetAttributes())
+	if attrs["service.name"] != serviceName || attrs["service.instance.id"] != "lab-1/charm-dev-36" || attrs["os.type"] != "ubuntu" {
+		t.Errorf("Expected only the non-identity attributes to be replaced, got %v", attrs)
+	}
+	if resourceFor(req, "lab-1") == nil {
+		t.Error("Expected the multipass host to keep its host.name")
+	}
+}
+
+func TestExport_GRPC(t *testing.T) {
+	receiver, addr := startGRPCReceiver(t)
+
+	exporter, err := New(Options{
+		Endpoint: addr,
+		Protocol: otlpspec.ProtocolGRPC,
+		Insecure: true,
+		Headers:  map[string]string{"authorization": "Bearer token"},
+		Hostname: "lab-1",
+		Interval: time.Minute,
+		Timeout:  5 * time.Second,
+	}, staticSource{data: testInfo})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer exporter.Close()
+
+	if err := exporter.Export(context.Background()); err != nil {
+		t.Fatalf("Expected export to succeed, got %v", err)
+	}
+
+	if len(receiver.requests) != 1 {
+		t.Fatalf("Expected 1 export, got %d", len(receiver.requests))
+	}
+	if resourceFor(receiver.requests[0], "charm-dev-36") == nil {
+		t.Error("Expected instance metrics in the export")
+	}
+	if got := receiver.headers[0].Get("authorization"); len(got) != 1 || got[0] != "Bearer token" {
+		t.Errorf("Expected authorization header, got %v", got)
+	}
+	if got := testutil.ToFloat64(exporter.lastSuccess); got == 0 {
+		t.Error("Expected last success timestamp to be set")
+	}
+}
+
+func TestExport_HTTP(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		paths    []string
+		requests []*colmetricpb.ExportMetricsServiceRequest
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req := &colmetricpb.ExportMetricsServiceRequest{}
+		if r.Header.Get("Content-Type") != "application/x-protobuf" || proto.Unmarshal(body, req) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		paths = append(paths, r.URL.Path)
+		requests = append(requests, req)
+	}))
+	defer server.Close()
+
+	exporter, err := New(Options{
+		Endpoint: server.URL,
+		Protocol: otlpspec.ProtocolHTTPProtobuf,
+		Hostname: "lab-1",
+		Interval: time.Minute,
+	}, staticSource{err: errors.New("multipassd is not running")})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if err := exporter.Export(context.Background()); err != nil {
+		t.Fatalf("Expected export to succeed, got %v", err)
+	}
+
+	if len(requests) != 1 || paths[0] != "/v1/metrics" {
+		t.Fatalf("Expected 1 export to /v1/metrics, got %v", paths)
+	}
+	host := resourceFor(requests[0], "lab-1")
+	if host == nil || gaugeValues(host)["multipass.up"] != 0 {
+		t.Errorf("Expected multipass.up 0 when multipass info fails, got %v", requests[0])
+	}
+}
+
+func TestExport_HTTPError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	exporter, err := New(Options{Endpoint: server.URL, Protocol: otlpspec.ProtocolHTTPProtobuf, Interval: time.Minute}, staticSource{data: testInfo})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := exporter.Export(context.Background()); err == nil {
+		t.Fatal("Expected export to fail")
+	}
+	if got := testutil.ToFloat64(exporter.failures); got != 1 {
+		t.Errorf("Expected 1 failure counted, got %v", got)
+	}
+}
@@ -0,0 +1,17 @@
+// Package otlpspec holds the OTLP exporter settings the configuration
+// checks, without the protobuf and gRPC dependencies of package otlp
+package otlpspec
+
+// Protocols accepted by otlp.Options.Protocol
+const (
+	ProtocolGRPC         = "grpc"
+	ProtocolHTTPProtobuf = "http/protobuf"
+)
+
+// Protocols lists the supported OTLP transports
+var Protocols = []string{ProtocolGRPC, ProtocolHTTPProtobuf}
+
+// IdentityAttributes identify each resource, so extra attributes never
+// replace them: a single host.name on every instance would merge the
+// instances into one
+var IdentityAttributes = []string{"host.name", "service.name", "service.instance.id"}
@@ -0,0 +1,145 @@
+package push
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/Abuelodelanada/multipass-exporter/internal/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/sirupsen/logrus"
+)
+
+// Options configures a Pusher
+type Options struct {
+	// URL is the Pushgateway base URL, e.g. http://pushgateway:9091
+	URL string
+	// Job is the job label of the pushed group
+	Job string
+	// Grouping holds the other labels of the group; see DefaultGrouping
+	Grouping map[string]string
+	// Interval is the time between two pushes
+	Interval time.Duration
+	// Timeout bounds each push attempt; zero means no timeout
+	Timeout time.Duration
+	// Username and Password enable basic auth when Username is set
+	Username string
+	Password string
+	// MaxRetries is how many times a failed push is retried
+	MaxRetries int
+	// Backoff is the wait before the first retry, doubled after each one
+	// and capped at Interval
+	Backoff time.Duration
+}
+
+// DefaultGrouping returns the grouping used when none is configured:
+// the host name as the instance label
+func DefaultGrouping() (map[string]string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hostname: %w", err)
+	}
+	return map[string]string{"instance": hostname}, nil
+}
+
+// Pusher gathers metrics and pushes them to a Pushgateway, replacing the
+// previous push of its group
+type Pusher struct {
+	opts     Options
+	gatherer prometheus.Gatherer
+	client   *http.Client
+	logger   *logrus.Logger
+
+	lastSuccess prometheus.Gauge
+	failures    prometheus.Counter
+}
+
+// New creates a Pusher sending what gatherer collects
+func New(opts Options, gatherer prometheus.Gatherer) *Pusher {
+	return &Pusher{
+		opts:     opts,
+		gatherer: gatherer,
+		client:   &http.Client{Timeout: opts.Timeout},
+		logger:   logging.New(),
+		lastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "multipass_exporter_push_last_success_timestamp_seconds",
+			Help: "Timestamp of the last successful push to the Pushgateway",
+		}),
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "multipass_exporter_push_failures_total",
+			Help: "Total number of push attempts to the Pushgateway that failed",
+		}),
+	}
+}
+
+// SetLogger replaces the pusher's own logger
+func (p *Pusher) SetLogger(logger *logrus.Logger) {
+	p.logger = logger
+}
+
+// Collectors returns the metrics describing the pusher's own health
+func (p *Pusher) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{p.lastSuccess, p.failures}
+}
+
+// Push gathers and pushes once, retrying with exponential backoff. It
+// returns the last error when every attempt failed or ctx is done.
+func (p *Pusher) Push(ctx context.Context) error {
+	backoff := p.opts.Backoff
+	for attempt := 0; ; attempt++ {
+		err := p.push(ctx)
+		if err == nil {
+			p.lastSuccess.SetToCurrentTime()
+			return nil
+		}
+		p.failures.Inc()
+		if attempt >= p.opts.MaxRetries {
+			return err
+		}
+
+		p.logger.WithError(err).WithField("retry_in", backoff).Warn("Push to Pushgateway failed, retrying")
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if p.opts.Interval > 0 && backoff > p.opts.Interval {
+			backoff = p.opts.Interval
+		}
+	}
+}
+
+func (p *Pusher) push(ctx context.Context) error {
+	pusher := push.New(p.opts.URL, p.opts.Job).Gatherer(p.gatherer).Client(p.client)
+	for name, value := range p.opts.Grouping {
+		pusher = pusher.Grouping(name, value)
+	}
+	if p.opts.Username != "" {
+		pusher = pusher.BasicAuth(p.opts.Username, p.opts.Password)
+	}
+	return pusher.PushContext(ctx)
+}
+
+// Run pushes right away and then every interval until ctx is done
+func (p *Pusher) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := p.Push(ctx); err != nil {
+			p.logger.WithError(err).Errorf("Failed to push metrics to %s", p.opts.URL)
+		} else {
+			p.logger.WithField("url", p.opts.URL).Debug("Pushed metrics to Pushgateway")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
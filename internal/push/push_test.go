@@ -0,0 +1,178 @@
+package push
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// gateway is an httptest stand-in for a Pushgateway that records pushes
+// and fails the first failures of them
+type gateway struct {
+	mu       sync.Mutex
+	failures int
+	requests []*http.Request
+	bodies   []string
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.requests = append(g.requests, r)
+	g.bodies = append(g.bodies, string(body))
+	if g.failures > 0 {
+		g.failures--
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (g *gateway) pushes() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.requests)
+}
+
+func testRegistry(t *testing.T) *prometheus.Registry {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "multipass_instances_total", Help: "Total"})
+	gauge.Set(3)
+	registry.MustRegister(gauge)
+	return registry
+}
+
+func TestPush(t *testing.T) {
+	gw := &gateway{}
+	server := httptest.NewServer(gw)
+	defer server.Close()
+
+	pusher := New(Options{
+		URL:      server.URL,
+		Job:      "multipass_exporter",
+		Grouping: map[string]string{"instance": "laptop-1"},
+		Username: "user",
+		Password: "secret",
+		Interval: time.Minute,
+	}, testRegistry(t))
+
+	if err := pusher.Push(context.Background()); err != nil {
+		t.Fatalf("Expected push to succeed, got %v", err)
+	}
+
+	if len(gw.requests) != 1 {
+		t.Fatalf("Expected 1 push, got %d", len(gw.requests))
+	}
+	request := gw.requests[0]
+	if request.Method != http.MethodPut {
+		t.Errorf("Expected PUT to replace the group, got %s", request.Method)
+	}
+	if want := "/metrics/job/multipass_exporter/instance/laptop-1"; request.URL.Path != want {
+		t.Errorf("Expected path %s, got %s", want, request.URL.Path)
+	}
+	if user, password, ok := request.BasicAuth(); !ok || user != "user" || password != "secret" {
+		t.Errorf("Expected basic auth user:secret, got %q:%q (%v)", user, password, ok)
+	}
+	if !strings.HasPrefix(request.Header.Get("Content-Type"), "application/vnd.google.protobuf") {
+		t.Errorf("Expected protobuf body, got content type %q", request.Header.Get("Content-Type"))
+	}
+	if gw.bodies[0] == "" {
+		t.Error("Expected metrics in the push body")
+	}
+	if got := testutil.ToFloat64(pusher.lastSuccess); got == 0 {
+		t.Error("Expected last success timestamp to be set")
+	}
+}
+
+func TestPush_RetriesWithBackoff(t *testing.T) {
+	gw := &gateway{failures: 2}
+	server := httptest.NewServer(gw)
+	defer server.Close()
+
+	pusher := New(Options{
+		URL:        server.URL,
+		Job:        "multipass_exporter",
+		Interval:   time.Minute,
+		MaxRetries: 3,
+		Backoff:    time.Millisecond,
+	}, testRegistry(t))
+
+	if err := pusher.Push(context.Background()); err != nil {
+		t.Fatalf("Expected push to succeed after retries, got %v", err)
+	}
+	if got := gw.pushes(); got != 3 {
+		t.Errorf("Expected 3 attempts, got %d", got)
+	}
+	if got := testutil.ToFloat64(pusher.failures); got != 2 {
+		t.Errorf("Expected 2 failures counted, got %v", got)
+	}
+}
+
+func TestPush_GivesUpAfterMaxRetries(t *testing.T) {
+	gw := &gateway{failures: 10}
+	server := httptest.NewServer(gw)
+	defer server.Close()
+
+	pusher := New(Options{
+		URL:        server.URL,
+		Job:        "multipass_exporter",
+		Interval:   time.Minute,
+		MaxRetries: 2,
+		Backoff:    time.Millisecond,
+	}, testRegistry(t))
+
+	if err := pusher.Push(context.Background()); err == nil {
+		t.Fatal("Expected push to fail")
+	}
+	if got := gw.pushes(); got != 3 {
+		t.Errorf("Expected 1 attempt and 2 retries, got %d", got)
+	}
+	if got := testutil.ToFloat64(pusher.lastSuccess); got != 0 {
+		t.Errorf("Expected no successful push, got timestamp %v", got)
+	}
+}
+
+func TestRun_PushesPeriodically(t *testing.T) {
+	gw := &gateway{}
+	server := httptest.NewServer(gw)
+	defer server.Close()
+
+	pusher := New(Options{
+		URL:      server.URL,
+		Job:      "multipass_exporter",
+		Interval: 5 * time.Millisecond,
+	}, testRegistry(t))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go pusher.Run(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for gw.pushes() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected periodic pushes, got %d", gw.pushes())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDefaultGrouping(t *testing.T) {
+	grouping, err := DefaultGrouping()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if grouping["instance"] == "" {
+		t.Errorf("Expected the hostname as instance, got %v", grouping)
+	}
+}
@@ -0,0 +1,157 @@
+package remotewrite
+
+import (
+	"math"
+	"sort"
+	"strconv"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers of the remote-write 1.0 messages, from prompb/remote.proto
+// and prompb/types.proto in the Prometheus repository
+const (
+	writeRequestTimeseries protowire.Number = 1
+	timeSeriesLabels       protowire.Number = 1
+	timeSeriesSamples      protowire.Number = 2
+	labelName              protowire.Number = 1
+	labelValue             protowire.Number = 2
+	sampleValue            protowire.Number = 1
+	sampleTimestamp        protowire.Number = 2
+)
+
+// Label is a name and value pair of a time series
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is a value at a time in milliseconds since the epoch
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+// TimeSeries is a set of samples sharing the same labels, the metric name
+// included as __name__
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+// Series converts gathered metric families into time series, one sample
+// each, stamped with nowMs unless the metric carries its own timestamp.
+// Summaries and histograms are split into their _sum, _count, quantile
+// and _bucket series. External labels are added to series that do not
+// already have them, and labels are sorted by name as the protocol requires.
+func Series(families []*dto.MetricFamily, external map[string]string, nowMs int64) []TimeSeries {
+	var series []TimeSeries
+	for _, family := range families {
+		name := family.GetName()
+		for _, metric := range family.GetMetric() {
+			timestamp := nowMs
+			if metric.TimestampMs != nil {
+				timestamp = metric.GetTimestampMs()
+			}
+			add := func(suffix string, value float64, extra ...Label) {
+				labels := make([]Label, 0, len(metric.GetLabel())+len(extra)+len(external)+1)
+				labels = append(labels, Label{Name: "__name__", Value: name + suffix})
+				for _, pair := range metric.GetLabel() {
+					labels = append(labels, Label{Name: pair.GetName(), Value: pair.GetValue()})
+				}
+				labels = append(labels, extra...)
+				series = append(series, TimeSeries{
+					Labels:  withExternal(labels, external),
+					Samples: []Sample{{Value: value, Timestamp: timestamp}},
+				})
+			}
+
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", metric.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add("", metric.GetGauge().GetValue())
+			case dto.MetricType_SUMMARY:
+				summary := metric.GetSummary()
+				for _, quantile := range summary.GetQuantile() {
+					add("", quantile.GetValue(), Label{Name: "quantile", Value: formatFloat(quantile.GetQuantile())})
+				}
+				add("_sum", summary.GetSampleSum())
+				add("_count", float64(summary.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+				histogram := metric.GetHistogram()
+				infSeen := false
+				for _, bucket := range histogram.GetBucket() {
+					infSeen = infSeen || math.IsInf(bucket.GetUpperBound(), 1)
+					add("_bucket", float64(bucket.GetCumulativeCount()), Label{Name: "le", Value: formatFloat(bucket.GetUpperBound())})
+				}
+				if !infSeen {
+					add("_bucket", float64(histogram.GetSampleCount()), Label{Name: "le", Value: "+Inf"})
+				}
+				add("_sum", histogram.GetSampleSum())
+				add("_count", float64(histogram.GetSampleCount()))
+			default:
+				add("", metric.GetUntyped().GetValue())
+			}
+		}
+	}
+	return series
+}
+
+// withExternal adds the external labels missing from labels and sorts them
+func withExternal(labels []Label, external map[string]string) []Label {
+	present := make(map[string]bool, len(labels))
+	for _, label := range labels {
+		present[label.Name] = true
+	}
+	for name, value := range external {
+		if !present[name] {
+			labels = append(labels, Label{Name: name, Value: value})
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	return labels
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Marshal encodes series as a remote-write WriteRequest protobuf
+func Marshal(series []TimeSeries) []byte {
+	var buf []byte
+	for _, ts := range series {
+		buf = protowire.AppendTag(buf, writeRequestTimeseries, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, marshalTimeSeries(ts))
+	}
+	return buf
+}
+
+func marshalTimeSeries(ts TimeSeries) []byte {
+	var buf []byte
+	for _, label := range ts.Labels {
+		var msg []byte
+		msg = protowire.AppendTag(msg, labelName, protowire.BytesType)
+		msg = protowire.AppendString(msg, label.Name)
+		msg = protowire.AppendTag(msg, labelValue, protowire.BytesType)
+		msg = protowire.AppendString(msg, label.Value)
+
+		buf = protowire.AppendTag(buf, timeSeriesLabels, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, msg)
+	}
+	for _, sample := range ts.Samples {
+		var msg []byte
+		msg = protowire.AppendTag(msg, sampleValue, protowire.Fixed64Type)
+		msg = protowire.AppendFixed64(msg, math.Float64bits(sample.Value))
+		msg = protowire.AppendTag(msg, sampleTimestamp, protowire.VarintType)
+		msg = protowire.AppendVarint(msg, uint64(sample.Timestamp))
+
+		buf = protowire.AppendTag(buf, timeSeriesSamples, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, msg)
+	}
+	return buf
+}
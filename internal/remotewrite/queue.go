@@ -0,0 +1,170 @@
+package remotewrite
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// batchSuffix marks queued write requests in the queue directory
+const batchSuffix = ".batch"
+
+// Queue holds compressed write requests, oldest first, until they are sent.
+// With a directory each request is a file there, so requests survive
+// restarts and sleep; without one they are kept in memory. Beyond
+// maxBatches requests the oldest are dropped. A Queue is safe for
+// concurrent use, e.g. by a sender and a scrape reading its length.
+type Queue struct {
+	dir        string
+	maxBatches int
+
+	mu     sync.Mutex
+	memory [][]byte
+	// files lists the queued request files, oldest first, so the directory
+	// is only read when the queue is opened
+	files []string
+	last  int64
+}
+
+// NewQueue opens the queue in dir, creating it when needed, or an
+// in-memory queue when dir is empty. A zero maxBatches means no limit.
+// Files left half-written by a crash are removed.
+func NewQueue(dir string, maxBatches int) (*Queue, error) {
+	q := &Queue{dir: dir, maxBatches: maxBatches}
+	if dir == "" {
+		return q, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create queue directory: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queue directory: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		switch {
+		case strings.HasSuffix(entry.Name(), batchSuffix+".tmp"):
+			if err := os.Remove(path); err != nil {
+				return nil, fmt.Errorf("failed to remove incomplete write request: %w", err)
+			}
+		case strings.HasSuffix(entry.Name(), batchSuffix):
+			q.files = append(q.files, path)
+			if n, err := strconv.ParseInt(strings.TrimSuffix(entry.Name(), batchSuffix), 10, 64); err == nil && n > q.last {
+				q.last = n
+			}
+		}
+	}
+	return q, nil
+}
+
+// Push appends a request and returns how many old requests were dropped
+// to stay within the limit
+func (q *Queue) Push(batch []byte) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.dir == "" {
+		q.memory = append(q.memory, batch)
+	} else if err := q.write(batch); err != nil {
+		return 0, err
+	}
+
+	dropped := 0
+	for q.maxBatches > 0 && q.len() > q.maxBatches {
+		if err := q.pop(); err != nil {
+			return dropped, err
+		}
+		dropped++
+	}
+	return dropped, nil
+}
+
+// write stores batch in a new file named after the time, so that lexical
+// order is queue order. The file is renamed into place once complete.
+// q.mu must be held.
+func (q *Queue) write(batch []byte) error {
+	name := time.Now().UnixNano()
+	if name <= q.last {
+		name = q.last + 1
+	}
+	q.last = name
+
+	path := filepath.Join(q.dir, fmt.Sprintf("%020d%s", name, batchSuffix))
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, batch, 0600); err != nil {
+		return fmt.Errorf("failed to queue write request: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to queue write request: %w", err)
+	}
+	q.files = append(q.files, path)
+	return nil
+}
+
+// Len returns the number of queued requests
+func (q *Queue) Len() (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.len(), nil
+}
+
+func (q *Queue) len() int {
+	if q.dir == "" {
+		return len(q.memory)
+	}
+	return len(q.files)
+}
+
+// Peek returns the oldest request, or false when the queue is empty
+func (q *Queue) Peek() ([]byte, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.dir == "" {
+		if len(q.memory) == 0 {
+			return nil, false, nil
+		}
+		return q.memory[0], true, nil
+	}
+	if len(q.files) == 0 {
+		return nil, false, nil
+	}
+	data, err := os.ReadFile(q.files[0])
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read queued write request: %w", err)
+	}
+	return data, true, nil
+}
+
+// Pop removes the oldest request
+func (q *Queue) Pop() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pop()
+}
+
+func (q *Queue) pop() error {
+	if q.dir == "" {
+		if len(q.memory) > 0 {
+			q.memory = q.memory[1:]
+		}
+		return nil
+	}
+	if len(q.files) == 0 {
+		return nil
+	}
+	if err := os.Remove(q.files[0]); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove queued write request: %w", err)
+	}
+	q.files = q.files[1:]
+	return nil
+}
@@ -0,0 +1,199 @@
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/Abuelodelanada/multipass-exporter/internal/logging"
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// userAgent identifies the exporter to the receiver
+const userAgent = "multipass-exporter"
+
+// Options configures a Sender
+type Options struct {
+	// URL is the remote-write endpoint, e.g. https://mimir/api/v1/push
+	URL string
+	// Headers are added to every request, such as X-Scope-OrgID
+	Headers map[string]string
+	// Username and Password enable basic auth when Username is set
+	Username string
+	Password string
+	// ExternalLabels are added to every series that does not have them
+	ExternalLabels map[string]string
+	// Interval is the time between two gathers
+	Interval time.Duration
+	// Timeout bounds each request; zero means no timeout
+	Timeout time.Duration
+}
+
+// Sender gathers metrics on an interval and ships them with the
+// Prometheus remote-write protocol. Every gather becomes a write request
+// in the queue, which is then flushed oldest first; requests the receiver
+// could not accept for a transient reason stay queued for the next round.
+type Sender struct {
+	opts     Options
+	gatherer prometheus.Gatherer
+	queue    *Queue
+	client   *http.Client
+	logger   *logrus.Logger
+
+	lastSuccess prometheus.Gauge
+	failures    prometheus.Counter
+	dropped     prometheus.Counter
+	samples     prometheus.Counter
+}
+
+// New creates a Sender shipping what gatherer collects through queue
+func New(opts Options, gatherer prometheus.Gatherer, queue *Queue) *Sender {
+	return &Sender{
+		opts:     opts,
+		gatherer: gatherer,
+		queue:    queue,
+		client:   &http.Client{Timeout: opts.Timeout},
+		logger:   logging.New(),
+		lastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "multipass_exporter_remote_write_last_success_timestamp_seconds",
+			Help: "Timestamp of the last write request accepted by the remote-write receiver",
+		}),
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "multipass_exporter_remote_write_failures_total",
+			Help: "Total number of remote-write requests that failed",
+		}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "multipass_exporter_remote_write_dropped_requests_total",
+			Help: "Total number of write requests dropped because they were rejected or the queue was full",
+		}),
+		samples: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "multipass_exporter_remote_write_samples_total",
+			Help: "Total number of samples gathered for remote write",
+		}),
+	}
+}
+
+// SetLogger replaces the sender's own logger
+func (s *Sender) SetLogger(logger *logrus.Logger) {
+	s.logger = logger
+}
+
+// Collectors returns the metrics describing the sender's own health
+func (s *Sender) Collectors() []prometheus.Collector {
+	queued := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "multipass_exporter_remote_write_queued_requests",
+		Help: "Number of write requests waiting to be sent",
+	}, func() float64 {
+		n, _ := s.queue.Len()
+		return float64(n)
+	})
+	return []prometheus.Collector{s.lastSuccess, s.failures, s.dropped, s.samples, queued}
+}
+
+// Send gathers once, queues the resulting write request and flushes the
+// queue. It returns the error that stopped the flush, if any.
+func (s *Sender) Send(ctx context.Context) error {
+	families, err := s.gatherer.Gather()
+	if err != nil && len(families) == 0 {
+		return fmt.Errorf("failed to gather metrics: %w", err)
+	}
+
+	series := Series(families, s.opts.ExternalLabels, time.Now().UnixMilli())
+	s.samples.Add(float64(len(series)))
+	dropped, err := s.queue.Push(snappy.Encode(nil, Marshal(series)))
+	if dropped > 0 {
+		s.dropped.Add(float64(dropped))
+		s.logger.Warnf("Remote-write queue is full, dropped %d oldest write requests", dropped)
+	}
+	if err != nil {
+		return err
+	}
+	return s.Flush(ctx)
+}
+
+// Flush sends the queued write requests, oldest first, until the queue is
+// empty or a request fails with an error worth retrying. Requests the
+// receiver rejects as invalid are dropped, since resending cannot help.
+func (s *Sender) Flush(ctx context.Context) error {
+	for {
+		batch, ok, err := s.queue.Peek()
+		if err != nil || !ok {
+			return err
+		}
+
+		retry, err := s.post(ctx, batch)
+		if err != nil {
+			s.failures.Inc()
+			if retry {
+				return err
+			}
+			s.dropped.Inc()
+			s.logger.WithError(err).Error("Remote-write receiver rejected a write request, dropping it")
+		} else {
+			s.lastSuccess.SetToCurrentTime()
+		}
+
+		if err := s.queue.Pop(); err != nil {
+			return err
+		}
+	}
+}
+
+// post sends one compressed write request and reports whether a failure
+// is worth retrying: network errors, 5xx and 429 responses are
+func (s *Sender) post(ctx context.Context, batch []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.opts.URL, bytes.NewReader(batch))
+	if err != nil {
+		return false, fmt.Errorf("failed to create remote-write request: %w", err)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	for name, value := range s.opts.Headers {
+		req.Header.Set(name, value)
+	}
+	if s.opts.Username != "" {
+		req.SetBasicAuth(s.opts.Username, s.opts.Password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("remote-write request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return false, nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("remote-write receiver returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// Run sends right away and then every interval until ctx is done
+func (s *Sender) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.Send(ctx); err != nil {
+			n, _ := s.queue.Len()
+			s.logger.WithError(err).WithField("queued", n).Warnf("Failed to send metrics to %s, will retry", s.opts.URL)
+		} else {
+			s.logger.WithField("url", s.opts.URL).Debug("Sent metrics with remote write")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
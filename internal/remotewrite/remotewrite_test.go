@@ -0,0 +1,379 @@
+package remotewrite
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// receiver is an httptest stand-in for a remote-write endpoint that
+// decodes every write request, answering the first failures of them with
+// status
+type receiver struct {
+	mu       sync.Mutex
+	failures int
+	status   int
+	requests []*http.Request
+	writes   [][]TimeSeries
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.requests = append(rc.requests, r)
+	if rc.failures > 0 {
+		rc.failures--
+		http.Error(w, "try later", rc.status)
+		return
+	}
+
+	compressed, _ := io.ReadAll(r.Body)
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	series, err := unmarshal(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rc.writes = append(rc.writes, series)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (rc *receiver) received() [][]TimeSeries {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([][]TimeSeries(nil), rc.writes...)
+}
+
+// unmarshal decodes a WriteRequest protobuf
+func unmarshal(data []byte) ([]TimeSeries, error) {
+	var series []TimeSeries
+	err := eachField(data, func(num protowire.Number, value []byte) error {
+		if num != writeRequestTimeseries {
+			return nil
+		}
+		var ts TimeSeries
+		err := eachField(value, func(num protowire.Number, value []byte) error {
+			switch num {
+			case timeSeriesLabels:
+				var label Label
+				err := eachField(value, func(num protowire.Number, value []byte) error {
+					if num == labelName {
+						label.Name = string(value)
+					} else if num == labelValue {
+						label.Value = string(value)
+					}
+					return nil
+				})
+				ts.Labels = append(ts.Labels, label)
+				return err
+			case timeSeriesSamples:
+				var sample Sample
+				for len(value) > 0 {
+					num, typ, n := protowire.ConsumeTag(value)
+					if n < 0 {
+						return protowire.ParseError(n)
+					}
+					value = value[n:]
+					switch {
+					case num == sampleValue && typ == protowire.Fixed64Type:
+						v, n := protowire.ConsumeFixed64(value)
+						if n < 0 {
+							return protowire.ParseError(n)
+						}
+						sample.Value = math.Float64frombits(v)
+						value = value[n:]
+					case num == sampleTimestamp && typ == protowire.VarintType:
+						v, n := protowire.ConsumeVarint(value)
+						if n < 0 {
+							return protowire.ParseError(n)
+						}
+						sample.Timestamp = int64(v)
+						value = value[n:]
+					default:
+						return fmt.Errorf("unexpected sample field %d", num)
+					}
+				}
+				ts.Samples = append(ts.Samples, sample)
+			}
+			return nil
+		})
+		series = append(series, ts)
+		return err
+	})
+	return series, err
+}
+
+// eachField calls fn with every length-delimited field of a message
+func eachField(data []byte, fn func(protowire.Number, []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if typ != protowire.BytesType {
+			return fmt.Errorf("unexpected wire type %d for field %d", typ, num)
+		}
+		value, n := protowire.ConsumeBytes(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if err := fn(num, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// find returns the series with the given metric name and label
+func find(series []TimeSeries, name string, labels ...Label) (TimeSeries, bool) {
+	for _, ts := range series {
+		have := make(map[string]string)
+		for _, label := range ts.Labels {
+			have[label.Name] = label.Value
+		}
+		if have["__name__"] != name {
+			continue
+		}
+		matches := true
+		for _, label := range labels {
+			matches = matches && have[label.Name] == label.Value
+		}
+		if matches {
+			return ts, true
+		}
+	}
+	return TimeSeries{}, false
+}
+
+func testRegistry(t *testing.T) *prometheus.Registry {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	memory := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "multipass_instance_memory_bytes", Help: "Memory"}, []string{"name"})
+	memory.WithLabelValues("charm-dev-36").Set(1073741824)
+	registry.MustRegister(memory)
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "multipass_command_seconds", Help: "Duration", Buckets: []float64{0.5, 1}})
+	histogram.Observe(0.7)
+	registry.MustRegister(histogram)
+	return registry
+}
+
+func newTestSender(t *testing.T, url string, queue *Queue) *Sender {
+	t.Helper()
+	if queue == nil {
+		var err error
+		if queue, err = NewQueue("", 0); err != nil {
+			t.Fatalf("Failed to create queue: %v", err)
+		}
+	}
+	return New(Options{
+		URL:            url,
+		Headers:        map[string]string{"X-Scope-OrgID": "laptops"},
+		Username:       "laptop-1",
+		Password:       "secret",
+		ExternalLabels: map[string]string{"instance": "laptop-1", "name": "overridden"},
+		Interval:       time.Minute,
+	}, testRegistry(t), queue)
+}
+
+func TestSend(t *testing.T) {
+	rc := &receiver{}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	before := time.Now().UnixMilli()
+	sender := newTestSender(t, server.URL, nil)
+	if err := sender.Send(context.Background()); err != nil {
+		t.Fatalf("Expected send to succeed, got %v", err)
+	}
+
+	writes := rc.received()
+	if len(writes) != 1 {
+		t.Fatalf("Expected 1 write request, got %d", len(writes))
+	}
+	request := rc.requests[0]
+	for header, want := range map[string]string{
+		"Content-Encoding":                  "snappy",
+		"Content-Type":                      "application/x-protobuf",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+		"X-Scope-OrgID":                     "laptops",
+	} {
+		if got := request.Header.Get(header); got != want {
+			t.Errorf("Expected %s %q, got %q", header, want, got)
+		}
+	}
+	if user, password, ok := request.BasicAuth(); !ok || user != "laptop-1" || password != "secret" {
+		t.Errorf("Expected basic auth laptop-1:secret, got %q:%q", user, password)
+	}
+
+	series := writes[0]
+	memory, ok := find(series, "multipass_instance_memory_bytes", Label{"instance", "laptop-1"}, Label{"name", "charm-dev-36"})
+	if !ok {
+		t.Fatalf("Expected memory series with external labels, got %+v", series)
+	}
+	if len(memory.Samples) != 1 || memory.Samples[0].Value != 1073741824 || memory.Samples[0].Timestamp < before {
+		t.Errorf("Expected one current memory sample, got %+v", memory.Samples)
+	}
+	for i := 1; i < len(memory.Labels); i++ {
+		if memory.Labels[i-1].Name >= memory.Labels[i].Name {
+			t.Errorf("Expected labels sorted by name, got %+v", memory.Labels)
+		}
+	}
+
+	for _, want := range []struct {
+		le    string
+		value float64
+	}{{"0.5", 0}, {"1", 1}, {"+Inf", 1}} {
+		bucket, ok := find(series, "multipass_command_seconds_bucket", Label{"le", want.le})
+		if !ok || bucket.Samples[0].Value != want.value {
+			t.Errorf("Expected bucket le=%s with %v, got %+v", want.le, want.value, bucket)
+		}
+	}
+	if _, ok := find(series, "multipass_command_seconds_count"); !ok {
+		t.Error("Expected histogram _count series")
+	}
+	if got := testutil.ToFloat64(sender.lastSuccess); got == 0 {
+		t.Error("Expected last success timestamp to be set")
+	}
+}
+
+func TestSend_QueuesWhileOffline(t *testing.T) {
+	rc := &receiver{failures: 2, status: http.StatusServiceUnavailable}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	queue, err := NewQueue(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("Failed to create queue: %v", err)
+	}
+	sender := newTestSender(t, server.URL, queue)
+
+	for i := 0; i < 2; i++ {
+		if err := sender.Send(context.Background()); err == nil {
+			t.Fatal("Expected send to fail while the receiver is unavailable")
+		}
+	}
+	if n, _ := queue.Len(); n != 2 {
+		t.Fatalf("Expected 2 queued requests, got %d", n)
+	}
+
+	if err := sender.Send(context.Background()); err != nil {
+		t.Fatalf("Expected send to succeed once the receiver is back, got %v", err)
+	}
+	if got := len(rc.received()); got != 3 {
+		t.Errorf("Expected the 2 queued and the new request to be delivered, got %d", got)
+	}
+	if n, _ := queue.Len(); n != 0 {
+		t.Errorf("Expected an empty queue, got %d", n)
+	}
+	if got := testutil.ToFloat64(sender.failures); got != 2 {
+		t.Errorf("Expected 2 failures counted, got %v", got)
+	}
+}
+
+func TestSend_DropsRejectedRequests(t *testing.T) {
+	rc := &receiver{failures: 1, status: http.StatusBadRequest}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	sender := newTestSender(t, server.URL, nil)
+	if err := sender.Send(context.Background()); err != nil {
+		t.Fatalf("Expected rejected request to be dropped without error, got %v", err)
+	}
+	if n, _ := sender.queue.Len(); n != 0 {
+		t.Errorf("Expected an empty queue, got %d", n)
+	}
+	if got := testutil.ToFloat64(sender.dropped); got != 1 {
+		t.Errorf("Expected 1 dropped request, got %v", got)
+	}
+}
+
+func TestQueue_PersistsAndDropsOldest(t *testing.T) {
+	dir := t.TempDir()
+	queue, err := NewQueue(dir, 2)
+	if err != nil {
+		t.Fatalf("Failed to create queue: %v", err)
+	}
+	for _, batch := range []string{"first", "second", "third"} {
+		if _, err := queue.Push([]byte(batch)); err != nil {
+			t.Fatalf("Failed to push: %v", err)
+		}
+	}
+
+	// A new queue on the same directory sees what was left, as after a restart
+	reopened, err := NewQueue(dir, 2)
+	if err != nil {
+		t.Fatalf("Failed to reopen queue: %v", err)
+	}
+	for _, want := range []string{"second", "third"} {
+		batch, ok, err := reopened.Peek()
+		if err != nil || !ok || string(batch) != want {
+			t.Fatalf("Expected %q, got %q (%v, %v)", want, batch, ok, err)
+		}
+		if err := reopened.Pop(); err != nil {
+			t.Fatalf("Failed to pop: %v", err)
+		}
+	}
+	if _, ok, _ := reopened.Peek(); ok {
+		t.Error("Expected an empty queue")
+	}
+}
+
+func TestQueue_RemovesIncompleteWrites(t *testing.T) {
+	dir := t.TempDir()
+	tmp := filepath.Join(dir, "00000000000000000001.batch.tmp")
+	if err := os.WriteFile(tmp, []byte("half"), 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	queue, err := NewQueue(dir, 0)
+	if err != nil {
+		t.Fatalf("Failed to create queue: %v", err)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("Expected the incomplete write to be removed, got %v", err)
+	}
+	if n, _ := queue.Len(); n != 0 {
+		t.Errorf("Expected an empty queue, got %d", n)
+	}
+}
+
+func TestQueue_Concurrent(t *testing.T) {
+	queue, err := NewQueue(t.TempDir(), 5)
+	if err != nil {
+		t.Fatalf("Failed to create queue: %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				queue.Push([]byte("batch"))
+				queue.Len()
+				queue.Peek()
+			}
+		}()
+	}
+	wg.Wait()
+	if n, _ := queue.Len(); n != 5 {
+		t.Errorf("Expected the queue to be capped at 5, got %d", n)
+	}
+}
@@ -0,0 +1,190 @@
+package sd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/Abuelodelanada/multipass-exporter/internal/collector"
+	"github.com/Abuelodelanada/multipass-exporter/internal/logging"
+	"github.com/Abuelodelanada/multipass-exporter/internal/sd/sdspec"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3" //nolint:typecheck
+)
+
+// FileOptions configures a FileWriter
+type FileOptions struct {
+	Options
+	// Path is the file_sd_configs file; its extension, .json, .yml or
+	// .yaml, selects the format
+	Path string
+	// Labels are templates executed with the collector.MultipassInfoOutput
+	// of each instance, e.g. {{ .Release }}, whose results become labels of
+	// its target group. Labels rendering to an empty string are left out.
+	Labels map[string]string
+}
+
+// FileWriter writes the target groups to a file for Prometheus
+// file_sd_configs. The file is replaced atomically and only when its
+// contents change, since every write makes Prometheus reload the targets.
+type FileWriter struct {
+	opts   FileOptions
+	format func(interface{}) ([]byte, error)
+	labels map[string]*template.Template
+	logger *logrus.Logger
+
+	mu sync.Mutex
+}
+
+// NewFileWriter checks opts and parses the label templates
+func NewFileWriter(opts FileOptions) (*FileWriter, error) {
+	w := &FileWriter{opts: opts, logger: logging.New()}
+
+	switch strings.ToLower(filepath.Ext(opts.Path)) {
+	case ".json":
+		w.format = func(v interface{}) ([]byte, error) {
+			data, err := json.MarshalIndent(v, "", "  ")
+			return append(data, '\n'), err
+		}
+	case ".yml", ".yaml":
+		w.format = func(v interface{}) ([]byte, error) {
+			var buf bytes.Buffer
+			encoder := yaml.NewEncoder(&buf) //nolint:typecheck
+			encoder.SetIndent(2)
+			if err := encoder.Encode(v); err != nil {
+				return nil, err
+			}
+			err := encoder.Close()
+			return buf.Bytes(), err
+		}
+	default:
+		return nil, fmt.Errorf("file service discovery path %q must end in %s", opts.Path, strings.Join(sdspec.FileExtensions, ", "))
+	}
+
+	labels, err := sdspec.ParseLabels(opts.Labels)
+	if err != nil {
+		return nil, err
+	}
+	w.labels = labels
+	return w, nil
+}
+
+// SetLogger replaces the writer's own logger
+func (w *FileWriter) SetLogger(logger *logrus.Logger) {
+	w.logger = logger
+}
+
+// Observe writes the targets of a `multipass info` response, logging
+// failures. It suits collector.MultipassCollector.AddInfoObserver, so the
+// file follows every refresh.
+func (w *FileWriter) Observe(data collector.MultipassInfoResponse) {
+	changed, err := w.Write(data)
+	if err != nil {
+		w.logger.WithError(err).Errorf("Failed to write service discovery file %s", w.opts.Path)
+		return
+	}
+	if changed {
+		w.logger.WithField("path", w.opts.Path).Debug("Updated service discovery file")
+	}
+}
+
+// Run refreshes `multipass info` right away and then every interval until
+// ctx is done, so the file stays current when nothing else runs it, e.g.
+// when Prometheus cannot reach the exporter. Refreshes reach the writer
+// through the collector's info observers.
+func (w *FileWriter) Run(ctx context.Context, source InfoSource, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		// Errors are already logged by the collector
+		source.Info()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Write renders the targets of data and replaces the file when they
+// differ from what it holds, reporting whether it did
+func (w *FileWriter) Write(data collector.MultipassInfoResponse) (bool, error) {
+	groups, err := w.TargetGroups(data)
+	if err != nil {
+		return false, err
+	}
+	content, err := w.format(groups)
+	if err != nil {
+		return false, fmt.Errorf("failed to encode targets: %w", err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if current, err := os.ReadFile(w.opts.Path); err == nil && bytes.Equal(current, content) {
+		return false, nil
+	}
+	return true, writeAtomic(w.opts.Path, content)
+}
+
+// TargetGroups builds the target groups of data with the label templates
+// applied. Template labels override the __meta_multipass_* labels of the
+// same name.
+func (w *FileWriter) TargetGroups(data collector.MultipassInfoResponse) ([]TargetGroup, error) {
+	groups := TargetGroups(data, w.opts.Options)
+
+	names := make([]string, 0, len(w.labels))
+	for name := range w.labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, group := range groups {
+		info := data.Info[group.Labels[LabelName]]
+		if info.Name == "" {
+			info.Name = group.Labels[LabelName]
+		}
+		for _, name := range names {
+			var value strings.Builder
+			if err := w.labels[name].Execute(&value, info); err != nil {
+				return nil, fmt.Errorf("failed to render label %s for %s: %w", name, group.Labels[LabelName], err)
+			}
+			if value.Len() > 0 {
+				group.Labels[name] = value.String()
+			}
+		}
+	}
+	return groups, nil
+}
+
+// writeAtomic writes content to a temporary file next to path and renames
+// it over path, so readers never see a partial file
+func writeAtomic(path string, content []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,161 @@
+package sd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Abuelodelanada/multipass-exporter/internal/collector"
+)
+
+// Meta labels attached to every target group. Prometheus drops __meta_*
+// labels after relabeling, so they only end up on series when relabeled.
+const (
+	LabelName      = "__meta_multipass_name"
+	LabelState     = "__meta_multipass_state"
+	LabelRelease   = "__meta_multipass_release"
+	LabelImageHash = "__meta_multipass_image_hash"
+)
+
+// InfoSource provides the parsed output of `multipass info`
+type InfoSource interface {
+	Info() (collector.MultipassInfoResponse, error)
+}
+
+// TargetGroup is one entry of the Prometheus HTTP and file service
+// discovery formats
+type TargetGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels" yaml:"labels"`
+}
+
+// Options selects the instances and ports that become targets
+type Options struct {
+	// Ports are combined with every address; an empty list yields no targets
+	Ports []int
+	// States lists the instance states, compared case-insensitively, that
+	// get targets; an empty list means every state
+	States []string
+	// AllAddresses uses every IPv4 address of an instance instead of the first
+	AllAddresses bool
+}
+
+// TargetGroups converts a `multipass info` response into one target group
+// per instance, sorted by instance name. Instances without an IPv4
+// address, such as stopped ones, have nothing to scrape and are left out.
+func TargetGroups(data collector.MultipassInfoResponse, opts Options) []TargetGroup {
+	names := make([]string, 0, len(data.Info))
+	for name := range data.Info {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	groups := []TargetGroup{}
+	for _, name := range names {
+		info := data.Info[name]
+		if !selected(info.State, opts.States) {
+			continue
+		}
+
+		addresses := info.IPv4
+		if !opts.AllAddresses && len(addresses) > 1 {
+			addresses = addresses[:1]
+		}
+		var targets []string
+		for _, address := range addresses {
+			for _, port := range opts.Ports {
+				targets = append(targets, net.JoinHostPort(address, strconv.Itoa(port)))
+			}
+		}
+		if len(targets) == 0 {
+			continue
+		}
+
+		groups = append(groups, TargetGroup{
+			Targets: targets,
+			Labels: map[string]string{
+				LabelName:      name,
+				LabelState:     info.State,
+				LabelRelease:   info.Release,
+				LabelImageHash: info.ImageHash,
+			},
+		})
+	}
+	return groups
+}
+
+func selected(state string, states []string) bool {
+	if len(states) == 0 {
+		return true
+	}
+	for _, s := range states {
+		if strings.EqualFold(s, state) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewHandler serves the target groups as Prometheus http_sd_config JSON.
+// options is called on every request, so reloaded settings apply right
+// away. Requests may replace the configured ports and states:
+//
+//	GET /sd?port=<port>&state=<state>
+//
+// with both parameters repeatable, so one endpoint can feed a scrape job
+// per exporter.
+func NewHandler(source InfoSource, options func() Options) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		opts := options()
+		query := r.URL.Query()
+		if values, ok := query["port"]; ok {
+			ports, err := parsePorts(values)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			opts.Ports = ports
+		}
+		if states, ok := query["state"]; ok {
+			opts.States = states
+		}
+
+		// Prometheus keeps the previous targets when discovery fails, so
+		// an error is better than an empty list
+		data, err := source.Info()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		body, err := json.Marshal(TargetGroups(data, opts))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(append(body, '\n'))
+	})
+}
+
+func parsePorts(values []string) ([]int, error) {
+	ports := make([]int, 0, len(values))
+	for _, value := range values {
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %q", value)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
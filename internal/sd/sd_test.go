@@ -0,0 +1,262 @@
+package sd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Abuelodelanada/multipass-exporter/internal/collector"
+	"gopkg.in/yaml.v3" //nolint:typecheck
+)
+
+// staticSource serves fixed multipass info data
+type staticSource struct {
+	data collector.MultipassInfoResponse
+	err  error
+}
+
+func (s staticSource) Info() (collector.MultipassInfoResponse, error) {
+	return s.data, s.err
+}
+
+var testInfo = collector.MultipassInfoResponse{Info: map[string]collector.MultipassInfoOutput{
+	"charm-dev-36": {
+		Name:      "charm-dev-36",
+		State:     "Running",
+		IPv4:      []string{"10.0.0.2", "172.17.0.1"},
+		Release:   "Ubuntu 24.04 LTS",
+		ImageHash: "a1b2c3",
+	},
+	"builder": {
+		Name:    "builder",
+		State:   "Suspended",
+		IPv4:    []string{"10.0.0.3"},
+		Release: "Ubuntu 22.04 LTS",
+	},
+	"coslite": {Name: "coslite", State: "Stopped"},
+}}
+
+func TestTargetGroups(t *testing.T) {
+	groups := TargetGroups(testInfo, Options{Ports: []int{9100, 8080}, States: []string{"running"}})
+
+	want := []TargetGroup{{
+		Targets: []string{"10.0.0.2:9100", "10.0.0.2:8080"},
+		Labels: map[string]string{
+			LabelName:      "charm-dev-36",
+			LabelState:     "Running",
+			LabelRelease:   "Ubuntu 24.04 LTS",
+			LabelImageHash: "a1b2c3",
+		},
+	}}
+	if !reflect.DeepEqual(groups, want) {
+		t.Errorf("Expected %+v, got %+v", want, groups)
+	}
+}
+
+func TestTargetGroups_AllAddressesAndStates(t *testing.T) {
+	groups := TargetGroups(testInfo, Options{Ports: []int{9100}, AllAddresses: true})
+
+	// Stopped instances have no address, so they are left out even when
+	// every state is selected
+	if len(groups) != 2 {
+		t.Fatalf("Expected 2 target groups, got %+v", groups)
+	}
+	if groups[0].Labels[LabelName] != "builder" {
+		t.Errorf("Expected groups sorted by name, got %+v", groups)
+	}
+	if want := []string{"10.0.0.2:9100", "172.17.0.1:9100"}; !reflect.DeepEqual(groups[1].Targets, want) {
+		t.Errorf("Expected targets %v, got %v", want, groups[1].Targets)
+	}
+}
+
+func get(handler http.Handler, target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	return rec
+}
+
+func TestHandler(t *testing.T) {
+	handler := NewHandler(staticSource{data: testInfo}, func() Options {
+		return Options{Ports: []int{9100}, States: []string{"Running"}}
+	})
+
+	rec := get(handler, "/sd")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("Expected JSON with status 200, got %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var groups []TargetGroup
+	if err := json.Unmarshal(rec.Body.Bytes(), &groups); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(groups) != 1 || groups[0].Targets[0] != "10.0.0.2:9100" {
+		t.Errorf("Expected the running instance on port 9100, got %+v", groups)
+	}
+
+	// Query parameters replace the configured ports and states
+	rec = get(handler, "/sd?port=9256&port=8080&state=Running&state=Suspended")
+	groups = nil
+	if err := json.Unmarshal(rec.Body.Bytes(), &groups); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(groups) != 2 || !reflect.DeepEqual(groups[1].Targets, []string{"10.0.0.2:9256", "10.0.0.2:8080"}) {
+		t.Errorf("Expected query ports and states to apply, got %+v", groups)
+	}
+}
+
+func TestHandler_EmptyList(t *testing.T) {
+	handler := NewHandler(staticSource{data: testInfo}, func() Options {
+		return Options{Ports: []int{9100}, States: []string{"Deleted"}}
+	})
+
+	rec := get(handler, "/sd")
+	if body := rec.Body.String(); body != "[]\n" {
+		t.Errorf("Expected an empty JSON list, got %q", body)
+	}
+}
+
+func TestHandler_Errors(t *testing.T) {
+	handler := NewHandler(staticSource{err: errors.New("multipassd is not running")}, func() Options {
+		return Options{Ports: []int{9100}}
+	})
+
+	if rec := get(handler, "/sd"); rec.Code != http.StatusBadGateway {
+		t.Errorf("Expected status 502 when multipass info fails, got %d", rec.Code)
+	}
+	if rec := get(handler, "/sd?port=70000"); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid port, got %d", rec.Code)
+	}
+}
+
+func TestFileWriter_WritesOnlyOnChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "multipass.json")
+	writer, err := NewFileWriter(FileOptions{
+		Options: Options{Ports: []int{9100}, States: []string{"Running"}},
+		Path:    path,
+		Labels:  map[string]string{"release": "{{ .Release }}", "image": "{{ .ImageRelease }}"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	changed, err := writer.Write(testInfo)
+	if err != nil || !changed {
+		t.Fatalf("Expected the first write to create the file, got %v, %v", changed, err)
+	}
+	var groups []TargetGroup
+	data, _ := os.ReadFile(path)
+	if err := json.Unmarshal(data, &groups); err != nil {
+		t.Fatalf("Failed to decode file: %v", err)
+	}
+	if len(groups) != 1 || groups[0].Labels["release"] != "Ubuntu 24.04 LTS" || groups[0].Labels[LabelName] != "charm-dev-36" {
+		t.Errorf("Expected the running instance with its templated labels, got %+v", groups)
+	}
+	if _, ok := groups[0].Labels["image"]; ok {
+		t.Error("Expected labels rendering to an empty string to be left out")
+	}
+
+	if changed, err := writer.Write(testInfo); err != nil || changed {
+		t.Errorf("Expected unchanged targets not to rewrite the file, got %v, %v", changed, err)
+	}
+
+	stopped := collector.MultipassInfoResponse{Info: map[string]collector.MultipassInfoOutput{"coslite": testInfo.Info["coslite"]}}
+	if changed, err := writer.Write(stopped); err != nil || !changed {
+		t.Errorf("Expected changed targets to rewrite the file, got %v, %v", changed, err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "[]\n" {
+		t.Errorf("Expected an empty target list, got %q", data)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("Expected no temporary files left behind, got %d entries", len(entries))
+	}
+}
+
+func TestFileWriter_YAML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "multipass.yml")
+	writer, err := NewFileWriter(FileOptions{Options: Options{Ports: []int{9100}}, Path: path})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := writer.Write(testInfo); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var groups []TargetGroup
+	data, _ := os.ReadFile(path)
+	if err := yaml.Unmarshal(data, &groups); err != nil {
+		t.Fatalf("Failed to decode file: %v", err)
+	}
+	if len(groups) != 2 || groups[1].Targets[0] != "10.0.0.2:9100" {
+		t.Errorf("Expected 2 target groups, got %+v", groups)
+	}
+	// Indented like the file_sd_configs examples, not yaml.v3's default of 4
+	if !strings.HasPrefix(string(data), "- targets:\n    - 10.0.0.3:9100\n  labels:\n") {
+		t.Errorf("Expected 2-space indentation, got:\n%s", data)
+	}
+}
+
+// observedSource hands every response to an observer, as the collector
+// does to its info observers
+type observedSource struct {
+	staticSource
+	observe func(collector.MultipassInfoResponse)
+	calls   *int32
+}
+
+func (s observedSource) Info() (collector.MultipassInfoResponse, error) {
+	atomic.AddInt32(s.calls, 1)
+	s.observe(s.data)
+	return s.data, s.err
+}
+
+func TestFileWriter_Run(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "multipass.json")
+	writer, err := NewFileWriter(FileOptions{Options: Options{Ports: []int{9100}}, Path: path})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// The file is written without anything else running multipass info
+	var calls int32
+	source := observedSource{staticSource: staticSource{data: testInfo}, observe: writer.Observe, calls: &calls}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		writer.Run(ctx, source, time.Hour)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the file")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if calls != 1 {
+		t.Errorf("Expected 1 refresh before the first interval, got %d", calls)
+	}
+}
+
+func TestNewFileWriter_Invalid(t *testing.T) {
+	if _, err := NewFileWriter(FileOptions{Path: "targets.txt"}); err == nil {
+		t.Error("Expected error for an unknown file extension")
+	}
+	if _, err := NewFileWriter(FileOptions{Path: "targets.json", Labels: map[string]string{"release": "{{ .Release"}}); err == nil {
+		t.Error("Expected error for an invalid label template")
+	}
+}
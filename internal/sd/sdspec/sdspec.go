@@ -0,0 +1,24 @@
+// Package sdspec holds the file service discovery settings the
+// configuration checks, without the collector dependencies of package sd
+package sdspec
+
+import (
+	"fmt"
+	"text/template"
+)
+
+// FileExtensions are the accepted sd.FileOptions.Path extensions
+var FileExtensions = []string{".json", ".yml", ".yaml"}
+
+// ParseLabels parses label templates keyed by label name
+func ParseLabels(labels map[string]string) (map[string]*template.Template, error) {
+	templates := make(map[string]*template.Template, len(labels))
+	for name, text := range labels {
+		tmpl, err := template.New(name).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template for label %s: %w", name, err)
+		}
+		templates[name] = tmpl
+	}
+	return templates, nil
+}